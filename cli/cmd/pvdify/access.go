@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var accessCmd = &cobra.Command{
+	Use:   "access [NAME]",
+	Short: "List who has access to an app, or global grants",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runListAccess,
+}
+
+var accessGrantCmd = &cobra.Command{
+	Use:   "access:grant SUBJECT ROLE",
+	Short: "Grant a role (admin, deployer, viewer) globally or on one app",
+	Long: `Grant a role to a user (by Cloudflare Access email) or an API token
+(as token:NAME). Without --app the role applies to every app.
+
+Roles:
+  admin     everything, including managing apps and access
+  deployer  deploy, roll back, scale, restart and manage config vars
+  viewer    read-only, without config var values`,
+	Args: cobra.ExactArgs(2),
+	RunE: runGrantAccess,
+}
+
+var accessRevokeCmd = &cobra.Command{
+	Use:   "access:revoke SUBJECT",
+	Short: "Revoke a role globally or on one app",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runRevokeAccess,
+}
+
+var whoamiCmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Show who you are authenticated as and your roles",
+	Args:  cobra.NoArgs,
+	RunE:  runWhoami,
+}
+
+var accessApp string
+
+func init() {
+	accessGrantCmd.Flags().StringVarP(&accessApp, "app", "a", "", "Grant on this app only")
+	accessRevokeCmd.Flags().StringVarP(&accessApp, "app", "a", "", "Revoke the grant on this app")
+
+	rootCmd.AddCommand(accessGrantCmd)
+	rootCmd.AddCommand(accessRevokeCmd)
+}
+
+func runListAccess(cmd *cobra.Command, args []string) error {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	c := getClient()
+
+	grants, err := c.ListGrants(name)
+	if err != nil {
+		return err
+	}
+
+	if len(grants) == 0 {
+		fmt.Printf("No grants on %s\n", scopeName(name))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBJECT\tROLE\tGRANTED BY\tGRANTED")
+	for _, g := range grants {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", g.Subject, g.Role, g.CreatedBy, g.CreatedAt.Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+	return nil
+}
+
+func runGrantAccess(cmd *cobra.Command, args []string) error {
+	subject, role := args[0], args[1]
+	c := getClient()
+
+	if _, err := c.Grant(accessApp, subject, role); err != nil {
+		return err
+	}
+
+	fmt.Printf("Granted %s to %s on %s\n", role, subject, scopeName(accessApp))
+	return nil
+}
+
+func runRevokeAccess(cmd *cobra.Command, args []string) error {
+	subject := args[0]
+	c := getClient()
+
+	if err := c.Revoke(accessApp, subject); err != nil {
+		return err
+	}
+
+	fmt.Printf("Revoked %s on %s\n", subject, scopeName(accessApp))
+	return nil
+}
+
+func runWhoami(cmd *cobra.Command, args []string) error {
+	c := getClient()
+
+	id, err := c.Me()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s (%s)\n", id.Subject, id.Method)
+	if len(id.Grants) == 0 {
+		fmt.Println("\nNo roles granted")
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tSCOPE")
+	for _, g := range id.Grants {
+		fmt.Fprintf(w, "%s\t%s\n", g.Role, scopeName(g.AppName))
+	}
+	w.Flush()
+	return nil
+}
+
+// scopeName describes the scope of a grant
+func scopeName(appName string) string {
+	if appName == "" {
+		return "all apps"
+	}
+	return appName
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/philoveracity/pvdify/internal/client"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit [NAME]",
+	Short: "Show who changed what, for an app or across all apps",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runAudit,
+}
+
+var auditQuery client.AuditQuery
+
+func init() {
+	auditCmd.Flags().StringVar(&auditQuery.Actor, "actor", "", "Only events by this subject")
+	auditCmd.Flags().StringVar(&auditQuery.Action, "action", "", "Only this action, or action group (e.g. config)")
+	auditCmd.Flags().StringVar(&auditQuery.Since, "since", "", "Only events since a time (RFC 3339) or duration ago (e.g. 24h)")
+	auditCmd.Flags().IntVarP(&auditQuery.Limit, "num", "n", 50, "Number of events to show")
+}
+
+func runAudit(cmd *cobra.Command, args []string) error {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	c := getClient()
+
+	events, err := c.ListAudit(name, auditQuery)
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		fmt.Println("No audit events")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tAPP\tACTOR\tACTION\tTARGET\tDETAILS")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			orDash(e.AppName), e.Actor, e.Action, orDash(e.Target), formatDetails(e.Details))
+	}
+	w.Flush()
+	return nil
+}
+
+// formatDetails renders audit details as sorted key=value pairs
+func formatDetails(details map[string]interface{}) string {
+	if len(details) == 0 {
+		return "-"
+	}
+
+	keys := make([]string, 0, len(details))
+	for k := range details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := details[k]
+		if list, ok := v.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			v = strings.Join(items, ",")
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", k, v))
+	}
+	return strings.Join(parts, " ")
+}
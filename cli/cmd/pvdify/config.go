@@ -2,12 +2,31 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 
+	"github.com/philoveracity/pvdify/internal/client"
 	"github.com/spf13/cobra"
 )
 
+var (
+	configNoRestart    bool
+	configHistoryLimit int
+	configReveal       bool
+	configPushFile     string
+	configPushFormat   string
+	configReplace      bool
+	configPullFile     string
+	configPullFormat   string
+	configSecretPublic bool
+	configSecretAuto   bool
+)
+
 var configCmd = &cobra.Command{
 	Use:   "config NAME",
 	Short: "Show config vars for an app",
@@ -29,36 +48,109 @@ var configUnsetCmd = &cobra.Command{
 	RunE:  runUnsetConfig,
 }
 
+var configHistoryCmd = &cobra.Command{
+	Use:   "config:history NAME",
+	Short: "List config versions",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConfigHistory,
+}
+
+var configDiffCmd = &cobra.Command{
+	Use:   "config:diff NAME [FROM [TO]]",
+	Short: "Show config changes between versions (default: the latest change)",
+	Args:  cobra.RangeArgs(1, 3),
+	RunE:  runConfigDiff,
+}
+
+var configRestoreCmd = &cobra.Command{
+	Use:   "config:restore NAME VERSION",
+	Short: "Restore an earlier config version",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runConfigRestore,
+}
+
+var configPushCmd = &cobra.Command{
+	Use:   "config:push NAME",
+	Short: "Set config vars from a dotenv, json or yaml file",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConfigPush,
+}
+
+var configSecretsCmd = &cobra.Command{
+	Use:   "config:secrets NAME",
+	Short: "Show which config vars are secret",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConfigSecrets,
+}
+
+var configSecretCmd = &cobra.Command{
+	Use:   "config:secret NAME KEY [KEY...]",
+	Short: "Mark config vars secret, or not secret with --public",
+	Long: `Mark config vars secret, so their values are masked unless revealed.
+
+Keys matching the server's secret patterns (such as *_KEY, *_SECRET and
+*_TOKEN) are secret without being marked. Use --public to mark such a key not
+secret, and --auto to go back to the patterns.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runConfigSecret,
+}
+
+var configPullCmd = &cobra.Command{
+	Use:   "config:pull NAME",
+	Short: "Write config vars to stdout or a file as dotenv, json or yaml",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConfigPull,
+}
+
 func init() {
+	for _, cmd := range []*cobra.Command{configSetCmd, configUnsetCmd, configRestoreCmd, configPushCmd} {
+		cmd.Flags().BoolVar(&configNoRestart, "no-restart", false, "Stage the change without releasing it; it goes out with the next release")
+	}
+	configHistoryCmd.Flags().IntVarP(&configHistoryLimit, "num", "n", 20, "Number of versions to show")
+	configDiffCmd.Flags().BoolVar(&configReveal, "reveal", false, "Show values instead of masking them (admin only; recorded in the audit log)")
+	configCmd.Flags().BoolVar(&configReveal, "reveal", false, "Show secret values (admin only; recorded in the audit log)")
+	configPullCmd.Flags().BoolVar(&configReveal, "reveal", false, "Include secret values (admin only; recorded in the audit log)")
+	configSecretCmd.Flags().BoolVar(&configSecretPublic, "public", false, "Mark the keys not secret")
+	configSecretCmd.Flags().BoolVar(&configSecretAuto, "auto", false, "Remove the marking, so the secret patterns decide")
+	configPushCmd.Flags().StringVarP(&configPushFile, "file", "f", ".env", "File to read, or - for stdin")
+	configPushCmd.Flags().StringVar(&configPushFormat, "format", "", "File format: dotenv, json or yaml (default: from the file extension)")
+	configPushCmd.Flags().BoolVar(&configReplace, "replace", false, "Replace all config vars with the file's, removing the others")
+	configPullCmd.Flags().StringVarP(&configPullFile, "file", "f", "", "File to write (default: stdout)")
+	configPullCmd.Flags().StringVar(&configPullFormat, "format", "dotenv", "File format: dotenv, json or yaml")
+
 	rootCmd.AddCommand(configSetCmd)
 	rootCmd.AddCommand(configUnsetCmd)
+	rootCmd.AddCommand(configHistoryCmd)
+	rootCmd.AddCommand(configDiffCmd)
+	rootCmd.AddCommand(configRestoreCmd)
+	rootCmd.AddCommand(configPushCmd)
+	rootCmd.AddCommand(configPullCmd)
+	rootCmd.AddCommand(configSecretsCmd)
+	rootCmd.AddCommand(configSecretCmd)
 }
 
 func runGetConfig(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
 
-	config, err := c.GetConfig(name)
+	cfg, err := c.GetConfig(name, configReveal)
 	if err != nil {
 		return err
 	}
+	config := cfg.Vars
 
 	if len(config) == 0 {
 		fmt.Printf("No config vars set for %s\n", name)
 		return nil
 	}
 
-	// Sort keys for consistent output
-	keys := make([]string, 0, len(config))
-	for k := range config {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
 	fmt.Printf("=== %s Config Vars ===\n", name)
-	for _, k := range keys {
+	for _, k := range sortedKeys(config) {
 		fmt.Printf("%s: %s\n", k, config[k])
 	}
+	if len(cfg.Secrets) > 0 && !cfg.Revealed {
+		fmt.Println("(secret values hidden; use --reveal to show them)")
+	}
 	return nil
 }
 
@@ -66,37 +158,315 @@ func runSetConfig(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
 
-	config := make(map[string]string)
-	for _, kv := range args[1:] {
-		parts := strings.SplitN(kv, "=", 2)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid config format: %s (expected KEY=VALUE)", kv)
+	config, err := parseConfigArgs(args[1:])
+	if err != nil {
+		return err
+	}
+
+	change, err := c.SetConfig(name, config, !configNoRestart)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Set config vars on %s (config v%d)\n", name, change.Version)
+	for _, k := range sortedKeys(config) {
+		fmt.Printf("  %s: %s\n", k, change.Vars[k])
+	}
+	return waitForConfigRelease(c, name, change)
+}
+
+func runUnsetConfig(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+	keys := args[1:]
+
+	// Release once, with the last key, rather than once per key
+	var change *client.ConfigChange
+	for i, key := range keys {
+		restart := !configNoRestart && i == len(keys)-1
+		var err error
+		if change, err = c.UnsetConfig(name, key, restart); err != nil {
+			return fmt.Errorf("failed to unset %s: %w", key, err)
 		}
-		config[parts[0]] = parts[1]
+		fmt.Printf("Unset %s\n", key)
 	}
+	fmt.Printf("Config of %s is now v%d\n", name, change.Version)
+	return waitForConfigRelease(c, name, change)
+}
 
-	if err := c.SetConfig(name, config); err != nil {
+func runConfigHistory(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	versions, err := c.ListConfigVersions(name, configHistoryLimit)
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Setting config vars and restarting %s...\n", name)
-	for k, v := range config {
-		fmt.Printf("  %s: %s\n", k, v)
+	if len(versions) == 0 {
+		fmt.Printf("No config versions for %s\n", name)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tCREATED\tKEYS")
+	for _, v := range versions {
+		fmt.Fprintf(w, "v%d\t%s\t%s\n",
+			v.Version,
+			v.CreatedAt.Format("2006-01-02 15:04:05"),
+			truncate(strings.Join(v.Keys, ", "), 60),
+		)
 	}
-	fmt.Println("done")
+	w.Flush()
 	return nil
 }
 
-func runUnsetConfig(cmd *cobra.Command, args []string) error {
+func runConfigDiff(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
 
+	versions := make([]int, 0, 2)
+	for _, arg := range args[1:] {
+		v, err := parseVersion(arg)
+		if err != nil {
+			return err
+		}
+		versions = append(versions, v)
+	}
+	from, to := -1, -1
+	if len(versions) > 0 {
+		from = versions[0]
+	}
+	if len(versions) > 1 {
+		to = versions[1]
+	}
+
+	diff, err := c.DiffConfig(name, from, to, configReveal)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("=== %s Config v%d..v%d ===\n", name, diff.From, diff.To)
+	if len(diff.Changes) == 0 {
+		fmt.Println("No changes")
+		return nil
+	}
+	for _, ch := range diff.Changes {
+		switch ch.Change {
+		case "added":
+			fmt.Printf("+ %s: %s\n", ch.Key, ch.New)
+		case "removed":
+			fmt.Printf("- %s: %s\n", ch.Key, ch.Old)
+		default:
+			fmt.Printf("~ %s: %s -> %s\n", ch.Key, ch.Old, ch.New)
+		}
+	}
+	if diff.Masked {
+		fmt.Println("(values hidden; use --reveal to show them)")
+	}
+	return nil
+}
+
+func runConfigRestore(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	version, err := parseVersion(args[1])
+	if err != nil {
+		return err
+	}
+
+	change, err := c.RestoreConfig(name, version, !configNoRestart)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored config v%d of %s as v%d\n", version, name, change.Version)
+	return waitForConfigRelease(c, name, change)
+}
+
+func runConfigPush(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	var data []byte
+	var err error
+	if configPushFile == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(configPushFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	format := configPushFormat
+	if format == "" {
+		format = formatFromPath(configPushFile)
+	}
+
+	change, err := c.ImportConfig(name, format, data, configReplace, !configNoRestart)
+	if err != nil {
+		return err
+	}
+
+	verb := "Merged"
+	if configReplace {
+		verb = "Replaced"
+	}
+	fmt.Printf("%s config of %s with %s (config v%d, %d vars)\n", verb, name, configPushFile, change.Version, len(change.Vars))
+	return waitForConfigRelease(c, name, change)
+}
+
+func runConfigPull(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	data, err := c.ExportConfig(name, configPullFormat, configReveal)
+	if err != nil {
+		return err
+	}
+
+	if configPullFile == "" || configPullFile == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	// The file holds secrets
+	if err := os.WriteFile(configPullFile, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote config of %s to %s\n", name, configPullFile)
+	return nil
+}
+
+func runConfigSecrets(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	secrets, err := c.ListConfigSecrets(name)
+	if err != nil {
+		return err
+	}
+
+	if len(secrets) == 0 {
+		fmt.Printf("No config vars set for %s\n", name)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSECRET\tSOURCE")
+	for _, s := range secrets {
+		secret := "no"
+		if s.Secret {
+			secret = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, secret, orDash(s.Source))
+	}
+	w.Flush()
+	return nil
+}
+
+func runConfigSecret(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	if configSecretPublic && configSecretAuto {
+		return fmt.Errorf("--public and --auto can't be combined")
+	}
+
 	for _, key := range args[1:] {
-		if err := c.UnsetConfig(name, key); err != nil {
-			return fmt.Errorf("failed to unset %s: %w", key, err)
+		var s *client.ConfigSecret
+		var err error
+		if configSecretAuto {
+			s, err = c.UnmarkConfigSecret(name, key)
+		} else {
+			s, err = c.MarkConfigSecret(name, key, !configSecretPublic)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mark %s: %w", key, err)
+		}
+
+		switch {
+		case s.Secret && s.Source == "pattern":
+			fmt.Printf("%s is secret (matches a secret pattern)\n", key)
+		case s.Secret:
+			fmt.Printf("%s is secret\n", key)
+		default:
+			fmt.Printf("%s is not secret\n", key)
+		}
+	}
+	return nil
+}
+
+// parseConfigArgs parses KEY=VALUE arguments
+func parseConfigArgs(args []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, kv := range args {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid config format: %s (expected KEY=VALUE)", kv)
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars, nil
+}
+
+// formatFromPath guesses a config file's format from its extension
+func formatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "dotenv"
+}
+
+// parseVersion parses a version argument, with or without a leading "v"
+func parseVersion(arg string) (int, error) {
+	v, err := strconv.Atoi(strings.TrimPrefix(arg, "v"))
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid version: %s", arg)
+	}
+	return v, nil
+}
+
+// waitForConfigRelease reports what happened to a config change and waits
+// for its release to be deployed
+func waitForConfigRelease(c *client.Client, name string, change *client.ConfigChange) error {
+	return waitForChangeRelease(c, name, change.Release, change.Job, configNoRestart)
+}
+
+// waitForChangeRelease waits for the release of a config change to be
+// deployed. A nil release means the change was staged, or that the app has
+// never been deployed.
+func waitForChangeRelease(c *client.Client, name string, release *client.Release, job *client.Job, staged bool) error {
+	if release == nil {
+		if staged {
+			fmt.Printf("Staged; release it with: pvdify deploy %s\n", name)
+		} else {
+			fmt.Println("Not released: the app has not been deployed yet")
 		}
-		fmt.Printf("Unsetting %s...\n", key)
+		return nil
 	}
-	fmt.Printf("Restarting %s... done\n", name)
+
+	fmt.Printf("Releasing v%d (job %d)...\n", release.Version, job.ID)
+	job, err := waitForJob(c, name, job.ID)
+	if err != nil {
+		return err
+	}
+	if job.Status != "succeeded" {
+		return fmt.Errorf("release v%d failed: %s", release.Version, job.Error)
+	}
+	fmt.Printf("Released v%d\n", release.Version)
 	return nil
 }
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/philoveracity/pvdify/internal/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	groupsApp       string
+	groupsReveal    bool
+	groupsNoRestart bool
+	groupsPosition  int
+)
+
+var groupsCmd = &cobra.Command{
+	Use:     "groups",
+	Aliases: []string{"config-groups"},
+	Short:   "List config groups, or those attached to an app with --app",
+	Args:    cobra.NoArgs,
+	RunE:    runListGroups,
+}
+
+var groupsCreateCmd = &cobra.Command{
+	Use:   "groups:create GROUP [KEY=VALUE...]",
+	Short: "Create a config group shared by apps",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runCreateGroup,
+}
+
+var groupsInfoCmd = &cobra.Command{
+	Use:   "groups:info GROUP",
+	Short: "Show a config group's vars and apps",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runGroupInfo,
+}
+
+var groupsSetCmd = &cobra.Command{
+	Use:   "groups:set GROUP KEY=VALUE [KEY=VALUE...]",
+	Short: "Set config vars of a group and release its apps",
+	Args:  cobra.MinimumNArgs(2),
+	RunE:  runSetGroupVars,
+}
+
+var groupsUnsetCmd = &cobra.Command{
+	Use:   "groups:unset GROUP KEY [KEY...]",
+	Short: "Unset config vars of a group and release its apps",
+	Args:  cobra.MinimumNArgs(2),
+	RunE:  runUnsetGroupVars,
+}
+
+var groupsDeleteCmd = &cobra.Command{
+	Use:   "groups:delete GROUP",
+	Short: "Delete a config group no app uses",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runDeleteGroup,
+}
+
+var groupsAttachCmd = &cobra.Command{
+	Use:   "groups:attach NAME GROUP",
+	Short: "Attach a config group to an app",
+	Long: `Attach a config group to an app, or move an attached group.
+
+Groups attached later (at a higher position) override earlier ones, and the
+app's own config vars override every group.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runAttachGroup,
+}
+
+var groupsDetachCmd = &cobra.Command{
+	Use:   "groups:detach NAME GROUP",
+	Short: "Detach a config group from an app",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runDetachGroup,
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{groupsSetCmd, groupsUnsetCmd, groupsAttachCmd, groupsDetachCmd} {
+		cmd.Flags().BoolVar(&groupsNoRestart, "no-restart", false, "Stage the change without releasing it; it goes out with the next release")
+	}
+	groupsCmd.Flags().StringVarP(&groupsApp, "app", "a", "", "List the groups attached to this app, lowest precedence first")
+	groupsInfoCmd.Flags().BoolVar(&groupsReveal, "reveal", false, "Show secret values (admin only; recorded in the audit log)")
+	groupsAttachCmd.Flags().IntVarP(&groupsPosition, "position", "p", 0, "1-based position among the app's groups (default: last, taking precedence)")
+
+	rootCmd.AddCommand(groupsCreateCmd)
+	rootCmd.AddCommand(groupsInfoCmd)
+	rootCmd.AddCommand(groupsSetCmd)
+	rootCmd.AddCommand(groupsUnsetCmd)
+	rootCmd.AddCommand(groupsDeleteCmd)
+	rootCmd.AddCommand(groupsAttachCmd)
+	rootCmd.AddCommand(groupsDetachCmd)
+}
+
+func runListGroups(cmd *cobra.Command, args []string) error {
+	c := getClient()
+
+	if groupsApp != "" {
+		groups, err := c.ListAppConfigGroups(groupsApp)
+		if err != nil {
+			return err
+		}
+		printAttachedGroups(groupsApp, groups)
+		return nil
+	}
+
+	groups, err := c.ListConfigGroups()
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		fmt.Println("No config groups")
+		fmt.Println("\nCreate one with: pvdify groups:create GROUP KEY=VALUE...")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tVERSION\tAPPS")
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s\tv%d\t%s\n", g.Name, g.Version, orDash(strings.Join(g.Apps, ", ")))
+	}
+	w.Flush()
+	return nil
+}
+
+func runCreateGroup(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	vars, err := parseConfigArgs(args[1:])
+	if err != nil {
+		return err
+	}
+
+	group, err := c.CreateConfigGroup(name, vars)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created config group %s", group.Name)
+	if group.Version > 0 {
+		fmt.Printf(" (config v%d)", group.Version)
+	}
+	fmt.Printf("\n  Attach it with: pvdify groups:attach NAME %s\n", group.Name)
+	return nil
+}
+
+func runGroupInfo(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	group, err := c.GetConfigGroup(name, groupsReveal)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("=== %s Config Group (v%d) ===\n", group.Name, group.Version)
+	fmt.Printf("Apps: %s\n", orDash(strings.Join(group.Apps, ", ")))
+	if len(group.Vars) == 0 {
+		fmt.Println("No config vars set")
+		return nil
+	}
+	fmt.Println()
+	for _, k := range sortedKeys(group.Vars) {
+		fmt.Printf("%s: %s\n", k, group.Vars[k])
+	}
+	if len(group.Secrets) > 0 && !group.Revealed {
+		fmt.Println("(secret values hidden; use --reveal to show them)")
+	}
+	return nil
+}
+
+func runSetGroupVars(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	vars, err := parseConfigArgs(args[1:])
+	if err != nil {
+		return err
+	}
+
+	change, err := c.SetConfigGroupVars(name, vars, !groupsNoRestart)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Set config vars on group %s (config v%d)\n", name, change.Version)
+	for _, k := range sortedKeys(vars) {
+		fmt.Printf("  %s: %s\n", k, change.Vars[k])
+	}
+	return waitForGroupReleases(c, name, change)
+}
+
+func runUnsetGroupVars(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+	keys := args[1:]
+
+	// Release once, with the last key, rather than once per key
+	var change *client.ConfigGroupChange
+	for i, key := range keys {
+		restart := !groupsNoRestart && i == len(keys)-1
+		var err error
+		if change, err = c.UnsetConfigGroupVar(name, key, restart); err != nil {
+			return fmt.Errorf("failed to unset %s: %w", key, err)
+		}
+		fmt.Printf("Unset %s\n", key)
+	}
+	fmt.Printf("Config of group %s is now v%d\n", name, change.Version)
+	return waitForGroupReleases(c, name, change)
+}
+
+func runDeleteGroup(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	if err := c.DeleteConfigGroup(name); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted config group %s\n", name)
+	return nil
+}
+
+func runAttachGroup(cmd *cobra.Command, args []string) error {
+	name, group := args[0], args[1]
+	c := getClient()
+
+	change, err := c.AttachConfigGroup(name, group, groupsPosition, !groupsNoRestart)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Attached %s to %s\n", group, name)
+	printAttachedGroups(name, change.Groups)
+	return waitForGroupsRelease(c, name, change)
+}
+
+func runDetachGroup(cmd *cobra.Command, args []string) error {
+	name, group := args[0], args[1]
+	c := getClient()
+
+	change, err := c.DetachConfigGroup(name, group, !groupsNoRestart)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Detached %s from %s\n", group, name)
+	printAttachedGroups(name, change.Groups)
+	return waitForGroupsRelease(c, name, change)
+}
+
+// printAttachedGroups lists an app's config groups, lowest precedence first
+func printAttachedGroups(name string, groups []client.ConfigGroupAttachment) {
+	if len(groups) == 0 {
+		fmt.Printf("No config groups attached to %s\n", name)
+		return
+	}
+
+	fmt.Printf("=== %s Config Groups (later ones take precedence) ===\n", name)
+	for _, g := range groups {
+		fmt.Printf("  %d. %s (v%d)\n", g.Position, g.GroupName, g.Version)
+	}
+}
+
+// waitForGroupReleases reports the releases a config group change started
+// and waits for each to be deployed
+func waitForGroupReleases(c *client.Client, name string, change *client.ConfigGroupChange) error {
+	if len(change.Releases) == 0 {
+		if groupsNoRestart {
+			fmt.Println("Staged; attached apps get it with their next release")
+		} else {
+			fmt.Println("No deployed apps use this group")
+		}
+		return nil
+	}
+
+	var failed []string
+	for _, d := range change.Releases {
+		app := d.Release.AppName
+		fmt.Printf("Releasing %s v%d (job %d)...\n", app, d.Release.Version, d.Job.ID)
+		job, err := waitForJob(c, app, d.Job.ID)
+		if err != nil {
+			return err
+		}
+		if job.Status != "succeeded" {
+			fmt.Printf("Release of %s v%d failed: %s\n", app, d.Release.Version, job.Error)
+			failed = append(failed, app)
+			continue
+		}
+		fmt.Printf("Released %s v%d\n", app, d.Release.Version)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("releases failed for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// waitForGroupsRelease reports what happened to a change of an app's config
+// groups and waits for its release to be deployed
+func waitForGroupsRelease(c *client.Client, name string, change *client.ConfigGroupsChange) error {
+	return waitForChangeRelease(c, name, change.Release, change.Job, groupsNoRestart)
+}
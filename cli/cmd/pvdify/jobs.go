@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var jobsCmd = &cobra.Command{
+	Use:   "jobs NAME [ID]",
+	Short: "List jobs for an app, or follow a single job",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE:  runJobs,
+}
+
+func runJobs(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	if len(args) == 2 {
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid job id: %s", args[1])
+		}
+
+		job, err := waitForJob(c, name, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Job %d %s\n", job.ID, job.Status)
+		if job.Error != "" {
+			fmt.Printf("  Error: %s\n", job.Error)
+		}
+		return nil
+	}
+
+	jobs, err := c.ListJobs(name)
+	if err != nil {
+		return err
+	}
+
+	if len(jobs) == 0 {
+		fmt.Printf("No jobs found for %s\n", name)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tRELEASE\tSTATUS\tCREATED")
+	for _, j := range jobs {
+		release := "-"
+		if j.ReleaseVersion > 0 {
+			release = fmt.Sprintf("v%d", j.ReleaseVersion)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+			j.ID,
+			j.Kind,
+			release,
+			j.Status,
+			j.CreatedAt.Format("2006-01-02 15:04:05"),
+		)
+	}
+	w.Flush()
+	return nil
+}
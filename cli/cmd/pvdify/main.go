@@ -36,10 +36,15 @@ func init() {
 	rootCmd.AddCommand(deployCmd)
 	rootCmd.AddCommand(releasesCmd)
 	rootCmd.AddCommand(rollbackCmd)
+	rootCmd.AddCommand(jobsCmd)
 	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(groupsCmd)
 	rootCmd.AddCommand(domainsCmd)
 	rootCmd.AddCommand(psCmd)
 	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(accessCmd)
+	rootCmd.AddCommand(whoamiCmd)
+	rootCmd.AddCommand(auditCmd)
 }
 
 func getEnvOrDefault(key, defaultVal string) string {
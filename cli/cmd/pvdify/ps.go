@@ -7,9 +7,30 @@ import (
 	"strings"
 	"text/tabwriter"
 
+	"github.com/philoveracity/pvdify/internal/client"
 	"github.com/spf13/cobra"
 )
 
+var (
+	psTypeCount     int
+	psTypeNoRestart bool
+
+	psResizeMemory  string
+	psResizeCPU     float64
+	psResizePids    int
+	psResizeUlimits []string
+	psResizeReset   bool
+
+	psHealthPath     string
+	psHealthCommand  string
+	psHealthInterval string
+	psHealthTimeout  string
+	psHealthRetries  int
+	psHealthClear    bool
+
+	psStopTimeoutReset bool
+)
+
 var psCmd = &cobra.Command{
 	Use:     "ps NAME",
 	Aliases: []string{"processes"},
@@ -32,9 +53,109 @@ var psRestartCmd = &cobra.Command{
 	RunE:  runRestart,
 }
 
+var psTypeCmd = &cobra.Command{
+	Use:   "ps:type NAME",
+	Short: "List an app's process types",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runListProcessTypes,
+}
+
+var psTypeSetCmd = &cobra.Command{
+	Use:   "ps:type:set NAME TYPE [COMMAND...]",
+	Short: "Add a process type or change its command",
+	Long: `Add a process type or change its command. Without a command, the type runs
+the image's default command.
+
+New commands and types run with the release this creates (or, with
+--no-restart, the next release); rollbacks restore the commands a release ran.
+New types start with no instances, except web; scale them with ps:scale or
+--count.
+
+Flags go before NAME; everything after TYPE is the command, flags included.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runSetProcessType,
+}
+
+var psTypeRemoveCmd = &cobra.Command{
+	Use:   "ps:type:remove NAME TYPE",
+	Short: "Remove a process type and stop its instances",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runRemoveProcessType,
+}
+
+var psResizeCmd = &cobra.Command{
+	Use:   "ps:resize NAME TYPE",
+	Short: "Set the resource limits of a process type",
+	Long: `Set the memory, CPU, process and ulimit limits of each instance of a process
+type. Limits not given keep their current value; --reset goes back to the
+defaults (512M of memory and half a CPU).
+
+Running instances restart with the new limits right away.`,
+	Example: `  pvdify ps:resize myapp worker --memory 1G --cpu 2
+  pvdify ps:resize myapp web --pids 200 --ulimit nofile=4096:8192`,
+	Args: cobra.ExactArgs(2),
+	RunE: runResize,
+}
+
+var psHealthcheckCmd = &cobra.Command{
+	Use:   "ps:healthcheck NAME TYPE",
+	Short: "Set the health check of a process type",
+	Long: `Set how podman checks each instance of a process type: over HTTP at --path
+(web only), or by running --command in the container. Deploys wait for web
+instances and for instances with a health check command to be healthy before
+switching traffic.
+
+Settings not given keep their current value; --clear removes the health check.
+Running instances restart with it right away.`,
+	Example: `  pvdify ps:healthcheck myapp web --path /health --interval 10s
+  pvdify ps:healthcheck myapp worker --command "pgrep -f sidekiq"`,
+	Args: cobra.ExactArgs(2),
+	RunE: runSetHealthcheck,
+}
+
+var psStopTimeoutCmd = &cobra.Command{
+	Use:   "ps:stop-timeout NAME TYPE [DURATION]",
+	Short: "Set how long a process type's instances get to shut down",
+	Long: `Set how long each instance of a process type gets to exit after SIGTERM
+before it is killed, like 30s or 5m; --reset goes back to the default of 10s.
+Web instances are first taken out of routing and drained of requests in
+flight, for up to the server's drain timeout.
+
+Running instances restart with it right away.`,
+	Example: `  pvdify ps:stop-timeout myapp web 60s
+  pvdify ps:stop-timeout myapp worker --reset`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: runSetStopTimeout,
+}
+
 func init() {
+	psTypeSetCmd.Flags().IntVarP(&psTypeCount, "count", "c", 0, "Number of instances (default: the current count; 0 for new types other than web)")
+	psTypeSetCmd.Flags().SetInterspersed(false)
+	psTypeSetCmd.Flags().BoolVar(&psTypeNoRestart, "no-restart", false, "Stage the change without releasing it; it goes out with the next release")
+
+	psResizeCmd.Flags().StringVarP(&psResizeMemory, "memory", "m", "", "Memory limit, like 512M or 1G")
+	psResizeCmd.Flags().Float64Var(&psResizeCPU, "cpu", 0, "Number of CPUs, like 0.5 or 2")
+	psResizeCmd.Flags().IntVar(&psResizePids, "pids", 0, "Maximum number of processes in the container (0 for podman's default)")
+	psResizeCmd.Flags().StringArrayVar(&psResizeUlimits, "ulimit", nil, "Ulimit as name=soft[:hard], like nofile=1024:2048 (repeatable; replaces the current ulimits)")
+	psResizeCmd.Flags().BoolVar(&psResizeReset, "reset", false, "Go back to the default limits")
+
+	psHealthcheckCmd.Flags().StringVar(&psHealthPath, "path", "", "HTTP path to check, like /health (web only)")
+	psHealthcheckCmd.Flags().StringVar(&psHealthCommand, "command", "", "Command to run in the container; exiting non-zero is unhealthy")
+	psHealthcheckCmd.Flags().StringVar(&psHealthInterval, "interval", "", "Time between checks (default 30s)")
+	psHealthcheckCmd.Flags().StringVar(&psHealthTimeout, "timeout", "", "Time a check may take (default 5s)")
+	psHealthcheckCmd.Flags().IntVar(&psHealthRetries, "retries", 0, "Failed checks before an instance is unhealthy (default 3)")
+	psHealthcheckCmd.Flags().BoolVar(&psHealthClear, "clear", false, "Remove the health check")
+
+	psStopTimeoutCmd.Flags().BoolVar(&psStopTimeoutReset, "reset", false, "Go back to the default stop timeout")
+
 	rootCmd.AddCommand(psScaleCmd)
 	rootCmd.AddCommand(psRestartCmd)
+	rootCmd.AddCommand(psTypeCmd)
+	rootCmd.AddCommand(psTypeSetCmd)
+	rootCmd.AddCommand(psTypeRemoveCmd)
+	rootCmd.AddCommand(psResizeCmd)
+	rootCmd.AddCommand(psHealthcheckCmd)
+	rootCmd.AddCommand(psStopTimeoutCmd)
 }
 
 func runListProcesses(cmd *cobra.Command, args []string) error {
@@ -46,25 +167,79 @@ func runListProcesses(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	if len(processes) == 0 {
+	if len(processes.Definitions) == 0 && len(processes.Instances) == 0 {
 		fmt.Printf("No processes running for %s\n", name)
 		fmt.Printf("\nDeploy an image first: pvdify deploy %s --image IMAGE\n", name)
 		return nil
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "TYPE\tCOUNT\tCOMMAND\tSTATUS")
-	for _, p := range processes {
+	fmt.Fprintln(w, "TYPE\tCOUNT\tCOMMAND")
+	for _, p := range processes.Definitions {
 		cmd := p.Command
 		if cmd == "" {
 			cmd = "-"
 		}
-		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", p.Type, p.Count, cmd, p.Status)
+		fmt.Fprintf(w, "%s\t%d\t%s\n", p.Name, p.Count, cmd)
+	}
+	w.Flush()
+
+	if len(processes.Instances) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tCOLOR\tPORT\tSTATE\tUPTIME\tRESTARTS\tMEMORY\tCPU\tHEALTH\tCONTAINER")
+	for _, i := range processes.Instances {
+		instance := fmt.Sprintf("%s.%d", i.Name, i.Instance)
+		if i.Name == "" {
+			instance = i.Container
+		}
+		state := i.State
+		if i.SubState != "" {
+			state += " (" + i.SubState + ")"
+		}
+		if !i.Desired {
+			state += " [not desired]"
+		}
+		port := "-"
+		if i.Port > 0 {
+			port = strconv.Itoa(i.Port)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%.1f%%\t%s\t%s\n",
+			instance, orDash(i.Color), port, state, orDash(i.Uptime), i.Restarts,
+			formatBytes(i.Memory), i.CPU, orDash(i.Health), orDash(i.ContainerID))
 	}
 	w.Flush()
 	return nil
 }
 
+// orDash substitutes "-" for empty table cells
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatBytes renders a byte count in binary units
+func formatBytes(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func runScale(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
@@ -98,16 +273,325 @@ func runScale(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func runRestart(cmd *cobra.Command, args []string) error {
+func runListProcessTypes(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
 
-	fmt.Printf("Restarting %s...\n", name)
+	processes, err := c.GetFormation(name)
+	if err != nil {
+		return err
+	}
+	printProcessTypes(name, processes)
+	return nil
+}
+
+func runSetProcessType(cmd *cobra.Command, args []string) error {
+	name, typ := args[0], args[1]
+	command := strings.Join(args[2:], " ")
+	c := getClient()
+
+	current, err := c.GetFormation(name)
+	if err != nil {
+		return err
+	}
+
+	decl := formationOf(current)
+	i := 0
+	for i < len(decl) && decl[i].Name != typ {
+		i++
+	}
+	found := i < len(decl)
+	if !found {
+		decl = append(decl, client.FormationProcess{Name: typ})
+	}
+	decl[i].Command = command
+	if cmd.Flags().Changed("count") {
+		decl[i].Count = &psTypeCount
+	}
+
+	change, err := c.SetFormation(name, decl, !psTypeNoRestart)
+	if err != nil {
+		return err
+	}
+	if found {
+		fmt.Printf("Updated process type %s\n", typ)
+	} else {
+		fmt.Printf("Added process type %s\n", typ)
+	}
+	printProcessTypes(name, change.Processes)
+	return waitForFormationRelease(c, name, change)
+}
+
+func runRemoveProcessType(cmd *cobra.Command, args []string) error {
+	name, typ := args[0], args[1]
+	c := getClient()
+
+	current, err := c.GetFormation(name)
+	if err != nil {
+		return err
+	}
+
+	var decl []client.FormationProcess
+	for _, p := range formationOf(current) {
+		if p.Name != typ {
+			decl = append(decl, p)
+		}
+	}
+	if len(decl) == len(current) {
+		return fmt.Errorf("%s has no process type %s", name, typ)
+	}
+	if len(decl) == 0 {
+		return fmt.Errorf("can't remove %s's last process type", name)
+	}
+
+	change, err := c.SetFormation(name, decl, !psTypeNoRestart)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed process type %s\n", typ)
+	printProcessTypes(name, change.Processes)
+	if change.RemovalJob != nil {
+		fmt.Printf("Stopping its instances (job %d)...\n", change.RemovalJob.ID)
+		job, err := waitForJob(c, name, change.RemovalJob.ID)
+		if err != nil {
+			return err
+		}
+		if job.Status != "succeeded" {
+			return fmt.Errorf("stopping %s's instances failed: %s", typ, job.Error)
+		}
+	}
+	return nil
+}
+
+func runResize(cmd *cobra.Command, args []string) error {
+	name, typ := args[0], args[1]
+	c := getClient()
+
+	flags := cmd.Flags()
+	changed := flags.Changed("memory") || flags.Changed("cpu") || flags.Changed("pids") || flags.Changed("ulimit")
+	if psResizeReset == changed {
+		return fmt.Errorf("give limits to set, or --reset")
+	}
+
+	p, err := processType(c, name, typ)
+	if err != nil {
+		return err
+	}
+
+	resources := client.ResourceLimits{}
+	if p.Resources != nil && !psResizeReset {
+		resources = *p.Resources
+	}
+	if flags.Changed("memory") {
+		resources.Memory = psResizeMemory
+	}
+	if flags.Changed("cpu") {
+		resources.CPU = psResizeCPU
+	}
+	if flags.Changed("pids") {
+		resources.Pids = psResizePids
+	}
+	if flags.Changed("ulimit") {
+		resources.Ulimits = psResizeUlimits
+	}
+
+	p, err = c.UpdateProcess(name, typ, client.UpdateProcessRequest{Resources: &resources})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resized %s: %s\n", typ, formatLimits(p.Resources))
+	return nil
+}
+
+func runSetHealthcheck(cmd *cobra.Command, args []string) error {
+	name, typ := args[0], args[1]
+	c := getClient()
+
+	flags := cmd.Flags()
+	changed := false
+	for _, f := range []string{"path", "command", "interval", "timeout", "retries"} {
+		changed = changed || flags.Changed(f)
+	}
+	if psHealthClear == changed {
+		return fmt.Errorf("give health check settings, or --clear")
+	}
+
+	p, err := processType(c, name, typ)
+	if err != nil {
+		return err
+	}
+
+	health := client.HealthcheckConfig{}
+	if p.Healthcheck != nil && !psHealthClear {
+		health = *p.Healthcheck
+	}
+	// A path replaces a command, and the other way around
+	if flags.Changed("path") {
+		health.Path, health.Command = psHealthPath, ""
+	}
+	if flags.Changed("command") {
+		health.Command, health.Path = psHealthCommand, ""
+	}
+	if flags.Changed("interval") {
+		health.Interval = psHealthInterval
+	}
+	if flags.Changed("timeout") {
+		health.Timeout = psHealthTimeout
+	}
+	if flags.Changed("retries") {
+		health.Retries = psHealthRetries
+	}
+
+	p, err = c.UpdateProcess(name, typ, client.UpdateProcessRequest{Healthcheck: &health})
+	if err != nil {
+		return err
+	}
+	if p.Healthcheck == nil {
+		fmt.Printf("Removed the health check of %s\n", typ)
+		return nil
+	}
+	fmt.Printf("Health check of %s: %s\n", typ, formatHealthcheck(p.Healthcheck))
+	return nil
+}
+
+func runSetStopTimeout(cmd *cobra.Command, args []string) error {
+	name, typ := args[0], args[1]
+	if psStopTimeoutReset == (len(args) == 3) {
+		return fmt.Errorf("give a duration, or --reset")
+	}
+	timeout := ""
+	if len(args) == 3 {
+		timeout = args[2]
+	}
+
+	p, err := getClient().UpdateProcess(name, typ, client.UpdateProcessRequest{StopTimeout: &timeout})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stop timeout of %s: %s\n", typ, formatStopTimeout(p.StopTimeout))
+	return nil
+}
+
+// processType fetches one of an app's process types
+func processType(c *client.Client, name, typ string) (*client.Process, error) {
+	processes, err := c.GetFormation(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range processes {
+		if processes[i].Name == typ {
+			return &processes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no process type %s", name, typ)
+}
+
+// formatLimits describes resource limits, or "default" if none are set
+func formatLimits(r *client.ResourceLimits) string {
+	if r == nil {
+		return "default"
+	}
+	var parts []string
+	if r.Memory != "" {
+		parts = append(parts, r.Memory)
+	}
+	if r.CPU > 0 {
+		parts = append(parts, fmt.Sprintf("%g cpu", r.CPU))
+	}
+	if r.Pids > 0 {
+		parts = append(parts, fmt.Sprintf("%d pids", r.Pids))
+	}
+	parts = append(parts, r.Ulimits...)
+	if len(parts) == 0 {
+		return "default"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatHealthcheck describes a health check, or "-" if there is none
+func formatHealthcheck(h *client.HealthcheckConfig) string {
+	if h == nil {
+		return "-"
+	}
+	check := h.Path
+	if h.Command != "" {
+		check = strconv.Quote(h.Command)
+	}
+	var opts []string
+	if h.Interval != "" {
+		opts = append(opts, "every "+h.Interval)
+	}
+	if h.Timeout != "" {
+		opts = append(opts, "timeout "+h.Timeout)
+	}
+	if h.Retries > 0 {
+		opts = append(opts, fmt.Sprintf("%d retries", h.Retries))
+	}
+	if len(opts) > 0 {
+		check += " (" + strings.Join(opts, ", ") + ")"
+	}
+	return check
+}
+
+// formatStopTimeout describes a stop timeout, or the default if it is unset
+func formatStopTimeout(timeout string) string {
+	if timeout == "" {
+		return "10s (default)"
+	}
+	return timeout
+}
+
+// formationOf declares process types as they are, keeping their counts
+func formationOf(processes []client.Process) []client.FormationProcess {
+	decl := make([]client.FormationProcess, len(processes))
+	for i, p := range processes {
+		decl[i] = client.FormationProcess{Name: p.Name, Command: p.Command}
+	}
+	return decl
+}
+
+// printProcessTypes lists an app's process types
+func printProcessTypes(name string, processes []client.Process) {
+	if len(processes) == 0 {
+		fmt.Printf("No process types for %s\n", name)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tCOUNT\tLIMITS\tHEALTH CHECK\tSTOP TIMEOUT\tCOMMAND")
+	for _, p := range processes {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", p.Name, p.Count, formatLimits(p.Resources),
+			formatHealthcheck(p.Healthcheck), formatStopTimeout(p.StopTimeout), orDash(p.Command))
+	}
+	w.Flush()
+}
+
+// waitForFormationRelease waits for the release a change of process types
+// started, if it took one
+func waitForFormationRelease(c *client.Client, name string, change *client.FormationChange) error {
+	if change.Release == nil && !psTypeNoRestart {
+		return nil
+	}
+	return waitForChangeRelease(c, name, change.Release, change.Job, psTypeNoRestart)
+}
+
+func runRestart(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
 
-	if err := c.Restart(name); err != nil {
+	job, err := c.Restart(name)
+	if err != nil {
 		return err
 	}
+	fmt.Printf("Restarting %s (job %d)...\n", name, job.ID)
 
+	job, err = waitForJob(c, name, job.ID)
+	if err != nil {
+		return err
+	}
+	if job.Status != "succeeded" {
+		return fmt.Errorf("restart failed: %s", job.Error)
+	}
 	fmt.Println("done")
 	return nil
 }
@@ -3,12 +3,24 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/philoveracity/pvdify/internal/client"
 	"github.com/spf13/cobra"
 )
 
-var deployImage string
+var (
+	deployImage     string
+	deployDetach    bool
+	deployProcfile  string
+	rollbackVersion int
+	rollbackDetach  bool
+	pruneDryRun     bool
+	retentionKeep   int
+	retentionDays   int
+)
 
 var deployCmd = &cobra.Command{
 	Use:   "deploy NAME",
@@ -27,33 +39,130 @@ var releasesCmd = &cobra.Command{
 
 var rollbackCmd = &cobra.Command{
 	Use:   "rollback NAME",
-	Short: "Rollback to the previous release",
+	Short: "Rollback to the previous release, or to --version",
 	Args:  cobra.ExactArgs(1),
 	RunE:  runRollback,
 }
 
+var releasesPruneCmd = &cobra.Command{
+	Use:   "releases:prune NAME",
+	Short: "Delete old releases and config versions now",
+	Long: `Delete the releases, config versions and images an app's retention policy
+no longer keeps. The server also does this periodically.
+
+A release is kept if it is among the newest --keep releases, younger than
+--days days, or active or being deployed. Config versions follow the same
+rules, and the latest one and those used by kept releases are always kept.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runPruneReleases,
+}
+
+var releasesRetentionCmd = &cobra.Command{
+	Use:   "releases:retention NAME",
+	Short: "Show or set how long an app's releases are kept",
+	Long: `Show or set how long an app's releases are kept. Setting a value to 0
+goes back to the server's default.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runReleasesRetention,
+}
+
 func init() {
-	deployCmd.Flags().StringVarP(&deployImage, "image", "i", "", "Container image to deploy (required)")
-	deployCmd.MarkFlagRequired("image")
+	deployCmd.Flags().StringVarP(&deployImage, "image", "i", "", "Container image to deploy (default: redeploy the current image with the latest config)")
+	deployCmd.Flags().BoolVar(&deployDetach, "detach", false, "Return once the deploy is queued instead of waiting for it")
+	deployCmd.Flags().StringVar(&deployProcfile, "procfile", "", "Procfile declaring the app's process types (types it leaves out are removed)")
+
+	rollbackCmd.Flags().IntVarP(&rollbackVersion, "version", "v", 0, "Release version to roll back to (default: previous)")
+	rollbackCmd.Flags().BoolVar(&rollbackDetach, "detach", false, "Return once the rollback is queued instead of waiting for it")
+
+	releasesPruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "List what would be deleted without deleting it")
+
+	releasesRetentionCmd.Flags().IntVar(&retentionKeep, "keep", 0, "Number of newest releases to keep (0: server default)")
+	releasesRetentionCmd.Flags().IntVar(&retentionDays, "days", 0, "Keep releases younger than this many days (0: server default)")
+
+	rootCmd.AddCommand(releasesPruneCmd)
+	rootCmd.AddCommand(releasesRetentionCmd)
 }
 
 func runDeploy(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
 
-	fmt.Printf("Deploying %s to %s...\n", deployImage, name)
+	if deployImage != "" {
+		fmt.Printf("Deploying %s to %s...\n", deployImage, name)
+	} else {
+		fmt.Printf("Redeploying %s with its latest config...\n", name)
+	}
 
-	release, err := c.CreateRelease(name, deployImage)
+	var procfile string
+	if deployProcfile != "" {
+		data, err := os.ReadFile(deployProcfile)
+		if err != nil {
+			return fmt.Errorf("read procfile: %w", err)
+		}
+		procfile = string(data)
+	}
+
+	deploy, err := c.CreateRelease(name, deployImage, procfile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created v%d (job %d)\n", deploy.Release.Version, deploy.Job.ID)
+	if deployDetach {
+		fmt.Printf("  Follow progress: pvdify jobs %s %d\n", name, deploy.Job.ID)
+		return nil
+	}
+
+	job, err := waitForJob(c, name, deploy.Job.ID)
 	if err != nil {
 		return err
 	}
+	if job.Status != "succeeded" {
+		return fmt.Errorf("deploy of v%d failed: %s", deploy.Release.Version, job.Error)
+	}
 
-	fmt.Printf("Released v%d\n", release.Version)
-	fmt.Printf("  Image: %s\n", release.Image)
-	fmt.Printf("  Status: %s\n", release.Status)
+	fmt.Printf("Released v%d\n", deploy.Release.Version)
+	fmt.Printf("  Image: %s\n", deploy.Release.Image)
+
+	// The digest is resolved while the release is deployed
+	if release, err := c.GetRelease(name, deploy.Release.Version); err == nil && release.ImageDigest != "" {
+		fmt.Printf("  Digest: %s\n", release.ImageDigest)
+	}
 	return nil
 }
 
+// jobPollInterval is how often waitForJob checks job progress
+const jobPollInterval = 2 * time.Second
+
+// waitForJob polls a job until it finishes, printing each step as it
+// completes
+func waitForJob(c *client.Client, name string, id int64) (*client.Job, error) {
+	printed := 0
+	for {
+		job, err := c.GetJob(name, id)
+		if err != nil {
+			return nil, err
+		}
+
+		for ; printed < len(job.Steps); printed++ {
+			step := job.Steps[printed]
+			if step.FinishedAt == nil {
+				break
+			}
+			fmt.Printf("  %-20s %s (%s)\n", step.Name, step.Status,
+				step.FinishedAt.Sub(step.StartedAt).Round(time.Millisecond))
+			if step.Error != "" {
+				fmt.Printf("    %s\n", step.Error)
+			}
+		}
+
+		if job.Done() {
+			return job, nil
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
 func runListReleases(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
@@ -69,11 +178,13 @@ func runListReleases(cmd *cobra.Command, args []string) error {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "VERSION\tIMAGE\tSTATUS\tCREATED")
+	fmt.Fprintln(w, "VERSION\tIMAGE\tDIGEST\tCONFIG\tSTATUS\tCREATED")
 	for _, r := range releases {
-		fmt.Fprintf(w, "v%d\t%s\t%s\t%s\n",
+		fmt.Fprintf(w, "v%d\t%s\t%s\t%s\t%s\t%s\n",
 			r.Version,
 			truncate(r.Image, 50),
+			orDash(shortDigest(r.ImageDigest)),
+			releaseConfig(r),
 			r.Status,
 			r.CreatedAt.Format("2006-01-02 15:04:05"),
 		)
@@ -82,22 +193,144 @@ func runListReleases(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// releaseConfig describes the config versions a release was built with:
+// its config groups, then the app's own config
+func releaseConfig(r client.Release) string {
+	parts := make([]string, 0, len(r.ConfigGroups)+1)
+	for _, g := range r.ConfigGroups {
+		parts = append(parts, fmt.Sprintf("%s:v%d", g.Name, g.Version))
+	}
+	return strings.Join(append(parts, fmt.Sprintf("v%d", r.ConfigVersion)), " ")
+}
+
 func runRollback(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	c := getClient()
 
 	fmt.Printf("Rolling back %s...\n", name)
 
-	release, err := c.Rollback(name)
+	deploy, err := c.Rollback(name, rollbackVersion)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created v%d (job %d)\n", deploy.Release.Version, deploy.Job.ID)
+	if rollbackDetach {
+		fmt.Printf("  Follow progress: pvdify jobs %s %d\n", name, deploy.Job.ID)
+		return nil
+	}
+
+	job, err := waitForJob(c, name, deploy.Job.ID)
+	if err != nil {
+		return err
+	}
+	if job.Status != "succeeded" {
+		return fmt.Errorf("rollback failed: %s", job.Error)
+	}
+
+	fmt.Printf("Rolled back as v%d\n", deploy.Release.Version)
+	fmt.Printf("  Image: %s\n", deploy.Release.Image)
+	if deploy.Release.ImageDigest != "" {
+		fmt.Printf("  Digest: %s\n", deploy.Release.ImageDigest)
+	}
+	fmt.Printf("  Config: v%d\n", deploy.Release.ConfigVersion)
+	return nil
+}
+
+func runPruneReleases(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	result, err := c.PruneReleases(name, pruneDryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "Deleted"
+	if result.DryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("Keeping the newest %d releases and those from the last %d days\n", result.KeepReleases, result.KeepDays)
+	if len(result.Releases) == 0 && len(result.ConfigVersions) == 0 && len(result.Images) == 0 {
+		fmt.Println("Nothing to prune")
+		return nil
+	}
+	if len(result.Releases) > 0 {
+		fmt.Printf("%s releases: %s\n", verb, joinVersions(result.Releases))
+	}
+	if len(result.ConfigVersions) > 0 {
+		fmt.Printf("%s config versions: %s\n", verb, joinVersions(result.ConfigVersions))
+	}
+	for _, image := range result.Images {
+		fmt.Printf("%s image: %s\n", verb, image)
+	}
+	return nil
+}
+
+func runReleasesRetention(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	c := getClient()
+
+	var req client.UpdateAppRequest
+	if cmd.Flags().Changed("keep") {
+		req.RetainReleases = &retentionKeep
+	}
+	if cmd.Flags().Changed("days") {
+		req.RetainDays = &retentionDays
+	}
+
+	var app *client.App
+	var err error
+	if req.RetainReleases != nil || req.RetainDays != nil {
+		app, err = c.UpdateApp(name, req)
+	} else {
+		app, err = c.GetApp(name)
+	}
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Rolled back to v%d\n", release.Version)
-	fmt.Printf("  Image: %s\n", release.Image)
+	// A dry run reports the policy in effect, server defaults included
+	policy, err := c.PruneReleases(name, true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("=== %s Retention ===\n", name)
+	fmt.Printf("Releases: newest %d%s\n", policy.KeepReleases, defaultNote(app.RetainReleases))
+	fmt.Printf("Days:     %d%s\n", policy.KeepDays, defaultNote(app.RetainDays))
+	if n := len(policy.Releases); n > 0 {
+		fmt.Printf("\n%d releases can be pruned; run: pvdify releases:prune %s\n", n, name)
+	}
 	return nil
 }
 
+// defaultNote marks a retention setting the app doesn't override
+func defaultNote(v int) string {
+	if v == 0 {
+		return " (server default)"
+	}
+	return ""
+}
+
+// joinVersions formats versions as "v1, v2, ..."
+func joinVersions(versions []int) string {
+	parts := make([]string, len(versions))
+	for i, v := range versions {
+		parts[i] = fmt.Sprintf("v%d", v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// shortDigest abbreviates an image digest to its algorithm and the first 12
+// hex digits, like podman's image IDs
+func shortDigest(digest string) string {
+	algo, hex, ok := strings.Cut(digest, ":")
+	if !ok || len(hex) <= 12 {
+		return digest
+	}
+	return algo + ":" + hex[:12]
+}
+
 func truncate(s string, max int) string {
 	if len(s) <= max {
 		return s
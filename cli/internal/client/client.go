@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -29,33 +31,281 @@ func New(baseURL, token string) *Client {
 
 // App represents an application
 type App struct {
-	Name        string            `json:"name"`
-	Environment string            `json:"environment,omitempty"`
-	Status      string            `json:"status"`
-	Image       string            `json:"image,omitempty"`
-	BindPort    int               `json:"bind_port,omitempty"`
-	Domains     []string          `json:"domains,omitempty"`
-	CreatedAt   time.Time         `json:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at"`
-	Config      map[string]string `json:"config,omitempty"`
+	Name           string            `json:"name"`
+	Environment    string            `json:"environment,omitempty"`
+	Status         string            `json:"status"`
+	Image          string            `json:"image,omitempty"`
+	BindPort       int               `json:"bind_port,omitempty"`
+	RetainReleases int               `json:"retain_releases,omitempty"`
+	RetainDays     int               `json:"retain_days,omitempty"`
+	Domains        []string          `json:"domains,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	Config         map[string]string `json:"config,omitempty"`
 }
 
 // Release represents a deployment release
 type Release struct {
-	Version       int       `json:"version"`
-	Image         string    `json:"image"`
-	ConfigVersion int       `json:"config_version"`
-	Status        string    `json:"status"`
-	CreatedAt     time.Time `json:"created_at"`
-	CreatedBy     string    `json:"created_by,omitempty"`
+	AppName       string               `json:"app_name,omitempty"`
+	Version       int                  `json:"version"`
+	Image         string               `json:"image"`
+	ImageDigest   string               `json:"image_digest,omitempty"`
+	ConfigVersion int                  `json:"config_version"`
+	ConfigGroups  []ReleaseConfigGroup `json:"config_groups,omitempty"`
+	Status        string               `json:"status"`
+	CreatedAt     time.Time            `json:"created_at"`
+	CreatedBy     string               `json:"created_by,omitempty"`
 }
 
-// Process represents a running process
+// ReleaseConfigGroup is a config group version a release was built with
+type ReleaseConfigGroup struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+}
+
+// Job represents a background job such as a deploy
+type Job struct {
+	ID             int64      `json:"id"`
+	Kind           string     `json:"kind"`
+	ReleaseVersion int        `json:"release_version,omitempty"`
+	Status         string     `json:"status"`
+	Error          string     `json:"error,omitempty"`
+	Steps          []JobStep  `json:"steps"`
+	CreatedAt      time.Time  `json:"created_at"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// Done reports whether the job has finished
+func (j *Job) Done() bool {
+	return j.Status == "succeeded" || j.Status == "failed"
+}
+
+// JobStep represents a single stage of a job
+type JobStep struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// DeployResponse is returned when a deploy has been queued
+type DeployResponse struct {
+	Release Release `json:"release"`
+	Job     Job     `json:"job"`
+}
+
+// Config is a config version. Values of the Secrets keys are masked unless
+// Revealed.
+type Config struct {
+	Version  int               `json:"version"`
+	Vars     map[string]string `json:"vars"`
+	Secrets  []string          `json:"secrets"`
+	Revealed bool              `json:"revealed"`
+}
+
+// ConfigSecret says whether a config var is secret, and why: "pattern" or
+// "explicit"
+type ConfigSecret struct {
+	Key    string `json:"key"`
+	Secret bool   `json:"secret"`
+	Source string `json:"source,omitempty"`
+}
+
+// ConfigChange is returned when config vars are set or unset. Release and
+// Job are nil when the change was staged or the app was never deployed.
+type ConfigChange struct {
+	Version int               `json:"version"`
+	Vars    map[string]string `json:"vars"` // Secret values masked
+	Secrets []string          `json:"secrets"`
+	Release *Release          `json:"release,omitempty"`
+	Job     *Job              `json:"job,omitempty"`
+}
+
+// ConfigVersion summarizes a config version
+type ConfigVersion struct {
+	Version   int       `json:"version"`
+	Keys      []string  `json:"keys"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ConfigDiffEntry describes how one key differs between config versions
+type ConfigDiffEntry struct {
+	Key    string `json:"key"`
+	Change string `json:"change"` // added, removed or changed
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// ConfigDiff lists the keys that differ between two config versions
+type ConfigDiff struct {
+	From    int               `json:"from"`
+	To      int               `json:"to"`
+	Masked  bool              `json:"masked"`
+	Changes []ConfigDiffEntry `json:"changes"`
+}
+
+// ConfigGroup is a named set of config vars shared by several apps. Vars
+// and Secrets are only returned by GetConfigGroup.
+type ConfigGroup struct {
+	Name      string            `json:"name"`
+	Version   int               `json:"version"`
+	Apps      []string          `json:"apps"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	Secrets   []string          `json:"secrets,omitempty"`
+	Revealed  bool              `json:"revealed"`
+	CreatedAt time.Time         `json:"created_at"`
+	CreatedBy string            `json:"created_by,omitempty"`
+}
+
+// ConfigGroupAttachment is a config group attached to an app. Higher
+// positions take precedence.
+type ConfigGroupAttachment struct {
+	GroupName string `json:"group_name"`
+	Position  int    `json:"position"`
+	Version   int    `json:"version"`
+}
+
+// ConfigGroupChange is returned when a config group's vars change, with the
+// releases started on attached apps
+type ConfigGroupChange struct {
+	Version  int               `json:"version"`
+	Vars     map[string]string `json:"vars"` // Secret values masked
+	Secrets  []string          `json:"secrets"`
+	Releases []DeployResponse  `json:"releases"`
+}
+
+// ConfigGroupsChange is returned when config groups are attached to or
+// detached from an app. Release and Job are nil if it wasn't released.
+type ConfigGroupsChange struct {
+	Groups  []ConfigGroupAttachment `json:"groups"`
+	Release *Release                `json:"release,omitempty"`
+	Job     *Job                    `json:"job,omitempty"`
+}
+
+// Process represents a process type definition
 type Process struct {
-	Type    string `json:"type"`
+	Name        string             `json:"name"`
+	Command     string             `json:"command,omitempty"`
+	Count       int                `json:"count"`
+	Resources   *ResourceLimits    `json:"resources,omitempty"`
+	Healthcheck *HealthcheckConfig `json:"healthcheck,omitempty"`
+	StopTimeout string             `json:"stop_timeout,omitempty"`
+}
+
+// ResourceLimits constrains each instance of a process type; unset fields
+// use the defaults
+type ResourceLimits struct {
+	Memory  string   `json:"memory,omitempty"`
+	CPU     float64  `json:"cpu,omitempty"`
+	Pids    int      `json:"pids,omitempty"`
+	Ulimits []string `json:"ulimits,omitempty"`
+}
+
+// HealthcheckConfig checks each instance of a process type, over HTTP at
+// Path (web only) or by running Command in the container
+type HealthcheckConfig struct {
+	Path     string `json:"path,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	Retries  int    `json:"retries,omitempty"`
+}
+
+// UpdateProcessRequest changes the limits, health check or stop timeout of
+// a process type; nil fields are left as is, empty ones go back to the
+// defaults
+type UpdateProcessRequest struct {
+	Resources   *ResourceLimits    `json:"resources,omitempty"`
+	Healthcheck *HealthcheckConfig `json:"healthcheck,omitempty"`
+	StopTimeout *string            `json:"stop_timeout,omitempty"`
+}
+
+// FormationProcess declares a process type; a nil Count keeps the current
+// count
+type FormationProcess struct {
+	Name    string `json:"name"`
 	Command string `json:"command,omitempty"`
-	Count   int    `json:"count"`
-	Status  string `json:"status"`
+	Count   *int   `json:"count,omitempty"`
+}
+
+// FormationRequest replaces an app's process types
+type FormationRequest struct {
+	Processes []FormationProcess `json:"processes"`
+}
+
+// FormationChange is the result of changing an app's process types; Release
+// and Job are set if the change was released, RemovalJob if types were
+// removed
+type FormationChange struct {
+	Processes  []Process `json:"processes"`
+	Removed    []string  `json:"removed"`
+	Release    *Release  `json:"release,omitempty"`
+	Job        *Job      `json:"job,omitempty"`
+	RemovalJob *Job      `json:"removal_job,omitempty"`
+}
+
+// ProcessInstance represents the runtime status of one process instance
+type ProcessInstance struct {
+	Name        string  `json:"name"`
+	Instance    int     `json:"instance"`
+	Color       string  `json:"color,omitempty"`
+	Port        int     `json:"port,omitempty"`
+	State       string  `json:"state"`
+	SubState    string  `json:"sub_state,omitempty"`
+	Container   string  `json:"container,omitempty"`
+	ContainerID string  `json:"container_id,omitempty"`
+	Uptime      string  `json:"uptime,omitempty"`
+	Restarts    int     `json:"restarts"`
+	Memory      int64   `json:"memory_bytes,omitempty"`
+	CPU         float64 `json:"cpu_percent"`
+	Health      string  `json:"health,omitempty"`
+	Desired     bool    `json:"desired"`
+}
+
+// ProcessList is the response from the ps endpoint
+type ProcessList struct {
+	Definitions []Process         `json:"definitions"`
+	Instances   []ProcessInstance `json:"instances"`
+}
+
+// Grant represents a role granted to a subject, globally or on one app
+type Grant struct {
+	ID        int64     `json:"id"`
+	Subject   string    `json:"subject"`
+	Role      string    `json:"role"`
+	AppName   string    `json:"app_name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// Identity represents the authenticated caller
+type Identity struct {
+	Subject string  `json:"subject"`
+	Method  string  `json:"method"`
+	Grants  []Grant `json:"grants"`
+}
+
+// AuditEvent represents an entry in the audit log
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	AppName   string                 `json:"app_name,omitempty"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Target    string                 `json:"target,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// AuditQuery filters the audit log. Empty fields don't filter.
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Since  string // RFC 3339 or a duration like 24h
+	Limit  int
 }
 
 // CreateAppRequest represents the request to create an app
@@ -66,7 +316,31 @@ type CreateAppRequest struct {
 
 // CreateReleaseRequest represents a deploy request
 type CreateReleaseRequest struct {
-	Image string `json:"image"`
+	Image    string `json:"image,omitempty"`
+	Procfile string `json:"procfile,omitempty"`
+}
+
+// UpdateAppRequest represents an app update; nil fields are left unchanged
+type UpdateAppRequest struct {
+	RetainReleases *int `json:"retain_releases,omitempty"`
+	RetainDays     *int `json:"retain_days,omitempty"`
+}
+
+// PruneResult lists the releases, config versions and images pruning
+// removed, or would remove on a dry run
+type PruneResult struct {
+	AppName        string   `json:"app_name"`
+	DryRun         bool     `json:"dry_run"`
+	KeepReleases   int      `json:"keep_releases"`
+	KeepDays       int      `json:"keep_days"`
+	Releases       []int    `json:"releases"`
+	ConfigVersions []int    `json:"config_versions"`
+	Images         []string `json:"images"`
+}
+
+// RollbackRequest represents a rollback request
+type RollbackRequest struct {
+	Version int `json:"version,omitempty"`
 }
 
 // ScaleRequest represents a scale request
@@ -89,13 +363,17 @@ func (c *Client) do(method, path string, body interface{}) (*http.Response, erro
 		}
 		bodyReader = bytes.NewReader(jsonBody)
 	}
+	return c.doRaw(method, path, "application/json", bodyReader)
+}
 
-	req, err := http.NewRequest(method, c.BaseURL+path, bodyReader)
+// doRaw performs an HTTP request with a body that isn't JSON
+func (c *Client) doRaw(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 	if c.Token != "" {
 		req.Header.Set("Authorization", "Bearer "+c.Token)
 	}
@@ -169,6 +447,20 @@ func (c *Client) CreateApp(name, environment string) (*App, error) {
 	return &app, nil
 }
 
+// UpdateApp changes an app's settings
+func (c *Client) UpdateApp(name string, req UpdateAppRequest) (*App, error) {
+	resp, err := c.do("PATCH", "/api/v1/apps/"+name, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var app App
+	if err := parseResponse(resp, &app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
 // DeleteApp deletes an app
 func (c *Client) DeleteApp(name string) error {
 	resp, err := c.do("DELETE", "/api/v1/apps/"+name, nil)
@@ -178,19 +470,49 @@ func (c *Client) DeleteApp(name string) error {
 	return parseResponse(resp, nil)
 }
 
-// CreateRelease deploys a new image
-func (c *Client) CreateRelease(appName, image string) (*Release, error) {
-	req := CreateReleaseRequest{Image: image}
+// CreateRelease deploys a new image, with the process types of procfile if
+// it is set. The deploy runs in the background; poll the returned job with
+// GetJob.
+func (c *Client) CreateRelease(appName, image, procfile string) (*DeployResponse, error) {
+	req := CreateReleaseRequest{Image: image, Procfile: procfile}
 	resp, err := c.do("POST", "/api/v1/apps/"+appName+"/releases", req)
 	if err != nil {
 		return nil, err
 	}
 
-	var release Release
-	if err := parseResponse(resp, &release); err != nil {
+	var deploy DeployResponse
+	if err := parseResponse(resp, &deploy); err != nil {
 		return nil, err
 	}
-	return &release, nil
+	return &deploy, nil
+}
+
+// ListJobs returns recent jobs for an app
+func (c *Client) ListJobs(appName string) ([]Job, error) {
+	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/jobs", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+	if err := parseResponse(resp, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetJob returns a job with its steps
+func (c *Client) GetJob(appName string, id int64) (*Job, error) {
+	resp, err := c.do("GET", fmt.Sprintf("/api/v1/apps/%s/jobs/%d", appName, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	if err := parseResponse(resp, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
 }
 
 // ListReleases returns all releases for an app
@@ -207,9 +529,9 @@ func (c *Client) ListReleases(appName string) ([]Release, error) {
 	return releases, nil
 }
 
-// Rollback rolls back to the previous release
-func (c *Client) Rollback(appName string) (*Release, error) {
-	resp, err := c.do("POST", "/api/v1/apps/"+appName+"/rollback", nil)
+// GetRelease returns a release of an app
+func (c *Client) GetRelease(appName string, version int) (*Release, error) {
+	resp, err := c.do("GET", fmt.Sprintf("/api/v1/apps/%s/releases/%d", appName, version), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -221,38 +543,381 @@ func (c *Client) Rollback(appName string) (*Release, error) {
 	return &release, nil
 }
 
-// GetConfig returns app configuration
-func (c *Client) GetConfig(appName string) (map[string]string, error) {
-	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/config", nil)
+// PruneReleases deletes the releases and config versions an app's retention
+// policy no longer keeps; with dryRun it only lists them
+func (c *Client) PruneReleases(appName string, dryRun bool) (*PruneResult, error) {
+	path := "/api/v1/apps/" + appName + "/releases/prune"
+	if dryRun {
+		path += "?dry_run=true"
+	}
+	resp, err := c.do("POST", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result PruneResult
+	if err := parseResponse(resp, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Rollback redeploys an earlier release; version 0 means the release that
+// was live before the current one
+func (c *Client) Rollback(appName string, version int) (*DeployResponse, error) {
+	req := RollbackRequest{Version: version}
+	resp, err := c.do("POST", "/api/v1/apps/"+appName+"/rollback", req)
 	if err != nil {
 		return nil, err
 	}
 
-	var config map[string]string
+	var deploy DeployResponse
+	if err := parseResponse(resp, &deploy); err != nil {
+		return nil, err
+	}
+	return &deploy, nil
+}
+
+// GetConfig returns the latest config vars of an app. Secret values are
+// masked unless reveal is set, which needs the admin role.
+func (c *Client) GetConfig(appName string, reveal bool) (*Config, error) {
+	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/config"+revealQuery(reveal), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
 	if err := parseResponse(resp, &config); err != nil {
 		return nil, err
 	}
-	return config, nil
+	return &config, nil
 }
 
-// SetConfig sets configuration variables
-func (c *Client) SetConfig(appName string, config map[string]string) error {
-	resp, err := c.do("PUT", "/api/v1/apps/"+appName+"/config", config)
+// SetConfig sets configuration variables. Unless restart is false, the new
+// config is released with the current image.
+func (c *Client) SetConfig(appName string, vars map[string]string, restart bool) (*ConfigChange, error) {
+	body := map[string]interface{}{"vars": vars}
+	resp, err := c.do("PUT", "/api/v1/apps/"+appName+"/config"+restartQuery(restart), body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return parseResponse(resp, nil)
+
+	var change ConfigChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// UnsetConfig removes a configuration variable. Unless restart is false, the
+// new config is released with the current image.
+func (c *Client) UnsetConfig(appName, key string, restart bool) (*ConfigChange, error) {
+	resp, err := c.do("DELETE", "/api/v1/apps/"+appName+"/config/"+url.PathEscape(key)+restartQuery(restart), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ConfigChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// ListConfigVersions returns an app's config versions, newest first
+func (c *Client) ListConfigVersions(appName string, limit int) ([]ConfigVersion, error) {
+	resp, err := c.do("GET", fmt.Sprintf("/api/v1/apps/%s/config/versions?limit=%d", appName, limit), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []ConfigVersion
+	if err := parseResponse(resp, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// DiffConfig compares two config versions; version 0 is the empty config.
+// Negative versions use the server's defaults: the latest version, compared
+// with the one before it.
+func (c *Client) DiffConfig(appName string, from, to int, reveal bool) (*ConfigDiff, error) {
+	q := url.Values{}
+	if from >= 0 {
+		q.Set("from", strconv.Itoa(from))
+	}
+	if to >= 0 {
+		q.Set("to", strconv.Itoa(to))
+	}
+	if reveal {
+		q.Set("reveal", "true")
+	}
+
+	path := "/api/v1/apps/" + appName + "/config/diff"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff ConfigDiff
+	if err := parseResponse(resp, &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// RestoreConfig saves an earlier config version as the latest. Unless
+// restart is false, it is released with the current image.
+func (c *Client) RestoreConfig(appName string, version int, restart bool) (*ConfigChange, error) {
+	body := map[string]int{"version": version}
+	resp, err := c.do("POST", "/api/v1/apps/"+appName+"/config/restore"+restartQuery(restart), body)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ConfigChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// ImportConfig sets config vars from a dotenv, json or yaml file, merged
+// into the app's config or replacing it, in one config version. Unless
+// restart is false, the new config is released with the current image.
+func (c *Client) ImportConfig(appName, format string, data []byte, replace, restart bool) (*ConfigChange, error) {
+	q := url.Values{}
+	q.Set("format", format)
+	if replace {
+		q.Set("replace", "true")
+	}
+	if !restart {
+		q.Set("restart", "false")
+	}
+
+	resp, err := c.doRaw("POST", "/api/v1/apps/"+appName+"/config/import?"+q.Encode(), "text/plain", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var change ConfigChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// ExportConfig returns the app's config vars as a dotenv, json or yaml file.
+// Secret values are masked unless reveal is set.
+func (c *Client) ExportConfig(appName, format string, reveal bool) ([]byte, error) {
+	path := "/api/v1/apps/" + appName + "/config/export?format=" + url.QueryEscape(format)
+	if reveal {
+		path += "&reveal=true"
+	}
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, parseResponse(resp, nil)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// ListConfigSecrets returns whether each of an app's config vars is secret
+func (c *Client) ListConfigSecrets(appName string) ([]ConfigSecret, error) {
+	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/config/secrets", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []ConfigSecret
+	if err := parseResponse(resp, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// MarkConfigSecret marks a config var secret or not secret, overriding the
+// server's secret key patterns
+func (c *Client) MarkConfigSecret(appName, key string, secret bool) (*ConfigSecret, error) {
+	resp, err := c.do("PUT", "/api/v1/apps/"+appName+"/config/secrets/"+url.PathEscape(key), map[string]bool{"secret": secret})
+	if err != nil {
+		return nil, err
+	}
+
+	var s ConfigSecret
+	if err := parseResponse(resp, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UnmarkConfigSecret removes the marking of a config var, so the server's
+// secret key patterns apply again
+func (c *Client) UnmarkConfigSecret(appName, key string) (*ConfigSecret, error) {
+	resp, err := c.do("DELETE", "/api/v1/apps/"+appName+"/config/secrets/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var s ConfigSecret
+	if err := parseResponse(resp, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListConfigGroups returns all config groups
+func (c *Client) ListConfigGroups() ([]ConfigGroup, error) {
+	resp, err := c.do("GET", "/api/v1/config-groups", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []ConfigGroup
+	if err := parseResponse(resp, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// CreateConfigGroup creates a config group, optionally with config vars
+func (c *Client) CreateConfigGroup(name string, vars map[string]string) (*ConfigGroup, error) {
+	body := map[string]interface{}{"name": name, "vars": vars}
+	resp, err := c.do("POST", "/api/v1/config-groups", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var group ConfigGroup
+	if err := parseResponse(resp, &group); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GetConfigGroup returns a config group with its latest config vars. Secret
+// values are masked unless reveal is set, which needs the admin role.
+func (c *Client) GetConfigGroup(name string, reveal bool) (*ConfigGroup, error) {
+	resp, err := c.do("GET", "/api/v1/config-groups/"+name+revealQuery(reveal), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var group ConfigGroup
+	if err := parseResponse(resp, &group); err != nil {
+		return nil, err
+	}
+	return &group, nil
 }
 
-// UnsetConfig removes a configuration variable
-func (c *Client) UnsetConfig(appName, key string) error {
-	resp, err := c.do("DELETE", "/api/v1/apps/"+appName+"/config/"+key, nil)
+// DeleteConfigGroup deletes a config group that no app uses
+func (c *Client) DeleteConfigGroup(name string) error {
+	resp, err := c.do("DELETE", "/api/v1/config-groups/"+name, nil)
 	if err != nil {
 		return err
 	}
 	return parseResponse(resp, nil)
 }
 
+// SetConfigGroupVars sets config vars of a group. Unless restart is false,
+// every attached app is released with the new values.
+func (c *Client) SetConfigGroupVars(name string, vars map[string]string, restart bool) (*ConfigGroupChange, error) {
+	body := map[string]interface{}{"vars": vars}
+	resp, err := c.do("PUT", "/api/v1/config-groups/"+name+"/config"+restartQuery(restart), body)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ConfigGroupChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// UnsetConfigGroupVar removes a config var from a group. Unless restart is
+// false, every attached app is released without it.
+func (c *Client) UnsetConfigGroupVar(name, key string, restart bool) (*ConfigGroupChange, error) {
+	resp, err := c.do("DELETE", "/api/v1/config-groups/"+name+"/config/"+url.PathEscape(key)+restartQuery(restart), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ConfigGroupChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// ListAppConfigGroups returns the config groups attached to an app, lowest
+// precedence first
+func (c *Client) ListAppConfigGroups(appName string) ([]ConfigGroupAttachment, error) {
+	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/config-groups", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []ConfigGroupAttachment
+	if err := parseResponse(resp, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// AttachConfigGroup attaches a config group to an app at a 1-based
+// position, or last if position is 0. Unless restart is false, the app is
+// released with the group's values.
+func (c *Client) AttachConfigGroup(appName, group string, position int, restart bool) (*ConfigGroupsChange, error) {
+	body := map[string]int{"position": position}
+	resp, err := c.do("PUT", "/api/v1/apps/"+appName+"/config-groups/"+group+restartQuery(restart), body)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ConfigGroupsChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// DetachConfigGroup detaches a config group from an app. Unless restart is
+// false, the app is released without the group's values.
+func (c *Client) DetachConfigGroup(appName, group string, restart bool) (*ConfigGroupsChange, error) {
+	resp, err := c.do("DELETE", "/api/v1/apps/"+appName+"/config-groups/"+group+restartQuery(restart), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ConfigGroupsChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func revealQuery(reveal bool) string {
+	if reveal {
+		return "?reveal=true"
+	}
+	return ""
+}
+
+func restartQuery(restart bool) string {
+	if restart {
+		return ""
+	}
+	return "?restart=false"
+}
+
 // ListDomains returns all domains for an app
 func (c *Client) ListDomains(appName string) ([]string, error) {
 	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/domains", nil)
@@ -285,18 +950,18 @@ func (c *Client) RemoveDomain(appName, domain string) error {
 	return parseResponse(resp, nil)
 }
 
-// ListProcesses returns all processes for an app
-func (c *Client) ListProcesses(appName string) ([]Process, error) {
+// ListProcesses returns the process definitions and instance status for an app
+func (c *Client) ListProcesses(appName string) (*ProcessList, error) {
 	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/ps", nil)
 	if err != nil {
 		return nil, err
 	}
 
-	var processes []Process
+	var processes ProcessList
 	if err := parseResponse(resp, &processes); err != nil {
 		return nil, err
 	}
-	return processes, nil
+	return &processes, nil
 }
 
 // Scale scales processes
@@ -309,13 +974,64 @@ func (c *Client) Scale(appName string, processes map[string]int) error {
 	return parseResponse(resp, nil)
 }
 
-// Restart restarts all processes
-func (c *Client) Restart(appName string) error {
+// GetFormation returns an app's process types
+func (c *Client) GetFormation(appName string) ([]Process, error) {
+	resp, err := c.do("GET", "/api/v1/apps/"+appName+"/formation", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []Process
+	if err := parseResponse(resp, &processes); err != nil {
+		return nil, err
+	}
+	return processes, nil
+}
+
+// SetFormation replaces an app's process types; types left out are
+// removed. New commands and types are released unless restart is false.
+func (c *Client) SetFormation(appName string, processes []FormationProcess, restart bool) (*FormationChange, error) {
+	req := FormationRequest{Processes: processes}
+	resp, err := c.do("PUT", "/api/v1/apps/"+appName+"/formation"+restartQuery(restart), req)
+	if err != nil {
+		return nil, err
+	}
+
+	var change FormationChange
+	if err := parseResponse(resp, &change); err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// UpdateProcess changes the limits or health check of a process type; its
+// instances restart with them
+func (c *Client) UpdateProcess(appName, processType string, req UpdateProcessRequest) (*Process, error) {
+	resp, err := c.do("PATCH", "/api/v1/apps/"+appName+"/formation/"+processType, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var process Process
+	if err := parseResponse(resp, &process); err != nil {
+		return nil, err
+	}
+	return &process, nil
+}
+
+// Restart queues a job restarting an app's running instances
+func (c *Client) Restart(appName string) (*Job, error) {
 	resp, err := c.do("POST", "/api/v1/apps/"+appName+"/ps/restart", nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return parseResponse(resp, nil)
+	var result struct {
+		Job *Job `json:"job"`
+	}
+	if err := parseResponse(resp, &result); err != nil {
+		return nil, err
+	}
+	return result.Job, nil
 }
 
 // GetLogs returns logs for an app (non-streaming)
@@ -336,3 +1052,105 @@ func (c *Client) GetLogs(appName string, lines int, follow bool) (io.ReadCloser,
 
 	return resp.Body, nil
 }
+
+// Me returns the authenticated caller and its grants
+func (c *Client) Me() (*Identity, error) {
+	resp, err := c.do("GET", "/api/v1/me", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var id Identity
+	if err := parseResponse(resp, &id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// ListGrants returns the grants on an app, or the global grants if appName
+// is empty
+func (c *Client) ListGrants(appName string) ([]Grant, error) {
+	resp, err := c.do("GET", accessPath(appName, ""), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []Grant
+	if err := parseResponse(resp, &grants); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// Grant gives a subject a role on an app, or globally if appName is empty
+func (c *Client) Grant(appName, subject, role string) (*Grant, error) {
+	resp, err := c.do("PUT", accessPath(appName, subject), map[string]string{"role": role})
+	if err != nil {
+		return nil, err
+	}
+
+	var grant Grant
+	if err := parseResponse(resp, &grant); err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// Revoke removes a subject's role on an app, or globally if appName is empty
+func (c *Client) Revoke(appName, subject string) error {
+	resp, err := c.do("DELETE", accessPath(appName, subject), nil)
+	if err != nil {
+		return err
+	}
+	return parseResponse(resp, nil)
+}
+
+// accessPath returns the grants endpoint for a scope, optionally for one
+// subject
+func accessPath(appName, subject string) string {
+	path := "/api/v1/access"
+	if appName != "" {
+		path = "/api/v1/apps/" + appName + "/access"
+	}
+	if subject != "" {
+		path += "/" + url.PathEscape(subject)
+	}
+	return path
+}
+
+// ListAudit returns audit events for an app, or across all apps if appName
+// is empty
+func (c *Client) ListAudit(appName string, q AuditQuery) ([]AuditEvent, error) {
+	path := "/api/v1/audit"
+	if appName != "" {
+		path = "/api/v1/apps/" + appName + "/audit"
+	}
+
+	params := url.Values{}
+	if q.Actor != "" {
+		params.Set("actor", q.Actor)
+	}
+	if q.Action != "" {
+		params.Set("action", q.Action)
+	}
+	if q.Since != "" {
+		params.Set("since", q.Since)
+	}
+	if q.Limit > 0 {
+		params.Set("limit", fmt.Sprint(q.Limit))
+	}
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	resp, err := c.do("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []AuditEvent
+	if err := parseResponse(resp, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
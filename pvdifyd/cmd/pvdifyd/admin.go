@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/config"
+	"github.com/philoveracity/pvdifyd/internal/db"
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/secrets"
+)
+
+const tokensUsage = `usage: pvdifyd tokens <command>
+
+commands:
+  create NAME   create an API token and print it once
+  list          list API tokens
+  revoke NAME   delete an API token`
+
+const accessUsage = `usage: pvdifyd access <command>
+
+commands:
+  grant SUBJECT ROLE [APP]   grant admin, deployer or viewer, globally or on APP
+  list [APP]                 list global grants, or the grants on APP
+  revoke SUBJECT [APP]       revoke a global grant, or a grant on APP`
+
+const keysUsage = `usage: pvdifyd keys <command>
+
+commands:
+  list     list the public keys in the config encryption key file
+  rotate   replace the config encryption key and re-encrypt all config`
+
+// runAdmin runs a host-side management command directly against the
+// database, bypassing the API. Whoever can read the config and database may
+// run them, which is how the first admin is created.
+func runAdmin(cfg *config.Config, args []string) error {
+	usage := map[string]string{"tokens": tokensUsage, "access": accessUsage, "keys": keysUsage}[args[0]]
+	if len(args) < 2 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	database, err := db.New(cfg.Database)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+	defer database.Close()
+
+	if err := database.Migrate(); err != nil {
+		return fmt.Errorf("run migrations: %w", err)
+	}
+
+	switch args[0] {
+	case "access":
+		return runAccess(database, args[1:])
+	case "keys":
+		return runKeys(cfg, database, args[1:])
+	}
+	return runTokens(database, args[1:])
+}
+
+// runTokens manages API tokens
+func runTokens(database *db.DB, args []string) error {
+	switch args[0] {
+	case "create":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: pvdifyd tokens create NAME")
+		}
+		token, err := auth.GenerateToken()
+		if err != nil {
+			return err
+		}
+		if err := database.CreateAPIToken(&models.APIToken{
+			Name:      args[1],
+			TokenHash: auth.HashToken(token),
+		}); err != nil {
+			return err
+		}
+		hostAudit(database, "", models.AuditTokenCreate, args[1], nil)
+		fmt.Fprintf(os.Stderr, "Created token %s. It will not be shown again.\n", args[1])
+		fmt.Fprintf(os.Stderr, "Grant it a role with: pvdifyd access grant %s ROLE [APP]\n", auth.TokenSubject(args[1]))
+		fmt.Println(token)
+
+	case "list":
+		tokens, err := database.ListAPITokens()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED\tLAST USED")
+		for _, t := range tokens {
+			lastUsed := "never"
+			if t.LastUsedAt != nil {
+				lastUsed = t.LastUsedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", t.Name, t.CreatedAt.Format(time.RFC3339), lastUsed)
+		}
+		w.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: pvdifyd tokens revoke NAME")
+		}
+		if err := database.DeleteAPIToken(args[1]); err != nil {
+			return err
+		}
+		hostAudit(database, "", models.AuditTokenRevoke, args[1], nil)
+		fmt.Fprintf(os.Stderr, "Revoked token %s\n", args[1])
+
+	default:
+		return fmt.Errorf("unknown tokens command %q\n%s", args[0], tokensUsage)
+	}
+
+	return nil
+}
+
+// runAccess manages role grants
+func runAccess(database *db.DB, args []string) error {
+	switch args[0] {
+	case "grant":
+		if len(args) != 3 && len(args) != 4 {
+			return fmt.Errorf("usage: pvdifyd access grant SUBJECT ROLE [APP]")
+		}
+		grant := &models.Grant{Subject: args[1], Role: models.Role(args[2]), CreatedBy: "pvdifyd"}
+		if !grant.Role.Valid() {
+			return fmt.Errorf("role must be admin, deployer or viewer")
+		}
+		if len(args) == 4 {
+			grant.AppName = args[3]
+			app, err := database.GetApp(grant.AppName)
+			if err != nil {
+				return err
+			}
+			if app == nil {
+				return fmt.Errorf("app not found: %s", grant.AppName)
+			}
+		}
+		if err := database.PutGrant(grant); err != nil {
+			return err
+		}
+		hostAudit(database, grant.AppName, models.AuditAccessGrant, grant.Subject, map[string]interface{}{
+			"role": grant.Role,
+		})
+		fmt.Fprintf(os.Stderr, "Granted %s to %s on %s\n", grant.Role, grant.Subject, scopeName(grant.AppName))
+
+	case "list":
+		appName := ""
+		if len(args) > 1 {
+			appName = args[1]
+		}
+		grants, err := database.ListGrants(appName)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SUBJECT\tROLE\tSCOPE\tGRANTED BY")
+		for _, g := range grants {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", g.Subject, g.Role, scopeName(g.AppName), g.CreatedBy)
+		}
+		w.Flush()
+
+	case "revoke":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf("usage: pvdifyd access revoke SUBJECT [APP]")
+		}
+		appName := ""
+		if len(args) == 3 {
+			appName = args[2]
+		}
+		if err := database.DeleteGrant(args[1], appName); err != nil {
+			return err
+		}
+		hostAudit(database, appName, models.AuditAccessRevoke, args[1], nil)
+		fmt.Fprintf(os.Stderr, "Revoked %s on %s\n", args[1], scopeName(appName))
+
+	default:
+		return fmt.Errorf("unknown access command %q\n%s", args[0], accessUsage)
+	}
+
+	return nil
+}
+
+// runKeys manages the config encryption key
+func runKeys(cfg *config.Config, database *db.DB, args []string) error {
+	switch args[0] {
+	case "list":
+		keyring, err := secrets.Load(cfg.SOPS.AgeKey)
+		if err != nil {
+			return err
+		}
+		keys, err := keyring.Identities()
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			status := "primary"
+			if i > 0 {
+				status = "retiring"
+			}
+			fmt.Printf("%s\t%s\n", k.Recipient(), status)
+		}
+
+	case "rotate":
+		logf := func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		}
+		if err := secrets.Rotate(cfg.SOPS.AgeKey, database, logf); err != nil {
+			return err
+		}
+		hostAudit(database, "", models.AuditKeyRotate, "", nil)
+		fmt.Fprintf(os.Stderr, "Rotated config encryption key in %s. Back up the new key file.\n", cfg.SOPS.AgeKey)
+
+	default:
+		return fmt.Errorf("unknown keys command %q\n%s", args[0], keysUsage)
+	}
+
+	return nil
+}
+
+// hostAudit records a change made from the host. The actor is the local
+// user, since there is no API identity.
+func hostAudit(database *db.DB, appName string, action models.AuditAction, target string, details map[string]interface{}) {
+	actor := "host"
+	if u, err := user.Current(); err == nil {
+		actor = "host:" + u.Username
+	}
+
+	event := &models.AuditEvent{
+		AppName: appName,
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+	if err := database.CreateAuditEvent(event); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: record audit event: %v\n", err)
+	}
+}
+
+// scopeName describes the scope of a grant
+func scopeName(appName string) string {
+	if appName == "" {
+		return "all apps"
+	}
+	return appName
+}
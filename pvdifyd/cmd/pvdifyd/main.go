@@ -12,6 +12,8 @@ import (
 	"github.com/philoveracity/pvdifyd/internal/api"
 	"github.com/philoveracity/pvdifyd/internal/config"
 	"github.com/philoveracity/pvdifyd/internal/db"
+	"github.com/philoveracity/pvdifyd/internal/deploy"
+	"github.com/philoveracity/pvdifyd/internal/secrets"
 )
 
 var (
@@ -39,6 +41,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Host-side management commands
+	if cmd := flag.Arg(0); cmd == "tokens" || cmd == "access" || cmd == "keys" {
+		if err := runAdmin(cfg, flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *dev {
 		cfg.Dev = true
 		cfg.Log.Level = "debug"
@@ -78,14 +89,48 @@ func main() {
 	}
 	logger.Info("database initialized", "path", cfg.Database)
 
+	// Config vars are encrypted at rest with age
+	keyring, created, err := secrets.LoadOrCreate(cfg.SOPS.AgeKey)
+	if err != nil {
+		logger.Error("failed to load config encryption key", "error", err)
+		os.Exit(1)
+	}
+	if created {
+		logger.Warn("generated new config encryption key, back it up: config vars can't be read without it", "path", cfg.SOPS.AgeKey)
+	}
+	database.SetCipher(keyring)
+
+	// Encrypt config stored before encryption at rest (one-time)
+	if n, err := database.EncryptPlaintextConfig(); err != nil {
+		logger.Error("failed to encrypt plaintext config", "error", err)
+		os.Exit(1)
+	} else if n > 0 {
+		logger.Info("encrypted plaintext config versions", "count", n)
+	}
+
+	// Jobs that were running when the daemon last stopped will never finish
+	if n, err := database.FailInterruptedJobs(); err != nil {
+		logger.Error("failed to clean up interrupted jobs", "error", err)
+	} else if n > 0 {
+		logger.Warn("marked interrupted jobs as failed", "count", n)
+	}
+
 	// Create state directories
 	if err := ensureStateDir(cfg.StateDir); err != nil {
 		logger.Error("failed to create state directory", "error", err)
 		os.Exit(1)
 	}
 
+	// Create deploy engine
+	engine, err := deploy.New(database, cfg, logger)
+	if err != nil {
+		logger.Error("failed to create deploy engine", "error", err)
+		os.Exit(1)
+	}
+	defer engine.Close()
+
 	// Create API server
-	server := api.New(database, cfg, logger)
+	server := api.New(database, engine, cfg, logger)
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -99,6 +144,24 @@ func main() {
 		cancel()
 	}()
 
+	// Keep systemd and podman in line with the database
+	go engine.RunReconciler(ctx)
+
+	// Prune releases and config versions the retention policy no longer keeps
+	go engine.RunPruner(ctx)
+
+	// Serve app traffic through the built-in proxy, if enabled or the tunnel
+	// routes through it
+	if p := engine.Proxy(); p != nil {
+		go engine.RunRouteReloader(ctx)
+		go func() {
+			if err := p.ListenAndServe(ctx, cfg.Proxy.Listen); err != nil {
+				logger.Error("proxy error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// Start server
 	if err := server.ListenAndServe(ctx); err != nil {
 		logger.Error("server error", "error", err)
@@ -3,7 +3,14 @@ module github.com/philoveracity/pvdifyd
 go 1.25.3
 
 require (
+	filippo.io/age v1.3.2
 	github.com/go-chi/chi/v5 v5.2.3
 	github.com/mattn/go-sqlite3 v1.14.33
 	gopkg.in/yaml.v3 v3.0.1
 )
+
+require (
+	filippo.io/hpke v0.4.0 // indirect
+	golang.org/x/crypto v0.55.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+)
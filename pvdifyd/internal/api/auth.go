@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// tokenTouchInterval limits how often last_used_at is written for a token
+const tokenTouchInterval = time.Minute
+
+var (
+	errNoCredentials = errors.New("no credentials")
+	errUnknownToken  = errors.New("unknown api token")
+)
+
+// authMiddleware rejects requests without a valid API token or Cloudflare
+// Access JWT and attaches the caller's identity and grants to the request
+// context. In dev mode, requests without credentials are let through as
+// "dev".
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := s.authenticate(r)
+		if err != nil {
+			s.logger.Warn("authentication failed", "error", err, "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pvdifyd"`)
+			s.error(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		grants, err := s.db.ListSubjectGrants(id.Subject)
+		if err != nil {
+			s.logger.Error("load grants", "error", err, "subject", id.Subject)
+			s.error(w, http.StatusInternalServerError, "failed to load permissions")
+			return
+		}
+		if grants == nil {
+			grants = []*models.Grant{}
+		}
+		id.Grants = grants
+
+		next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+	})
+}
+
+// authorize returns middleware that only lets through callers allowed to
+// perform p on the app named in the route, or globally for routes without
+// an app
+func (s *Server) authorize(p auth.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := auth.FromContext(r.Context())
+			if !id.Can(chi.URLParam(r, "name"), p) {
+				s.error(w, http.StatusForbidden, "forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authenticate resolves the identity behind a request. A bearer token is
+// either a pvdify API token or an Access JWT (as sent by `cloudflared access
+// token`); otherwise the JWT Access adds to proxied requests is used.
+func (s *Server) authenticate(r *http.Request) (*auth.Identity, error) {
+	if bearer := bearerToken(r); bearer != "" {
+		if auth.IsToken(bearer) {
+			return s.authenticateToken(bearer)
+		}
+		if s.access != nil {
+			return s.access.Verify(r.Context(), bearer)
+		}
+		return nil, errUnknownToken
+	}
+
+	if s.access != nil {
+		if jwt := r.Header.Get("Cf-Access-Jwt-Assertion"); jwt != "" {
+			return s.access.Verify(r.Context(), jwt)
+		}
+		if c, err := r.Cookie("CF_Authorization"); err == nil && c.Value != "" {
+			return s.access.Verify(r.Context(), c.Value)
+		}
+	}
+
+	if s.cfg.Dev {
+		return &auth.Identity{Subject: "dev", Method: auth.MethodDev}, nil
+	}
+	return nil, errNoCredentials
+}
+
+// authenticateToken looks up an API token by its hash
+func (s *Server) authenticateToken(token string) (*auth.Identity, error) {
+	t, err := s.db.GetAPITokenByHash(auth.HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, errUnknownToken
+	}
+
+	if t.LastUsedAt == nil || time.Since(*t.LastUsedAt) > tokenTouchInterval {
+		if err := s.db.TouchAPIToken(t.ID); err != nil {
+			s.logger.Warn("touch api token", "error", err, "token", t.Name)
+		}
+	}
+
+	return &auth.Identity{Subject: auth.TokenSubject(t.Name), Method: auth.MethodToken, TokenID: t.ID}, nil
+}
+
+// bearerToken extracts the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// handleMe returns the caller's identity and grants
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	s.json(w, http.StatusOK, auth.FromContext(r.Context()))
+}
+
+// handleListGrants returns the grants on an app, or the global grants when
+// the route has no app
+func (s *Server) handleListGrants(w http.ResponseWriter, r *http.Request) {
+	appName, ok := s.grantScope(w, r)
+	if !ok {
+		return
+	}
+
+	grants, err := s.db.ListGrants(appName)
+	if err != nil {
+		s.logger.Error("list grants", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list grants")
+		return
+	}
+	if grants == nil {
+		grants = []*models.Grant{}
+	}
+	s.json(w, http.StatusOK, grants)
+}
+
+// handlePutGrant grants a role to a subject, replacing its previous role in
+// the same scope
+func (s *Server) handlePutGrant(w http.ResponseWriter, r *http.Request) {
+	appName, ok := s.grantScope(w, r)
+	if !ok {
+		return
+	}
+	subject, err := url.PathUnescape(chi.URLParam(r, "subject"))
+	if err != nil || strings.TrimSpace(subject) == "" {
+		s.error(w, http.StatusBadRequest, "invalid subject")
+		return
+	}
+
+	var req models.GrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !req.Role.Valid() {
+		s.error(w, http.StatusBadRequest, "role must be admin, deployer or viewer")
+		return
+	}
+
+	grant := &models.Grant{
+		Subject:   subject,
+		Role:      req.Role,
+		AppName:   appName,
+		CreatedBy: auth.FromContext(r.Context()).Subject,
+	}
+	if err := s.db.PutGrant(grant); err != nil {
+		s.logger.Error("put grant", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to grant role")
+		return
+	}
+
+	s.logger.Info("role granted", "subject", subject, "role", req.Role, "app", appName, "by", grant.CreatedBy)
+	s.audit(r, appName, models.AuditAccessGrant, subject, map[string]interface{}{
+		"role": req.Role,
+	})
+	s.json(w, http.StatusOK, grant)
+}
+
+// handleDeleteGrant revokes a subject's role in the route's scope
+func (s *Server) handleDeleteGrant(w http.ResponseWriter, r *http.Request) {
+	appName, ok := s.grantScope(w, r)
+	if !ok {
+		return
+	}
+	subject, err := url.PathUnescape(chi.URLParam(r, "subject"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "invalid subject")
+		return
+	}
+
+	if err := s.db.DeleteGrant(subject, appName); err != nil {
+		s.error(w, http.StatusNotFound, "grant not found")
+		return
+	}
+
+	s.logger.Info("role revoked", "subject", subject, "app", appName, "by", auth.FromContext(r.Context()).Subject)
+	s.audit(r, appName, models.AuditAccessRevoke, subject, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// grantScope returns the app a grants route applies to, or "" for global
+// grants, writing a 404 if the app doesn't exist
+func (s *Server) grantScope(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := chi.URLParam(r, "name")
+	if name == "" {
+		return "", true
+	}
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return "", false
+	}
+	return name, true
+}
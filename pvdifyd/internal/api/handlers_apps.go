@@ -5,19 +5,26 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/deploy"
 	"github.com/philoveracity/pvdifyd/internal/models"
 )
 
-// handleListApps returns all apps
+// handleListApps returns the apps the caller can read
 func (s *Server) handleListApps(w http.ResponseWriter, r *http.Request) {
-	apps, err := s.db.ListApps()
+	all, err := s.db.ListApps()
 	if err != nil {
 		s.logger.Error("list apps", "error", err)
 		s.error(w, http.StatusInternalServerError, "failed to list apps")
 		return
 	}
-	if apps == nil {
-		apps = []*models.App{}
+
+	id := auth.FromContext(r.Context())
+	apps := []*models.App{}
+	for _, app := range all {
+		if id.Can(app.Name, auth.PermRead) {
+			apps = append(apps, app)
+		}
 	}
 	s.json(w, http.StatusOK, apps)
 }
@@ -34,6 +41,10 @@ func (s *Server) handleCreateApp(w http.ResponseWriter, r *http.Request) {
 		s.error(w, http.StatusBadRequest, "name is required")
 		return
 	}
+	if err := deploy.ValidateAppName(req.Name); err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// Check if app exists
 	existing, err := s.db.GetApp(req.Name)
@@ -47,19 +58,10 @@ func (s *Server) handleCreateApp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Allocate port
-	port, err := s.db.AllocatePort(s.cfg.Ports.Start, s.cfg.Ports.End)
-	if err != nil {
-		s.logger.Error("allocate port", "error", err)
-		s.error(w, http.StatusInternalServerError, "failed to allocate port")
-		return
-	}
-
 	app := &models.App{
 		Name:        req.Name,
 		Environment: req.Environment,
 		Status:      models.AppStatusCreated,
-		BindPort:    port,
 	}
 	if app.Environment == "" {
 		app.Environment = "production"
@@ -81,7 +83,10 @@ func (s *Server) handleCreateApp(w http.ResponseWriter, r *http.Request) {
 		s.logger.Error("create default process", "error", err)
 	}
 
-	s.logger.Info("app created", "name", app.Name, "port", app.BindPort)
+	s.logger.Info("app created", "name", app.Name)
+	s.audit(r, app.Name, models.AuditAppCreate, app.Name, map[string]interface{}{
+		"environment": app.Environment,
+	})
 	s.json(w, http.StatusCreated, app)
 }
 
@@ -138,12 +143,44 @@ func (s *Server) handleUpdateApp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.UpdateApp(name, req.Image, nil, nil); err != nil {
+	if (req.RetainReleases != nil && *req.RetainReleases < 0) || (req.RetainDays != nil && *req.RetainDays < 0) {
+		s.error(w, http.StatusBadRequest, "retention settings can't be negative")
+		return
+	}
+
+	if err := s.db.UpdateApp(name, req.Image, nil); err != nil {
 		s.logger.Error("update app", "error", err)
 		s.error(w, http.StatusInternalServerError, "failed to update app")
 		return
 	}
 
+	var details map[string]interface{}
+	if req.Image != nil {
+		details = map[string]interface{}{"image": *req.Image}
+	}
+
+	// Either retention setting can be changed on its own
+	if req.RetainReleases != nil || req.RetainDays != nil {
+		keepReleases, keepDays := app.RetainReleases, app.RetainDays
+		if req.RetainReleases != nil {
+			keepReleases = *req.RetainReleases
+		}
+		if req.RetainDays != nil {
+			keepDays = *req.RetainDays
+		}
+		if err := s.db.SetAppRetention(name, keepReleases, keepDays); err != nil {
+			s.logger.Error("set app retention", "error", err)
+			s.error(w, http.StatusInternalServerError, "failed to update app")
+			return
+		}
+		if details == nil {
+			details = make(map[string]interface{})
+		}
+		details["retain_releases"] = keepReleases
+		details["retain_days"] = keepDays
+	}
+	s.audit(r, name, models.AuditAppUpdate, name, details)
+
 	app, _ = s.db.GetApp(name)
 	s.json(w, http.StatusOK, app)
 }
@@ -163,16 +200,13 @@ func (s *Server) handleDeleteApp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Stop running containers
-	// TODO: Remove systemd units
-	// TODO: Update tunnel config
-
-	if err := s.db.DeleteApp(name); err != nil {
+	if err := s.engine.DeleteApp(r.Context(), name); err != nil {
 		s.logger.Error("delete app", "error", err)
 		s.error(w, http.StatusInternalServerError, "failed to delete app")
 		return
 	}
 
 	s.logger.Info("app deleted", "name", name)
+	s.audit(r, name, models.AuditAppDelete, name, nil)
 	w.WriteHeader(http.StatusNoContent)
 }
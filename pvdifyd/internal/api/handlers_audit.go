@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// maxAuditLimit caps how many events one request can return
+const maxAuditLimit = 1000
+
+// audit records a change made by the request's caller. Failures are logged
+// but don't fail the request, since the change has already happened.
+func (s *Server) audit(r *http.Request, appName string, action models.AuditAction, target string, details map[string]interface{}) {
+	event := &models.AuditEvent{
+		AppName:    appName,
+		Actor:      auth.FromContext(r.Context()).Subject,
+		Action:     action,
+		Target:     target,
+		Details:    details,
+		RequestID:  middleware.GetReqID(r.Context()),
+		RemoteAddr: auditRemoteAddr(r),
+	}
+	if err := s.db.CreateAuditEvent(event); err != nil {
+		s.logger.Error("record audit event", "error", err, "action", action, "app", appName)
+	}
+}
+
+type peerAddrKey struct{}
+
+// peerAddrMiddleware records the address the request's connection came
+// from, before anything rewrites RemoteAddr
+func peerAddrMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerAddrKey{}, r.RemoteAddr)))
+	})
+}
+
+// auditRemoteAddr returns the address to record for a request's caller.
+// X-Forwarded-For and X-Real-IP can be set by anyone, so only the peer
+// address is trusted, except for Access users coming through cloudflared:
+// Cloudflare sets CF-Connecting-IP itself, overwriting any the client sent.
+func auditRemoteAddr(r *http.Request) string {
+	peer, ok := r.Context().Value(peerAddrKey{}).(string)
+	if !ok {
+		peer = r.RemoteAddr
+	}
+	if id := auth.FromContext(r.Context()); id == nil || id.Method != auth.MethodAccess {
+		return peer
+	}
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return peer
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return peer
+	}
+	if cf := net.ParseIP(r.Header.Get("CF-Connecting-IP")); cf != nil {
+		return cf.String()
+	}
+	return peer
+}
+
+// handleListAudit returns audit events, for one app when the route has an
+// app and across all apps otherwise
+func (s *Server) handleListAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	filter := models.AuditFilter{
+		AppName: chi.URLParam(r, "name"),
+		Actor:   q.Get("actor"),
+		Action:  q.Get("action"),
+		Limit:   100,
+	}
+	if filter.AppName == "" {
+		filter.AppName = q.Get("app")
+	} else {
+		app, err := s.db.GetApp(filter.AppName)
+		if err != nil || app == nil {
+			s.error(w, http.StatusNotFound, "app not found")
+			return
+		}
+	}
+
+	var err error
+	if filter.Since, err = parseAuditTime(q.Get("since")); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid since: use RFC 3339 or a duration like 24h")
+		return
+	}
+	if filter.Until, err = parseAuditTime(q.Get("until")); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid until: use RFC 3339 or a duration like 24h")
+		return
+	}
+	if l := q.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			filter.Limit = min(parsed, maxAuditLimit)
+		}
+	}
+
+	events, err := s.db.ListAuditEvents(filter)
+	if err != nil {
+		s.logger.Error("list audit events", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list audit events")
+		return
+	}
+	if events == nil {
+		events = []*models.AuditEvent{}
+	}
+	s.json(w, http.StatusOK, events)
+}
+
+// parseAuditTime accepts an RFC 3339 timestamp or a duration meaning that
+// long ago
+func parseAuditTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
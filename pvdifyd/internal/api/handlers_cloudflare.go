@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/models"
 )
 
 // CloudflareZone represents a Cloudflare zone
@@ -152,6 +153,12 @@ func (s *Server) handleCreateCloudflareDNS(w http.ResponseWriter, r *http.Reques
 	}
 
 	s.logger.Info("DNS record created", "domain", domainName, "zone", req.ZoneName, "output", stdout.String())
+	s.audit(r, appName, models.AuditDomainDNS, domainName, map[string]interface{}{
+		"zone":    req.ZoneName,
+		"type":    req.Type,
+		"content": req.Content,
+		"proxied": req.Proxied,
+	})
 
 	s.json(w, http.StatusCreated, map[string]interface{}{
 		"success": true,
@@ -2,14 +2,22 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/configfile"
+	"github.com/philoveracity/pvdifyd/internal/deploy"
 	"github.com/philoveracity/pvdifyd/internal/models"
 	"gopkg.in/yaml.v3"
 )
 
-// handleGetConfig returns current config vars
+// handleGetConfig returns current config vars, with secret values masked
+// unless ?reveal=true
 func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
@@ -27,29 +35,23 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if cfg == nil {
-		s.json(w, http.StatusOK, map[string]interface{}{
-			"version": 0,
-			"vars":    map[string]string{},
-		})
+		s.respondConfig(w, r, name, 0, nil, models.ConfigData{})
 		return
 	}
 
-	// Decrypt and parse config
-	// TODO: Implement SOPS decryption
-	var vars models.ConfigData
-	if err := yaml.Unmarshal(cfg.Data, &vars); err != nil {
+	// Parse config (decrypted by the db layer)
+	vars, err := parseConfig(cfg)
+	if err != nil {
 		s.logger.Error("parse config", "error", err)
 		s.error(w, http.StatusInternalServerError, "failed to parse config")
 		return
 	}
 
-	s.json(w, http.StatusOK, map[string]interface{}{
-		"version": cfg.Version,
-		"vars":    vars,
-	})
+	s.respondConfig(w, r, name, cfg.Version, &cfg.CreatedAt, vars)
 }
 
-// handleSetConfig sets config vars
+// handleSetConfig merges config vars into the app's config, or replaces it
+// with them if the request asks to
 func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
@@ -59,46 +61,200 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+
 	var req models.SetConfigRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.error(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
 
-	// Get current config and merge
-	currentVars := make(models.ConfigData)
-	currentCfg, _ := s.db.GetLatestConfig(name)
-	if currentCfg != nil {
-		yaml.Unmarshal(currentCfg.Data, &currentVars)
+	s.saveConfig(w, r, name, req.Vars, req.Replace)
+}
+
+// handleImportConfig sets config vars from a dotenv, JSON or YAML file sent
+// as the request body (?format=, default dotenv). They are merged into the
+// app's config, or replace it with ?replace=true.
+func (s *Server) handleImportConfig(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	q := r.URL.Query()
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+	format, err := configfile.ParseFormat(q.Get("format"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	replace, err := parseBoolParam(q.Get("replace"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "invalid replace parameter")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigFileSize))
+	if err != nil {
+		s.error(w, http.StatusRequestEntityTooLarge, "config file too large")
+		return
+	}
+	vars, err := configfile.Parse(format, data)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.saveConfig(w, r, name, vars, replace)
+}
+
+// maxConfigFileSize bounds imported config files
+const maxConfigFileSize = 1 << 20
+
+// handleExportConfig returns the app's latest config vars as a dotenv, JSON
+// or YAML file (?format=, default dotenv). Secret values are masked unless
+// ?reveal=true.
+func (s *Server) handleExportConfig(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	format, err := configfile.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reveal, ok := s.revealRequested(w, r, name)
+	if !ok {
+		return
+	}
+
+	cfg, err := s.db.GetLatestConfig(name)
+	if err != nil {
+		s.logger.Error("get config", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config")
+		return
+	}
+	vars, version := models.ConfigData{}, 0
+	if cfg != nil {
+		version = cfg.Version
+		if vars, err = parseConfig(cfg); err != nil {
+			s.logger.Error("parse config", "error", err)
+			s.error(w, http.StatusInternalServerError, "failed to parse config")
+			return
+		}
 	}
 
-	// Merge new vars
-	for k, v := range req.Vars {
-		currentVars[k] = v
+	masked, secrets, err := s.maskSecrets(name, vars)
+	if err != nil {
+		s.logger.Error("list config secrets", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config")
+		return
+	}
+	if reveal {
+		masked = vars
+		s.auditReveal(r, name, version, secrets)
 	}
 
-	// Serialize
-	data, err := yaml.Marshal(currentVars)
+	data, err := configfile.Render(format, masked)
 	if err != nil {
-		s.logger.Error("marshal config", "error", err)
-		s.error(w, http.StatusInternalServerError, "failed to serialize config")
+		s.logger.Error("render config", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to render config")
 		return
 	}
 
-	// TODO: Encrypt with SOPS before storing
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Write(data)
+}
+
+// saveConfig validates vars, merges them into the app's latest config (or
+// replaces it with them) as one new config version, and releases it
+func (s *Server) saveConfig(w http.ResponseWriter, r *http.Request, name string, vars models.ConfigData, replace bool) {
+	if err := validateConfigVars(vars); err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	cfg, err := s.db.CreateConfigVersion(name, data)
+	details := map[string]interface{}{
+		"keys": configKeys(vars),
+	}
+	var newVars models.ConfigData
+	cfg, err := s.db.UpdateConfig(name, changeConfig(&newVars, func(current models.ConfigData) error {
+		if replace {
+			removed := []string{}
+			for k := range current {
+				if _, ok := vars[k]; !ok {
+					removed = append(removed, k)
+				}
+			}
+			sort.Strings(removed)
+			details["replace"] = true
+			details["removed"] = removed
+			clear(current)
+		}
+		for k, v := range vars {
+			current[k] = v
+		}
+		return nil
+	}))
 	if err != nil {
 		s.logger.Error("create config version", "error", err)
 		s.error(w, http.StatusInternalServerError, "failed to save config")
 		return
 	}
 
-	s.logger.Info("config updated", "app", name, "version", cfg.Version)
-	s.json(w, http.StatusOK, map[string]interface{}{
-		"version": cfg.Version,
-		"vars":    currentVars,
-	})
+	s.logger.Info("config updated", "app", name, "version", cfg.Version, "replace", replace)
+	s.audit(r, name, models.AuditConfigSet, fmt.Sprintf("v%d", cfg.Version), details)
+	s.respondConfigChange(w, r, name, cfg.Version, newVars)
+}
+
+// errConfigKeyNotFound is returned by config changes that unset a key the
+// config doesn't have
+var errConfigKeyNotFound = errors.New("config key not found")
+
+// changeConfig returns an update for UpdateConfig or UpdateConfigGroup that
+// applies change to the latest version's vars. vars is set to the result.
+func changeConfig(vars *models.ConfigData, change func(current models.ConfigData) error) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		current := make(models.ConfigData)
+		if err := yaml.Unmarshal(data, &current); err != nil {
+			return nil, fmt.Errorf("parse config: %w", err)
+		}
+		if err := change(current); err != nil {
+			return nil, err
+		}
+		*vars = current
+		return yaml.Marshal(current)
+	}
+}
+
+// validateConfigVars checks that vars can be written to an env file and
+// aren't the mask of a secret
+func validateConfigVars(vars models.ConfigData) error {
+	for _, k := range configKeys(vars) {
+		if err := deploy.ValidateConfigVar(k, vars[k]); err != nil {
+			return err
+		}
+		// Guard against writing back a masked export
+		if vars[k] == maskedValue {
+			return fmt.Errorf("config var %s: value is the mask of a secret, not the secret itself", k)
+		}
+	}
+	return nil
 }
 
 // handleUnsetConfig removes a config var
@@ -112,23 +268,23 @@ func (s *Server) handleUnsetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get current config
-	currentVars := make(models.ConfigData)
-	currentCfg, _ := s.db.GetLatestConfig(name)
-	if currentCfg != nil {
-		yaml.Unmarshal(currentCfg.Data, &currentVars)
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
 	}
 
-	// Remove key
-	if _, exists := currentVars[key]; !exists {
+	var vars models.ConfigData
+	cfg, err := s.db.UpdateConfig(name, changeConfig(&vars, func(current models.ConfigData) error {
+		if _, exists := current[key]; !exists {
+			return errConfigKeyNotFound
+		}
+		delete(current, key)
+		return nil
+	}))
+	if errors.Is(err, errConfigKeyNotFound) {
 		s.error(w, http.StatusNotFound, "config key not found")
 		return
 	}
-	delete(currentVars, key)
-
-	// Serialize and save
-	data, _ := yaml.Marshal(currentVars)
-	cfg, err := s.db.CreateConfigVersion(name, data)
 	if err != nil {
 		s.logger.Error("create config version", "error", err)
 		s.error(w, http.StatusInternalServerError, "failed to save config")
@@ -136,5 +292,98 @@ func (s *Server) handleUnsetConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.logger.Info("config key removed", "app", name, "key", key, "version", cfg.Version)
-	w.WriteHeader(http.StatusNoContent)
+	s.audit(r, name, models.AuditConfigUnset, fmt.Sprintf("v%d", cfg.Version), map[string]interface{}{
+		"keys": []string{key},
+	})
+	s.respondConfigChange(w, r, name, cfg.Version, vars)
+}
+
+// respondConfigChange releases a new config version with the current image,
+// like a deploy, and writes the response. The release is skipped with
+// ?restart=false, to stage several changes and release them together, and
+// for apps that have never been deployed.
+func (s *Server) respondConfigChange(w http.ResponseWriter, r *http.Request, name string, version int, vars models.ConfigData) {
+	masked, secrets, err := s.maskSecrets(name, vars)
+	if err != nil {
+		s.logger.Error("list config secrets", "error", err)
+		s.error(w, http.StatusInternalServerError, fmt.Sprintf("config saved as v%d but failed to list secrets", version))
+		return
+	}
+
+	resp := &models.ConfigChangeResponse{Version: version, Vars: masked, Secrets: secrets}
+	if restart, _ := restartRequested(r); !restart {
+		s.json(w, http.StatusOK, resp)
+		return
+	}
+
+	image, digest, err := s.currentImage(name)
+	if err != nil {
+		s.logger.Error("get current image", "error", err)
+		s.error(w, http.StatusInternalServerError, fmt.Sprintf("config saved as v%d but failed to get current release", version))
+		return
+	}
+	if image == "" {
+		s.json(w, http.StatusOK, resp)
+		return
+	}
+
+	deployed, err := s.deployRelease(r, name, image, digest, version, nil, map[string]interface{}{
+		"reason": "config change",
+	})
+	if err != nil {
+		s.error(w, http.StatusInternalServerError, fmt.Sprintf("config saved as v%d but failed to create release", version))
+		return
+	}
+	resp.Release = deployed.Release
+	resp.Job = deployed.Job
+	s.json(w, http.StatusAccepted, resp)
+}
+
+// restartRequested reports whether a config change should be released right
+// away, per the restart query parameter (default true)
+func restartRequested(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("restart")
+	if v == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// parseBoolParam parses an optional boolean query parameter, false if empty
+func parseBoolParam(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// currentConfig returns the app's latest config vars. Errors, including
+// failures to decrypt, are returned rather than treated as empty config, so
+// a change is never saved on top of config that couldn't be read.
+func (s *Server) currentConfig(name string) (models.ConfigData, error) {
+	cfg, err := s.db.GetLatestConfig(name)
+	if err != nil || cfg == nil {
+		return make(models.ConfigData), err
+	}
+	return parseConfig(cfg)
+}
+
+// parseConfig returns the vars of a config version
+func parseConfig(cfg *models.ConfigVar) (models.ConfigData, error) {
+	vars := make(models.ConfigData)
+	if err := yaml.Unmarshal(cfg.Data, &vars); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	return vars, nil
+}
+
+// configKeys returns the sorted key names of vars, for logging changes
+// without their values
+func configKeys(vars models.ConfigData) []string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
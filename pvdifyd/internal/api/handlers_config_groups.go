@@ -0,0 +1,531 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// groupNamePattern restricts config group names to what is safe in URLs
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// handleListConfigGroups returns all config groups with their attached apps
+func (s *Server) handleListConfigGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.db.ListConfigGroups()
+	if err != nil {
+		s.logger.Error("list config groups", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list config groups")
+		return
+	}
+	if groups == nil {
+		groups = []*models.ConfigGroup{}
+	}
+	s.json(w, http.StatusOK, groups)
+}
+
+// handleCreateConfigGroup creates a config group, with its first version if
+// vars are given
+func (s *Server) handleCreateConfigGroup(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateConfigGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !groupNamePattern.MatchString(req.Name) {
+		s.error(w, http.StatusBadRequest, "invalid group name: use lowercase letters, digits and dashes")
+		return
+	}
+	if err := validateConfigVars(req.Vars); err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	existing, err := s.db.GetConfigGroup(req.Name)
+	if err != nil {
+		s.logger.Error("get config group", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to create config group")
+		return
+	}
+	if existing != nil {
+		s.error(w, http.StatusConflict, "config group already exists")
+		return
+	}
+
+	group, err := s.db.CreateConfigGroup(req.Name, auth.FromContext(r.Context()).Subject)
+	if err != nil {
+		s.logger.Error("create config group", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to create config group")
+		return
+	}
+
+	if len(req.Vars) > 0 {
+		data, err := yaml.Marshal(req.Vars)
+		if err != nil {
+			s.logger.Error("marshal config", "error", err)
+			s.error(w, http.StatusInternalServerError, "failed to serialize config")
+			return
+		}
+		cfg, err := s.db.CreateConfigGroupVersion(group.Name, data)
+		if err != nil {
+			s.logger.Error("create config group version", "error", err)
+			s.error(w, http.StatusInternalServerError, "config group created but failed to save its config")
+			return
+		}
+		group.Version = cfg.Version
+	}
+
+	s.logger.Info("config group created", "group", group.Name)
+	s.audit(r, "", models.AuditGroupCreate, group.Name, map[string]interface{}{
+		"keys": configKeys(req.Vars),
+	})
+	s.json(w, http.StatusCreated, group)
+}
+
+// handleGetConfigGroup returns a config group with the vars of its latest
+// version, secret values masked unless ?reveal=true. Only the secret key
+// patterns decide which values are secret.
+func (s *Server) handleGetConfigGroup(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "group")
+
+	reveal, ok := s.revealRequested(w, r, "")
+	if !ok {
+		return
+	}
+
+	group, ok := s.getConfigGroup(w, name)
+	if !ok {
+		return
+	}
+	vars, err := s.currentGroupConfig(name)
+	if err != nil {
+		s.logger.Error("get config group version", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config")
+		return
+	}
+
+	secrets := s.groupSecretKeys(vars)
+	detail := &models.ConfigGroupDetail{
+		ConfigGroup: group,
+		Vars:        maskKeys(vars, secrets),
+		Secrets:     secrets,
+	}
+	if reveal {
+		detail.Vars = vars
+		detail.Revealed = true
+		s.audit(r, "", models.AuditGroupReveal, group.Name, map[string]interface{}{
+			"version": group.Version,
+			"keys":    secrets,
+		})
+	}
+	s.json(w, http.StatusOK, detail)
+}
+
+// handleDeleteConfigGroup deletes a config group. Groups still attached to
+// apps, or pinned by releases that could be rolled back to, are kept.
+func (s *Server) handleDeleteConfigGroup(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "group")
+
+	group, ok := s.getConfigGroup(w, name)
+	if !ok {
+		return
+	}
+	if len(group.Apps) > 0 {
+		s.error(w, http.StatusConflict, "config group is attached to: "+strings.Join(group.Apps, ", "))
+		return
+	}
+	pinned, err := s.db.CountConfigGroupReleases(name)
+	if err != nil {
+		s.logger.Error("count config group releases", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to delete config group")
+		return
+	}
+	if pinned > 0 {
+		s.error(w, http.StatusConflict, fmt.Sprintf("config group is pinned by %d releases", pinned))
+		return
+	}
+
+	if err := s.db.DeleteConfigGroup(name); err != nil {
+		s.logger.Error("delete config group", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to delete config group")
+		return
+	}
+
+	s.logger.Info("config group deleted", "group", name)
+	s.audit(r, "", models.AuditGroupDelete, name, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetConfigGroupVars merges config vars into a group's config, or
+// replaces it with them if the request asks to, and releases every attached
+// app
+func (s *Server) handleSetConfigGroupVars(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "group")
+
+	if _, ok := s.getConfigGroup(w, name); !ok {
+		return
+	}
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+
+	var req models.SetConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := validateConfigVars(req.Vars); err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	details := map[string]interface{}{
+		"keys": configKeys(req.Vars),
+	}
+	s.saveGroupConfig(w, r, name, func(vars models.ConfigData) error {
+		if req.Replace {
+			details["replace"] = true
+			clear(vars)
+		}
+		for k, v := range req.Vars {
+			vars[k] = v
+		}
+		return nil
+	}, models.AuditGroupSet, details)
+}
+
+// handleUnsetConfigGroupVar removes a config var from a group and releases
+// every attached app
+func (s *Server) handleUnsetConfigGroupVar(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "group")
+	key := chi.URLParam(r, "key")
+
+	if _, ok := s.getConfigGroup(w, name); !ok {
+		return
+	}
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+
+	s.saveGroupConfig(w, r, name, func(vars models.ConfigData) error {
+		if _, exists := vars[key]; !exists {
+			return errConfigKeyNotFound
+		}
+		delete(vars, key)
+		return nil
+	}, models.AuditGroupUnset, map[string]interface{}{
+		"keys": []string{key},
+	})
+}
+
+// handleListConfigGroupVersions returns a group's config versions with their
+// key names, newest first
+func (s *Server) handleListConfigGroupVersions(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "group")
+
+	if _, ok := s.getConfigGroup(w, name); !ok {
+		return
+	}
+
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+
+	cfgs, err := s.db.ListConfigGroupVersions(name, limit)
+	if err != nil {
+		s.logger.Error("list config group versions", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list config versions")
+		return
+	}
+
+	versions := []*models.ConfigVersion{}
+	for _, cfg := range cfgs {
+		vars, err := parseConfig(cfg)
+		if err != nil {
+			s.logger.Error("parse config", "error", err)
+			s.error(w, http.StatusInternalServerError, "failed to parse config")
+			return
+		}
+		versions = append(versions, &models.ConfigVersion{
+			Version:   cfg.Version,
+			Keys:      configKeys(vars),
+			CreatedAt: cfg.CreatedAt,
+		})
+	}
+	s.json(w, http.StatusOK, versions)
+}
+
+// handleListAppConfigGroups returns the config groups attached to an app,
+// lowest precedence first
+func (s *Server) handleListAppConfigGroups(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	groups, err := s.db.ListAppConfigGroups(name)
+	if err != nil {
+		s.logger.Error("list app config groups", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list config groups")
+		return
+	}
+	if groups == nil {
+		groups = []*models.ConfigGroupAttachment{}
+	}
+	s.json(w, http.StatusOK, groups)
+}
+
+// handleAttachConfigGroup attaches a config group to an app, or moves it to
+// another position, and releases the app. Since the group's values end up
+// in the app's environment, the caller needs to be able to read config
+// groups, not just the app's config.
+func (s *Server) handleAttachConfigGroup(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	groupName := chi.URLParam(r, "group")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+	if !auth.FromContext(r.Context()).Can("", auth.PermReadConfig) {
+		s.error(w, http.StatusForbidden, "attaching a config group requires a global role that can read config")
+		return
+	}
+	if _, ok := s.getConfigGroup(w, groupName); !ok {
+		return
+	}
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+
+	var req models.AttachConfigGroupRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.error(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	if req.Position < 0 {
+		s.error(w, http.StatusBadRequest, "invalid position")
+		return
+	}
+
+	position, err := s.db.AttachConfigGroup(name, groupName, req.Position)
+	if err != nil {
+		s.logger.Error("attach config group", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to attach config group")
+		return
+	}
+
+	s.logger.Info("config group attached", "app", name, "group", groupName)
+	s.audit(r, name, models.AuditGroupAttach, groupName, map[string]interface{}{
+		"position": position,
+	})
+	s.respondConfigGroupsChange(w, r, name, "config group attached")
+}
+
+// handleDetachConfigGroup detaches a config group from an app and releases
+// the app
+func (s *Server) handleDetachConfigGroup(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	groupName := chi.URLParam(r, "group")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+
+	if err := s.db.DetachConfigGroup(name, groupName); err != nil {
+		s.error(w, http.StatusNotFound, "config group not attached")
+		return
+	}
+
+	s.logger.Info("config group detached", "app", name, "group", groupName)
+	s.audit(r, name, models.AuditGroupDetach, groupName, nil)
+	s.respondConfigGroupsChange(w, r, name, "config group detached")
+}
+
+// respondConfigGroupsChange releases an app whose attached config groups
+// changed, unless ?restart=false, and writes its attached groups
+func (s *Server) respondConfigGroupsChange(w http.ResponseWriter, r *http.Request, name, reason string) {
+	groups, err := s.db.ListAppConfigGroups(name)
+	if err != nil {
+		s.logger.Error("list app config groups", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list config groups")
+		return
+	}
+	if groups == nil {
+		groups = []*models.ConfigGroupAttachment{}
+	}
+
+	resp := &models.ConfigGroupsChangeResponse{Groups: groups}
+	if restart, _ := restartRequested(r); !restart {
+		s.json(w, http.StatusOK, resp)
+		return
+	}
+
+	deployed, err := s.releaseLatestConfig(r, name, map[string]interface{}{"reason": reason})
+	if err != nil {
+		s.error(w, http.StatusInternalServerError, "config groups changed but failed to create release")
+		return
+	}
+	if deployed == nil {
+		s.json(w, http.StatusOK, resp)
+		return
+	}
+	resp.Release = deployed.Release
+	resp.Job = deployed.Job
+	s.json(w, http.StatusAccepted, resp)
+}
+
+// saveGroupConfig applies change to the vars of a config group's latest
+// version and saves them as a new version in one transaction and, unless
+// ?restart=false, releases every attached app that has been deployed
+func (s *Server) saveGroupConfig(w http.ResponseWriter, r *http.Request, name string, change func(vars models.ConfigData) error, action models.AuditAction, details map[string]interface{}) {
+	var vars models.ConfigData
+	cfg, err := s.db.UpdateConfigGroup(name, changeConfig(&vars, change))
+	if errors.Is(err, errConfigKeyNotFound) {
+		s.error(w, http.StatusNotFound, "config key not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("create config group version", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to save config")
+		return
+	}
+
+	s.logger.Info("config group updated", "group", name, "version", cfg.Version)
+	details["version"] = cfg.Version
+	s.audit(r, "", action, name, details)
+
+	secrets := s.groupSecretKeys(vars)
+	resp := &models.ConfigGroupChangeResponse{
+		Version:  cfg.Version,
+		Vars:     maskKeys(vars, secrets),
+		Secrets:  secrets,
+		Releases: []*models.DeployResponse{},
+	}
+	if restart, _ := restartRequested(r); !restart {
+		s.json(w, http.StatusOK, resp)
+		return
+	}
+
+	apps, err := s.db.ListConfigGroupApps(name)
+	if err != nil {
+		s.logger.Error("list config group apps", "error", err)
+		s.error(w, http.StatusInternalServerError, fmt.Sprintf("config group saved as v%d but failed to list its apps", cfg.Version))
+		return
+	}
+
+	// One app failing to release shouldn't keep the rest on the old values
+	var failed []string
+	for _, app := range apps {
+		deployed, err := s.releaseLatestConfig(r, app, map[string]interface{}{
+			"reason":               "config group change",
+			"config_group":         name,
+			"config_group_version": cfg.Version,
+		})
+		if err != nil {
+			failed = append(failed, app)
+			continue
+		}
+		if deployed != nil {
+			resp.Releases = append(resp.Releases, deployed)
+		}
+	}
+	if len(failed) > 0 {
+		s.error(w, http.StatusInternalServerError, fmt.Sprintf("config group saved as v%d but failed to create releases for: %s",
+			cfg.Version, strings.Join(failed, ", ")))
+		return
+	}
+
+	if len(resp.Releases) == 0 {
+		s.json(w, http.StatusOK, resp)
+		return
+	}
+	s.json(w, http.StatusAccepted, resp)
+}
+
+// releaseLatestConfig releases an app's current image, at the same digest,
+// with its latest config and config group versions. It returns nil if the
+// app has never been deployed.
+func (s *Server) releaseLatestConfig(r *http.Request, name string, details map[string]interface{}) (*models.DeployResponse, error) {
+	image, digest, err := s.currentImage(name)
+	if err != nil {
+		s.logger.Error("get current image", "error", err)
+		return nil, err
+	}
+	if image == "" {
+		return nil, nil
+	}
+
+	cfg, err := s.db.GetLatestConfig(name)
+	if err != nil {
+		s.logger.Error("get config", "error", err)
+		return nil, err
+	}
+	configVersion := 0
+	if cfg != nil {
+		configVersion = cfg.Version
+	}
+	return s.deployRelease(r, name, image, digest, configVersion, nil, details)
+}
+
+// getConfigGroup loads a config group, writing a 404 if it doesn't exist
+func (s *Server) getConfigGroup(w http.ResponseWriter, name string) (*models.ConfigGroup, bool) {
+	group, err := s.db.GetConfigGroup(name)
+	if err != nil {
+		s.logger.Error("get config group", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config group")
+		return nil, false
+	}
+	if group == nil {
+		s.error(w, http.StatusNotFound, "config group not found")
+		return nil, false
+	}
+	return group, true
+}
+
+// currentGroupConfig returns the vars of a group's latest config version
+func (s *Server) currentGroupConfig(name string) (models.ConfigData, error) {
+	cfg, err := s.db.GetLatestConfigGroupVersion(name)
+	if err != nil || cfg == nil {
+		return make(models.ConfigData), err
+	}
+	return parseConfig(cfg)
+}
+
+// groupSecretKeys returns the sorted keys of a group's vars whose values are
+// secret by the secret key patterns
+func (s *Server) groupSecretKeys(vars models.ConfigData) []string {
+	secrets := []string{}
+	for _, k := range configKeys(vars) {
+		if s.classifyKey(k, nil).Secret {
+			secrets = append(secrets, k)
+		}
+	}
+	return secrets
+}
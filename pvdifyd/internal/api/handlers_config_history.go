@@ -0,0 +1,280 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// maskedValue replaces config values that weren't asked for
+const maskedValue = "********"
+
+// handleListConfigVersions returns an app's config versions with their key
+// names, newest first
+func (s *Server) handleListConfigVersions(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+
+	cfgs, err := s.db.ListConfigVersions(name, limit)
+	if err != nil {
+		s.logger.Error("list config versions", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list config versions")
+		return
+	}
+
+	versions := []*models.ConfigVersion{}
+	for _, cfg := range cfgs {
+		vars, err := parseConfig(cfg)
+		if err != nil {
+			s.logger.Error("parse config", "error", err, "version", cfg.Version)
+			s.error(w, http.StatusInternalServerError, "failed to parse config")
+			return
+		}
+		versions = append(versions, &models.ConfigVersion{
+			Version:   cfg.Version,
+			Keys:      configKeys(vars),
+			CreatedAt: cfg.CreatedAt,
+		})
+	}
+	s.json(w, http.StatusOK, versions)
+}
+
+// handleGetConfigVersion returns the vars of a config version, with secret
+// values masked unless ?reveal=true
+func (s *Server) handleGetConfigVersion(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	version, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil || version < 1 {
+		s.error(w, http.StatusBadRequest, "invalid version")
+		return
+	}
+
+	cfg, err := s.db.GetConfigVersion(name, version)
+	if err != nil {
+		s.logger.Error("get config version", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config version")
+		return
+	}
+	if cfg == nil {
+		s.error(w, http.StatusNotFound, "config version not found")
+		return
+	}
+
+	vars, err := parseConfig(cfg)
+	if err != nil {
+		s.logger.Error("parse config", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to parse config")
+		return
+	}
+
+	s.respondConfig(w, r, name, cfg.Version, &cfg.CreatedAt, vars)
+}
+
+// handleDiffConfig compares two config versions, given as ?from=N&to=M.
+// to defaults to the latest version and from to the one before it; version 0
+// is the empty config. Values are masked unless ?reveal=true, which needs the
+// permission to reveal secret values.
+func (s *Server) handleDiffConfig(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	q := r.URL.Query()
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	to := -1
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil || to < 0 {
+			s.error(w, http.StatusBadRequest, "invalid to version")
+			return
+		}
+	} else {
+		latest, err := s.db.GetLatestConfig(name)
+		if err != nil {
+			s.logger.Error("get config", "error", err)
+			s.error(w, http.StatusInternalServerError, "failed to get config")
+			return
+		}
+		to = 0
+		if latest != nil {
+			to = latest.Version
+		}
+	}
+
+	from := to - 1
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil || from < 0 {
+			s.error(w, http.StatusBadRequest, "invalid from version")
+			return
+		}
+	}
+	if from < 0 {
+		from = 0
+	}
+
+	reveal, ok := s.revealRequested(w, r, name)
+	if !ok {
+		return
+	}
+
+	oldVars, ok := s.configAt(w, name, from)
+	if !ok {
+		return
+	}
+	newVars, ok := s.configAt(w, name, to)
+	if !ok {
+		return
+	}
+
+	changes := diffConfig(oldVars, newVars, reveal)
+	if reveal {
+		changed := make(models.ConfigData, len(changes))
+		for _, ch := range changes {
+			changed[ch.Key] = ""
+		}
+		secrets, err := s.secretKeys(name, changed)
+		if err != nil {
+			s.logger.Error("list config secrets", "error", err)
+			s.error(w, http.StatusInternalServerError, "failed to get config")
+			return
+		}
+		s.auditReveal(r, name, to, secrets)
+	}
+
+	s.json(w, http.StatusOK, &models.ConfigDiff{
+		From:    from,
+		To:      to,
+		Masked:  !reveal,
+		Changes: changes,
+	})
+}
+
+// configAt loads the vars of a config version, writing an error response
+// if that fails. Version 0 is the empty config apps start with.
+func (s *Server) configAt(w http.ResponseWriter, name string, version int) (models.ConfigData, bool) {
+	if version == 0 {
+		return models.ConfigData{}, true
+	}
+
+	cfg, err := s.db.GetConfigVersion(name, version)
+	if err != nil {
+		s.logger.Error("get config version", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config version")
+		return nil, false
+	}
+	if cfg == nil {
+		s.error(w, http.StatusNotFound, fmt.Sprintf("config version %d not found", version))
+		return nil, false
+	}
+
+	vars, err := parseConfig(cfg)
+	if err != nil {
+		s.logger.Error("parse config", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to parse config")
+		return nil, false
+	}
+	return vars, true
+}
+
+// diffConfig returns the keys added, removed or changed from oldVars to
+// newVars, sorted by key
+func diffConfig(oldVars, newVars models.ConfigData, reveal bool) []*models.ConfigDiffEntry {
+	show := func(v string) string {
+		if reveal {
+			return v
+		}
+		return maskedValue
+	}
+
+	changes := []*models.ConfigDiffEntry{}
+	for k, v := range newVars {
+		old, existed := oldVars[k]
+		switch {
+		case !existed:
+			changes = append(changes, &models.ConfigDiffEntry{Key: k, Change: models.ConfigKeyAdded, New: show(v)})
+		case old != v:
+			changes = append(changes, &models.ConfigDiffEntry{Key: k, Change: models.ConfigKeyChanged, Old: show(old), New: show(v)})
+		}
+	}
+	for k, v := range oldVars {
+		if _, exists := newVars[k]; !exists {
+			changes = append(changes, &models.ConfigDiffEntry{Key: k, Change: models.ConfigKeyRemoved, Old: show(v)})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// handleRestoreConfig saves the vars of an earlier config version as a new
+// version and releases it like any other config change
+func (s *Server) handleRestoreConfig(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	if _, err := restartRequested(r); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+
+	var req models.RestoreConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Version < 1 {
+		s.error(w, http.StatusBadRequest, "version is required")
+		return
+	}
+
+	vars, ok := s.configAt(w, name, req.Version)
+	if !ok {
+		return
+	}
+	data, err := yaml.Marshal(vars)
+	if err != nil {
+		s.logger.Error("marshal config", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to serialize config")
+		return
+	}
+
+	cfg, err := s.db.CreateConfigVersion(name, data)
+	if err != nil {
+		s.logger.Error("create config version", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to save config")
+		return
+	}
+
+	s.logger.Info("config restored", "app", name, "from_version", req.Version, "version", cfg.Version)
+	s.audit(r, name, models.AuditConfigRestore, fmt.Sprintf("v%d", cfg.Version), map[string]interface{}{
+		"from_version": req.Version,
+		"keys":         configKeys(vars),
+	})
+	s.respondConfigChange(w, r, name, cfg.Version, vars)
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/deploy"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// handleListConfigSecrets returns whether each of the app's config vars is
+// secret and why, including keys marked explicitly but not currently set
+func (s *Server) handleListConfigSecrets(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	vars, err := s.currentConfig(name)
+	if err != nil {
+		s.logger.Error("get config", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config")
+		return
+	}
+	flags, err := s.db.ListConfigSecrets(name)
+	if err != nil {
+		s.logger.Error("list config secrets", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list config secrets")
+		return
+	}
+
+	keys := configKeys(vars)
+	for k := range flags {
+		if _, ok := vars[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	secrets := []*models.ConfigSecret{}
+	for _, k := range keys {
+		secrets = append(secrets, s.classifyKey(k, flags))
+	}
+	s.json(w, http.StatusOK, secrets)
+}
+
+// handlePutConfigSecret marks a config var secret or not secret, overriding
+// the secret key patterns. The key doesn't have to be set yet.
+func (s *Server) handlePutConfigSecret(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	key := chi.URLParam(r, "key")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+	if err := deploy.ValidateConfigVar(key, ""); err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req models.SetConfigSecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// Marking a key not secret shows its value to everyone who can read
+	// config, which is as good as revealing it
+	if !req.Secret && !s.canUnmarkSecret(w, r, name) {
+		return
+	}
+	flags, err := s.db.ListConfigSecrets(name)
+	if err != nil {
+		s.logger.Error("list config secrets", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to mark config var")
+		return
+	}
+	wasSecret := s.classifyKey(key, flags).Secret
+
+	if err := s.db.SetConfigSecret(name, key, req.Secret, auth.FromContext(r.Context()).Subject); err != nil {
+		s.logger.Error("set config secret", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to mark config var")
+		return
+	}
+
+	s.logger.Info("config var marked", "app", name, "key", key, "secret", req.Secret)
+	s.audit(r, name, models.AuditConfigSecret, key, map[string]interface{}{
+		"secret": req.Secret,
+	})
+	if wasSecret && !req.Secret {
+		s.auditUnmask(r, name, key)
+	}
+	s.json(w, http.StatusOK, &models.ConfigSecret{
+		Key:    key,
+		Secret: req.Secret,
+		Source: models.SecretSourceExplicit,
+	})
+}
+
+// handleDeleteConfigSecret removes the explicit marking of a config var, so
+// the secret key patterns decide again
+func (s *Server) handleDeleteConfigSecret(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	key := chi.URLParam(r, "key")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	// Without its marking a secret key may no longer match the patterns
+	if !s.canUnmarkSecret(w, r, name) {
+		return
+	}
+	flags, err := s.db.ListConfigSecrets(name)
+	if err != nil {
+		s.logger.Error("list config secrets", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to unmark config var")
+		return
+	}
+	wasSecret := s.classifyKey(key, flags).Secret
+
+	if err := s.db.DeleteConfigSecret(name, key); err != nil {
+		s.error(w, http.StatusNotFound, "config var is not marked")
+		return
+	}
+
+	s.logger.Info("config var unmarked", "app", name, "key", key)
+	s.audit(r, name, models.AuditConfigSecret, key, map[string]interface{}{
+		"reset": true,
+	})
+	secret := s.classifyKey(key, nil)
+	if wasSecret && !secret.Secret {
+		s.auditUnmask(r, name, key)
+	}
+	s.json(w, http.StatusOK, secret)
+}
+
+// canUnmarkSecret reports whether the caller may make a config var of app
+// not secret, which needs the permission to reveal secret values. Callers
+// without it get a 403.
+func (s *Server) canUnmarkSecret(w http.ResponseWriter, r *http.Request, name string) bool {
+	if !auth.FromContext(r.Context()).Can(name, auth.PermRevealConfig) {
+		s.error(w, http.StatusForbidden, "making a config var not secret requires the admin role")
+		return false
+	}
+	return true
+}
+
+// auditUnmask records that a secret config var was made not secret, which
+// reveals its value like a reveal does
+func (s *Server) auditUnmask(r *http.Request, name, key string) {
+	s.audit(r, name, models.AuditConfigReveal, key, map[string]interface{}{
+		"keys":     []string{key},
+		"path":     r.URL.Path,
+		"unmarked": true,
+	})
+}
+
+// classifyKey says whether key is secret: as marked in flags if it is,
+// otherwise as the secret key patterns say
+func (s *Server) classifyKey(key string, flags map[string]bool) *models.ConfigSecret {
+	if secret, ok := flags[key]; ok {
+		return &models.ConfigSecret{Key: key, Secret: secret, Source: models.SecretSourceExplicit}
+	}
+	upper := strings.ToUpper(key)
+	for _, pattern := range s.cfg.Secrets.Patterns {
+		if ok, _ := path.Match(strings.ToUpper(pattern), upper); ok {
+			return &models.ConfigSecret{Key: key, Secret: true, Source: models.SecretSourcePattern}
+		}
+	}
+	return &models.ConfigSecret{Key: key}
+}
+
+// secretKeys returns the sorted keys of vars whose values are secret
+func (s *Server) secretKeys(name string, vars models.ConfigData) ([]string, error) {
+	flags, err := s.db.ListConfigSecrets(name)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []string{}
+	for _, k := range configKeys(vars) {
+		if s.classifyKey(k, flags).Secret {
+			secrets = append(secrets, k)
+		}
+	}
+	return secrets, nil
+}
+
+// maskSecrets returns a copy of vars with secret values masked, and the
+// secret keys
+func (s *Server) maskSecrets(name string, vars models.ConfigData) (models.ConfigData, []string, error) {
+	secrets, err := s.secretKeys(name, vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	return maskKeys(vars, secrets), secrets, nil
+}
+
+// maskKeys returns a copy of vars with the values of keys masked
+func maskKeys(vars models.ConfigData, keys []string) models.ConfigData {
+	masked := make(models.ConfigData, len(vars))
+	for k, v := range vars {
+		masked[k] = v
+	}
+	for _, k := range keys {
+		masked[k] = maskedValue
+	}
+	return masked
+}
+
+// revealRequested reports whether the request asks for secret values with
+// ?reveal=true. Callers without the reveal permission get a 403 and ok is
+// false.
+func (s *Server) revealRequested(w http.ResponseWriter, r *http.Request, name string) (reveal, ok bool) {
+	if r.URL.Query().Get("reveal") != "true" {
+		return false, true
+	}
+	if !auth.FromContext(r.Context()).Can(name, auth.PermRevealConfig) {
+		s.error(w, http.StatusForbidden, "revealing secret config values requires the admin role")
+		return false, false
+	}
+	return true, true
+}
+
+// auditReveal records that secret values of a config version were shown
+func (s *Server) auditReveal(r *http.Request, name string, version int, keys []string) {
+	s.audit(r, name, models.AuditConfigReveal, fmt.Sprintf("v%d", version), map[string]interface{}{
+		"keys": keys,
+		"path": r.URL.Path,
+	})
+}
+
+// respondConfig writes a config version with its secret values masked, or
+// revealed and audited if the request asks to
+func (s *Server) respondConfig(w http.ResponseWriter, r *http.Request, name string, version int, createdAt *time.Time, vars models.ConfigData) {
+	reveal, ok := s.revealRequested(w, r, name)
+	if !ok {
+		return
+	}
+
+	masked, secrets, err := s.maskSecrets(name, vars)
+	if err != nil {
+		s.logger.Error("list config secrets", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config")
+		return
+	}
+
+	detail := &models.ConfigVersionDetail{
+		Version:   version,
+		Vars:      masked,
+		Secrets:   secrets,
+		CreatedAt: createdAt,
+	}
+	if reveal {
+		detail.Vars = vars
+		detail.Revealed = true
+		s.auditReveal(r, name, version, secrets)
+	}
+	s.json(w, http.StatusOK, detail)
+}
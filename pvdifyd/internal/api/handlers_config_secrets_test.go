@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/config"
+	"github.com/philoveracity/pvdifyd/internal/db"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+func TestClassifyKey(t *testing.T) {
+	s := &Server{cfg: config.Default()}
+	flags := map[string]bool{"PUBLIC_KEY": false, "LICENSE": true}
+
+	tests := []struct {
+		key    string
+		secret bool
+		source models.SecretSource
+	}{
+		{"STRIPE_SECRET", true, models.SecretSourcePattern},
+		{"api_token", true, models.SecretSourcePattern},
+		{"DB_PASSWORD", true, models.SecretSourcePattern},
+		{"PUBLIC_KEY", false, models.SecretSourceExplicit},
+		{"LICENSE", true, models.SecretSourceExplicit},
+		{"NODE_ENV", false, ""},
+		{"KEYS", false, ""},
+	}
+	for _, tt := range tests {
+		got := s.classifyKey(tt.key, flags)
+		if got.Key != tt.key || got.Secret != tt.secret || got.Source != tt.source {
+			t.Errorf("classifyKey(%q) = %+v, want secret %v from %q", tt.key, got, tt.secret, tt.source)
+		}
+	}
+}
+
+func TestMaskKeys(t *testing.T) {
+	vars := models.ConfigData{"NODE_ENV": "production", "API_TOKEN": "t0ken", "DB_PASSWORD": "hunter2"}
+
+	masked := maskKeys(vars, []string{"API_TOKEN", "DB_PASSWORD"})
+	want := models.ConfigData{"NODE_ENV": "production", "API_TOKEN": maskedValue, "DB_PASSWORD": maskedValue}
+	if !reflect.DeepEqual(masked, want) {
+		t.Errorf("maskKeys = %v, want %v", masked, want)
+	}
+	if vars["API_TOKEN"] != "t0ken" {
+		t.Error("maskKeys changed the original vars")
+	}
+
+	if got := maskKeys(vars, nil); !reflect.DeepEqual(got, vars) {
+		t.Errorf("maskKeys with no keys = %v, want %v", got, vars)
+	}
+}
+
+func TestUnmarkSecretNeedsReveal(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pvdify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CreateApp(&models.App{Name: "shop"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetConfigSecret("shop", "LICENSE", true, "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{db: database, cfg: config.Default(), logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	deployer := &auth.Identity{Subject: "dev@example.com", Method: auth.MethodAccess, Grants: []*models.Grant{
+		{Role: models.RoleDeployer, AppName: "shop"},
+	}}
+	admin := &auth.Identity{Subject: "admin@example.com", Method: auth.MethodAccess, Grants: []*models.Grant{
+		{Role: models.RoleAdmin},
+	}}
+
+	tests := []struct {
+		name    string
+		id      *auth.Identity
+		method  string
+		key     string
+		body    string
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"deployer marks secret", deployer, http.MethodPut, "NEW_KEY", `{"secret":true}`, s.handlePutConfigSecret, http.StatusOK},
+		{"deployer unmarks", deployer, http.MethodPut, "LICENSE", `{"secret":false}`, s.handlePutConfigSecret, http.StatusForbidden},
+		{"deployer deletes marking", deployer, http.MethodDelete, "LICENSE", "", s.handleDeleteConfigSecret, http.StatusForbidden},
+		{"deployer unmarks pattern key", deployer, http.MethodPut, "API_TOKEN", `{"secret":false}`, s.handlePutConfigSecret, http.StatusForbidden},
+		{"admin unmarks", admin, http.MethodPut, "LICENSE", `{"secret":false}`, s.handlePutConfigSecret, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/apps/shop/config/secrets/"+tt.key, strings.NewReader(tt.body))
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", "shop")
+		rctx.URLParams.Add("key", tt.key)
+		ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+		req = req.WithContext(auth.WithIdentity(ctx, tt.id))
+
+		rec := httptest.NewRecorder()
+		tt.handler(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+	}
+
+	flags, err := database.ListConfigSecrets("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, ok := flags["API_TOKEN"]; ok {
+		t.Errorf("API_TOKEN marked %v by a deployer", secret)
+	}
+
+	// Only the admin's unmarking revealed anything
+	events, err := database.ListAuditEvents(models.AuditFilter{AppName: "shop", Action: string(models.AuditConfigReveal)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Actor != admin.Subject || events[0].Target != "LICENSE" {
+		t.Errorf("reveal events = %+v, want one by %s for LICENSE", events, admin.Subject)
+	}
+}
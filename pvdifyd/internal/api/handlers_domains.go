@@ -73,7 +73,12 @@ func (s *Server) handleAddDomain(w http.ResponseWriter, r *http.Request) {
 	// TODO: Update tunnel config
 	// TODO: Validate domain ownership
 
+	if err := s.engine.ReloadRoutes(); err != nil {
+		s.logger.Error("reload routes", "error", err)
+	}
+
 	s.logger.Info("domain added", "app", name, "domain", req.Domain)
+	s.audit(r, name, models.AuditDomainAdd, req.Domain, nil)
 	s.json(w, http.StatusCreated, domain)
 }
 
@@ -102,6 +107,11 @@ func (s *Server) handleRemoveDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.engine.ReloadRoutes(); err != nil {
+		s.logger.Error("reload routes", "error", err)
+	}
+
 	s.logger.Info("domain removed", "app", name, "domain", domainName)
+	s.audit(r, name, models.AuditDomainRemove, domainName, nil)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// handleListJobs returns recent jobs for an app
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil {
+			limit = parsed
+		}
+	}
+
+	jobs, err := s.db.ListJobs(name, limit)
+	if err != nil {
+		s.logger.Error("list jobs", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list jobs")
+		return
+	}
+	if jobs == nil {
+		jobs = []*models.Job{}
+	}
+	s.json(w, http.StatusOK, jobs)
+}
+
+// handleGetJob returns a job with its step-by-step progress
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "invalid job id")
+		return
+	}
+
+	job, err := s.db.GetJob(name, id)
+	if err != nil {
+		s.logger.Error("get job", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get job")
+		return
+	}
+	if job == nil {
+		s.error(w, http.StatusNotFound, "job not found")
+		return
+	}
+
+	s.json(w, http.StatusOK, job)
+}
@@ -8,6 +8,8 @@ import (
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/systemd"
 )
 
 // handleLogs streams logs for an app (SSE)
@@ -31,15 +33,41 @@ func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Get process filter
-	process := r.URL.Query().Get("process")
-	if process == "" {
-		process = "*"
+	processes, err := s.db.ListProcesses(name)
+	if err != nil {
+		s.logger.Error("list processes", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list processes")
+		return
+	}
+	if process := r.URL.Query().Get("process"); process != "" {
+		var found []*models.Process
+		for _, p := range processes {
+			if p.Name == process {
+				found = append(found, p)
+			}
+		}
+		if len(found) == 0 {
+			s.error(w, http.StatusNotFound, "process type not found")
+			return
+		}
+		processes = found
+	}
+	// journalctl without a unit would read the whole journal
+	if len(processes) == 0 {
+		s.error(w, http.StatusNotFound, "app has no process types")
+		return
 	}
 
-	// Build journalctl command
-	unit := fmt.Sprintf("pvdify-%s-%s@*", name, process)
-	args := []string{"-u", unit, "-n", strconv.Itoa(lines), "--no-pager", "-o", "short-iso"}
+	// Build journalctl command from the app's own units in every blue/green
+	// slot. A wildcard on the app name would also match apps whose names
+	// start with it (shop and shop-api).
+	var args []string
+	for _, p := range processes {
+		for _, color := range []models.Color{"", models.ColorBlue, models.ColorGreen} {
+			args = append(args, "-u", systemd.UnitName(name, p.Name, string(color))+"@*")
+		}
+	}
+	args = append(args, "-n", strconv.Itoa(lines), "--no-pager", "-o", "short-iso")
 	if follow {
 		args = append(args, "-f")
 	}
@@ -2,9 +2,11 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/deploy"
 	"github.com/philoveracity/pvdifyd/internal/models"
 )
 
@@ -25,16 +27,14 @@ func (s *Server) handleListProcesses(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Get actual runtime status from Podman/systemd
-	var statuses []models.ProcessStatus
-	for _, p := range processes {
-		for i := 1; i <= p.Count; i++ {
-			statuses = append(statuses, models.ProcessStatus{
-				Name:     p.Name,
-				Instance: i,
-				State:    "unknown", // TODO: Query actual state
-			})
-		}
+	statuses, err := s.engine.Status(r.Context(), app, processes)
+	if err != nil {
+		s.logger.Error("process status", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get process status")
+		return
+	}
+	if processes == nil {
+		processes = []*models.Process{}
 	}
 
 	s.json(w, http.StatusOK, map[string]interface{}{
@@ -64,30 +64,48 @@ func (s *Server) handleScale(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check every type before scaling any
 	for procName, count := range req.Processes {
 		if count < 0 {
 			s.error(w, http.StatusBadRequest, "count must be non-negative")
 			return
 		}
+		p, err := s.db.GetProcess(name, procName)
+		if err != nil {
+			s.logger.Error("get process", "error", err, "process", procName)
+			s.error(w, http.StatusInternalServerError, "failed to scale process")
+			return
+		}
+		if p == nil {
+			s.error(w, http.StatusNotFound, fmt.Sprintf("no process type %s; declare it in the app's formation first", procName))
+			return
+		}
+	}
 
+	for procName, count := range req.Processes {
 		if err := s.db.ScaleProcess(name, procName, count); err != nil {
 			s.logger.Error("scale process", "error", err, "process", procName)
 			s.error(w, http.StatusInternalServerError, "failed to scale process")
 			return
 		}
 
-		// TODO: Actually start/stop systemd units
-
 		s.logger.Info("process scaled", "app", name, "process", procName, "count", count)
 	}
 
+	s.audit(r, name, models.AuditProcessScale, "", map[string]interface{}{
+		"processes": req.Processes,
+	})
+
+	// Start or stop instances to match the new counts
+	s.engine.Reconcile(name)
+
 	// Return updated process list
 	processes, _ := s.db.ListProcesses(name)
 	s.json(w, http.StatusOK, processes)
 }
 
-// handleRestart restarts all processes
-func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+// handleGetFormation returns an app's process types
+func (s *Server) handleGetFormation(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
 	app, err := s.db.GetApp(name)
@@ -102,13 +120,308 @@ func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
 		s.error(w, http.StatusInternalServerError, "failed to list processes")
 		return
 	}
+	if processes == nil {
+		processes = []*models.Process{}
+	}
+	s.json(w, http.StatusOK, processes)
+}
+
+// handlePutFormation replaces an app's process types. New commands and
+// types take a release to run, which is created unless ?restart=false;
+// count changes apply right away, and removed types are stopped.
+func (s *Server) handlePutFormation(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+	restart, err := restartRequested(r)
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "invalid restart parameter")
+		return
+	}
+
+	var req models.FormationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	resp, changed, ok := s.setFormation(w, r, name, req.Processes, nil)
+	if !ok {
+		return
+	}
+	s.engine.Reconcile(name)
 
-	// TODO: Actually restart systemd units
+	if !changed || !restart {
+		status := http.StatusOK
+		if resp.RemovalJob != nil {
+			status = http.StatusAccepted
+		}
+		s.json(w, status, resp)
+		return
+	}
+	deployed, err := s.releaseLatestConfig(r, name, map[string]interface{}{"reason": "formation change"})
+	if err != nil {
+		s.error(w, http.StatusInternalServerError, "process types changed but failed to create release")
+		return
+	}
+	if deployed == nil {
+		status := http.StatusOK
+		if resp.RemovalJob != nil {
+			status = http.StatusAccepted
+		}
+		s.json(w, status, resp)
+		return
+	}
+	resp.Release = deployed.Release
+	resp.Job = deployed.Job
+	s.json(w, http.StatusAccepted, resp)
+}
+
+// handleUpdateProcess sets the resource limits, health check or stop timeout
+// of a process type. They aren't pinned by releases, so running instances
+// are restarted with them right away.
+func (s *Server) handleUpdateProcess(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	procName := chi.URLParam(r, "type")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	p, err := s.db.GetProcess(name, procName)
+	if err != nil {
+		s.logger.Error("get process", "error", err, "process", procName)
+		s.error(w, http.StatusInternalServerError, "failed to get process")
+		return
+	}
+	if p == nil {
+		s.error(w, http.StatusNotFound, fmt.Sprintf("no process type %s", procName))
+		return
+	}
+
+	var req models.UpdateProcessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Resources == nil && req.Healthcheck == nil && req.StopTimeout == nil {
+		s.error(w, http.StatusBadRequest, "resources, healthcheck or stop_timeout is required")
+		return
+	}
+
+	details := make(map[string]interface{})
+	if req.Resources != nil {
+		p.Resources = req.Resources
+		// Empty limits go back to the defaults
+		details["resources"] = p.Resources
+		if isZeroResources(req.Resources) {
+			p.Resources = nil
+			details["resources"] = "default"
+		}
+	}
+	if req.Healthcheck != nil {
+		p.Healthcheck = req.Healthcheck
+		details["healthcheck"] = p.Healthcheck
+		if *req.Healthcheck == (models.HealthcheckConfig{}) {
+			p.Healthcheck = nil
+			details["healthcheck"] = "none"
+		}
+	}
+	if req.StopTimeout != nil {
+		p.StopTimeout = *req.StopTimeout
+		details["stop_timeout"] = p.StopTimeout
+		if p.StopTimeout == "" {
+			details["stop_timeout"] = "default"
+		}
+	}
+	if err := deploy.ValidateLimits(p.Name, p.Resources, p.Healthcheck, p.StopTimeout); err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.db.SetProcessLimits(name, p.Name, p.Resources, p.Healthcheck, p.StopTimeout); err != nil {
+		s.logger.Error("set process limits", "error", err, "process", procName)
+		s.error(w, http.StatusInternalServerError, "failed to update process")
+		return
+	}
+
+	s.logger.Info("process updated", "app", name, "process", procName)
+	s.audit(r, name, models.AuditProcessUpdate, procName, details)
+
+	// Rewrite the units and restart the instances running the old ones
+	s.engine.Reconcile(name)
+
+	s.json(w, http.StatusOK, p)
+}
+
+// isZeroResources reports whether resource limits set nothing
+func isZeroResources(r *models.ResourceLimits) bool {
+	return r.Memory == "" && r.CPU == 0 && r.Pids == 0 && len(r.Ulimits) == 0
+}
+
+// setFormation replaces an app's process types with decl, queues a job
+// stopping the instances of types it drops, and records the change in the
+// audit log.
+// Types keep their count unless decl sets one; new types start with one web
+// instance and no others. It reports whether a command changed or a type
+// was added, which takes a release to run. On failure it has written the
+// error response.
+func (s *Server) setFormation(w http.ResponseWriter, r *http.Request, name string, decl []models.FormationProcess, details map[string]interface{}) (*models.FormationResponse, bool, bool) {
+	processes, changed, ok := s.planFormation(w, name, decl)
+	if !ok {
+		return nil, false, false
+	}
+
+	removed, err := s.db.SetFormation(name, processes)
+	if err != nil {
+		s.logger.Error("set formation", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to update process types")
+		return nil, false, false
+	}
+
+	resp, err := s.formationChanged(r, name, processes, removed, details)
+	if err != nil {
+		s.error(w, http.StatusInternalServerError, "process types updated but failed to stop removed ones")
+		return nil, false, false
+	}
+	resp.Processes, err = s.db.ListProcesses(name)
+	if err != nil {
+		s.logger.Error("list processes", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list processes")
+		return nil, false, false
+	}
+	return resp, changed, true
+}
+
+// planFormation checks decl and returns the process types it declares,
+// with their counts, without saving them. It reports whether a command
+// changed or a type was added. On failure it has written the error response.
+func (s *Server) planFormation(w http.ResponseWriter, name string, decl []models.FormationProcess) ([]*models.Process, bool, bool) {
+	if len(decl) == 0 {
+		s.error(w, http.StatusBadRequest, "processes is required")
+		return nil, false, false
+	}
+
+	current, err := s.db.ListProcesses(name)
+	if err != nil {
+		s.logger.Error("list processes", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to list processes")
+		return nil, false, false
+	}
+	existing := make(map[string]*models.Process, len(current))
+	for _, p := range current {
+		existing[p.Name] = p
+	}
+
+	changed := false
+	seen := make(map[string]bool, len(decl))
+	processes := make([]*models.Process, 0, len(decl))
+	for _, d := range decl {
+		if err := deploy.ValidateProcess(d.Name, d.Command); err != nil {
+			s.error(w, http.StatusBadRequest, err.Error())
+			return nil, false, false
+		}
+		if seen[d.Name] {
+			s.error(w, http.StatusBadRequest, fmt.Sprintf("process type %s is declared twice", d.Name))
+			return nil, false, false
+		}
+		seen[d.Name] = true
+
+		p := &models.Process{AppName: name, Name: d.Name, Command: d.Command}
+		switch old := existing[d.Name]; {
+		case d.Count != nil:
+			if *d.Count < 0 {
+				s.error(w, http.StatusBadRequest, "count must be non-negative")
+				return nil, false, false
+			}
+			p.Count = *d.Count
+		case old != nil:
+			p.Count = old.Count
+		case d.Name == "web":
+			p.Count = 1
+		}
+		if old := existing[d.Name]; old == nil || old.Command != p.Command {
+			changed = true
+		}
+		processes = append(processes, p)
+	}
+	return processes, changed, true
+}
+
+// formationChanged records a saved formation change in the audit log and
+// queues a job stopping the instances of the removed types
+func (s *Server) formationChanged(r *http.Request, name string, processes, removed []*models.Process, details map[string]interface{}) (*models.FormationResponse, error) {
+	resp := &models.FormationResponse{Removed: []string{}}
+	for _, p := range removed {
+		resp.Removed = append(resp.Removed, p.Name)
+	}
+	if details == nil {
+		details = make(map[string]interface{})
+	}
+	types := make(map[string]int, len(processes))
 	for _, p := range processes {
-		s.logger.Info("restarting process", "app", name, "process", p.Name, "count", p.Count)
+		types[p.Name] = p.Count
+	}
+	details["processes"] = types
+	if len(removed) > 0 {
+		details["removed"] = resp.Removed
+	}
+	s.logger.Info("formation changed", "app", name, "processes", len(processes), "removed", len(removed))
+	s.audit(r, name, models.AuditFormation, "", details)
+
+	if len(removed) > 0 {
+		var err error
+		resp.RemovalJob, err = s.engine.EnqueueRemoveProcesses(name, removed)
+		if err != nil {
+			s.logger.Error("enqueue remove processes", "error", err)
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// handleRestart queues a job restarting the instances of the app's live
+// release
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	release, err := s.db.GetActiveRelease(name)
+	if err != nil {
+		s.logger.Error("get active release", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get active release")
+		return
+	}
+	if release == nil {
+		s.error(w, http.StatusConflict, "app has no active release to restart")
+		return
 	}
 
-	s.json(w, http.StatusOK, map[string]string{
+	job, err := s.engine.EnqueueRestart(name)
+	if err != nil {
+		s.logger.Error("enqueue restart", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to restart processes")
+		return
+	}
+
+	s.logger.Info("restarting processes", "app", name, "job", job.ID)
+	s.audit(r, name, models.AuditProcessRestart, "", map[string]interface{}{
+		"job": job.ID,
+	})
+
+	s.json(w, http.StatusAccepted, map[string]interface{}{
 		"status": "restarting",
+		"job":    job,
 	})
 }
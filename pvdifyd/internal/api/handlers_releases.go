@@ -2,10 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/philoveracity/pvdifyd/internal/auth"
+	"github.com/philoveracity/pvdifyd/internal/deploy"
 	"github.com/philoveracity/pvdifyd/internal/models"
 )
 
@@ -54,48 +57,201 @@ func (s *Server) handleCreateRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Image == "" {
-		s.error(w, http.StatusBadRequest, "image is required")
-		return
+	// Without a new image, the release runs exactly what is running now
+	var digest string
+	if req.Image != "" {
+		if err := deploy.ValidateImage(req.Image); err != nil {
+			s.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		req.Image, digest, err = s.currentImage(name)
+		if err != nil {
+			s.logger.Error("get current image", "error", err)
+			s.error(w, http.StatusInternalServerError, "failed to get current release")
+			return
+		}
+		if req.Image == "" {
+			s.error(w, http.StatusBadRequest, "image is required for the first deploy")
+			return
+		}
+	}
+
+	// A Procfile declares the process types the release runs. They're saved
+	// with the release, so a failed request leaves the formation as it was.
+	var procfile []*models.Process
+	if req.Procfile != "" {
+		decl, err := parseProcfile(req.Procfile)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var ok bool
+		if procfile, _, ok = s.planFormation(w, name, decl); !ok {
+			return
+		}
 	}
 
 	// Get current config version
 	var configVersion int
-	cfg, _ := s.db.GetLatestConfig(name)
+	cfg, err := s.db.GetLatestConfig(name)
+	if err != nil {
+		s.logger.Error("get config", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to get config")
+		return
+	}
 	if cfg != nil {
 		configVersion = cfg.Version
 	}
 
+	resp, err := s.deployRelease(r, name, req.Image, digest, configVersion, procfile, nil)
+	if err != nil {
+		s.error(w, http.StatusInternalServerError, "failed to create release")
+		return
+	}
+	s.json(w, http.StatusAccepted, resp)
+}
+
+// deployRelease creates a release of image with the given config version,
+// pinned to the latest versions of the app's config groups and its current
+// process commands, and queues its deploy. An empty digest is resolved from
+// the image's tag when the release is deployed. If procfile isn't nil, it
+// replaces the app's process types in the same transaction and the release
+// pins its commands instead. details are added to the audit event.
+func (s *Server) deployRelease(r *http.Request, name, image, digest string, configVersion int, procfile []*models.Process, details map[string]interface{}) (*models.DeployResponse, error) {
+	groups, err := s.configGroupPins(name)
+	if err != nil {
+		s.logger.Error("list app config groups", "error", err)
+		return nil, err
+	}
+	var processes []models.ReleaseProcess
+	if procfile != nil {
+		for _, p := range procfile {
+			processes = append(processes, models.ReleaseProcess{Name: p.Name, Command: p.Command})
+		}
+	} else if processes, err = s.processPins(name); err != nil {
+		s.logger.Error("list processes", "error", err)
+		return nil, err
+	}
+
 	release := &models.Release{
 		AppName:       name,
-		Image:         req.Image,
+		Image:         image,
+		ImageDigest:   digest,
 		ConfigVersion: configVersion,
 		Status:        models.ReleaseStatusPending,
-		CreatedBy:     req.CreatedBy,
+		CreatedBy:     auth.FromContext(r.Context()).Subject,
+		ConfigGroups:  groups,
+		Processes:     processes,
 	}
 
-	if err := s.db.CreateRelease(release); err != nil {
+	var removed []*models.Process
+	if procfile == nil {
+		err = s.db.CreateRelease(release)
+	} else {
+		removed, err = s.db.CreateReleaseWithFormation(release, procfile)
+	}
+	if err != nil {
 		s.logger.Error("create release", "error", err)
-		s.error(w, http.StatusInternalServerError, "failed to create release")
-		return
+		return nil, err
+	}
+	if procfile != nil {
+		// The release and formation are saved, so the release deploys even
+		// if the job stopping dropped types can't be queued; that's logged
+		s.formationChanged(r, name, procfile, removed, map[string]interface{}{
+			"procfile": true,
+			"release":  fmt.Sprintf("v%d", release.Version),
+		})
+	}
+
+	job, err := s.engine.EnqueueDeploy(release)
+	if err != nil {
+		s.logger.Error("enqueue deploy", "error", err)
+		return nil, err
+	}
+
+	s.logger.Info("release created", "app", name, "version", release.Version, "image", image, "job", job.ID)
+	if details == nil {
+		details = make(map[string]interface{})
+	}
+	details["image"] = release.Image
+	if release.ImageDigest != "" {
+		details["image_digest"] = release.ImageDigest
+	}
+	details["config_version"] = release.ConfigVersion
+	if len(groups) > 0 {
+		details["config_groups"] = groups
+	}
+	details["job_id"] = job.ID
+	s.audit(r, name, models.AuditDeploy, fmt.Sprintf("v%d", release.Version), details)
+
+	return &models.DeployResponse{Release: release, Job: job}, nil
+}
+
+// configGroupPins returns the latest versions of the config groups attached
+// to an app, for a new release to pin. Groups without any vars are skipped.
+func (s *Server) configGroupPins(name string) ([]models.ReleaseConfigGroup, error) {
+	attached, err := s.db.ListAppConfigGroups(name)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update app with new image
-	if err := s.db.UpdateApp(name, &req.Image, nil, nil); err != nil {
-		s.logger.Error("update app image", "error", err)
+	var pins []models.ReleaseConfigGroup
+	for _, a := range attached {
+		if a.Version > 0 {
+			pins = append(pins, models.ReleaseConfigGroup{Name: a.GroupName, Version: a.Version})
+		}
 	}
+	return pins, nil
+}
 
-	// TODO: Actually deploy the release
-	// 1. Pull image
-	// 2. Generate/update systemd unit
-	// 3. Start new container
-	// 4. Health check
-	// 5. Update tunnel config
-	// 6. Stop old container
-	// 7. Update release status
+// processPins returns the app's process types with their current commands,
+// for a new release to pin
+func (s *Server) processPins(name string) ([]models.ReleaseProcess, error) {
+	processes, err := s.db.ListProcesses(name)
+	if err != nil {
+		return nil, err
+	}
 
-	s.logger.Info("release created", "app", name, "version", release.Version, "image", req.Image)
-	s.json(w, http.StatusCreated, release)
+	pins := make([]models.ReleaseProcess, 0, len(processes))
+	for _, p := range processes {
+		pins = append(pins, models.ReleaseProcess{Name: p.Name, Command: p.Command})
+	}
+	return pins, nil
+}
+
+// parseProcfile reads the process types declared by a Procfile, keeping
+// the current counts of existing types
+func parseProcfile(data string) ([]models.FormationProcess, error) {
+	processes, err := deploy.ParseProcfile(data)
+	if err != nil {
+		return nil, err
+	}
+	decl := make([]models.FormationProcess, len(processes))
+	for i, p := range processes {
+		decl[i] = models.FormationProcess{Name: p.Name, Command: p.Command}
+	}
+	return decl, nil
+}
+
+// currentImage returns the image and digest a release without a new image
+// should run: those of a deploy still queued or in progress, otherwise those
+// of the active release. The image is empty if the app has never been
+// deployed; the digest is empty if it hasn't been resolved yet.
+func (s *Server) currentImage(name string) (image, digest string, err error) {
+	latest, err := s.db.GetLatestRelease(name)
+	if err != nil || latest == nil {
+		return "", "", err
+	}
+	if latest.Status == models.ReleaseStatusPending || latest.Status == models.ReleaseStatusDeploying {
+		return latest.Image, latest.ImageDigest, nil
+	}
+
+	active, err := s.db.GetActiveRelease(name)
+	if err != nil || active == nil {
+		return "", "", err
+	}
+	return active.Image, active.ImageDigest, nil
 }
 
 // handleGetRelease returns a specific release
@@ -123,7 +279,41 @@ func (s *Server) handleGetRelease(w http.ResponseWriter, r *http.Request) {
 	s.json(w, http.StatusOK, release)
 }
 
-// handleRollback rolls back to a previous release
+// handlePruneReleases deletes the releases and config versions the app's
+// retention policy no longer keeps, or with ?dry_run=true lists them
+func (s *Server) handlePruneReleases(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	app, err := s.db.GetApp(name)
+	if err != nil || app == nil {
+		s.error(w, http.StatusNotFound, "app not found")
+		return
+	}
+	dryRun, err := parseBoolParam(r.URL.Query().Get("dry_run"))
+	if err != nil {
+		s.error(w, http.StatusBadRequest, "invalid dry_run parameter")
+		return
+	}
+
+	result, err := s.engine.Prune(r.Context(), name, dryRun)
+	if err != nil {
+		s.logger.Error("prune releases", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to prune releases")
+		return
+	}
+
+	if !dryRun {
+		s.audit(r, name, models.AuditReleasePrune, name, map[string]interface{}{
+			"releases":        result.Releases,
+			"config_versions": result.ConfigVersions,
+			"images":          result.Images,
+		})
+	}
+	s.json(w, http.StatusOK, result)
+}
+
+// handleRollback rolls back to a previous release by deploying a copy of it
+// with its image and pinned config and config group versions
 func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
@@ -141,25 +331,34 @@ func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
 	if req.Version > 0 {
 		target, err = s.db.GetRelease(name, req.Version)
 	} else {
-		// Get previous release (latest - 1)
-		releases, _ := s.db.ListReleases(name, 2)
-		if len(releases) >= 2 {
-			target = releases[1]
+		// Get the release that was live before the active one
+		var active *models.Release
+		active, err = s.db.GetActiveRelease(name)
+		if err == nil && active != nil {
+			target, err = s.db.GetPreviousRelease(name, active.Version)
 		}
 	}
+	if err != nil {
+		s.logger.Error("get rollback target", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to find release")
+		return
+	}
 
 	if target == nil {
 		s.error(w, http.StatusBadRequest, "no release to rollback to")
 		return
 	}
 
-	// Create new release with old image
+	// Create new release with old image, at the digest it ran
 	release := &models.Release{
 		AppName:       name,
 		Image:         target.Image,
+		ImageDigest:   target.ImageDigest,
 		ConfigVersion: target.ConfigVersion,
 		Status:        models.ReleaseStatusPending,
-		CreatedBy:     "rollback",
+		CreatedBy:     auth.FromContext(r.Context()).Subject,
+		ConfigGroups:  target.ConfigGroups,
+		Processes:     target.Processes,
 	}
 
 	if err := s.db.CreateRelease(release); err != nil {
@@ -168,8 +367,24 @@ func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Actually deploy the rollback
+	job, err := s.engine.EnqueueRollback(release)
+	if err != nil {
+		s.logger.Error("enqueue rollback", "error", err)
+		s.error(w, http.StatusInternalServerError, "failed to start rollback")
+		return
+	}
 
-	s.logger.Info("rollback initiated", "app", name, "to_version", target.Version, "new_version", release.Version)
-	s.json(w, http.StatusCreated, release)
+	s.logger.Info("rollback initiated", "app", name, "to_version", target.Version, "new_version", release.Version, "job", job.ID)
+	s.audit(r, name, models.AuditRollback, fmt.Sprintf("v%d", release.Version), map[string]interface{}{
+		"to_version":     target.Version,
+		"image":          release.Image,
+		"image_digest":   release.ImageDigest,
+		"config_version": release.ConfigVersion,
+		"config_groups":  release.ConfigGroups,
+		"job_id":         job.ID,
+	})
+	s.json(w, http.StatusAccepted, models.DeployResponse{
+		Release: release,
+		Job:     job,
+	})
 }
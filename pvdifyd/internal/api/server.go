@@ -13,26 +13,42 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/philoveracity/pvdifyd/internal/auth"
 	"github.com/philoveracity/pvdifyd/internal/config"
 	"github.com/philoveracity/pvdifyd/internal/db"
+	"github.com/philoveracity/pvdifyd/internal/deploy"
 )
 
 // Server represents the HTTP API server
 type Server struct {
 	router *chi.Mux
 	db     *db.DB
+	engine *deploy.Engine
+	access *auth.AccessVerifier // nil when Cloudflare Access isn't configured
 	cfg    *config.Config
 	logger *slog.Logger
 }
 
 // New creates a new API server
-func New(database *db.DB, cfg *config.Config, logger *slog.Logger) *Server {
+func New(database *db.DB, engine *deploy.Engine, cfg *config.Config, logger *slog.Logger) *Server {
 	s := &Server{
 		router: chi.NewRouter(),
 		db:     database,
+		engine: engine,
 		cfg:    cfg,
 		logger: logger,
 	}
+
+	if cfg.Auth.CFAccessTeam != "" && cfg.Auth.CFAccessAUD != "" {
+		var source auth.KeySource = &auth.URLKeySource{URL: auth.CertsURL(cfg.Auth.CFAccessTeam)}
+		if cfg.Auth.JWKSFile != "" {
+			source = &auth.FileKeySource{Path: cfg.Auth.JWKSFile}
+		}
+		s.access = auth.NewAccessVerifier(cfg.Auth.CFAccessTeam, cfg.Auth.CFAccessAUD, source)
+	} else if !cfg.Dev {
+		logger.Warn("cloudflare access not configured, only api tokens will be accepted")
+	}
+
 	s.setupRoutes()
 	return s
 }
@@ -43,6 +59,9 @@ func (s *Server) setupRoutes() {
 
 	// Middleware
 	r.Use(middleware.RequestID)
+	// RealIP rewrites RemoteAddr from headers the client controls; keep
+	// the peer address for the audit log first
+	r.Use(peerAddrMiddleware)
 	r.Use(middleware.RealIP)
 	r.Use(s.loggerMiddleware)
 	r.Use(middleware.Recoverer)
@@ -55,55 +74,122 @@ func (s *Server) setupRoutes() {
 	r.Route("/api/v1", func(r chi.Router) {
 		// CORS for Admin UI
 		r.Use(corsMiddleware)
+		r.Use(s.authMiddleware)
+
+		// Caller identity and roles
+		r.Get("/me", s.handleMe)
+
+		// Audit log across apps
+		r.With(s.authorize(auth.PermRead)).Get("/audit", s.handleListAudit)
+
+		// Global role grants
+		r.Route("/access", func(r chi.Router) {
+			r.Use(s.authorize(auth.PermManageAccess))
+			r.Get("/", s.handleListGrants)
+			r.Put("/{subject}", s.handlePutGrant)
+			r.Delete("/{subject}", s.handleDeleteGrant)
+		})
 
 		// Cloudflare integration
 		r.Route("/cloudflare", func(r chi.Router) {
+			r.Use(s.authorize(auth.PermManage))
 			r.Get("/zones", s.handleListCloudflareZones)
 			r.Get("/dns", s.handleListCloudflareDNS)
 		})
 
+		// Config groups shared by apps
+		r.Route("/config-groups", func(r chi.Router) {
+			r.With(s.authorize(auth.PermReadConfig)).Get("/", s.handleListConfigGroups)
+			r.With(s.authorize(auth.PermWriteConfig)).Post("/", s.handleCreateConfigGroup)
+			r.Route("/{group}", func(r chi.Router) {
+				r.With(s.authorize(auth.PermReadConfig)).Get("/", s.handleGetConfigGroup)
+				r.With(s.authorize(auth.PermWriteConfig)).Delete("/", s.handleDeleteConfigGroup)
+				r.With(s.authorize(auth.PermWriteConfig)).Put("/config", s.handleSetConfigGroupVars)
+				r.With(s.authorize(auth.PermWriteConfig)).Delete("/config/{key}", s.handleUnsetConfigGroupVar)
+				r.With(s.authorize(auth.PermReadConfig)).Get("/versions", s.handleListConfigGroupVersions)
+			})
+		})
+
 		// Apps
 		r.Route("/apps", func(r chi.Router) {
-			r.Get("/", s.handleListApps)
-			r.Post("/", s.handleCreateApp)
+			r.Get("/", s.handleListApps) // Filtered to apps the caller can read
+			r.With(s.authorize(auth.PermManage)).Post("/", s.handleCreateApp)
 			r.Route("/{name}", func(r chi.Router) {
-				r.Get("/", s.handleGetApp)
-				r.Patch("/", s.handleUpdateApp)
-				r.Delete("/", s.handleDeleteApp)
+				r.With(s.authorize(auth.PermRead)).Get("/", s.handleGetApp)
+				r.With(s.authorize(auth.PermManage)).Patch("/", s.handleUpdateApp)
+				r.With(s.authorize(auth.PermManage)).Delete("/", s.handleDeleteApp)
 
 				// Releases
 				r.Route("/releases", func(r chi.Router) {
-					r.Get("/", s.handleListReleases)
-					r.Post("/", s.handleCreateRelease)
-					r.Get("/{version}", s.handleGetRelease)
+					r.With(s.authorize(auth.PermRead)).Get("/", s.handleListReleases)
+					r.With(s.authorize(auth.PermDeploy)).Post("/", s.handleCreateRelease)
+					r.With(s.authorize(auth.PermRead)).Get("/{version}", s.handleGetRelease)
+					r.With(s.authorize(auth.PermManage)).Post("/prune", s.handlePruneReleases)
+				})
+				r.With(s.authorize(auth.PermDeploy)).Post("/rollback", s.handleRollback)
+
+				// Jobs
+				r.Route("/jobs", func(r chi.Router) {
+					r.Use(s.authorize(auth.PermRead))
+					r.Get("/", s.handleListJobs)
+					r.Get("/{id}", s.handleGetJob)
 				})
-				r.Post("/rollback", s.handleRollback)
 
 				// Config
 				r.Route("/config", func(r chi.Router) {
-					r.Get("/", s.handleGetConfig)
-					r.Put("/", s.handleSetConfig)
-					r.Delete("/{key}", s.handleUnsetConfig)
+					r.With(s.authorize(auth.PermReadConfig)).Get("/", s.handleGetConfig)
+					r.With(s.authorize(auth.PermWriteConfig)).Put("/", s.handleSetConfig)
+					r.With(s.authorize(auth.PermWriteConfig)).Delete("/{key}", s.handleUnsetConfig)
+					r.With(s.authorize(auth.PermReadConfig)).Get("/versions", s.handleListConfigVersions)
+					r.With(s.authorize(auth.PermReadConfig)).Get("/versions/{version}", s.handleGetConfigVersion)
+					r.With(s.authorize(auth.PermReadConfig)).Get("/diff", s.handleDiffConfig)
+					r.With(s.authorize(auth.PermWriteConfig)).Post("/restore", s.handleRestoreConfig)
+					r.With(s.authorize(auth.PermReadConfig)).Get("/export", s.handleExportConfig)
+					r.With(s.authorize(auth.PermWriteConfig)).Post("/import", s.handleImportConfig)
+					r.With(s.authorize(auth.PermReadConfig)).Get("/secrets", s.handleListConfigSecrets)
+					r.With(s.authorize(auth.PermWriteConfig)).Put("/secrets/{key}", s.handlePutConfigSecret)
+					r.With(s.authorize(auth.PermWriteConfig)).Delete("/secrets/{key}", s.handleDeleteConfigSecret)
+				})
+
+				// Attached config groups
+				r.Route("/config-groups", func(r chi.Router) {
+					r.With(s.authorize(auth.PermReadConfig)).Get("/", s.handleListAppConfigGroups)
+					r.With(s.authorize(auth.PermWriteConfig)).Put("/{group}", s.handleAttachConfigGroup)
+					r.With(s.authorize(auth.PermWriteConfig)).Delete("/{group}", s.handleDetachConfigGroup)
 				})
 
 				// Domains
 				r.Route("/domains", func(r chi.Router) {
-					r.Get("/", s.handleListDomains)
-					r.Post("/", s.handleAddDomain)
-					r.Delete("/{domain}", s.handleRemoveDomain)
+					r.With(s.authorize(auth.PermRead)).Get("/", s.handleListDomains)
+					r.With(s.authorize(auth.PermManage)).Post("/", s.handleAddDomain)
+					r.With(s.authorize(auth.PermManage)).Delete("/{domain}", s.handleRemoveDomain)
 					// Cloudflare DNS integration
-					r.Post("/{domain}/cloudflare", s.handleCreateCloudflareDNS)
+					r.With(s.authorize(auth.PermManage)).Post("/{domain}/cloudflare", s.handleCreateCloudflareDNS)
 				})
 
 				// Processes
 				r.Route("/ps", func(r chi.Router) {
-					r.Get("/", s.handleListProcesses)
-					r.Post("/scale", s.handleScale)
-					r.Post("/restart", s.handleRestart)
+					r.With(s.authorize(auth.PermRead)).Get("/", s.handleListProcesses)
+					r.With(s.authorize(auth.PermDeploy)).Post("/scale", s.handleScale)
+					r.With(s.authorize(auth.PermDeploy)).Post("/restart", s.handleRestart)
 				})
+				r.With(s.authorize(auth.PermRead)).Get("/formation", s.handleGetFormation)
+				r.With(s.authorize(auth.PermDeploy)).Put("/formation", s.handlePutFormation)
+				r.With(s.authorize(auth.PermDeploy)).Patch("/formation/{type}", s.handleUpdateProcess)
 
 				// Logs
-				r.Get("/logs", s.handleLogs)
+				r.With(s.authorize(auth.PermRead)).Get("/logs", s.handleLogs)
+
+				// Audit log
+				r.With(s.authorize(auth.PermRead)).Get("/audit", s.handleListAudit)
+
+				// App role grants
+				r.Route("/access", func(r chi.Router) {
+					r.Use(s.authorize(auth.PermManageAccess))
+					r.Get("/", s.handleListGrants)
+					r.Put("/{subject}", s.handlePutGrant)
+					r.Delete("/{subject}", s.handleDeleteGrant)
+				})
 			})
 		})
 	})
@@ -183,7 +269,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Cf-Access-Jwt-Assertion")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
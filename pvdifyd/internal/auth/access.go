@@ -0,0 +1,299 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksTTL        = time.Hour        // How long fetched keys are trusted before refetching
+	jwksMinRefresh = time.Minute      // Minimum gap between refetches triggered by unknown key IDs
+	clockSkew      = 60 * time.Second // Tolerance for exp/nbf checks
+)
+
+// ErrInvalidToken is returned for any JWT that fails verification
+var ErrInvalidToken = errors.New("invalid access token")
+
+// KeySource supplies the public keys Access JWTs are signed with, by key ID
+type KeySource interface {
+	Keys(ctx context.Context) (map[string]*rsa.PublicKey, error)
+}
+
+// URLKeySource fetches a JWKS document over HTTP
+type URLKeySource struct {
+	URL    string
+	Client *http.Client
+}
+
+// Keys implements KeySource
+func (s *URLKeySource) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("read jwks: %w", err)
+	}
+	return parseJWKS(data)
+}
+
+// FileKeySource reads a JWKS document from disk, for tests and hosts that
+// can't reach Cloudflare
+type FileKeySource struct {
+	Path string
+}
+
+// Keys implements KeySource
+func (s *FileKeySource) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("read jwks: %w", err)
+	}
+	return parseJWKS(data)
+}
+
+// parseJWKS extracts the RSA keys from a JWKS document
+func parseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var doc struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks key %s: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks key %s: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("parse jwks: no RSA keys")
+	}
+	return keys, nil
+}
+
+// TeamDomain expands a bare Access team name to its cloudflareaccess.com
+// domain; full domains are returned as is
+func TeamDomain(team string) string {
+	if strings.Contains(team, ".") {
+		return team
+	}
+	return team + ".cloudflareaccess.com"
+}
+
+// CertsURL returns the JWKS endpoint of an Access team
+func CertsURL(team string) string {
+	return "https://" + TeamDomain(team) + "/cdn-cgi/access/certs"
+}
+
+// AccessVerifier validates the JWTs Cloudflare Access attaches to proxied
+// requests. Signing keys are cached and refetched hourly, or early when a
+// token names a key ID that isn't cached yet (Access rotates keys).
+type AccessVerifier struct {
+	issuer   string
+	audience string
+	source   KeySource
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// NewAccessVerifier creates a verifier for tokens issued by team for the
+// application with the given AUD tag
+func NewAccessVerifier(team, audience string, source KeySource) *AccessVerifier {
+	return &AccessVerifier{
+		issuer:   "https://" + TeamDomain(team),
+		audience: audience,
+		source:   source,
+	}
+}
+
+// accessClaims are the JWT claims pvdifyd cares about
+type accessClaims struct {
+	Issuer     string   `json:"iss"`
+	Audience   audience `json:"aud"`
+	Subject    string   `json:"sub"`
+	Email      string   `json:"email"`
+	CommonName string   `json:"common_name"` // Set instead of email for service tokens
+	ExpiresAt  int64    `json:"exp"`
+	NotBefore  int64    `json:"nbf"`
+}
+
+// audience accepts both forms of the aud claim: a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Verify checks a token's signature, issuer, audience and validity period
+// and returns the identity it asserts
+func (v *AccessVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, header.Alg)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims accessClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if !v.audienceMatches(claims.Audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if claims.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("%w: not yet valid", ErrInvalidToken)
+	}
+
+	subject := claims.Email
+	if subject == "" {
+		subject = claims.CommonName
+	}
+	if subject == "" {
+		subject = claims.Subject
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	return &Identity{Subject: subject, Method: MethodAccess}, nil
+}
+
+func (v *AccessVerifier) audienceMatches(aud audience) bool {
+	for _, a := range aud {
+		if a == v.audience {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the signing key with the given ID, refreshing the cache when
+// it has expired or doesn't know the ID
+func (v *AccessVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	age := time.Since(v.fetched)
+	if ok && age < jwksTTL {
+		return key, nil
+	}
+	if !ok && v.keys != nil && age < jwksMinRefresh {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	keys, err := v.source.Keys(ctx)
+	if err != nil {
+		// Keep using the cached keys if Cloudflare is briefly unreachable
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// decodeSegment decodes one base64url JSON segment of a JWT
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testTeam     = "acme"
+	testIssuer   = "https://acme.cloudflareaccess.com"
+	testAudience = "aud-tag"
+)
+
+// countingSource counts how often the verifier fetches keys
+type countingSource struct {
+	KeySource
+	fetches int
+}
+
+func (s *countingSource) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	s.fetches++
+	return s.KeySource.Keys(ctx)
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeJWKS writes the public halves of keys, by key ID, as a JWKS document
+func writeJWKS(t *testing.T, path string, keys map[string]*rsa.PrivateKey) {
+	t.Helper()
+	type jwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		doc.Keys = append(doc.Keys, jwk{
+			Kid: kid,
+			Kty: "RSA",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken returns an RS256 JWT of claims signed by key
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// validClaims returns claims Access would issue for a user, valid now
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   testIssuer,
+		"aud":   []string{testAudience},
+		"sub":   "user-id",
+		"email": "dev@example.com",
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+}
+
+func newTestVerifier(t *testing.T, keys map[string]*rsa.PrivateKey) (*AccessVerifier, *countingSource, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, keys)
+	source := &countingSource{KeySource: &FileKeySource{Path: path}}
+	return NewAccessVerifier(testTeam, testAudience, source), source, path
+}
+
+func TestAccessVerify(t *testing.T) {
+	key := generateKey(t)
+	other := generateKey(t)
+	v, _, _ := newTestVerifier(t, map[string]*rsa.PrivateKey{"k1": key})
+
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := validClaims()
+		for k, c := range changes {
+			if c == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = c
+			}
+		}
+		return claims
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   string
+		subject string // Empty if the token must be rejected
+	}{
+		{"valid", signToken(t, key, "k1", validClaims()), "dev@example.com"},
+		{"aud as a string", signToken(t, key, "k1", with(map[string]interface{}{"aud": testAudience})), "dev@example.com"},
+		{"service token", signToken(t, key, "k1", with(map[string]interface{}{"email": "", "common_name": "ci.access"})), "ci.access"},
+		{"signed by another key", signToken(t, other, "k1", validClaims()), ""},
+		{"wrong issuer", signToken(t, key, "k1", with(map[string]interface{}{"iss": "https://evil.cloudflareaccess.com"})), ""},
+		{"wrong audience", signToken(t, key, "k1", with(map[string]interface{}{"aud": []string{"other-app"}})), ""},
+		{"no exp", signToken(t, key, "k1", with(map[string]interface{}{"exp": nil})), ""},
+		{"expired within skew", signToken(t, key, "k1", with(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), "dev@example.com"},
+		{"expired beyond skew", signToken(t, key, "k1", with(map[string]interface{}{"exp": now.Add(-90 * time.Second).Unix()})), ""},
+		{"not yet valid within skew", signToken(t, key, "k1", with(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()})), "dev@example.com"},
+		{"not yet valid beyond skew", signToken(t, key, "k1", with(map[string]interface{}{"nbf": now.Add(90 * time.Second).Unix()})), ""},
+		{"no subject", signToken(t, key, "k1", with(map[string]interface{}{"email": nil, "sub": nil})), ""},
+		{"not a jwt", "not-a-jwt", ""},
+	}
+	for _, tt := range tests {
+		id, err := v.Verify(context.Background(), tt.token)
+		if tt.subject == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %s", tt.name, id.Subject)
+			} else if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("%s: error %v isn't ErrInvalidToken", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if id.Subject != tt.subject || id.Method != MethodAccess {
+			t.Errorf("%s: identity %+v, want %s by %s", tt.name, id, tt.subject, MethodAccess)
+		}
+	}
+}
+
+func TestAccessVerifyRejectsOtherAlgs(t *testing.T) {
+	key := generateKey(t)
+	v, _, _ := newTestVerifier(t, map[string]*rsa.PrivateKey{"k1": key})
+	claims := encodeSegment(t, validClaims())
+
+	// alg none: no signature at all
+	none := encodeSegment(t, map[string]string{"alg": "none", "kid": "k1"}) + "." + claims + "."
+
+	// HS256 keyed with the public key, the classic algorithm confusion
+	header := encodeSegment(t, map[string]string{"alg": "HS256", "kid": "k1"})
+	mac := hmac.New(sha256.New, key.N.Bytes())
+	mac.Write([]byte(header + "." + claims))
+	hs256 := header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	for name, token := range map[string]string{"none": none, "HS256": hs256} {
+		if id, err := v.Verify(context.Background(), token); err == nil {
+			t.Errorf("alg %s: accepted as %s", name, id.Subject)
+		} else if !strings.Contains(err.Error(), "unsupported alg") {
+			t.Errorf("alg %s: %v, want unsupported alg", name, err)
+		}
+	}
+}
+
+func TestAccessKeyRefresh(t *testing.T) {
+	k1 := generateKey(t)
+	k2 := generateKey(t)
+	v, source, path := newTestVerifier(t, map[string]*rsa.PrivateKey{"k1": k1})
+	ctx := context.Background()
+
+	if _, err := v.Verify(ctx, signToken(t, k1, "k1", validClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if source.fetches != 1 {
+		t.Fatalf("fetches = %d after the first token, want 1", source.fetches)
+	}
+
+	// Access rotates in k2. A token naming it right after the last fetch
+	// doesn't refetch, so unknown key IDs can't hammer the JWKS endpoint.
+	writeJWKS(t, path, map[string]*rsa.PrivateKey{"k1": k1, "k2": k2})
+	token := signToken(t, k2, "k2", validClaims())
+	if _, err := v.Verify(ctx, token); err == nil {
+		t.Error("unknown key accepted within the min refresh interval")
+	}
+	if source.fetches != 1 {
+		t.Errorf("fetches = %d within the min refresh interval, want 1", source.fetches)
+	}
+
+	// Once the interval has passed, the unknown key ID triggers a refetch
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-jwksMinRefresh - time.Second)
+	v.mu.Unlock()
+	if _, err := v.Verify(ctx, token); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if source.fetches != 2 {
+		t.Errorf("fetches = %d after an unknown key ID, want 2", source.fetches)
+	}
+
+	// Known keys are served from the cache
+	if _, err := v.Verify(ctx, signToken(t, k1, "k1", validClaims())); err != nil {
+		t.Error(err)
+	}
+	if source.fetches != 2 {
+		t.Errorf("fetches = %d for a cached key, want 2", source.fetches)
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// Method identifies how a request was authenticated
+type Method string
+
+const (
+	MethodAccess Method = "cf-access" // Cloudflare Access JWT
+	MethodToken  Method = "token"     // API token
+	MethodDev    Method = "dev"       // Development mode, no credentials
+)
+
+// Identity is the authenticated caller of an API request
+type Identity struct {
+	Subject string          `json:"subject"` // Email for Access users, "token:<name>" for API tokens
+	Method  Method          `json:"method"`  // How the caller authenticated
+	TokenID int64           `json:"token_id,omitempty"`
+	Grants  []*models.Grant `json:"grants"` // Roles held by the subject
+}
+
+// TokenSubject is the subject API tokens authenticate as, so roles can be
+// granted to them like to users
+func TokenSubject(name string) string {
+	return "token:" + name
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity attached to ctx, or nil
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
@@ -0,0 +1,60 @@
+package auth
+
+import "github.com/philoveracity/pvdifyd/internal/models"
+
+// Permission is an action guarded by role-based access control
+type Permission string
+
+const (
+	PermRead         Permission = "read"          // App metadata, releases, jobs, processes, domains, logs
+	PermReadConfig   Permission = "config:read"   // Config var values, with secret values masked
+	PermRevealConfig Permission = "config:reveal" // Secret config var values
+	PermWriteConfig  Permission = "config:write"  // Set and unset config vars, mark them secret
+	PermDeploy       Permission = "deploy"        // Deploy, roll back, scale and restart
+	PermManage       Permission = "manage"        // Create, update and delete apps and domains
+	PermManageAccess Permission = "access"        // Grant and revoke roles
+)
+
+// rolePermissions lists what each role may do
+var rolePermissions = map[models.Role][]Permission{
+	models.RoleAdmin: {
+		PermRead, PermReadConfig, PermRevealConfig, PermWriteConfig, PermDeploy, PermManage, PermManageAccess,
+	},
+	models.RoleDeployer: {
+		PermRead, PermReadConfig, PermWriteConfig, PermDeploy,
+	},
+	models.RoleViewer: {
+		PermRead,
+	},
+}
+
+// Allows reports whether role includes permission p
+func Allows(role models.Role, p Permission) bool {
+	for _, perm := range rolePermissions[role] {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the identity may perform p on app. Global grants
+// apply to every app; an empty app asks for a global permission, which only
+// global grants give. In dev mode everything is allowed.
+func (id *Identity) Can(app string, p Permission) bool {
+	if id == nil {
+		return false
+	}
+	if id.Method == MethodDev {
+		return true
+	}
+	for _, g := range id.Grants {
+		if g.AppName != "" && g.AppName != app {
+			continue
+		}
+		if Allows(g.Role, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		role models.Role
+		perm Permission
+		want bool
+	}{
+		{models.RoleViewer, PermRead, true},
+		{models.RoleViewer, PermReadConfig, false},
+		{models.RoleViewer, PermDeploy, false},
+		{models.RoleDeployer, PermReadConfig, true},
+		{models.RoleDeployer, PermWriteConfig, true},
+		{models.RoleDeployer, PermDeploy, true},
+		{models.RoleDeployer, PermRevealConfig, false},
+		{models.RoleDeployer, PermManage, false},
+		{models.RoleDeployer, PermManageAccess, false},
+		{models.RoleAdmin, PermRevealConfig, true},
+		{models.RoleAdmin, PermManageAccess, true},
+		{models.Role("owner"), PermRead, false},
+	}
+	for _, tt := range tests {
+		if got := Allows(tt.role, tt.perm); got != tt.want {
+			t.Errorf("Allows(%s, %s) = %v, want %v", tt.role, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestIdentityCan(t *testing.T) {
+	global := &Identity{Method: MethodAccess, Grants: []*models.Grant{
+		{Role: models.RoleViewer},
+	}}
+	perApp := &Identity{Method: MethodToken, Grants: []*models.Grant{
+		{Role: models.RoleViewer},
+		{Role: models.RoleDeployer, AppName: "shop"},
+	}}
+	dev := &Identity{Method: MethodDev}
+	none := &Identity{Method: MethodAccess}
+
+	tests := []struct {
+		name string
+		id   *Identity
+		app  string
+		perm Permission
+		want bool
+	}{
+		{"global grant covers every app", global, "shop", PermRead, true},
+		{"global grant covers global permissions", global, "", PermRead, true},
+		{"global grant limited by role", global, "shop", PermDeploy, false},
+		{"app grant covers its app", perApp, "shop", PermDeploy, true},
+		{"app grant doesn't cover other apps", perApp, "blog", PermDeploy, false},
+		{"app grant doesn't give global permissions", perApp, "", PermDeploy, false},
+		{"global grant still applies next to an app grant", perApp, "blog", PermRead, true},
+		{"dev mode allows everything", dev, "", PermManageAccess, true},
+		{"no grants", none, "shop", PermRead, false},
+		{"no identity", nil, "shop", PermRead, false},
+	}
+	for _, tt := range tests {
+		if got := tt.id.Can(tt.app, tt.perm); got != tt.want {
+			t.Errorf("%s: Can(%q, %s) = %v, want %v", tt.name, tt.app, tt.perm, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// tokenPrefix marks pvdify API tokens so they are easy to recognise in
+// secret scanners and distinguishable from JWTs
+const tokenPrefix = "pvd_"
+
+// GenerateToken returns a new random API token. Only its hash is stored;
+// the token itself is shown to the user once.
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 of a token, as stored in the database.
+// Tokens are high-entropy, so a fast unsalted hash is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsToken reports whether s looks like a pvdify API token
+func IsToken(s string) bool {
+	return strings.HasPrefix(s, tokenPrefix)
+}
@@ -3,24 +3,30 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents daemon configuration
 type Config struct {
-	Listen    string       `yaml:"listen"`
-	StateDir  string       `yaml:"state_dir"`
-	Database  string       `yaml:"database"`
-	StaticDir string       `yaml:"static_dir"` // Directory for Admin UI static files
-	Dev       bool         `yaml:"dev"`
-	Log       LogConfig    `yaml:"log"`
-	TLS       TLSConfig    `yaml:"tls"`
-	Auth      AuthConfig   `yaml:"auth"`
-	Podman    PodmanConfig `yaml:"podman"`
-	Ports     PortConfig   `yaml:"ports"`
-	Tunnel    TunnelConfig `yaml:"tunnel"`
-	SOPS      SOPSConfig   `yaml:"sops"`
+	Listen    string          `yaml:"listen"`
+	StateDir  string          `yaml:"state_dir"`
+	Database  string          `yaml:"database"`
+	StaticDir string          `yaml:"static_dir"` // Directory for Admin UI static files
+	Dev       bool            `yaml:"dev"`
+	Log       LogConfig       `yaml:"log"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Podman    PodmanConfig    `yaml:"podman"`
+	Systemd   SystemdConfig   `yaml:"systemd"`
+	Ports     PortConfig      `yaml:"ports"`
+	Tunnel    TunnelConfig    `yaml:"tunnel"`
+	Proxy     ProxyConfig     `yaml:"proxy"`
+	Deploy    DeployConfig    `yaml:"deploy"`
+	SOPS      SOPSConfig      `yaml:"sops"`
+	Secrets   SecretsConfig   `yaml:"secrets"`
+	Retention RetentionConfig `yaml:"retention"`
 }
 
 // LogConfig for logging settings
@@ -38,8 +44,9 @@ type TLSConfig struct {
 
 // AuthConfig for authentication
 type AuthConfig struct {
-	CFAccessTeam string `yaml:"cf_access_team"`
-	CFAccessAUD  string `yaml:"cf_access_aud"`
+	CFAccessTeam string `yaml:"cf_access_team"` // Team name or domain, e.g. "acme" or "acme.cloudflareaccess.com"
+	CFAccessAUD  string `yaml:"cf_access_aud"`  // Application audience tag
+	JWKSFile     string `yaml:"jwks_file"`      // Read Access signing keys from this file instead of fetching them
 }
 
 // PodmanConfig for container runtime
@@ -47,6 +54,11 @@ type PodmanConfig struct {
 	Socket string `yaml:"socket"`
 }
 
+// SystemdConfig for unit file generation
+type SystemdConfig struct {
+	UnitDir string `yaml:"unit_dir"`
+}
+
 // PortConfig for port allocation
 type PortConfig struct {
 	Start int `yaml:"start"`
@@ -58,11 +70,44 @@ type TunnelConfig struct {
 	Enabled     bool   `yaml:"enabled"`
 	Config      string `yaml:"config"`
 	Credentials string `yaml:"credentials"`
+	Service     string `yaml:"service"` // systemd unit running cloudflared, restarted when domains are routed or removed
+	Metrics     string `yaml:"metrics"` // Address cloudflared serves readiness on
+}
+
+// ProxyConfig for the built-in reverse proxy in front of web instances
+type ProxyConfig struct {
+	Enabled        bool          `yaml:"enabled"`         // Always on with the tunnel, which routes through it
+	Listen         string        `yaml:"listen"`          // Address the tunnel or clients connect to
+	Balance        string        `yaml:"balance"`         // round_robin or least_conn
+	MaxFails       int           `yaml:"max_fails"`       // Failed requests in a row before an instance is ejected
+	EjectTime      time.Duration `yaml:"eject_time"`      // How long an ejected instance gets no traffic
+	ReloadInterval time.Duration `yaml:"reload_interval"` // How often the route table is reloaded from the database
+}
+
+// DeployConfig for the release pipeline
+type DeployConfig struct {
+	HealthTimeout     time.Duration `yaml:"health_timeout"`     // How long new instances have to become healthy
+	VerifyPeriod      time.Duration `yaml:"verify_period"`      // How long instances must stay healthy after cutover before the previous slot is stopped
+	DrainTimeout      time.Duration `yaml:"drain_timeout"`      // Longest instances taken out of routing get to finish requests in flight before they are stopped
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"` // How often host state is converged to the database
 }
 
 // SOPSConfig for secrets encryption
 type SOPSConfig struct {
-	AgeKey string `yaml:"age_key"`
+	AgeKey string `yaml:"age_key"` // Path to an age key file (generated if missing), or an AGE-SECRET-KEY
+}
+
+// SecretsConfig for masking config var values in API responses
+type SecretsConfig struct {
+	Patterns []string `yaml:"patterns"` // Key patterns (path.Match syntax, case-insensitive) whose values are secret
+}
+
+// RetentionConfig for pruning old releases and config versions. Apps can
+// override KeepReleases and KeepDays.
+type RetentionConfig struct {
+	KeepReleases int           `yaml:"keep_releases"` // Newest releases of an app that are always kept
+	KeepDays     int           `yaml:"keep_days"`     // Releases younger than this are always kept; 0 keeps none by age
+	Interval     time.Duration `yaml:"interval"`      // How often the background pruner runs; 0 disables it
 }
 
 // Default returns default configuration
@@ -85,6 +130,9 @@ func Default() *Config {
 		Podman: PodmanConfig{
 			Socket: "unix:///run/user/1000/podman/podman.sock",
 		},
+		Systemd: SystemdConfig{
+			UnitDir: "/etc/systemd/system",
+		},
 		Ports: PortConfig{
 			Start: 3000,
 			End:   3999,
@@ -92,6 +140,33 @@ func Default() *Config {
 		Tunnel: TunnelConfig{
 			Enabled: true,
 			Config:  "/var/lib/pvdify/tunnels/pvdify-apps.yml",
+			Service: "cloudflared-pvdify-apps.service",
+			Metrics: "127.0.0.1:20241",
+		},
+		Proxy: ProxyConfig{
+			Enabled:        false,
+			Listen:         "127.0.0.1:8080",
+			Balance:        "round_robin",
+			MaxFails:       3,
+			EjectTime:      30 * time.Second,
+			ReloadInterval: 10 * time.Second,
+		},
+		Deploy: DeployConfig{
+			HealthTimeout:     60 * time.Second,
+			VerifyPeriod:      30 * time.Second,
+			DrainTimeout:      10 * time.Second,
+			ReconcileInterval: 30 * time.Second,
+		},
+		SOPS: SOPSConfig{
+			AgeKey: "/etc/pvdify/age.key",
+		},
+		Secrets: SecretsConfig{
+			Patterns: []string{"*_KEY", "*_SECRET", "*_TOKEN", "*_PASSWORD"},
+		},
+		Retention: RetentionConfig{
+			KeepReleases: 20,
+			KeepDays:     30,
+			Interval:     6 * time.Hour,
 		},
 	}
 }
@@ -123,6 +198,9 @@ func Load(path string) (*Config, error) {
 	if v := os.Getenv("PVDIFY_DB"); v != "" {
 		cfg.Database = v
 	}
+	if v := os.Getenv("PVDIFY_AGE_KEY"); v != "" {
+		cfg.SOPS.AgeKey = v
+	}
 	if v := os.Getenv("PVDIFY_LOG_LEVEL"); v != "" {
 		cfg.Log.Level = v
 	}
@@ -0,0 +1,266 @@
+// Package configfile reads and writes app config vars as dotenv, JSON or
+// YAML files, for importing and exporting them in bulk
+package configfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Format names a config file format
+type Format string
+
+const (
+	FormatDotenv Format = "dotenv"
+	FormatJSON   Format = "json"
+	FormatYAML   Format = "yaml"
+)
+
+// ParseFormat returns the format with the given name; empty means dotenv
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case "", FormatDotenv, "env":
+		return FormatDotenv, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	case FormatYAML, "yml":
+		return FormatYAML, nil
+	}
+	return "", fmt.Errorf("unknown config format %q: use dotenv, json or yaml", name)
+}
+
+// ContentType returns the MIME type of files in the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatJSON:
+		return "application/json"
+	case FormatYAML:
+		return "application/yaml"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Parse reads config vars from data. JSON and YAML files hold a single flat
+// object; numbers and booleans are taken as their text. A key set twice is
+// an error, as it's unclear which value was meant.
+func Parse(f Format, data []byte) (models.ConfigData, error) {
+	switch f {
+	case FormatJSON:
+		if err := checkJSONKeys(data); err != nil {
+			return nil, err
+		}
+		var raw map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("parse json: %w", err)
+		}
+		return flatten(raw)
+	case FormatYAML:
+		var raw map[string]interface{}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("parse yaml: %w", err)
+		}
+		return flatten(raw)
+	}
+	return parseDotenv(data)
+}
+
+// Render writes vars in the format, ordered by key
+func Render(f Format, vars models.ConfigData) ([]byte, error) {
+	if vars == nil {
+		vars = models.ConfigData{}
+	}
+	switch f {
+	case FormatJSON:
+		data, err := json.MarshalIndent(vars, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case FormatYAML:
+		return yaml.Marshal(vars)
+	}
+	return renderDotenv(vars), nil
+}
+
+// checkJSONKeys rejects a JSON object that sets a key twice, which
+// encoding/json would silently resolve to the last value. Malformed input
+// is left for json.Unmarshal to report.
+func checkJSONKeys(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		key, _ := tok.(string)
+		if seen[key] {
+			return fmt.Errorf("parse json: %s: duplicate key", key)
+		}
+		seen[key] = true
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func flatten(raw map[string]interface{}) (models.ConfigData, error) {
+	vars := make(models.ConfigData, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			vars[k] = v
+		case nil:
+			vars[k] = ""
+		case bool, int, int64, float64:
+			vars[k] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s: value must be a string, number or boolean", k)
+		}
+	}
+	return vars, nil
+}
+
+// parseDotenv reads KEY=VALUE lines. Blank lines, comments and an "export "
+// prefix are ignored. Values may be single-quoted (literal), double-quoted
+// (with \n, \r, \t, \" and \\ escapes) or bare, where a " #" starts a comment
+// and surrounding spaces are trimmed.
+func parseDotenv(data []byte) (models.ConfigData, error) {
+	vars := make(models.ConfigData)
+	lines := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		key = strings.TrimSpace(key)
+		if first, ok := lines[key]; ok {
+			return nil, fmt.Errorf("line %d: %s: already set on line %d", n, key, first)
+		}
+		lines[key] = n
+		value, err := unquote(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read dotenv: %w", err)
+	}
+	return vars, nil
+}
+
+func unquote(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	switch s[0] {
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		if err := trailing(s[end+2:]); err != nil {
+			return "", err
+		}
+		return s[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			c := s[i]
+			switch {
+			case c == '"':
+				if err := trailing(s[i+1:]); err != nil {
+					return "", err
+				}
+				return b.String(), nil
+			case c == '\\' && i+1 < len(s):
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 'r':
+					b.WriteByte('\r')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
+
+// trailing checks that only a comment follows a closing quote
+func trailing(s string) error {
+	s = strings.TrimSpace(s)
+	if s != "" && !strings.HasPrefix(s, "#") {
+		return fmt.Errorf("unexpected text after closing quote")
+	}
+	return nil
+}
+
+// bareValue matches values that can be written without quotes
+var bareValue = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+
+// renderDotenv writes values bare when that's unambiguous, single-quoted
+// when possible and double-quoted with escapes otherwise, so that the output
+// reads back the same with parseDotenv and common dotenv tools
+func renderDotenv(vars models.ConfigData) []byte {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		v := vars[k]
+		b.WriteString(k)
+		b.WriteByte('=')
+		switch {
+		case bareValue.MatchString(v):
+			b.WriteString(v)
+		case !strings.ContainsAny(v, "'\n\r"):
+			b.WriteString("'" + v + "'")
+		default:
+			r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+			b.WriteString(`"` + r.Replace(v) + `"`)
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
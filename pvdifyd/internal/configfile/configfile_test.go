@@ -0,0 +1,95 @@
+package configfile
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		data   string
+		want   models.ConfigData // nil if parsing must fail
+	}{
+		{"dotenv bare", FormatDotenv, "A=one\n B = two words \n", models.ConfigData{"A": "one", "B": "two words"}},
+		{"dotenv comments and blanks", FormatDotenv, "# comment\n\nA=1 # trailing\nB=x#y\n", models.ConfigData{"A": "1", "B": "x#y"}},
+		{"dotenv export prefix", FormatDotenv, "export A=1\nexport B='2'\n", models.ConfigData{"A": "1", "B": "2"}},
+		{"dotenv byte order mark", FormatDotenv, "\ufeffA=1\n", models.ConfigData{"A": "1"}},
+		{"dotenv empty value", FormatDotenv, "A=\nB=''\nC=\"\"\n", models.ConfigData{"A": "", "B": "", "C": ""}},
+		{"dotenv value with =", FormatDotenv, "URL=postgres://db/app?sslmode=require\n", models.ConfigData{"URL": "postgres://db/app?sslmode=require"}},
+		{"dotenv single quotes are literal", FormatDotenv, `A='x \n "y" # z'` + "\n", models.ConfigData{"A": `x \n "y" # z`}},
+		{"dotenv double quote escapes", FormatDotenv, `A="l1\nl2\r\t \"q\" \\ \$"` + "\n", models.ConfigData{"A": "l1\nl2\r\t \"q\" \\ $"}},
+		{"dotenv comment after quotes", FormatDotenv, `A="x" # note` + "\n", models.ConfigData{"A": "x"}},
+		{"dotenv text after quotes", FormatDotenv, `A="x" y` + "\n", nil},
+		{"dotenv unterminated single quote", FormatDotenv, "A='x\n", nil},
+		{"dotenv unterminated double quote", FormatDotenv, "A=\"x\n", nil},
+		{"dotenv no =", FormatDotenv, "A\n", nil},
+		{"dotenv duplicate key", FormatDotenv, "A=1\nexport A=2\n", nil},
+		{"json strings", FormatJSON, `{"A": "one", "B": ""}`, models.ConfigData{"A": "one", "B": ""}},
+		{"json non-strings", FormatJSON, `{"PORT": 3000, "RATIO": 0.5, "DEBUG": true, "EMPTY": null}`, models.ConfigData{"PORT": "3000", "RATIO": "0.5", "DEBUG": "true", "EMPTY": ""}},
+		{"json nested object", FormatJSON, `{"A": {"B": "c"}}`, nil},
+		{"json array", FormatJSON, `{"A": ["b"]}`, nil},
+		{"json not an object", FormatJSON, `["A"]`, nil},
+		{"json duplicate key", FormatJSON, `{"A": "1", "B": {"A": "x"}, "A": "2"}`, nil},
+		{"yaml scalars", FormatYAML, "A: one\nPORT: 3000\nDEBUG: false\nEMPTY:\n", models.ConfigData{"A": "one", "PORT": "3000", "DEBUG": "false", "EMPTY": ""}},
+		{"yaml block scalar", FormatYAML, "CERT: |\n  line1\n  line2\n", models.ConfigData{"CERT": "line1\nline2\n"}},
+		{"yaml nested mapping", FormatYAML, "A:\n  B: c\n", nil},
+		{"yaml sequence", FormatYAML, "A:\n  - b\n", nil},
+		{"yaml duplicate key", FormatYAML, "A: 1\nA: 2\n", nil},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.format, []byte(tt.data))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: parsed %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderDotenvRoundTrip(t *testing.T) {
+	vars := models.ConfigData{
+		"BARE":      "postgres://u@db:5432/app?sslmode=require",
+		"SPACES":    "two words # not a comment",
+		"QUOTES":    `say "hi" and 'bye'`,
+		"BACKSLASH": `C:\path\n`,
+		"CERT":      "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+		"CRLF":      "a\r\nb",
+		"EMPTY":     "",
+	}
+	for _, format := range []Format{FormatDotenv, FormatJSON, FormatYAML} {
+		data, err := Render(format, vars)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got, err := Parse(format, data)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", format, err, data)
+		}
+		if !reflect.DeepEqual(got, vars) {
+			t.Errorf("%s round trip = %q, want %q", format, got, vars)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, want := range map[string]Format{"": FormatDotenv, "env": FormatDotenv, "JSON": FormatJSON, "yml": FormatYAML} {
+		if got, err := ParseFormat(name); err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseFormat("toml"); err == nil {
+		t.Error("ParseFormat(toml) succeeded")
+	}
+}
@@ -21,25 +21,35 @@ func (db *DB) CreateApp(app *models.App) error {
 	}
 
 	_, err := db.Exec(`
-		INSERT INTO apps (name, environment, status, image, bind_port, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, app.Name, app.Environment, app.Status, app.Image, app.BindPort, app.CreatedAt, app.UpdatedAt)
+		INSERT INTO apps (name, environment, status, image, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, app.Name, app.Environment, app.Status, app.Image, app.CreatedAt, app.UpdatedAt)
 	if err != nil {
 		return fmt.Errorf("insert app: %w", err)
 	}
 	return nil
 }
 
+// appColumns are the columns GetApp and ListApps read. The bound and standby
+// ports are those of the first web instance of the live and idle slots.
+const appColumns = `name, environment, status, image,
+	(SELECT port FROM port_allocations
+		WHERE app_name = apps.name AND color = COALESCE(apps.active_color, '') AND instance = 1),
+	(SELECT port FROM port_allocations
+		WHERE app_name = apps.name AND color = CASE apps.active_color WHEN 'blue' THEN 'green' ELSE 'blue' END AND instance = 1),
+	active_color, retain_releases, retain_days, created_at, updated_at`
+
 // GetApp retrieves an app by name
 func (db *DB) GetApp(name string) (*models.App, error) {
 	app := &models.App{}
-	var image sql.NullString
-	var bindPort sql.NullInt64
+	var image, activeColor sql.NullString
+	var bindPort, standbyPort, retainReleases, retainDays sql.NullInt64
 
 	err := db.QueryRow(`
-		SELECT name, environment, status, image, bind_port, created_at, updated_at
+		SELECT `+appColumns+`
 		FROM apps WHERE name = ?
-	`, name).Scan(&app.Name, &app.Environment, &app.Status, &image, &bindPort, &app.CreatedAt, &app.UpdatedAt)
+	`, name).Scan(&app.Name, &app.Environment, &app.Status, &image, &bindPort, &standbyPort, &activeColor,
+		&retainReleases, &retainDays, &app.CreatedAt, &app.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -53,6 +63,14 @@ func (db *DB) GetApp(name string) (*models.App, error) {
 	if bindPort.Valid {
 		app.BindPort = int(bindPort.Int64)
 	}
+	if standbyPort.Valid {
+		app.StandbyPort = int(standbyPort.Int64)
+	}
+	if activeColor.Valid {
+		app.ActiveColor = models.Color(activeColor.String)
+	}
+	app.RetainReleases = int(retainReleases.Int64)
+	app.RetainDays = int(retainDays.Int64)
 
 	return app, nil
 }
@@ -60,7 +78,7 @@ func (db *DB) GetApp(name string) (*models.App, error) {
 // ListApps retrieves all apps
 func (db *DB) ListApps() ([]*models.App, error) {
 	rows, err := db.Query(`
-		SELECT name, environment, status, image, bind_port, created_at, updated_at
+		SELECT ` + appColumns + `
 		FROM apps ORDER BY name
 	`)
 	if err != nil {
@@ -71,10 +89,11 @@ func (db *DB) ListApps() ([]*models.App, error) {
 	var apps []*models.App
 	for rows.Next() {
 		app := &models.App{}
-		var image sql.NullString
-		var bindPort sql.NullInt64
+		var image, activeColor sql.NullString
+		var bindPort, standbyPort, retainReleases, retainDays sql.NullInt64
 
-		if err := rows.Scan(&app.Name, &app.Environment, &app.Status, &image, &bindPort, &app.CreatedAt, &app.UpdatedAt); err != nil {
+		if err := rows.Scan(&app.Name, &app.Environment, &app.Status, &image, &bindPort, &standbyPort, &activeColor,
+			&retainReleases, &retainDays, &app.CreatedAt, &app.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("scan app: %w", err)
 		}
 
@@ -84,6 +103,14 @@ func (db *DB) ListApps() ([]*models.App, error) {
 		if bindPort.Valid {
 			app.BindPort = int(bindPort.Int64)
 		}
+		if standbyPort.Valid {
+			app.StandbyPort = int(standbyPort.Int64)
+		}
+		if activeColor.Valid {
+			app.ActiveColor = models.Color(activeColor.String)
+		}
+		app.RetainReleases = int(retainReleases.Int64)
+		app.RetainDays = int(retainDays.Int64)
 
 		apps = append(apps, app)
 	}
@@ -92,7 +119,7 @@ func (db *DB) ListApps() ([]*models.App, error) {
 }
 
 // UpdateApp updates an existing app
-func (db *DB) UpdateApp(name string, image *string, status *models.AppStatus, bindPort *int) error {
+func (db *DB) UpdateApp(name string, image *string, status *models.AppStatus) error {
 	updates := "updated_at = ?"
 	args := []interface{}{time.Now()}
 
@@ -104,10 +131,6 @@ func (db *DB) UpdateApp(name string, image *string, status *models.AppStatus, bi
 		updates += ", status = ?"
 		args = append(args, *status)
 	}
-	if bindPort != nil {
-		updates += ", bind_port = ?"
-		args = append(args, *bindPort)
-	}
 
 	args = append(args, name)
 	_, err := db.Exec("UPDATE apps SET "+updates+" WHERE name = ?", args...)
@@ -117,6 +140,27 @@ func (db *DB) UpdateApp(name string, image *string, status *models.AppStatus, bi
 	return nil
 }
 
+// SetAppRetention sets how many releases, and how many days of releases,
+// are kept for an app. 0 falls back to the server's retention settings.
+func (db *DB) SetAppRetention(name string, releases, days int) error {
+	_, err := db.Exec("UPDATE apps SET retain_releases = NULLIF(?, 0), retain_days = NULLIF(?, 0), updated_at = ? WHERE name = ?",
+		releases, days, time.Now(), name)
+	if err != nil {
+		return fmt.Errorf("set app retention: %w", err)
+	}
+	return nil
+}
+
+// SwapColor makes color the live slot after a cutover
+func (db *DB) SwapColor(name string, color models.Color) error {
+	_, err := db.Exec("UPDATE apps SET active_color = ?, updated_at = ? WHERE name = ?",
+		color, time.Now(), name)
+	if err != nil {
+		return fmt.Errorf("swap color: %w", err)
+	}
+	return nil
+}
+
 // DeleteApp removes an app
 func (db *DB) DeleteApp(name string) error {
 	result, err := db.Exec("DELETE FROM apps WHERE name = ?", name)
@@ -127,25 +171,11 @@ func (db *DB) DeleteApp(name string) error {
 	if rows == 0 {
 		return fmt.Errorf("app not found: %s", name)
 	}
-	return nil
-}
-
-// AllocatePort finds the next available port
-func (db *DB) AllocatePort(startPort, endPort int) (int, error) {
-	var maxPort sql.NullInt64
-	err := db.QueryRow("SELECT MAX(bind_port) FROM apps WHERE bind_port IS NOT NULL").Scan(&maxPort)
-	if err != nil {
-		return 0, fmt.Errorf("query max port: %w", err)
-	}
-
-	nextPort := startPort
-	if maxPort.Valid && int(maxPort.Int64) >= startPort {
-		nextPort = int(maxPort.Int64) + 1
-	}
 
-	if nextPort > endPort {
-		return 0, fmt.Errorf("no ports available in range %d-%d", startPort, endPort)
+	// Grants aren't tied to apps by a foreign key, since global grants have
+	// no app
+	if _, err := db.Exec("DELETE FROM grants WHERE app_name = ?", name); err != nil {
+		return fmt.Errorf("delete app grants: %w", err)
 	}
-
-	return nextPort, nil
+	return nil
 }
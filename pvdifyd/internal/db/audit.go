@@ -0,0 +1,108 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// CreateAuditEvent appends an event to the audit log. Audit events are
+// never updated or deleted.
+func (db *DB) CreateAuditEvent(event *models.AuditEvent) error {
+	// Stored in UTC so time range filters compare correctly as text
+	event.CreatedAt = time.Now().UTC()
+
+	var details sql.NullString
+	if len(event.Details) > 0 {
+		data, err := json.Marshal(event.Details)
+		if err != nil {
+			return fmt.Errorf("marshal audit details: %w", err)
+		}
+		details = sql.NullString{String: string(data), Valid: true}
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO audit_events (app_name, actor, action, target, details, request_id, remote_addr, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, event.AppName, event.Actor, event.Action, event.Target, details, event.RequestID, event.RemoteAddr, event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert audit event: %w", err)
+	}
+
+	id, _ := result.LastInsertId()
+	event.ID = id
+	return nil
+}
+
+// ListAuditEvents retrieves audit events matching filter, newest first
+func (db *DB) ListAuditEvents(filter models.AuditFilter) ([]*models.AuditEvent, error) {
+	var where []string
+	var args []interface{}
+
+	if filter.AppName != "" {
+		where = append(where, "app_name = ?")
+		args = append(args, filter.AppName)
+	}
+	if filter.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		where = append(where, "(action = ? OR action LIKE ?)")
+		args = append(args, filter.Action, filter.Action+".%")
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.Until.UTC())
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := "SELECT id, app_name, actor, action, target, details, request_id, remote_addr, created_at FROM audit_events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query audit events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*models.AuditEvent
+	for rows.Next() {
+		e := &models.AuditEvent{}
+		var target, details, requestID, remoteAddr sql.NullString
+
+		if err := rows.Scan(&e.ID, &e.AppName, &e.Actor, &e.Action, &target, &details,
+			&requestID, &remoteAddr, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan audit event: %w", err)
+		}
+
+		e.Target = target.String
+		e.RequestID = requestID.String
+		e.RemoteAddr = remoteAddr.String
+		if details.Valid {
+			if err := json.Unmarshal([]byte(details.String), &e.Details); err != nil {
+				return nil, fmt.Errorf("parse audit details: %w", err)
+			}
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
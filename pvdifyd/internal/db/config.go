@@ -2,39 +2,87 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/philoveracity/pvdifyd/internal/models"
 )
 
-// CreateConfigVersion inserts a new config version
+// errNoCipher is returned when config is accessed before SetCipher
+var errNoCipher = errors.New("config encryption key not loaded")
+
+// CreateConfigVersion encrypts data and inserts it as a new config version
 func (db *DB) CreateConfigVersion(appName string, data []byte) (*models.ConfigVar, error) {
-	// Get next version
-	var maxVersion sql.NullInt64
-	err := db.QueryRow("SELECT MAX(version) FROM config_vars WHERE app_name = ?", appName).Scan(&maxVersion)
+	return db.UpdateConfig(appName, func([]byte) ([]byte, error) { return data, nil })
+}
+
+// UpdateConfig passes the data of an app's latest config version (nil if it
+// has none) to update and inserts what it returns as the next version, in
+// one transaction, so concurrent changes can't build on the same version.
+// An error from update is returned as is and nothing is saved.
+func (db *DB) UpdateConfig(appName string, update func(current []byte) ([]byte, error)) (*models.ConfigVar, error) {
+	cfg, err := db.updateVersioned("config_vars", "app_name", appName, update)
 	if err != nil {
-		return nil, fmt.Errorf("query max config version: %w", err)
+		return nil, err
+	}
+	cfg.AppName = appName
+	return cfg, nil
+}
+
+// updateVersioned inserts the next version of owner's config in table,
+// built by update from the latest one, in one transaction
+func (db *DB) updateVersioned(table, ownerColumn, owner string, update func(current []byte) ([]byte, error)) (*models.ConfigVar, error) {
+	if db.cipher == nil {
+		return nil, errNoCipher
 	}
 
-	version := 1
-	if maxVersion.Valid {
-		version = int(maxVersion.Int64) + 1
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
 	}
+	defer tx.Rollback()
 
+	var version int
+	var current []byte
+	err = tx.QueryRow(
+		"SELECT version, data FROM "+table+" WHERE "+ownerColumn+" = ? ORDER BY version DESC LIMIT 1",
+		owner,
+	).Scan(&version, &current)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("query latest config: %w", err)
+	}
+	if current != nil {
+		if current, err = db.cipher.Decrypt(current); err != nil {
+			return nil, fmt.Errorf("decrypt config %s v%d: %w", owner, version, err)
+		}
+	}
+
+	data, err := update(current)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := db.cipher.Encrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt config: %w", err)
+	}
+
+	version++
 	now := time.Now()
-	result, err := db.Exec(`
-		INSERT INTO config_vars (app_name, version, data, created_at)
-		VALUES (?, ?, ?, ?)
-	`, appName, version, data, now)
+	result, err := tx.Exec(
+		"INSERT INTO "+table+" ("+ownerColumn+", version, data, created_at) VALUES (?, ?, ?, ?)",
+		owner, version, encrypted, now,
+	)
 	if err != nil {
 		return nil, fmt.Errorf("insert config: %w", err)
 	}
-
 	id, _ := result.LastInsertId()
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
 	return &models.ConfigVar{
 		ID:        id,
-		AppName:   appName,
 		Version:   version,
 		Data:      data,
 		CreatedAt: now,
@@ -54,7 +102,7 @@ func (db *DB) GetLatestConfig(appName string) (*models.ConfigVar, error) {
 	if err != nil {
 		return nil, fmt.Errorf("query config: %w", err)
 	}
-	return cfg, nil
+	return cfg, db.decryptConfig(cfg)
 }
 
 // GetConfigVersion retrieves a specific config version
@@ -70,5 +118,178 @@ func (db *DB) GetConfigVersion(appName string, version int) (*models.ConfigVar,
 	if err != nil {
 		return nil, fmt.Errorf("query config version: %w", err)
 	}
-	return cfg, nil
+	return cfg, db.decryptConfig(cfg)
+}
+
+// ListConfigVersions retrieves an app's config versions, newest first
+func (db *DB) ListConfigVersions(appName string, limit int) ([]*models.ConfigVar, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+
+	rows, err := db.Query(`
+		SELECT id, app_name, version, data, created_at
+		FROM config_vars WHERE app_name = ? ORDER BY version DESC LIMIT ?
+	`, appName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query config versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []*models.ConfigVar
+	for rows.Next() {
+		cfg := &models.ConfigVar{}
+		if err := rows.Scan(&cfg.ID, &cfg.AppName, &cfg.Version, &cfg.Data, &cfg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan config version: %w", err)
+		}
+		versions = append(versions, cfg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query config versions: %w", err)
+	}
+
+	for _, cfg := range versions {
+		if err := db.decryptConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// ListConfigVersionMeta retrieves every config version of an app, newest
+// first, without its data
+func (db *DB) ListConfigVersionMeta(appName string) ([]*models.ConfigVar, error) {
+	rows, err := db.Query(`
+		SELECT id, app_name, version, created_at
+		FROM config_vars WHERE app_name = ? ORDER BY version DESC
+	`, appName)
+	if err != nil {
+		return nil, fmt.Errorf("query config versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []*models.ConfigVar
+	for rows.Next() {
+		cfg := &models.ConfigVar{}
+		if err := rows.Scan(&cfg.ID, &cfg.AppName, &cfg.Version, &cfg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan config version: %w", err)
+		}
+		versions = append(versions, cfg)
+	}
+	return versions, rows.Err()
+}
+
+// DeleteConfigVersions deletes config versions of an app, for pruning
+func (db *DB) DeleteConfigVersions(appName string, versions []int) error {
+	for _, v := range versions {
+		if _, err := db.Exec("DELETE FROM config_vars WHERE app_name = ? AND version = ?", appName, v); err != nil {
+			return fmt.Errorf("delete config version: %w", err)
+		}
+	}
+	return nil
+}
+
+// decryptConfig replaces a config version's data with its plaintext
+func (db *DB) decryptConfig(cfg *models.ConfigVar) error {
+	if db.cipher == nil {
+		return errNoCipher
+	}
+	data, err := db.cipher.Decrypt(cfg.Data)
+	if err != nil {
+		return fmt.Errorf("decrypt config %s v%d: %w", cfg.Owner(), cfg.Version, err)
+	}
+	cfg.Data = data
+	return nil
+}
+
+// EncryptPlaintextConfig encrypts config versions stored before config was
+// encrypted at rest. Rows that are already encrypted are left alone, so it
+// is safe to run on every start.
+func (db *DB) EncryptPlaintextConfig() (int, error) {
+	if db.cipher == nil {
+		return 0, errNoCipher
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, data FROM config_vars")
+	if err != nil {
+		return 0, fmt.Errorf("query config: %w", err)
+	}
+	plaintext := make(map[int64][]byte)
+	for rows.Next() {
+		var id int64
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan config: %w", err)
+		}
+		if !db.cipher.IsEncrypted(data) {
+			plaintext[id] = data
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("scan config: %w", err)
+	}
+	rows.Close()
+
+	for id, data := range plaintext {
+		encrypted, err := db.cipher.Encrypt(data)
+		if err != nil {
+			return 0, fmt.Errorf("encrypt config %d: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE config_vars SET data = ? WHERE id = ?", encrypted, id); err != nil {
+			return 0, fmt.Errorf("update config %d: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return len(plaintext), nil
+}
+
+// ListEncryptedConfig retrieves every config version of apps and config
+// groups without decrypting it, for key rotation
+func (db *DB) ListEncryptedConfig() ([]*models.ConfigVar, error) {
+	rows, err := db.Query(`
+		SELECT id, app_name, '', version, data, created_at FROM config_vars
+		UNION ALL
+		SELECT id, '', group_name, version, data, created_at FROM config_group_versions
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query config: %w", err)
+	}
+	defer rows.Close()
+
+	var configs []*models.ConfigVar
+	for rows.Next() {
+		cfg := &models.ConfigVar{}
+		if err := rows.Scan(&cfg.ID, &cfg.AppName, &cfg.GroupName, &cfg.Version, &cfg.Data, &cfg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan config: %w", err)
+		}
+		configs = append(configs, cfg)
+	}
+
+	return configs, nil
+}
+
+// UpdateEncryptedConfig replaces the stored ciphertext of a config version
+// listed by ListEncryptedConfig, for key rotation. The plaintext must not
+// change.
+func (db *DB) UpdateEncryptedConfig(cfg *models.ConfigVar, data []byte) error {
+	table := "config_vars"
+	if cfg.GroupName != "" {
+		table = "config_group_versions"
+	}
+	_, err := db.Exec("UPDATE "+table+" SET data = ? WHERE id = ?", data, cfg.ID)
+	if err != nil {
+		return fmt.Errorf("update config %s v%d: %w", cfg.Owner(), cfg.Version, err)
+	}
+	return nil
 }
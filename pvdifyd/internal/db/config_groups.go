@@ -0,0 +1,397 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// CreateConfigGroup inserts a new config group with no config versions
+func (db *DB) CreateConfigGroup(name, createdBy string) (*models.ConfigGroup, error) {
+	group := &models.ConfigGroup{
+		Name:      name,
+		Apps:      []string{},
+		CreatedAt: time.Now(),
+		CreatedBy: createdBy,
+	}
+	_, err := db.Exec("INSERT INTO config_groups (name, created_at, created_by) VALUES (?, ?, ?)",
+		group.Name, group.CreatedAt, group.CreatedBy)
+	if err != nil {
+		return nil, fmt.Errorf("insert config group: %w", err)
+	}
+	return group, nil
+}
+
+// GetConfigGroup retrieves a config group with its latest version and
+// attached apps
+func (db *DB) GetConfigGroup(name string) (*models.ConfigGroup, error) {
+	group := &models.ConfigGroup{}
+	var createdBy sql.NullString
+	err := db.QueryRow(`
+		SELECT g.name, g.created_at, g.created_by,
+			(SELECT COALESCE(MAX(version), 0) FROM config_group_versions v WHERE v.group_name = g.name)
+		FROM config_groups g WHERE g.name = ?
+	`, name).Scan(&group.Name, &group.CreatedAt, &createdBy, &group.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query config group: %w", err)
+	}
+	group.CreatedBy = createdBy.String
+
+	if group.Apps, err = db.ListConfigGroupApps(name); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// ListConfigGroups retrieves all config groups with their latest versions
+// and attached apps
+func (db *DB) ListConfigGroups() ([]*models.ConfigGroup, error) {
+	rows, err := db.Query(`
+		SELECT g.name, g.created_at, g.created_by,
+			(SELECT COALESCE(MAX(version), 0) FROM config_group_versions v WHERE v.group_name = g.name)
+		FROM config_groups g ORDER BY g.name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query config groups: %w", err)
+	}
+
+	var groups []*models.ConfigGroup
+	for rows.Next() {
+		group := &models.ConfigGroup{}
+		var createdBy sql.NullString
+		if err := rows.Scan(&group.Name, &group.CreatedAt, &createdBy, &group.Version); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan config group: %w", err)
+		}
+		group.CreatedBy = createdBy.String
+		groups = append(groups, group)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query config groups: %w", err)
+	}
+
+	for _, group := range groups {
+		if group.Apps, err = db.ListConfigGroupApps(group.Name); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// DeleteConfigGroup deletes a config group and its versions. It fails while
+// the group is attached to an app or pinned by a release.
+func (db *DB) DeleteConfigGroup(name string) error {
+	result, err := db.Exec("DELETE FROM config_groups WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("delete config group: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("config group not found: %s", name)
+	}
+	return nil
+}
+
+// CountConfigGroupReleases counts the releases pinned to a version of a
+// config group
+func (db *DB) CountConfigGroupReleases(name string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM release_config_groups WHERE group_name = ?", name).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count config group releases: %w", err)
+	}
+	return count, nil
+}
+
+// CreateConfigGroupVersion encrypts data and inserts it as a new version of
+// a config group
+func (db *DB) CreateConfigGroupVersion(groupName string, data []byte) (*models.ConfigVar, error) {
+	return db.UpdateConfigGroup(groupName, func([]byte) ([]byte, error) { return data, nil })
+}
+
+// UpdateConfigGroup passes the data of a config group's latest version (nil
+// if it has none) to update and inserts what it returns as the next version,
+// in one transaction, like UpdateConfig
+func (db *DB) UpdateConfigGroup(groupName string, update func(current []byte) ([]byte, error)) (*models.ConfigVar, error) {
+	cfg, err := db.updateVersioned("config_group_versions", "group_name", groupName, update)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GroupName = groupName
+	return cfg, nil
+}
+
+// GetLatestConfigGroupVersion retrieves the latest version of a config group
+func (db *DB) GetLatestConfigGroupVersion(groupName string) (*models.ConfigVar, error) {
+	cfg := &models.ConfigVar{}
+	err := db.QueryRow(`
+		SELECT id, group_name, version, data, created_at
+		FROM config_group_versions WHERE group_name = ? ORDER BY version DESC LIMIT 1
+	`, groupName).Scan(&cfg.ID, &cfg.GroupName, &cfg.Version, &cfg.Data, &cfg.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query config group version: %w", err)
+	}
+	return cfg, db.decryptConfig(cfg)
+}
+
+// GetConfigGroupVersion retrieves a specific version of a config group
+func (db *DB) GetConfigGroupVersion(groupName string, version int) (*models.ConfigVar, error) {
+	cfg := &models.ConfigVar{}
+	err := db.QueryRow(`
+		SELECT id, group_name, version, data, created_at
+		FROM config_group_versions WHERE group_name = ? AND version = ?
+	`, groupName, version).Scan(&cfg.ID, &cfg.GroupName, &cfg.Version, &cfg.Data, &cfg.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query config group version: %w", err)
+	}
+	return cfg, db.decryptConfig(cfg)
+}
+
+// ListConfigGroupVersions retrieves a config group's versions, newest first
+func (db *DB) ListConfigGroupVersions(groupName string, limit int) ([]*models.ConfigVar, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+
+	rows, err := db.Query(`
+		SELECT id, group_name, version, data, created_at
+		FROM config_group_versions WHERE group_name = ? ORDER BY version DESC LIMIT ?
+	`, groupName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query config group versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []*models.ConfigVar
+	for rows.Next() {
+		cfg := &models.ConfigVar{}
+		if err := rows.Scan(&cfg.ID, &cfg.GroupName, &cfg.Version, &cfg.Data, &cfg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan config group version: %w", err)
+		}
+		versions = append(versions, cfg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query config group versions: %w", err)
+	}
+
+	for _, cfg := range versions {
+		if err := db.decryptConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// ListConfigGroupVersionMeta retrieves every version of every config group,
+// newest first within each group, without its data
+func (db *DB) ListConfigGroupVersionMeta() ([]*models.ConfigVar, error) {
+	rows, err := db.Query(`
+		SELECT id, group_name, version, created_at
+		FROM config_group_versions ORDER BY group_name, version DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query config group versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []*models.ConfigVar
+	for rows.Next() {
+		cfg := &models.ConfigVar{}
+		if err := rows.Scan(&cfg.ID, &cfg.GroupName, &cfg.Version, &cfg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan config group version: %w", err)
+		}
+		versions = append(versions, cfg)
+	}
+	return versions, rows.Err()
+}
+
+// ListPinnedConfigGroupVersions retrieves the config group versions pinned
+// by any release
+func (db *DB) ListPinnedConfigGroupVersions() (map[models.ReleaseConfigGroup]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT group_name, group_version FROM release_config_groups")
+	if err != nil {
+		return nil, fmt.Errorf("query pinned config group versions: %w", err)
+	}
+	defer rows.Close()
+
+	pinned := make(map[models.ReleaseConfigGroup]bool)
+	for rows.Next() {
+		var pin models.ReleaseConfigGroup
+		if err := rows.Scan(&pin.Name, &pin.Version); err != nil {
+			return nil, fmt.Errorf("scan pinned config group version: %w", err)
+		}
+		pinned[pin] = true
+	}
+	return pinned, rows.Err()
+}
+
+// DeleteConfigGroupVersion deletes a version of a config group, for pruning
+func (db *DB) DeleteConfigGroupVersion(groupName string, version int) error {
+	_, err := db.Exec("DELETE FROM config_group_versions WHERE group_name = ? AND version = ?", groupName, version)
+	if err != nil {
+		return fmt.Errorf("delete config group version: %w", err)
+	}
+	return nil
+}
+
+// ListConfigGroupApps retrieves the names of the apps a config group is
+// attached to
+func (db *DB) ListConfigGroupApps(groupName string) ([]string, error) {
+	rows, err := db.Query("SELECT app_name FROM app_config_groups WHERE group_name = ? ORDER BY app_name", groupName)
+	if err != nil {
+		return nil, fmt.Errorf("query config group apps: %w", err)
+	}
+	defer rows.Close()
+
+	apps := []string{}
+	for rows.Next() {
+		var app string
+		if err := rows.Scan(&app); err != nil {
+			return nil, fmt.Errorf("scan config group app: %w", err)
+		}
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+// ListAppConfigGroups retrieves the config groups attached to an app, lowest
+// precedence first, with their latest versions
+func (db *DB) ListAppConfigGroups(appName string) ([]*models.ConfigGroupAttachment, error) {
+	rows, err := db.Query(`
+		SELECT app_name, group_name, position, created_at,
+			(SELECT COALESCE(MAX(version), 0) FROM config_group_versions v WHERE v.group_name = a.group_name)
+		FROM app_config_groups a WHERE app_name = ? ORDER BY position
+	`, appName)
+	if err != nil {
+		return nil, fmt.Errorf("query app config groups: %w", err)
+	}
+	defer rows.Close()
+
+	var groups []*models.ConfigGroupAttachment
+	for rows.Next() {
+		a := &models.ConfigGroupAttachment{}
+		if err := rows.Scan(&a.AppName, &a.GroupName, &a.Position, &a.CreatedAt, &a.Version); err != nil {
+			return nil, fmt.Errorf("scan app config group: %w", err)
+		}
+		groups = append(groups, a)
+	}
+	return groups, rows.Err()
+}
+
+// AttachConfigGroup attaches a config group to an app at a 1-based
+// position, or moves it there if it is already attached. Position 0 (or
+// past the end) puts it last, above every other attached group. It returns
+// the position the group ends up at.
+func (db *DB) AttachConfigGroup(appName, groupName string, position int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	order, err := attachedGroups(tx, appName)
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range order {
+		if name == groupName {
+			order = append(order[:i], order[i+1:]...)
+			break
+		}
+	}
+	if position <= 0 || position > len(order) {
+		position = len(order) + 1
+	}
+	order = append(order[:position-1], append([]string{groupName}, order[position-1:]...)...)
+
+	if _, err := tx.Exec(`
+		INSERT INTO app_config_groups (app_name, group_name, position, created_at)
+		VALUES (?, ?, 0, ?)
+		ON CONFLICT(app_name, group_name) DO NOTHING
+	`, appName, groupName, time.Now()); err != nil {
+		return 0, fmt.Errorf("attach config group: %w", err)
+	}
+	if err := renumberGroups(tx, appName, order); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return position, nil
+}
+
+// DetachConfigGroup detaches a config group from an app
+func (db *DB) DetachConfigGroup(appName, groupName string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM app_config_groups WHERE app_name = ? AND group_name = ?", appName, groupName)
+	if err != nil {
+		return fmt.Errorf("detach config group: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("config group not attached: %s", groupName)
+	}
+
+	order, err := attachedGroups(tx, appName)
+	if err != nil {
+		return err
+	}
+	if err := renumberGroups(tx, appName, order); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// attachedGroups returns the names of the groups attached to an app, in
+// position order
+func attachedGroups(tx *sql.Tx, appName string) ([]string, error) {
+	rows, err := tx.Query("SELECT group_name FROM app_config_groups WHERE app_name = ? ORDER BY position", appName)
+	if err != nil {
+		return nil, fmt.Errorf("query app config groups: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("scan app config group: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// renumberGroups sets the positions of an app's attached groups to 1..n in
+// the given order
+func renumberGroups(tx *sql.Tx, appName string, order []string) error {
+	for i, name := range order {
+		if _, err := tx.Exec("UPDATE app_config_groups SET position = ? WHERE app_name = ? AND group_name = ?",
+			i+1, appName, name); err != nil {
+			return fmt.Errorf("update config group position: %w", err)
+		}
+	}
+	return nil
+}
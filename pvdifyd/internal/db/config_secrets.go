@@ -0,0 +1,59 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetConfigSecret marks an app's config var as secret or not secret,
+// overriding the secret key patterns
+func (db *DB) SetConfigSecret(appName, key string, secret bool, createdBy string) error {
+	_, err := db.Exec(`
+		INSERT INTO config_secrets (app_name, key, secret, created_at, created_by)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(app_name, key) DO UPDATE SET
+			secret = excluded.secret,
+			created_at = excluded.created_at,
+			created_by = excluded.created_by
+	`, appName, key, secret, time.Now(), createdBy)
+	if err != nil {
+		return fmt.Errorf("set config secret: %w", err)
+	}
+	return nil
+}
+
+// ListConfigSecrets retrieves the keys of an app explicitly marked secret
+// (true) or not secret (false)
+func (db *DB) ListConfigSecrets(appName string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT key, secret FROM config_secrets WHERE app_name = ?", appName)
+	if err != nil {
+		return nil, fmt.Errorf("query config secrets: %w", err)
+	}
+	defer rows.Close()
+
+	flags := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		var secret bool
+		if err := rows.Scan(&key, &secret); err != nil {
+			return nil, fmt.Errorf("scan config secret: %w", err)
+		}
+		flags[key] = secret
+	}
+	return flags, rows.Err()
+}
+
+// DeleteConfigSecret removes the explicit marking of a config var, so the
+// secret key patterns apply to it again
+func (db *DB) DeleteConfigSecret(appName, key string) error {
+	result, err := db.Exec("DELETE FROM config_secrets WHERE app_name = ? AND key = ?", appName, key)
+	if err != nil {
+		return fmt.Errorf("delete config secret: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("config secret not found: %s", key)
+	}
+	return nil
+}
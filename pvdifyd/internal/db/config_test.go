@@ -0,0 +1,167 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/secrets"
+)
+
+// newTestDB returns a migrated database in a temporary directory, with
+// config encrypted by a fresh key
+func newTestDB(t *testing.T) (*DB, *secrets.Keyring) {
+	t.Helper()
+	db, err := New(filepath.Join(t.TempDir(), "pvdify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := secrets.NewKeyring(identity)
+	db.SetCipher(keyring)
+	return db, keyring
+}
+
+func createTestApp(t *testing.T, db *DB, name string) {
+	t.Helper()
+	if err := db.CreateApp(&models.App{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateConfigConcurrent(t *testing.T) {
+	db, _ := newTestDB(t)
+	createTestApp(t, db, "shop")
+
+	// Every update appends its own line to the latest version; none may be
+	// lost, and none may fail on a version another update took
+	const updates = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, updates)
+	for i := range updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.UpdateConfig("shop", func(current []byte) ([]byte, error) {
+				return fmt.Appendf(current, "KEY_%d: v\n", i), nil
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	latest, err := db.GetLatestConfig("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version != updates {
+		t.Errorf("latest version = %d, want %d", latest.Version, updates)
+	}
+	for i := range updates {
+		if !strings.Contains(string(latest.Data), fmt.Sprintf("KEY_%d: v\n", i)) {
+			t.Errorf("KEY_%d lost", i)
+		}
+	}
+}
+
+func TestUpdateConfigError(t *testing.T) {
+	db, _ := newTestDB(t)
+	createTestApp(t, db, "shop")
+
+	if _, err := db.CreateConfigVersion("shop", []byte("A: one\n")); err != nil {
+		t.Fatal(err)
+	}
+	failed := fmt.Errorf("no change")
+	_, err := db.UpdateConfig("shop", func([]byte) ([]byte, error) { return nil, failed })
+	if err != failed {
+		t.Errorf("UpdateConfig error = %v, want the update's", err)
+	}
+
+	latest, err := db.GetLatestConfig("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version != 1 || string(latest.Data) != "A: one\n" {
+		t.Errorf("latest = v%d %q, want v1 unchanged", latest.Version, latest.Data)
+	}
+}
+
+func TestEncryptPlaintextConfig(t *testing.T) {
+	db, keyring := newTestDB(t)
+	createTestApp(t, db, "shop")
+
+	// Versions stored before encryption at rest, next to one stored since
+	three, err := keyring.Encrypt([]byte("A: three\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, data := range map[int][]byte{1: []byte("A: one\n"), 2: []byte("A: two\n"), 3: three} {
+		if _, err := db.Exec("INSERT INTO config_vars (app_name, version, data, created_at) VALUES ('shop', ?, ?, CURRENT_TIMESTAMP)", v, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func(version int) []byte {
+		t.Helper()
+		var data []byte
+		if err := db.QueryRow("SELECT data FROM config_vars WHERE app_name = 'shop' AND version = ?", version).Scan(&data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	encrypted := stored(3)
+
+	n, err := db.EncryptPlaintextConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("encrypted %d versions, want 2", n)
+	}
+	for v, want := range map[int]string{1: "A: one\n", 2: "A: two\n", 3: "A: three\n"} {
+		if data := stored(v); !keyring.IsEncrypted(data) {
+			t.Errorf("v%d still stored in plaintext", v)
+		}
+		cfg, err := db.GetConfigVersion("shop", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(cfg.Data) != want {
+			t.Errorf("v%d = %q, want %q", v, cfg.Data, want)
+		}
+	}
+	if !bytes.Equal(stored(3), encrypted) {
+		t.Error("an already encrypted version was rewritten")
+	}
+
+	// The next start finds nothing to do
+	migrated := stored(1)
+	n, err = db.EncryptPlaintextConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("second run encrypted %d versions, want 0", n)
+	}
+	if !bytes.Equal(stored(1), migrated) {
+		t.Error("second run rewrote a migrated version")
+	}
+}
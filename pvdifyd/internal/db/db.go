@@ -12,6 +12,14 @@ import (
 // DB wraps the SQLite database connection
 type DB struct {
 	*sql.DB
+	cipher Cipher
+}
+
+// Cipher encrypts config data at rest
+type Cipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+	IsEncrypted(data []byte) bool
 }
 
 // New creates a new database connection
@@ -22,7 +30,9 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("create db directory: %w", err)
 	}
 
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=on")
+	// Transactions take the write lock when they begin, so two that read
+	// and then write wait for each other instead of failing with SQLITE_BUSY
+	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=on&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -32,7 +42,13 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("ping database: %w", err)
 	}
 
-	return &DB{db}, nil
+	return &DB{DB: db}, nil
+}
+
+// SetCipher sets the cipher config versions are encrypted with. Config
+// can't be read or written until one is set.
+func (db *DB) SetCipher(c Cipher) {
+	db.cipher = c
 }
 
 // Close closes the database connection
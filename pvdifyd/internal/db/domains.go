@@ -101,3 +101,35 @@ func (db *DB) DeleteDomain(domain string) error {
 	}
 	return nil
 }
+
+// ListRoutes returns the host ports of the live slot's web instances behind
+// every domain, in instance order. Domains of apps that have never gone
+// live are left out.
+func (db *DB) ListRoutes() (map[string][]int, error) {
+	rows, err := db.Query(`
+		SELECT d.domain, pa.port
+		FROM domains d
+		JOIN apps a ON a.name = d.app_name
+		JOIN processes p ON p.app_name = a.name AND p.name = 'web'
+		JOIN port_allocations pa ON pa.app_name = a.name
+			AND pa.color = COALESCE(a.active_color, '') AND pa.instance <= p.count
+		WHERE COALESCE(a.active_color, '') != ''
+			OR EXISTS (SELECT 1 FROM releases r WHERE r.app_name = a.name AND r.status = ?)
+		ORDER BY d.domain, pa.instance
+	`, models.ReleaseStatusActive)
+	if err != nil {
+		return nil, fmt.Errorf("query routes: %w", err)
+	}
+	defer rows.Close()
+
+	routes := make(map[string][]int)
+	for rows.Next() {
+		var domain string
+		var port int
+		if err := rows.Scan(&domain, &port); err != nil {
+			return nil, fmt.Errorf("scan route: %w", err)
+		}
+		routes[domain] = append(routes[domain], port)
+	}
+	return routes, rows.Err()
+}
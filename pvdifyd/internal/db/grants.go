@@ -0,0 +1,83 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+const grantColumns = "id, subject, role, app_name, created_at, created_by"
+
+// PutGrant grants a role to a subject, replacing any role it already has
+// in the same scope
+func (db *DB) PutGrant(grant *models.Grant) error {
+	grant.CreatedAt = time.Now()
+
+	_, err := db.Exec(`
+		INSERT INTO grants (subject, role, app_name, created_at, created_by)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(subject, app_name) DO UPDATE SET
+			role = excluded.role,
+			created_at = excluded.created_at,
+			created_by = excluded.created_by
+	`, grant.Subject, grant.Role, grant.AppName, grant.CreatedAt, grant.CreatedBy)
+	if err != nil {
+		return fmt.Errorf("put grant: %w", err)
+	}
+
+	return db.QueryRow("SELECT id FROM grants WHERE subject = ? AND app_name = ?",
+		grant.Subject, grant.AppName).Scan(&grant.ID)
+}
+
+// ListGrants retrieves the grants on an app, or the global grants if
+// appName is empty
+func (db *DB) ListGrants(appName string) ([]*models.Grant, error) {
+	return db.queryGrants("SELECT "+grantColumns+" FROM grants WHERE app_name = ? ORDER BY subject", appName)
+}
+
+// ListSubjectGrants retrieves every grant held by a subject
+func (db *DB) ListSubjectGrants(subject string) ([]*models.Grant, error) {
+	return db.queryGrants("SELECT "+grantColumns+" FROM grants WHERE subject = ? ORDER BY app_name", subject)
+}
+
+// DeleteGrant revokes a subject's role in a scope
+func (db *DB) DeleteGrant(subject, appName string) error {
+	result, err := db.Exec("DELETE FROM grants WHERE subject = ? AND app_name = ?", subject, appName)
+	if err != nil {
+		return fmt.Errorf("delete grant: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("grant not found: %s", subject)
+	}
+	return nil
+}
+
+func (db *DB) queryGrants(query string, args ...interface{}) ([]*models.Grant, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query grants: %w", err)
+	}
+	defer rows.Close()
+
+	var grants []*models.Grant
+	for rows.Next() {
+		g := &models.Grant{}
+		var createdBy sql.NullString
+
+		if err := rows.Scan(&g.ID, &g.Subject, &g.Role, &g.AppName, &g.CreatedAt, &createdBy); err != nil {
+			return nil, fmt.Errorf("scan grant: %w", err)
+		}
+
+		if createdBy.Valid {
+			g.CreatedBy = createdBy.String
+		}
+
+		grants = append(grants, g)
+	}
+
+	return grants, nil
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// CreateJob inserts a new pending job
+func (db *DB) CreateJob(job *models.Job) error {
+	job.CreatedAt = time.Now()
+	if job.Status == "" {
+		job.Status = models.JobStatusPending
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO jobs (app_name, kind, release_version, status, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, job.AppName, job.Kind, job.ReleaseVersion, job.Status, job.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert job: %w", err)
+	}
+
+	id, _ := result.LastInsertId()
+	job.ID = id
+	job.Steps = []*models.JobStep{}
+	return nil
+}
+
+// GetJob retrieves a job and its steps
+func (db *DB) GetJob(appName string, id int64) (*models.Job, error) {
+	job := &models.Job{}
+	var releaseVersion sql.NullInt64
+	var jobErr sql.NullString
+	var startedAt, finishedAt sql.NullTime
+
+	err := db.QueryRow(`
+		SELECT id, app_name, kind, release_version, status, error, created_at, started_at, finished_at
+		FROM jobs WHERE app_name = ? AND id = ?
+	`, appName, id).Scan(&job.ID, &job.AppName, &job.Kind, &releaseVersion, &job.Status, &jobErr,
+		&job.CreatedAt, &startedAt, &finishedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query job: %w", err)
+	}
+
+	if releaseVersion.Valid {
+		job.ReleaseVersion = int(releaseVersion.Int64)
+	}
+	if jobErr.Valid {
+		job.Error = jobErr.String
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+
+	steps, err := db.listJobSteps(job.ID)
+	if err != nil {
+		return nil, err
+	}
+	job.Steps = steps
+
+	return job, nil
+}
+
+// ListJobs retrieves the most recent jobs for an app, without steps
+func (db *DB) ListJobs(appName string, limit int) ([]*models.Job, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+
+	rows, err := db.Query(`
+		SELECT id, app_name, kind, release_version, status, error, created_at, started_at, finished_at
+		FROM jobs WHERE app_name = ? ORDER BY id DESC LIMIT ?
+	`, appName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*models.Job
+	for rows.Next() {
+		job := &models.Job{}
+		var releaseVersion sql.NullInt64
+		var jobErr sql.NullString
+		var startedAt, finishedAt sql.NullTime
+
+		if err := rows.Scan(&job.ID, &job.AppName, &job.Kind, &releaseVersion, &job.Status, &jobErr,
+			&job.CreatedAt, &startedAt, &finishedAt); err != nil {
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+
+		if releaseVersion.Valid {
+			job.ReleaseVersion = int(releaseVersion.Int64)
+		}
+		if jobErr.Valid {
+			job.Error = jobErr.String
+		}
+		if startedAt.Valid {
+			job.StartedAt = &startedAt.Time
+		}
+		if finishedAt.Valid {
+			job.FinishedAt = &finishedAt.Time
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// StartJob marks a job as running
+func (db *DB) StartJob(id int64) error {
+	_, err := db.Exec("UPDATE jobs SET status = ?, started_at = ? WHERE id = ?",
+		models.JobStatusRunning, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("start job: %w", err)
+	}
+	return nil
+}
+
+// FinishJob marks a job as succeeded, or failed if jobErr is non-nil
+func (db *DB) FinishJob(id int64, jobErr error) error {
+	status := models.JobStatusSucceeded
+	var message sql.NullString
+	if jobErr != nil {
+		status = models.JobStatusFailed
+		message = sql.NullString{String: jobErr.Error(), Valid: true}
+	}
+
+	_, err := db.Exec("UPDATE jobs SET status = ?, error = ?, finished_at = ? WHERE id = ?",
+		status, message, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("finish job: %w", err)
+	}
+	return nil
+}
+
+// FailInterruptedJobs marks jobs left unfinished by a previous daemon
+// process as failed
+func (db *DB) FailInterruptedJobs() (int64, error) {
+	now := time.Now()
+	const reason = "interrupted by daemon restart"
+
+	if _, err := db.Exec("UPDATE job_steps SET status = ?, error = ?, finished_at = ? WHERE status = ?",
+		models.JobStatusFailed, reason, now, models.JobStatusRunning); err != nil {
+		return 0, fmt.Errorf("fail interrupted job steps: %w", err)
+	}
+
+	result, err := db.Exec("UPDATE jobs SET status = ?, error = ?, finished_at = ? WHERE status IN (?, ?)",
+		models.JobStatusFailed, reason, now, models.JobStatusPending, models.JobStatusRunning)
+	if err != nil {
+		return 0, fmt.Errorf("fail interrupted jobs: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	return rows, nil
+}
+
+// StartJobStep records the start of a job step
+func (db *DB) StartJobStep(jobID int64, name string) (*models.JobStep, error) {
+	step := &models.JobStep{
+		JobID:     jobID,
+		Name:      name,
+		Status:    models.JobStatusRunning,
+		StartedAt: time.Now(),
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO job_steps (job_id, name, status, started_at)
+		VALUES (?, ?, ?, ?)
+	`, step.JobID, step.Name, step.Status, step.StartedAt)
+	if err != nil {
+		return nil, fmt.Errorf("insert job step: %w", err)
+	}
+
+	id, _ := result.LastInsertId()
+	step.ID = id
+	return step, nil
+}
+
+// FinishJobStep marks a step as succeeded, or failed if stepErr is non-nil
+func (db *DB) FinishJobStep(id int64, stepErr error) error {
+	status := models.JobStatusSucceeded
+	var message sql.NullString
+	if stepErr != nil {
+		status = models.JobStatusFailed
+		message = sql.NullString{String: stepErr.Error(), Valid: true}
+	}
+
+	_, err := db.Exec("UPDATE job_steps SET status = ?, error = ?, finished_at = ? WHERE id = ?",
+		status, message, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("finish job step: %w", err)
+	}
+	return nil
+}
+
+// listJobSteps retrieves the steps of a job in order
+func (db *DB) listJobSteps(jobID int64) ([]*models.JobStep, error) {
+	rows, err := db.Query(`
+		SELECT id, job_id, name, status, error, started_at, finished_at
+		FROM job_steps WHERE job_id = ? ORDER BY id
+	`, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("query job steps: %w", err)
+	}
+	defer rows.Close()
+
+	steps := []*models.JobStep{}
+	for rows.Next() {
+		step := &models.JobStep{}
+		var stepErr sql.NullString
+		var finishedAt sql.NullTime
+
+		if err := rows.Scan(&step.ID, &step.JobID, &step.Name, &step.Status, &stepErr,
+			&step.StartedAt, &finishedAt); err != nil {
+			return nil, fmt.Errorf("scan job step: %w", err)
+		}
+
+		if stepErr.Valid {
+			step.Error = stepErr.String
+		}
+		if finishedAt.Valid {
+			step.FinishedAt = &finishedAt.Time
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
@@ -103,4 +103,184 @@ var migrations = []string{
 	CREATE INDEX IF NOT EXISTS idx_config_vars_app_name ON config_vars(app_name);
 	CREATE INDEX IF NOT EXISTS idx_processes_app_name ON processes(app_name);
 	`,
+	// Migration 2: Background jobs
+	`
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		app_name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		release_version INTEGER,
+		status TEXT NOT NULL DEFAULT 'pending',
+		error TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		started_at DATETIME,
+		finished_at DATETIME,
+		FOREIGN KEY (app_name) REFERENCES apps(name) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS job_steps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'running',
+		error TEXT,
+		started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		finished_at DATETIME,
+		FOREIGN KEY (job_id) REFERENCES jobs(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_jobs_app_name ON jobs(app_name);
+	CREATE INDEX IF NOT EXISTS idx_job_steps_job_id ON job_steps(job_id);
+	`,
+	// Migration 3: Blue/green slots
+	`
+	ALTER TABLE apps ADD COLUMN standby_port INTEGER;
+	ALTER TABLE apps ADD COLUMN active_color TEXT;
+	`,
+	// Migration 4: Release failure reasons
+	`
+	ALTER TABLE releases ADD COLUMN failure_reason TEXT;
+	`,
+	// Migration 5: API tokens
+	`
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME
+	);
+	`,
+	// Migration 6: Role grants
+	`
+	CREATE TABLE IF NOT EXISTS grants (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		subject TEXT NOT NULL,
+		role TEXT NOT NULL,
+		app_name TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		created_by TEXT,
+		UNIQUE(subject, app_name)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_grants_app_name ON grants(app_name);
+	`,
+	// Migration 7: Audit log
+	`
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		app_name TEXT NOT NULL DEFAULT '',
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT,
+		details TEXT,
+		request_id TEXT,
+		remote_addr TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_audit_events_app_name ON audit_events(app_name);
+	CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+	`,
+	// Migration 8: Explicit config var sensitivity
+	`
+	CREATE TABLE IF NOT EXISTS config_secrets (
+		app_name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		secret INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		created_by TEXT,
+		PRIMARY KEY (app_name, key),
+		FOREIGN KEY (app_name) REFERENCES apps(name) ON DELETE CASCADE
+	);
+	`,
+	// Migration 9: Shared config groups
+	`
+	CREATE TABLE IF NOT EXISTS config_groups (
+		name TEXT PRIMARY KEY,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		created_by TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS config_group_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(group_name, version),
+		FOREIGN KEY (group_name) REFERENCES config_groups(name) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS app_config_groups (
+		app_name TEXT NOT NULL,
+		group_name TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (app_name, group_name),
+		FOREIGN KEY (app_name) REFERENCES apps(name) ON DELETE CASCADE,
+		FOREIGN KEY (group_name) REFERENCES config_groups(name)
+	);
+
+	CREATE TABLE IF NOT EXISTS release_config_groups (
+		release_id INTEGER NOT NULL,
+		group_name TEXT NOT NULL,
+		group_version INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (release_id, group_name),
+		FOREIGN KEY (release_id) REFERENCES releases(id) ON DELETE CASCADE,
+		FOREIGN KEY (group_name) REFERENCES config_groups(name)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_app_config_groups_group_name ON app_config_groups(group_name);
+	`,
+	// Migration 10: Per-app retention
+	`
+	ALTER TABLE apps ADD COLUMN retain_releases INTEGER;
+	ALTER TABLE apps ADD COLUMN retain_days INTEGER;
+	`,
+	// Migration 11: Image digests of releases
+	`
+	ALTER TABLE releases ADD COLUMN image_digest TEXT;
+	`,
+	// Migration 12: Process commands pinned by releases
+	`
+	CREATE TABLE IF NOT EXISTS release_processes (
+		release_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		command TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (release_id, name),
+		FOREIGN KEY (release_id) REFERENCES releases(id) ON DELETE CASCADE
+	);
+	`,
+	// Migration 13: Per-process limits and health checks, as JSON
+	`
+	ALTER TABLE processes ADD COLUMN resources TEXT;
+	ALTER TABLE processes ADD COLUMN healthcheck TEXT;
+	`,
+	// Migration 14: A host port per web instance and slot, replacing
+	// apps.bind_port and apps.standby_port, which are no longer used
+	`
+	CREATE TABLE IF NOT EXISTS port_allocations (
+		port INTEGER PRIMARY KEY,
+		app_name TEXT NOT NULL,
+		color TEXT NOT NULL DEFAULT '',
+		instance INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (app_name, color, instance),
+		FOREIGN KEY (app_name) REFERENCES apps(name) ON DELETE CASCADE
+	);
+
+	INSERT OR IGNORE INTO port_allocations (port, app_name, color, instance)
+		SELECT bind_port, name, COALESCE(active_color, ''), 1 FROM apps WHERE bind_port IS NOT NULL;
+	INSERT OR IGNORE INTO port_allocations (port, app_name, color, instance)
+		SELECT standby_port, name, CASE active_color WHEN 'blue' THEN 'green' ELSE 'blue' END, 1
+		FROM apps WHERE standby_port IS NOT NULL;
+	`,
+
+	// Migration 15: How long each process type's instances get to exit
+	// when stopped
+	`
+	ALTER TABLE processes ADD COLUMN stop_timeout TEXT;
+	`,
 }
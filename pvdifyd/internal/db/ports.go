@@ -0,0 +1,119 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// AllocatePort returns the host port of an instance of an app's web process
+// in a slot. The first time, it allocates the lowest port in start..end no
+// instance of any app holds.
+func (db *DB) AllocatePort(appName string, color models.Color, instance, start, end int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	var port int
+	err = tx.QueryRow(`
+		SELECT port FROM port_allocations WHERE app_name = ? AND color = ? AND instance = ?
+	`, appName, color, instance).Scan(&port)
+	if err == nil {
+		return port, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("query port: %w", err)
+	}
+
+	rows, err := tx.Query(`
+		SELECT port FROM port_allocations WHERE port BETWEEN ? AND ? ORDER BY port
+	`, start, end)
+	if err != nil {
+		return 0, fmt.Errorf("query ports: %w", err)
+	}
+	port = start
+	for rows.Next() {
+		var taken int
+		if err := rows.Scan(&taken); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan port: %w", err)
+		}
+		if taken != port {
+			break
+		}
+		port++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("query ports: %w", err)
+	}
+	if port > end {
+		return 0, fmt.Errorf("no ports available in range %d-%d", start, end)
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO port_allocations (port, app_name, color, instance) VALUES (?, ?, ?, ?)
+	`, port, appName, color, instance); err != nil {
+		return 0, fmt.Errorf("insert port allocation: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return port, nil
+}
+
+// InstancePorts returns the ports held by an app's web instances in a slot,
+// by instance
+func (db *DB) InstancePorts(appName string, color models.Color) (map[int]int, error) {
+	rows, err := db.Query(`
+		SELECT instance, port FROM port_allocations WHERE app_name = ? AND color = ?
+	`, appName, color)
+	if err != nil {
+		return nil, fmt.Errorf("query ports: %w", err)
+	}
+	defer rows.Close()
+
+	ports := make(map[int]int)
+	for rows.Next() {
+		var instance, port int
+		if err := rows.Scan(&instance, &port); err != nil {
+			return nil, fmt.Errorf("scan port: %w", err)
+		}
+		ports[instance] = port
+	}
+	return ports, rows.Err()
+}
+
+// ReleasePorts frees the ports of an app's web instances in a slot above
+// instance keep, and returns the instances that held one
+func (db *DB) ReleasePorts(appName string, color models.Color, keep int) ([]int, error) {
+	rows, err := db.Query(`
+		SELECT instance FROM port_allocations WHERE app_name = ? AND color = ? AND instance > ? ORDER BY instance
+	`, appName, color, keep)
+	if err != nil {
+		return nil, fmt.Errorf("query ports: %w", err)
+	}
+	var instances []int
+	for rows.Next() {
+		var instance int
+		if err := rows.Scan(&instance); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan port: %w", err)
+		}
+		instances = append(instances, instance)
+	}
+	rows.Close()
+	if len(instances) == 0 {
+		return nil, rows.Err()
+	}
+
+	if _, err := db.Exec(`
+		DELETE FROM port_allocations WHERE app_name = ? AND color = ? AND instance > ?
+	`, appName, color, keep); err != nil {
+		return nil, fmt.Errorf("release ports: %w", err)
+	}
+	return instances, nil
+}
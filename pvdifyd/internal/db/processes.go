@@ -2,11 +2,46 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 
 	"github.com/philoveracity/pvdifyd/internal/models"
 )
 
+// processColumns are the columns scanProcess reads
+const processColumns = "id, app_name, name, command, count, resources, healthcheck, stop_timeout"
+
+// scanProcess reads a process row selected with processColumns
+func scanProcess(row interface{ Scan(...interface{}) error }) (*models.Process, error) {
+	p := &models.Process{}
+	var command, resources, healthcheck, stopTimeout sql.NullString
+
+	if err := row.Scan(&p.ID, &p.AppName, &p.Name, &command, &p.Count, &resources, &healthcheck, &stopTimeout); err != nil {
+		return nil, err
+	}
+
+	if command.Valid {
+		p.Command = command.String
+	}
+	if stopTimeout.Valid {
+		p.StopTimeout = stopTimeout.String
+	}
+	if resources.Valid {
+		p.Resources = &models.ResourceLimits{}
+		if err := json.Unmarshal([]byte(resources.String), p.Resources); err != nil {
+			return nil, fmt.Errorf("unmarshal resources of %s: %w", p.Name, err)
+		}
+	}
+	if healthcheck.Valid {
+		p.Healthcheck = &models.HealthcheckConfig{}
+		if err := json.Unmarshal([]byte(healthcheck.String), p.Healthcheck); err != nil {
+			return nil, fmt.Errorf("unmarshal healthcheck of %s: %w", p.Name, err)
+		}
+	}
+
+	return p, nil
+}
+
 // UpsertProcess creates or updates a process definition
 func (db *DB) UpsertProcess(process *models.Process) error {
 	_, err := db.Exec(`
@@ -24,13 +59,10 @@ func (db *DB) UpsertProcess(process *models.Process) error {
 
 // GetProcess retrieves a process by app name and process name
 func (db *DB) GetProcess(appName, name string) (*models.Process, error) {
-	p := &models.Process{}
-	var command sql.NullString
-
-	err := db.QueryRow(`
-		SELECT id, app_name, name, command, count
+	p, err := scanProcess(db.QueryRow(`
+		SELECT `+processColumns+`
 		FROM processes WHERE app_name = ? AND name = ?
-	`, appName, name).Scan(&p.ID, &p.AppName, &p.Name, &command, &p.Count)
+	`, appName, name))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -38,17 +70,13 @@ func (db *DB) GetProcess(appName, name string) (*models.Process, error) {
 		return nil, fmt.Errorf("query process: %w", err)
 	}
 
-	if command.Valid {
-		p.Command = command.String
-	}
-
 	return p, nil
 }
 
 // ListProcesses retrieves all processes for an app
 func (db *DB) ListProcesses(appName string) ([]*models.Process, error) {
 	rows, err := db.Query(`
-		SELECT id, app_name, name, command, count
+		SELECT `+processColumns+`
 		FROM processes WHERE app_name = ? ORDER BY name
 	`, appName)
 	if err != nil {
@@ -58,24 +86,17 @@ func (db *DB) ListProcesses(appName string) ([]*models.Process, error) {
 
 	var processes []*models.Process
 	for rows.Next() {
-		p := &models.Process{}
-		var command sql.NullString
-
-		if err := rows.Scan(&p.ID, &p.AppName, &p.Name, &command, &p.Count); err != nil {
+		p, err := scanProcess(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan process: %w", err)
 		}
-
-		if command.Valid {
-			p.Command = command.String
-		}
-
 		processes = append(processes, p)
 	}
 
 	return processes, nil
 }
 
-// ScaleProcess updates the count for a process
+// ScaleProcess updates the count for a process type, which must exist
 func (db *DB) ScaleProcess(appName, name string, count int) error {
 	result, err := db.Exec("UPDATE processes SET count = ? WHERE app_name = ? AND name = ?",
 		count, appName, name)
@@ -84,16 +105,97 @@ func (db *DB) ScaleProcess(appName, name string, count int) error {
 	}
 	rows, _ := result.RowsAffected()
 	if rows == 0 {
-		// Create new process with default command
-		return db.UpsertProcess(&models.Process{
-			AppName: appName,
-			Name:    name,
-			Count:   count,
-		})
+		return fmt.Errorf("scale process: no process type %s", name)
 	}
 	return nil
 }
 
+// SetProcessLimits sets the resource limits, health check and stop timeout
+// of a process type, which must exist. Nil and empty clear them.
+func (db *DB) SetProcessLimits(appName, name string, resources *models.ResourceLimits, healthcheck *models.HealthcheckConfig, stopTimeout string) error {
+	var resourcesJSON, healthcheckJSON sql.NullString
+	if resources != nil {
+		data, err := json.Marshal(resources)
+		if err != nil {
+			return fmt.Errorf("marshal resources: %w", err)
+		}
+		resourcesJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	if healthcheck != nil {
+		data, err := json.Marshal(healthcheck)
+		if err != nil {
+			return fmt.Errorf("marshal healthcheck: %w", err)
+		}
+		healthcheckJSON = sql.NullString{String: string(data), Valid: true}
+	}
+
+	result, err := db.Exec("UPDATE processes SET resources = ?, healthcheck = ?, stop_timeout = ? WHERE app_name = ? AND name = ?",
+		resourcesJSON, healthcheckJSON, sql.NullString{String: stopTimeout, Valid: stopTimeout != ""}, appName, name)
+	if err != nil {
+		return fmt.Errorf("set process limits: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("set process limits: no process type %s", name)
+	}
+	return nil
+}
+
+// SetFormation replaces an app's process types with processes, keeping the
+// IDs, limits, health checks and stop timeouts of types that remain, and
+// returns the types it removed
+func (db *DB) SetFormation(appName string, processes []*models.Process) ([]*models.Process, error) {
+	current, err := db.ListProcesses(appName)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	removed, err := setFormation(tx, appName, current, processes)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return removed, nil
+}
+
+// setFormation replaces the current process types of an app with
+// processes in tx
+func setFormation(tx *sql.Tx, appName string, current, processes []*models.Process) ([]*models.Process, error) {
+	keep := make(map[string]bool, len(processes))
+	for _, p := range processes {
+		keep[p.Name] = true
+		if _, err := tx.Exec(`
+			INSERT INTO processes (app_name, name, command, count)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(app_name, name) DO UPDATE SET
+				command = excluded.command,
+				count = excluded.count
+		`, appName, p.Name, p.Command, p.Count); err != nil {
+			return nil, fmt.Errorf("upsert process: %w", err)
+		}
+	}
+
+	var removed []*models.Process
+	for _, p := range current {
+		if keep[p.Name] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM processes WHERE app_name = ? AND name = ?", appName, p.Name); err != nil {
+			return nil, fmt.Errorf("delete process: %w", err)
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
+
 // DeleteProcess removes a process
 func (db *DB) DeleteProcess(appName, name string) error {
 	_, err := db.Exec("DELETE FROM processes WHERE app_name = ? AND name = ?", appName, name)
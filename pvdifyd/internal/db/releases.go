@@ -8,11 +8,87 @@ import (
 	"github.com/philoveracity/pvdifyd/internal/models"
 )
 
-// CreateRelease inserts a new release
+// releaseColumns lists the columns read by scanRelease
+const releaseColumns = "id, app_name, version, image, image_digest, config_version, status, failure_reason, created_at, created_by"
+
+// scanRelease reads a release row selected with releaseColumns
+func scanRelease(row interface{ Scan(...interface{}) error }) (*models.Release, error) {
+	release := &models.Release{}
+	var configVersion sql.NullInt64
+	var imageDigest, failureReason, createdBy sql.NullString
+
+	if err := row.Scan(&release.ID, &release.AppName, &release.Version, &release.Image, &imageDigest,
+		&configVersion, &release.Status, &failureReason, &release.CreatedAt, &createdBy); err != nil {
+		return nil, err
+	}
+
+	if imageDigest.Valid {
+		release.ImageDigest = imageDigest.String
+	}
+	if configVersion.Valid {
+		release.ConfigVersion = int(configVersion.Int64)
+	}
+	if failureReason.Valid {
+		release.FailureReason = failureReason.String
+	}
+	if createdBy.Valid {
+		release.CreatedBy = createdBy.String
+	}
+
+	return release, nil
+}
+
+// CreateRelease inserts a new release with its config group and process
+// pins
 func (db *DB) CreateRelease(release *models.Release) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := createRelease(tx, release); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// CreateReleaseWithFormation inserts a new release and, in the same
+// transaction, replaces the app's process types with processes as
+// SetFormation does, returning the types it removed
+func (db *DB) CreateReleaseWithFormation(release *models.Release, processes []*models.Process) ([]*models.Process, error) {
+	current, err := db.ListProcesses(release.AppName)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	removed, err := setFormation(tx, release.AppName, current, processes)
+	if err != nil {
+		return nil, err
+	}
+	if err := createRelease(tx, release); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return removed, nil
+}
+
+// createRelease inserts release in tx, setting its ID and version
+func createRelease(tx *sql.Tx, release *models.Release) error {
 	// Get next version
 	var maxVersion sql.NullInt64
-	err := db.QueryRow("SELECT MAX(version) FROM releases WHERE app_name = ?", release.AppName).Scan(&maxVersion)
+	err := tx.QueryRow("SELECT MAX(version) FROM releases WHERE app_name = ?", release.AppName).Scan(&maxVersion)
 	if err != nil {
 		return fmt.Errorf("query max version: %w", err)
 	}
@@ -26,113 +102,176 @@ func (db *DB) CreateRelease(release *models.Release) error {
 		release.Status = models.ReleaseStatusPending
 	}
 
-	result, err := db.Exec(`
-		INSERT INTO releases (app_name, version, image, config_version, status, created_at, created_by)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, release.AppName, release.Version, release.Image, release.ConfigVersion, release.Status, release.CreatedAt, release.CreatedBy)
+	result, err := tx.Exec(`
+		INSERT INTO releases (app_name, version, image, image_digest, config_version, status, created_at, created_by)
+		VALUES (?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?)
+	`, release.AppName, release.Version, release.Image, release.ImageDigest, release.ConfigVersion, release.Status, release.CreatedAt, release.CreatedBy)
 	if err != nil {
 		return fmt.Errorf("insert release: %w", err)
 	}
-
 	id, _ := result.LastInsertId()
+
+	for i, group := range release.ConfigGroups {
+		if _, err := tx.Exec(`
+			INSERT INTO release_config_groups (release_id, group_name, group_version, position)
+			VALUES (?, ?, ?, ?)
+		`, id, group.Name, group.Version, i+1); err != nil {
+			return fmt.Errorf("insert release config group: %w", err)
+		}
+	}
+	for _, p := range release.Processes {
+		if _, err := tx.Exec(`
+			INSERT INTO release_processes (release_id, name, command)
+			VALUES (?, ?, ?)
+		`, id, p.Name, p.Command); err != nil {
+			return fmt.Errorf("insert release process: %w", err)
+		}
+	}
+
 	release.ID = id
 	return nil
 }
 
+// loadPins fills in the config group versions and process commands pinned
+// by releases
+func (db *DB) loadPins(releases ...*models.Release) error {
+	for _, release := range releases {
+		if err := db.loadProcesses(release); err != nil {
+			return err
+		}
+
+		rows, err := db.Query(`
+			SELECT group_name, group_version FROM release_config_groups
+			WHERE release_id = ? ORDER BY position
+		`, release.ID)
+		if err != nil {
+			return fmt.Errorf("query release config groups: %w", err)
+		}
+		release.ConfigGroups = nil
+		for rows.Next() {
+			var group models.ReleaseConfigGroup
+			if err := rows.Scan(&group.Name, &group.Version); err != nil {
+				rows.Close()
+				return fmt.Errorf("scan release config group: %w", err)
+			}
+			release.ConfigGroups = append(release.ConfigGroups, group)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("query release config groups: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadProcesses fills in the process commands pinned by a release
+func (db *DB) loadProcesses(release *models.Release) error {
+	rows, err := db.Query(`
+		SELECT name, command FROM release_processes
+		WHERE release_id = ? ORDER BY name
+	`, release.ID)
+	if err != nil {
+		return fmt.Errorf("query release processes: %w", err)
+	}
+	defer rows.Close()
+
+	release.Processes = nil
+	for rows.Next() {
+		var p models.ReleaseProcess
+		if err := rows.Scan(&p.Name, &p.Command); err != nil {
+			return fmt.Errorf("scan release process: %w", err)
+		}
+		release.Processes = append(release.Processes, p)
+	}
+	return rows.Err()
+}
+
 // GetRelease retrieves a release by app name and version
 func (db *DB) GetRelease(appName string, version int) (*models.Release, error) {
-	release := &models.Release{}
-	var configVersion sql.NullInt64
-	var createdBy sql.NullString
-
-	err := db.QueryRow(`
-		SELECT id, app_name, version, image, config_version, status, created_at, created_by
+	release, err := scanRelease(db.QueryRow(`
+		SELECT `+releaseColumns+`
 		FROM releases WHERE app_name = ? AND version = ?
-	`, appName, version).Scan(&release.ID, &release.AppName, &release.Version, &release.Image,
-		&configVersion, &release.Status, &release.CreatedAt, &createdBy)
+	`, appName, version))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("query release: %w", err)
 	}
-
-	if configVersion.Valid {
-		release.ConfigVersion = int(configVersion.Int64)
-	}
-	if createdBy.Valid {
-		release.CreatedBy = createdBy.String
-	}
-
-	return release, nil
+	return release, db.loadPins(release)
 }
 
 // GetLatestRelease retrieves the most recent release for an app
 func (db *DB) GetLatestRelease(appName string) (*models.Release, error) {
-	release := &models.Release{}
-	var configVersion sql.NullInt64
-	var createdBy sql.NullString
-
-	err := db.QueryRow(`
-		SELECT id, app_name, version, image, config_version, status, created_at, created_by
+	release, err := scanRelease(db.QueryRow(`
+		SELECT `+releaseColumns+`
 		FROM releases WHERE app_name = ? ORDER BY version DESC LIMIT 1
-	`, appName).Scan(&release.ID, &release.AppName, &release.Version, &release.Image,
-		&configVersion, &release.Status, &release.CreatedAt, &createdBy)
+	`, appName))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("query latest release: %w", err)
 	}
-
-	if configVersion.Valid {
-		release.ConfigVersion = int(configVersion.Int64)
-	}
-	if createdBy.Valid {
-		release.CreatedBy = createdBy.String
-	}
-
-	return release, nil
+	return release, db.loadPins(release)
 }
 
 // GetActiveRelease retrieves the currently active release
 func (db *DB) GetActiveRelease(appName string) (*models.Release, error) {
-	release := &models.Release{}
-	var configVersion sql.NullInt64
-	var createdBy sql.NullString
-
-	err := db.QueryRow(`
-		SELECT id, app_name, version, image, config_version, status, created_at, created_by
+	release, err := scanRelease(db.QueryRow(`
+		SELECT `+releaseColumns+`
 		FROM releases WHERE app_name = ? AND status = 'active' ORDER BY version DESC LIMIT 1
-	`, appName).Scan(&release.ID, &release.AppName, &release.Version, &release.Image,
-		&configVersion, &release.Status, &release.CreatedAt, &createdBy)
+	`, appName))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("query active release: %w", err)
 	}
+	return release, db.loadPins(release)
+}
 
-	if configVersion.Valid {
-		release.ConfigVersion = int(configVersion.Int64)
+// GetPreviousRelease retrieves the most recent release older than version
+// that was once successfully deployed
+func (db *DB) GetPreviousRelease(appName string, version int) (*models.Release, error) {
+	release, err := scanRelease(db.QueryRow(`
+		SELECT `+releaseColumns+`
+		FROM releases WHERE app_name = ? AND version < ? AND status IN (?, ?, ?)
+		ORDER BY version DESC LIMIT 1
+	`, appName, version, models.ReleaseStatusActive, models.ReleaseStatusSuperseded, models.ReleaseStatusRolledBack))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	if createdBy.Valid {
-		release.CreatedBy = createdBy.String
+	if err != nil {
+		return nil, fmt.Errorf("query previous release: %w", err)
 	}
-
-	return release, nil
+	return release, db.loadPins(release)
 }
 
-// ListReleases retrieves all releases for an app
+// ListReleases retrieves an app's newest releases
 func (db *DB) ListReleases(appName string, limit int) ([]*models.Release, error) {
 	if limit <= 0 {
 		limit = 20
 	}
 
-	rows, err := db.Query(`
-		SELECT id, app_name, version, image, config_version, status, created_at, created_by
+	return db.queryReleases(`
+		SELECT `+releaseColumns+`
 		FROM releases WHERE app_name = ? ORDER BY version DESC LIMIT ?
 	`, appName, limit)
+}
+
+// ListAllReleases retrieves every release of an app, newest first
+func (db *DB) ListAllReleases(appName string) ([]*models.Release, error) {
+	return db.queryReleases(`
+		SELECT `+releaseColumns+`
+		FROM releases WHERE app_name = ? ORDER BY version DESC
+	`, appName)
+}
+
+// queryReleases retrieves the releases selected by query, which must select
+// releaseColumns
+func (db *DB) queryReleases(query string, args ...interface{}) ([]*models.Release, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query releases: %w", err)
 	}
@@ -140,26 +279,66 @@ func (db *DB) ListReleases(appName string, limit int) ([]*models.Release, error)
 
 	var releases []*models.Release
 	for rows.Next() {
-		release := &models.Release{}
-		var configVersion sql.NullInt64
-		var createdBy sql.NullString
-
-		if err := rows.Scan(&release.ID, &release.AppName, &release.Version, &release.Image,
-			&configVersion, &release.Status, &release.CreatedAt, &createdBy); err != nil {
+		release, err := scanRelease(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan release: %w", err)
 		}
+		releases = append(releases, release)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query releases: %w", err)
+	}
+	rows.Close()
+
+	return releases, db.loadPins(releases...)
+}
 
-		if configVersion.Valid {
-			release.ConfigVersion = int(configVersion.Int64)
+// DeleteReleases deletes releases of an app with their jobs, for pruning
+func (db *DB) DeleteReleases(appName string, versions []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, v := range versions {
+		if _, err := tx.Exec("DELETE FROM jobs WHERE app_name = ? AND release_version = ?", appName, v); err != nil {
+			return fmt.Errorf("delete release jobs: %w", err)
 		}
-		if createdBy.Valid {
-			release.CreatedBy = createdBy.String
+		if _, err := tx.Exec("DELETE FROM releases WHERE app_name = ? AND version = ?", appName, v); err != nil {
+			return fmt.Errorf("delete release: %w", err)
 		}
+	}
 
-		releases = append(releases, release)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// CountImageReleases counts the releases of every app that use image,
+// pinned to digest if it is set
+func (db *DB) CountImageReleases(image, digest string) (int, error) {
+	query, args := "SELECT COUNT(*) FROM releases WHERE image = ?", []interface{}{image}
+	if digest != "" {
+		query += " AND image_digest = ?"
+		args = append(args, digest)
+	}
+
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("count image releases: %w", err)
 	}
+	return count, nil
+}
 
-	return releases, nil
+// SetReleaseImageDigest records the digest a release's image resolved to
+func (db *DB) SetReleaseImageDigest(id int64, digest string) error {
+	_, err := db.Exec("UPDATE releases SET image_digest = ? WHERE id = ?", digest, id)
+	if err != nil {
+		return fmt.Errorf("set release image digest: %w", err)
+	}
+	return nil
 }
 
 // UpdateReleaseStatus updates the status of a release
@@ -171,3 +350,13 @@ func (db *DB) UpdateReleaseStatus(appName string, version int, status models.Rel
 	}
 	return nil
 }
+
+// FailRelease marks a release as failed and records why
+func (db *DB) FailRelease(appName string, version int, reason string) error {
+	_, err := db.Exec("UPDATE releases SET status = ?, failure_reason = ? WHERE app_name = ? AND version = ?",
+		models.ReleaseStatusFailed, reason, appName, version)
+	if err != nil {
+		return fmt.Errorf("fail release: %w", err)
+	}
+	return nil
+}
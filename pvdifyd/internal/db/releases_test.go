@@ -0,0 +1,50 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+func TestCreateReleaseWithFormation(t *testing.T) {
+	db, _ := newTestDB(t)
+	createTestApp(t, db, "shop")
+
+	if _, err := db.SetFormation("shop", []*models.Process{
+		{Name: "web", Command: "bin/web", Count: 2},
+		{Name: "worker", Command: "bin/worker", Count: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	release := &models.Release{
+		AppName:   "shop",
+		Image:     "ghcr.io/acme/shop:v2",
+		Processes: []models.ReleaseProcess{{Name: "web", Command: "bin/web --v2"}},
+	}
+	removed, err := db.CreateReleaseWithFormation(release, []*models.Process{
+		{Name: "web", Command: "bin/web --v2", Count: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Name != "worker" {
+		t.Errorf("removed = %v, want worker", removed)
+	}
+
+	processes, err := db.ListProcesses("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes) != 1 || processes[0].Command != "bin/web --v2" || processes[0].Count != 2 {
+		t.Errorf("processes = %+v, want web running bin/web --v2 twice", processes)
+	}
+
+	saved, err := db.GetRelease("shop", release.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || len(saved.Processes) != 1 || saved.Processes[0].Command != "bin/web --v2" {
+		t.Errorf("release = %+v, want it to pin bin/web --v2", saved)
+	}
+}
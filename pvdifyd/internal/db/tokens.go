@@ -0,0 +1,102 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// CreateAPIToken inserts a new API token
+func (db *DB) CreateAPIToken(token *models.APIToken) error {
+	token.CreatedAt = time.Now()
+
+	result, err := db.Exec(`
+		INSERT INTO api_tokens (name, token_hash, created_at)
+		VALUES (?, ?, ?)
+	`, token.Name, token.TokenHash, token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert api token: %w", err)
+	}
+
+	id, _ := result.LastInsertId()
+	token.ID = id
+	return nil
+}
+
+// GetAPITokenByHash retrieves the token with the given hash
+func (db *DB) GetAPITokenByHash(hash string) (*models.APIToken, error) {
+	t := &models.APIToken{}
+	var lastUsedAt sql.NullTime
+
+	err := db.QueryRow(`
+		SELECT id, name, token_hash, created_at, last_used_at
+		FROM api_tokens WHERE token_hash = ?
+	`, hash).Scan(&t.ID, &t.Name, &t.TokenHash, &t.CreatedAt, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query api token: %w", err)
+	}
+
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return t, nil
+}
+
+// ListAPITokens retrieves all API tokens
+func (db *DB) ListAPITokens() ([]*models.APIToken, error) {
+	rows, err := db.Query(`
+		SELECT id, name, token_hash, created_at, last_used_at
+		FROM api_tokens ORDER BY name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*models.APIToken
+	for rows.Next() {
+		t := &models.APIToken{}
+		var lastUsedAt sql.NullTime
+
+		if err := rows.Scan(&t.ID, &t.Name, &t.TokenHash, &t.CreatedAt, &lastUsedAt); err != nil {
+			return nil, fmt.Errorf("scan api token: %w", err)
+		}
+
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+// TouchAPIToken records that a token was just used
+func (db *DB) TouchAPIToken(id int64) error {
+	_, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("touch api token: %w", err)
+	}
+	return nil
+}
+
+// DeleteAPIToken revokes a token by name
+func (db *DB) DeleteAPIToken(name string) error {
+	result, err := db.Exec("DELETE FROM api_tokens WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("delete api token: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return fmt.Errorf("api token not found: %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package deploy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// appNamePattern matches app names: lowercase DNS labels. Names end up in
+// unit, container and file names and in default hostnames.
+var appNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidateAppName reports whether name can be used for a new app
+func ValidateAppName(name string) error {
+	if !appNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid app name %q: use up to 63 lowercase letters, digits and dashes, starting and ending with a letter or digit", name)
+	}
+	return nil
+}
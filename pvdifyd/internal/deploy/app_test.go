@@ -0,0 +1,35 @@
+package deploy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAppName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"shop", true},
+		{"my-app", true},
+		{"2048", true},
+		{strings.Repeat("a", 63), true},
+		{"", false},
+		{strings.Repeat("a", 64), false},
+		{"Shop", false},
+		{"-shop", false},
+		{"shop-", false},
+		{"my_app", false},
+		{"my.app", false},
+		{"..", false},
+		{"../etc", false},
+		{"shop/../../etc", false},
+		{"shop\n", false},
+	}
+	for _, tt := range tests {
+		err := ValidateAppName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateAppName(%q) = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
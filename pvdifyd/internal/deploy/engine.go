@@ -0,0 +1,819 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/config"
+	"github.com/philoveracity/pvdifyd/internal/db"
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/podman"
+	"github.com/philoveracity/pvdifyd/internal/proxy"
+	"github.com/philoveracity/pvdifyd/internal/systemd"
+	"github.com/philoveracity/pvdifyd/internal/tunnel"
+)
+
+// Engine applies releases to the host: it pulls images, renders systemd
+// units, starts instances and routes traffic to them
+type Engine struct {
+	db        *db.DB
+	cfg       *config.Config
+	podman    *podman.Client
+	generator *systemd.Generator
+	systemd   *systemd.Manager
+	tunnel    *tunnel.Manager
+	proxy     *proxy.Proxy
+	logger    *slog.Logger
+
+	// proxyPort is where the tunnel reaches the proxy
+	proxyPort int
+
+	// Background jobs run on ctx and are tracked by wg so Close can wait
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// appLocks serializes operations that touch the same app; each is a
+	// one-slot semaphore so waiting for it can be cancelled
+	mu       sync.Mutex
+	appLocks map[string]chan struct{}
+
+	// portMu serializes port allocation across apps
+	portMu sync.Mutex
+
+	// kick requests an immediate reconcile of an app
+	kick chan string
+}
+
+// New creates a new deploy engine
+func New(database *db.DB, cfg *config.Config, logger *slog.Logger) (*Engine, error) {
+	generator, err := systemd.New(cfg.Systemd.UnitDir)
+	if err != nil {
+		return nil, fmt.Errorf("create unit generator: %w", err)
+	}
+
+	var tun *tunnel.Manager
+	if cfg.Tunnel.Enabled {
+		tun, err = tunnel.NewManager(cfg.Tunnel.Config, cfg.Tunnel.Credentials, cfg.Tunnel.Service, cfg.Tunnel.Metrics)
+		if err != nil {
+			return nil, fmt.Errorf("create tunnel manager: %w", err)
+		}
+	}
+
+	// The tunnel always reaches apps through the proxy, so cloudflared's
+	// config only changes with the domains; cutovers re-point the proxy in
+	// process instead of restarting cloudflared
+	var prx *proxy.Proxy
+	var proxyPort int
+	if cfg.Tunnel.Enabled && !cfg.Proxy.Enabled {
+		logger.Info("tunnel enabled: starting the built-in proxy it routes through", "listen", cfg.Proxy.Listen)
+	} else if !cfg.Proxy.Enabled && cfg.Deploy.DrainTimeout > 0 {
+		logger.Warn("built-in proxy disabled: requests in flight can't be counted, so draining instances always waits the full drain_timeout", "drain_timeout", cfg.Deploy.DrainTimeout.String())
+	}
+	if cfg.Proxy.Enabled || cfg.Tunnel.Enabled {
+		prx, err = proxy.New(cfg.Proxy, logger)
+		if err != nil {
+			return nil, err
+		}
+		_, port, err := net.SplitHostPort(cfg.Proxy.Listen)
+		if err == nil {
+			proxyPort, err = strconv.Atoi(port)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy listen address %q", cfg.Proxy.Listen)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Engine{
+		db:        database,
+		cfg:       cfg,
+		podman:    podman.New(cfg.Podman.Socket),
+		generator: generator,
+		systemd:   systemd.NewManager(),
+		tunnel:    tun,
+		proxy:     prx,
+		proxyPort: proxyPort,
+		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		appLocks:  make(map[string]chan struct{}),
+		kick:      make(chan string, 16),
+	}, nil
+}
+
+// Deploy moves a pending release through deploying to active, or to failed
+// if any step of the pipeline errors. Progress is recorded on job when it
+// is non-nil.
+func (e *Engine) Deploy(ctx context.Context, job *models.Job, release *models.Release) error {
+	logger := e.logger.With("app", release.AppName, "version", release.Version)
+
+	if err := e.setReleaseStatus(release, models.ReleaseStatusDeploying); err != nil {
+		return err
+	}
+
+	// Whatever the outcome, only the live release's env file is needed
+	defer e.cleanEnvFiles(release.AppName, logger)
+
+	replaced := models.ReleaseStatusSuperseded
+	if job != nil && job.Kind == models.JobKindRollback {
+		replaced = models.ReleaseStatusRolledBack
+	}
+
+	if err := e.deploy(ctx, job, release, replaced, logger); err != nil {
+		logger.Error("deploy failed", "error", err)
+		if ferr := e.db.FailRelease(release.AppName, release.Version, err.Error()); ferr != nil {
+			logger.Error("mark release failed", "error", ferr)
+		}
+		release.Status = models.ReleaseStatusFailed
+		release.FailureReason = err.Error()
+
+		// The app is only down if there was no previous release to fall
+		// back to
+		if active, _ := e.db.GetActiveRelease(release.AppName); active == nil {
+			status := models.AppStatusFailed
+			if uerr := e.db.UpdateApp(release.AppName, nil, &status); uerr != nil {
+				logger.Error("mark app failed", "error", uerr)
+			}
+		}
+		return err
+	}
+
+	logger.Info("release deployed", "image", release.Image)
+	return nil
+}
+
+func (e *Engine) deploy(ctx context.Context, job *models.Job, release *models.Release, replaced models.ReleaseStatus, logger *slog.Logger) (err error) {
+	app, err := e.db.GetApp(release.AppName)
+	if err != nil {
+		return fmt.Errorf("get app: %w", err)
+	}
+	if app == nil {
+		return fmt.Errorf("app not found: %s", release.AppName)
+	}
+
+	previous, err := e.db.GetActiveRelease(app.Name)
+	if err != nil {
+		return fmt.Errorf("get active release: %w", err)
+	}
+
+	processes, err := e.db.ListProcesses(app.Name)
+	if err != nil {
+		return fmt.Errorf("list processes: %w", err)
+	}
+	processes = releaseProcesses(processes, release)
+
+	// The new release starts in the idle slot, each web instance on its own
+	// port, while the live slot keeps serving traffic. The idle slot keeps
+	// its ports between deploys.
+	live := app.ActiveColor
+	next := live.Other()
+	ports, err := e.assignPorts(app.Name, next, webCount(processes))
+	if err != nil {
+		return err
+	}
+	if err := e.releasePorts(app.Name, next, len(ports)); err != nil {
+		return err
+	}
+	logger = logger.With("color", next, "ports", ports)
+
+	err = e.step(job, "pull image", func() error {
+		return e.pullImage(ctx, release, logger)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = e.step(job, "write units", func() error {
+		env, err := e.writeEnvFile(release)
+		if err != nil {
+			return err
+		}
+		for _, p := range processes {
+			if _, err := e.generator.Generate(e.unitConfig(app, p, next, release.ImageRef(), env)); err != nil {
+				return fmt.Errorf("generate unit for %s: %w", p.Name, err)
+			}
+		}
+		return e.systemd.DaemonReload(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Until the previous slot is stopped, a failure rolls back to it: the
+	// new slot is torn down and, if traffic was already switched, routes
+	// are pointed back at the previous slot
+	cutover, committed := false, false
+	defer func() {
+		if err == nil || committed {
+			return
+		}
+		restoreCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if rerr := e.restore(restoreCtx, app, processes, previous, live, next, cutover); rerr != nil {
+			logger.Error("restore previous release", "error", rerr)
+			err = fmt.Errorf("%w; restoring previous release failed: %v", err, rerr)
+			return
+		}
+		if previous != nil {
+			logger.Warn("rolled back to previous release", "previous", previous.Version, "reason", err)
+			err = fmt.Errorf("%w; rolled back to v%d", err, previous.Version)
+		}
+	}()
+
+	err = e.step(job, "start processes", func() error {
+		for _, p := range processes {
+			if err := e.startInstances(ctx, systemd.UnitName(app.Name, p.Name, string(next)), p.Count); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = e.step(job, "health check", func() error {
+		for _, p := range checkedProcesses(processes) {
+			if err := e.waitHealthy(ctx, app, p, next, ports); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = e.step(job, "switch routes", func() error {
+		if err := e.updateRoutes(ctx, app.Name, ports); err != nil {
+			return err
+		}
+		if err := e.db.SwapColor(app.Name, next); err != nil {
+			return err
+		}
+		return e.ReloadRoutes()
+	})
+	if err != nil {
+		return err
+	}
+	cutover = true
+	logger.Info("traffic switched", "from", live)
+
+	// Keep the previous slot running until the new one has proven itself
+	// under real traffic
+	if previous != nil {
+		err = e.step(job, "verify", func() error {
+			return e.verify(ctx, app, checkedProcesses(processes), next, ports)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	committed = true
+
+	err = e.step(job, "stop previous", func() error {
+		// Routes left the previous slot at cutover; let it finish the
+		// requests it already had. It ran the previous formation, so its
+		// own ports are drained, not as many as the new release has.
+		if previous != nil {
+			ports, err := e.recordedPorts(app.Name, live)
+			if err != nil {
+				return err
+			}
+			if err := e.drain(ctx, logger, ports); err != nil {
+				return err
+			}
+		}
+		if err := e.stopColor(ctx, app.Name, processes, live); err != nil {
+			return err
+		}
+		// Nothing deploys to the uncolored slot again
+		if live == "" {
+			if err := e.releasePorts(app.Name, live, 0); err != nil {
+				return err
+			}
+		}
+		return e.systemd.DaemonReload(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	return e.step(job, "activate release", func() error {
+		if previous != nil && previous.Version != release.Version {
+			if err := e.setReleaseStatus(previous, replaced); err != nil {
+				return err
+			}
+		}
+		if err := e.setReleaseStatus(release, models.ReleaseStatusActive); err != nil {
+			return err
+		}
+		status := models.AppStatusRunning
+		return e.db.UpdateApp(app.Name, &release.Image, &status)
+	})
+}
+
+// restore undoes a failed deploy: routes and the active slot go back to
+// the previous release, the new slot is drained and stopped, and any
+// previous instance that is not running is started again
+func (e *Engine) restore(ctx context.Context, app *models.App, processes []*models.Process, previous *models.Release, live, next models.Color, cutover bool) error {
+	if cutover {
+		ports, err := e.recordedPorts(app.Name, live)
+		if err != nil {
+			return err
+		}
+		if err := e.updateRoutes(ctx, app.Name, ports); err != nil {
+			return err
+		}
+		if err := e.db.SwapColor(app.Name, live); err != nil {
+			return err
+		}
+		if err := e.ReloadRoutes(); err != nil {
+			return err
+		}
+
+		// Requests the new slot took since cutover get to finish
+		failed, err := e.slotPorts(app.Name, next, webCount(processes))
+		if err != nil {
+			return err
+		}
+		if err := e.drain(ctx, e.logger.With("app", app.Name), failed); err != nil {
+			return err
+		}
+	}
+
+	if err := e.stopColor(ctx, app.Name, processes, next); err != nil {
+		return err
+	}
+
+	if previous != nil {
+		for _, p := range processes {
+			unit := systemd.UnitName(app.Name, p.Name, string(live))
+			for i := 1; i <= p.Count; i++ {
+				// Start is a no-op for instances that are still running
+				if err := e.systemd.Start(ctx, unit, i); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return e.systemd.DaemonReload(ctx)
+}
+
+// pullImage makes the release's image available locally. The first deploy
+// of a release resolves its tag to a digest and records it; later deploys
+// of it, and rollbacks to it, use that digest and skip the pull if the
+// image is already there.
+func (e *Engine) pullImage(ctx context.Context, release *models.Release, logger *slog.Logger) error {
+	if release.ImageDigest != "" {
+		ref := release.ImageRef()
+		if exists, err := e.podman.ImageExists(ctx, ref); err == nil && exists {
+			logger.Info("image present", "image", ref)
+			return nil
+		}
+		logger.Info("pulling image", "image", ref)
+		return e.podman.PullImage(ctx, ref)
+	}
+
+	logger.Info("pulling image", "image", release.Image)
+	if err := e.podman.PullImage(ctx, release.Image); err != nil {
+		return err
+	}
+	digest, err := e.podman.ImageDigest(ctx, release.Image)
+	if err != nil {
+		return err
+	}
+	if err := e.db.SetReleaseImageDigest(release.ID, digest); err != nil {
+		return err
+	}
+	release.ImageDigest = digest
+	logger.Info("resolved image digest", "image", release.Image, "digest", digest)
+	return nil
+}
+
+// checkedProcesses returns the scaled up processes a deploy waits to be
+// healthy: web, which serves HTTP, and those with a health check command
+func checkedProcesses(processes []*models.Process) []*models.Process {
+	var checked []*models.Process
+	for _, p := range processes {
+		if p.Count == 0 {
+			continue
+		}
+		if p.Name == "web" || (p.Healthcheck != nil && p.Healthcheck.Command != "") {
+			checked = append(checked, p)
+		}
+	}
+	return checked
+}
+
+// releaseProcesses returns an app's process types as a release runs them:
+// with the commands the release pinned, and types it doesn't pin scaled to
+// zero. Releases without pins run the app's current commands.
+func releaseProcesses(processes []*models.Process, release *models.Release) []*models.Process {
+	if len(release.Processes) == 0 {
+		return processes
+	}
+	commands := make(map[string]string, len(release.Processes))
+	for _, p := range release.Processes {
+		commands[p.Name] = p.Command
+	}
+
+	pinned := make([]*models.Process, 0, len(processes))
+	for _, p := range processes {
+		run := *p
+		if command, ok := commands[p.Name]; ok {
+			run.Command = command
+		} else {
+			run.Count = 0
+		}
+		pinned = append(pinned, &run)
+	}
+	return pinned
+}
+
+// unitConfig builds the systemd unit parameters for a process
+func (e *Engine) unitConfig(app *models.App, p *models.Process, color models.Color, image string, env envFiles) *systemd.UnitConfig {
+	cfg := &systemd.UnitConfig{
+		App:              app.Name,
+		Process:          p.Name,
+		Color:            string(color),
+		Image:            image,
+		Command:          p.Command,
+		EnvFile:          env.path,
+		MultilineEnvFile: env.multilinePath,
+		MultilineEnv:     env.multilineKeys,
+	}
+	// Only the web process is bound to ports
+	if p.Name == "web" {
+		cfg.PortDir = portFileDir(env.dir)
+	}
+	if r := p.Resources; r != nil {
+		cfg.Memory = r.Memory
+		if r.CPU > 0 {
+			cfg.CPU = fmt.Sprintf("%g", r.CPU)
+		}
+		cfg.PidsLimit = r.Pids
+		cfg.Ulimits = r.Ulimits
+	}
+	if h := p.Healthcheck; h != nil {
+		if p.Name == "web" {
+			cfg.HealthCheckPath = h.Path
+		}
+		cfg.HealthCheckCommand = h.Command
+		cfg.HealthCheckInterval = seconds(h.Interval)
+		cfg.HealthCheckTimeout = seconds(h.Timeout)
+		cfg.HealthCheckRetries = h.Retries
+	}
+	cfg.StopTimeout = seconds(p.StopTimeout)
+	return cfg
+}
+
+// startInstances (re)starts instances 1..count of a unit and stops the rest
+func (e *Engine) startInstances(ctx context.Context, unit string, count int) error {
+	for i := 1; i <= count; i++ {
+		if err := e.systemd.Restart(ctx, unit, i); err != nil {
+			return err
+		}
+		if err := e.systemd.Enable(ctx, fmt.Sprintf("%s@%d", unit, i)); err != nil {
+			return err
+		}
+	}
+
+	running, err := e.systemd.ListInstances(ctx, unit)
+	if err != nil {
+		return err
+	}
+	for _, i := range running {
+		if i <= count {
+			continue
+		}
+		if err := e.stopInstance(ctx, unit, i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stopColor stops every instance in a slot and removes its unit files
+func (e *Engine) stopColor(ctx context.Context, appName string, processes []*models.Process, color models.Color) error {
+	for _, p := range processes {
+		unit := systemd.UnitName(appName, p.Name, string(color))
+		running, err := e.systemd.ListInstances(ctx, unit)
+		if err != nil {
+			return err
+		}
+		for _, i := range running {
+			if err := e.stopInstance(ctx, unit, i); err != nil {
+				return err
+			}
+		}
+		if err := e.generator.Remove(appName, p.Name, string(color)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnqueueRemoveProcesses records a job that takes the instances of process
+// types removed from an app off the host, and runs it in the background
+func (e *Engine) EnqueueRemoveProcesses(appName string, processes []*models.Process) (*models.Job, error) {
+	job := &models.Job{
+		AppName: appName,
+		Kind:    models.JobKindRemoveProcesses,
+	}
+	if err := e.db.CreateJob(job); err != nil {
+		return nil, err
+	}
+
+	e.run(job, func(ctx context.Context) error {
+		return e.removeProcesses(ctx, job, appName, processes)
+	})
+	return job, nil
+}
+
+// removeProcesses stops every instance of process types removed from an
+// app, in every slot, deletes their unit files and frees their ports. A
+// removed web process leaves the routes and is drained first, like
+// instances scaled away.
+func (e *Engine) removeProcesses(ctx context.Context, job *models.Job, appName string, processes []*models.Process) error {
+	logger := e.logger.With("app", appName)
+
+	if hasWeb(processes) {
+		var ports []int
+		for _, color := range allColors {
+			byInstance, err := e.db.InstancePorts(appName, color)
+			if err != nil {
+				return err
+			}
+			for _, port := range byInstance {
+				ports = append(ports, port)
+			}
+		}
+
+		err := e.step(job, "switch routes", func() error {
+			// The proxy's routes follow the formation; the tunnel's are
+			// removed since nothing serves the domains any more
+			if err := e.ReloadRoutes(); err != nil {
+				return err
+			}
+			return e.removeTunnelRoutes(ctx, appName)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = e.step(job, "drain", func() error {
+			return e.drain(ctx, logger, ports)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.step(job, "stop processes", func() error {
+		for _, color := range allColors {
+			if err := e.stopColor(ctx, appName, processes, color); err != nil {
+				return err
+			}
+		}
+		if hasWeb(processes) {
+			for _, color := range allColors {
+				if err := e.releasePorts(appName, color, 0); err != nil {
+					return err
+				}
+			}
+		}
+		return e.systemd.DaemonReload(ctx)
+	})
+}
+
+// hasWeb reports whether processes include the web process
+func hasWeb(processes []*models.Process) bool {
+	for _, p := range processes {
+		if p.Name == "web" {
+			return true
+		}
+	}
+	return false
+}
+
+// removeTunnelRoutes takes an app's domains out of the tunnel and reloads
+// it if any were routed
+func (e *Engine) removeTunnelRoutes(ctx context.Context, appName string) error {
+	if e.tunnel == nil {
+		return nil
+	}
+	domains, err := e.db.ListDomains(appName)
+	if err != nil {
+		return fmt.Errorf("list domains: %w", err)
+	}
+	hostnames := make([]string, len(domains))
+	for i, d := range domains {
+		hostnames[i] = d.Domain
+	}
+	changed, err := e.tunnel.RemoveRoutes(hostnames)
+	if err != nil {
+		return fmt.Errorf("remove routes: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+	if err := e.tunnel.Reload(ctx); err != nil {
+		return fmt.Errorf("reload tunnel: %w", err)
+	}
+	return nil
+}
+
+// DeleteApp takes an app off the host and out of the database: every
+// instance in every slot is stopped and its unit file removed, its domains
+// leave the tunnel, and only then are the app's row, which frees its
+// ports, and its env and port files deleted
+func (e *Engine) DeleteApp(ctx context.Context, appName string) error {
+	unlock, err := e.lockAppContext(ctx, appName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	processes, err := e.db.ListProcesses(appName)
+	if err != nil {
+		return fmt.Errorf("list processes: %w", err)
+	}
+	for _, color := range allColors {
+		if err := e.stopColor(ctx, appName, processes, color); err != nil {
+			return err
+		}
+	}
+	if err := e.systemd.DaemonReload(ctx); err != nil {
+		return err
+	}
+
+	if err := e.removeTunnelRoutes(ctx, appName); err != nil {
+		return err
+	}
+
+	// Ports are freed with the row, so nothing may still be bound to them
+	e.portMu.Lock()
+	err = e.db.DeleteApp(appName)
+	e.portMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := e.RemoveEnvFiles(appName); err != nil {
+		return err
+	}
+	return e.ReloadRoutes()
+}
+
+// restart restarts the instances of an app's live release in its live
+// slot, one process type and instance at a time so the others keep serving
+func (e *Engine) restart(ctx context.Context, job *models.Job, appName string) error {
+	app, err := e.db.GetApp(appName)
+	if err != nil {
+		return fmt.Errorf("get app: %w", err)
+	}
+	if app == nil {
+		return fmt.Errorf("app not found: %s", appName)
+	}
+	release, err := e.db.GetActiveRelease(appName)
+	if err != nil {
+		return fmt.Errorf("get active release: %w", err)
+	}
+	if release == nil {
+		return fmt.Errorf("%s has no active release to restart", appName)
+	}
+	processes, err := e.db.ListProcesses(appName)
+	if err != nil {
+		return fmt.Errorf("list processes: %w", err)
+	}
+
+	for _, p := range releaseProcesses(processes, release) {
+		if p.Count == 0 {
+			continue
+		}
+		unit := systemd.UnitName(appName, p.Name, string(app.ActiveColor))
+		err := e.step(job, "restart "+p.Name, func() error {
+			for i := 1; i <= p.Count; i++ {
+				if err := e.systemd.Restart(ctx, unit, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopInstance stops and disables a single unit instance
+func (e *Engine) stopInstance(ctx context.Context, unit string, instance int) error {
+	if err := e.systemd.Stop(ctx, unit, instance); err != nil {
+		return err
+	}
+	return e.systemd.Disable(ctx, fmt.Sprintf("%s@%d", unit, instance))
+}
+
+// drain waits for requests in flight to the web instances on ports, which
+// no longer get new ones, to finish, for at most deploy.drain_timeout. The
+// proxy counts them; without it there's no telling, so it waits the full
+// period.
+func (e *Engine) drain(ctx context.Context, logger *slog.Logger, ports []int) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	timeout := time.NewTimer(e.cfg.Deploy.DrainTimeout)
+	defer timeout.Stop()
+
+	if e.proxy == nil {
+		if e.cfg.Deploy.DrainTimeout <= 0 {
+			logger.Warn("drain disabled, stopping instances without waiting for requests in flight", "ports", ports)
+			return nil
+		}
+		logger.Info("draining without the proxy, waiting the full drain period", "ports", ports, "period", e.cfg.Deploy.DrainTimeout.String())
+		select {
+		case <-timeout.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := e.proxy.Connections(ports...)
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-timeout.C:
+			logger.Warn("drain timed out, stopping instances with requests in flight", "ports", ports, "connections", n)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateRoutes points the app's domains at its web instances. The tunnel
+// sends every domain to the proxy, so its config, and cloudflared, only
+// change when a domain is routed for the first time; ReloadRoutes then
+// balances each request across the live slot's instances once the slot is
+// recorded.
+func (e *Engine) updateRoutes(ctx context.Context, appName string, ports []int) error {
+	if e.proxy == nil || len(ports) == 0 {
+		return nil
+	}
+
+	domains, err := e.db.ListDomains(appName)
+	if err != nil {
+		return fmt.Errorf("list domains: %w", err)
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+
+	if e.tunnel != nil {
+		routes := make([]tunnel.Route, len(domains))
+		for i, d := range domains {
+			routes[i] = tunnel.Route{Hostname: d.Domain, Port: e.proxyPort}
+		}
+		changed, err := e.tunnel.SetRoutes(routes)
+		if err != nil {
+			return fmt.Errorf("update routes: %w", err)
+		}
+		if changed {
+			if err := e.tunnel.Reload(ctx); err != nil {
+				return fmt.Errorf("reload tunnel: %w", err)
+			}
+		}
+	}
+
+	for _, d := range domains {
+		if d.Status != models.DomainStatusActive {
+			if err := e.db.UpdateDomainStatus(d.Domain, models.DomainStatusActive, nil); err != nil {
+				return fmt.Errorf("update domain status: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Engine) setReleaseStatus(release *models.Release, status models.ReleaseStatus) error {
+	if err := e.db.UpdateReleaseStatus(release.AppName, release.Version, status); err != nil {
+		return err
+	}
+	release.Status = status
+	return nil
+}
@@ -0,0 +1,264 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// envKeyPattern matches the config var names that can be used as
+// environment variables
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateConfigVar reports whether a config var can be passed to a
+// container. Podman reads env files line by line and takes everything after
+// the first "=" literally, so values can hold quotes, "=", "#" and
+// surrounding spaces as is. Multi-line values go through systemd instead
+// (see renderMultilineEnvFile); only NUL bytes can't be passed at all.
+func ValidateConfigVar(key, value string) error {
+	if !envKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid config var name %q: use letters, digits and underscores, not starting with a digit", key)
+	}
+	if strings.ContainsRune(value, 0) {
+		return fmt.Errorf("config var %s: values can't contain NUL bytes", key)
+	}
+	return nil
+}
+
+// isMultiline reports whether a value can't be written on one env file line
+func isMultiline(value string) bool {
+	return strings.ContainsAny(value, "\n\r")
+}
+
+// renderEnvFile renders vars in podman's env-file format, one KEY=VALUE per
+// line in key order. Values are written verbatim: podman does not unquote
+// them, so quoting would end up in the value. Multi-line values are left
+// out and their keys returned, for renderMultilineEnvFile.
+func renderEnvFile(vars models.ConfigData) ([]byte, []string, error) {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	var multiline []string
+	for _, k := range keys {
+		if err := ValidateConfigVar(k, vars[k]); err != nil {
+			return nil, nil, err
+		}
+		if isMultiline(vars[k]) {
+			multiline = append(multiline, k)
+			continue
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(vars[k])
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), multiline, nil
+}
+
+// renderMultilineEnvFile renders the vars named by keys for a unit's
+// EnvironmentFile, which podman then passes on with --env KEY. systemd
+// keeps line breaks inside double quotes, where only \, ", $ and ` need a
+// backslash.
+func renderMultilineEnvFile(vars models.ConfigData, keys []string) []byte {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	var b bytes.Buffer
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(r.Replace(vars[k]))
+		b.WriteString("\"\n")
+	}
+	return b.Bytes()
+}
+
+// envFiles are the files a release's config is rendered into
+type envFiles struct {
+	dir           string   // The app's env file directory
+	path          string   // Passed to podman with --env-file
+	multilinePath string   // Read by systemd; empty without multi-line values
+	multilineKeys []string // Vars in multilinePath
+}
+
+// envFileDir returns the directory holding an app's env files. App names
+// are checked when apps are created; a name that would lead anywhere else
+// under, or out of, the state directory is refused here too, as the
+// directory is removed with the app.
+func (e *Engine) envFileDir(appName string) (string, error) {
+	if appName == "" || appName == "." || appName == ".." || filepath.Base(appName) != appName {
+		return "", fmt.Errorf("invalid app name %q", appName)
+	}
+	return filepath.Join(e.cfg.StateDir, "config", appName), nil
+}
+
+// envFilePath returns the env file of a release, in an app's env file
+// directory
+func envFilePath(dir string, version int) string {
+	return filepath.Join(dir, strconv.Itoa(version)+".env")
+}
+
+// multilineEnvFilePath returns the file holding a release's multi-line
+// config vars, in an app's env file directory
+func multilineEnvFilePath(dir string, version int) string {
+	return filepath.Join(dir, strconv.Itoa(version)+".multiline.env")
+}
+
+// writeEnvFile renders the config versions pinned by the release (not the
+// latest config) into the file passed to podman via --env-file: its config
+// groups in order, then the app's own config, each overriding the last.
+// Multi-line values go in a second file read by systemd. Each release has
+// its own files, so the previous slot keeps its config while a new release
+// starts. Unchanged files are left alone.
+func (e *Engine) writeEnvFile(release *models.Release) (envFiles, error) {
+	vars := make(models.ConfigData)
+	for _, group := range release.ConfigGroups {
+		cfg, err := e.db.GetConfigGroupVersion(group.Name, group.Version)
+		if err != nil {
+			return envFiles{}, err
+		}
+		if cfg == nil {
+			return envFiles{}, fmt.Errorf("config group %s v%d not found", group.Name, group.Version)
+		}
+		if err := yaml.Unmarshal(cfg.Data, &vars); err != nil {
+			return envFiles{}, fmt.Errorf("parse config group %s: %w", group.Name, err)
+		}
+	}
+	if release.ConfigVersion > 0 {
+		cfg, err := e.db.GetConfigVersion(release.AppName, release.ConfigVersion)
+		if err != nil {
+			return envFiles{}, err
+		}
+		if cfg != nil {
+			if err := yaml.Unmarshal(cfg.Data, &vars); err != nil {
+				return envFiles{}, fmt.Errorf("parse config: %w", err)
+			}
+		}
+	}
+
+	data, multiline, err := renderEnvFile(vars)
+	if err != nil {
+		return envFiles{}, err
+	}
+
+	dir, err := e.envFileDir(release.AppName)
+	if err != nil {
+		return envFiles{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return envFiles{}, fmt.Errorf("create env file directory: %w", err)
+	}
+	files := envFiles{dir: dir, path: envFilePath(dir, release.Version)}
+	if err := writeSecretFile(dir, files.path, data); err != nil {
+		return envFiles{}, err
+	}
+	if len(multiline) > 0 {
+		files.multilinePath = multilineEnvFilePath(dir, release.Version)
+		files.multilineKeys = multiline
+		if err := writeSecretFile(dir, files.multilinePath, renderMultilineEnvFile(vars, multiline)); err != nil {
+			return envFiles{}, err
+		}
+	}
+	return files, nil
+}
+
+// writeSecretFile replaces an env file in an app's env file directory with
+// data, unless it already holds it
+func writeSecretFile(dir, path string, data []byte) error {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(dir, ".env-*")
+	if err != nil {
+		return fmt.Errorf("write env file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp already uses 0600; be explicit since the file holds secrets
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write env file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write env file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write env file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write env file: %w", err)
+	}
+	return nil
+}
+
+// cleanEnvFiles removes the env files of every release of an app except the
+// active one, so secrets from old config don't linger on disk. Rollbacks
+// create a new release and write its file again.
+func (e *Engine) cleanEnvFiles(appName string, logger *slog.Logger) {
+	dir, err := e.envFileDir(appName)
+	if err != nil {
+		logger.Error("clean env files", "error", err)
+		return
+	}
+	active, err := e.db.GetActiveRelease(appName)
+	if err != nil {
+		logger.Error("clean env files", "error", err)
+		return
+	}
+	keep := make(map[string]bool)
+	if active != nil {
+		keep[filepath.Base(envFilePath(dir, active.Version))] = true
+		keep[filepath.Base(multilineEnvFilePath(dir, active.Version))] = true
+
+		// Units written by earlier versions share one env file per app;
+		// drop it once the live units use a per-release file
+		if _, err := os.Stat(envFilePath(dir, active.Version)); err == nil {
+			legacy := filepath.Join(e.cfg.StateDir, "config", appName+".env")
+			if err := os.Remove(legacy); err != nil && !os.IsNotExist(err) {
+				logger.Error("remove legacy env file", "error", err)
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error("clean env files", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		if keep[entry.Name()] || !strings.HasSuffix(entry.Name(), ".env") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			logger.Error("remove env file", "file", entry.Name(), "error", err)
+		}
+	}
+}
+
+// RemoveEnvFiles deletes all env files of an app, when it is deleted
+func (e *Engine) RemoveEnvFiles(appName string) error {
+	dir, err := e.envFileDir(appName)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("remove env files: %w", err)
+	}
+	if err := os.Remove(filepath.Join(e.cfg.StateDir, "config", appName+".env")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove env files: %w", err)
+	}
+	return nil
+}
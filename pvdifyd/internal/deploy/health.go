@@ -0,0 +1,121 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/systemd"
+)
+
+// healthPollInterval is how often instances are probed while waiting
+const healthPollInterval = 2 * time.Second
+
+// waitHealthy blocks until every instance of a process passes its health
+// check or the configured timeout elapses
+func (e *Engine) waitHealthy(ctx context.Context, app *models.App, p *models.Process, color models.Color, ports []int) error {
+	timeout := e.cfg.Deploy.HealthTimeout
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		lastErr = e.checkHealth(ctx, app, p, color, ports)
+		if lastErr == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not become healthy within %s: %w", p.Name, timeout, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// verify re-checks the new slot for the configured verify period after
+// traffic has been switched to it. Any failed check fails the deploy.
+func (e *Engine) verify(ctx context.Context, app *models.App, processes []*models.Process, color models.Color, ports []int) error {
+	deadline := time.Now().Add(e.cfg.Deploy.VerifyPeriod)
+
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		for _, p := range processes {
+			if err := e.checkHealth(ctx, app, p, color, ports); err != nil {
+				return fmt.Errorf("%s became unhealthy after cutover: %w", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkHealth probes each instance of a slot once. Every unit must be
+// active; then processes with a health check command must be reported
+// healthy by podman, web processes with a health check path must pass it
+// over HTTP, and other web processes must have their port open. ports are
+// the web instances' ports, in instance order.
+func (e *Engine) checkHealth(ctx context.Context, app *models.App, p *models.Process, color models.Color, ports []int) error {
+	unit := systemd.UnitName(app.Name, p.Name, string(color))
+
+	for i := 1; i <= p.Count; i++ {
+		status, err := e.systemd.Status(ctx, unit, i)
+		if err != nil {
+			return err
+		}
+		if status.Active != "active" {
+			return fmt.Errorf("instance %d is %s (%s)", i, status.Active, status.SubState)
+		}
+	}
+
+	h := p.Healthcheck
+	switch {
+	case h != nil && h.Command != "":
+		for i := 1; i <= p.Count; i++ {
+			health, err := e.podman.Health(ctx, fmt.Sprintf("%s-%d", unit, i))
+			if err != nil {
+				return err
+			}
+			if health == "" {
+				health = "not reported yet"
+			}
+			if health != "healthy" {
+				return fmt.Errorf("instance %d health check is %s", i, health)
+			}
+		}
+		return nil
+	case p.Name != "web":
+		return nil
+	}
+
+	for i, port := range ports {
+		if h != nil && h.Path != "" {
+			if err := e.podman.HealthCheck(ctx, port, h.Path); err != nil {
+				return fmt.Errorf("instance %d: %w", i+1, err)
+			}
+			continue
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			return fmt.Errorf("instance %d port %d not accepting connections: %w", i+1, port, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
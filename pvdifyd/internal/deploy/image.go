@@ -0,0 +1,28 @@
+package deploy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// imageRefPattern matches image references as podman accepts them:
+// [registry[:port]/]path[:tag][@digest]. References end up on the unit's
+// ExecStart line, so anything else is rejected before it gets there.
+var imageRefPattern = regexp.MustCompile(`^` +
+	// Registry, told apart from the first path component by a dot, a port
+	// or being localhost
+	`(?:(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?)/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*` +
+	`(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?` +
+	`(?:@[a-zA-Z][a-zA-Z0-9]*(?:[-_+.][a-zA-Z][a-zA-Z0-9]*)*:[0-9a-fA-F]{32,})?` +
+	`$`)
+
+// ValidateImage reports whether image is an image reference a release can
+// run
+func ValidateImage(image string) error {
+	if len(image) > 512 || !imageRefPattern.MatchString(image) {
+		return fmt.Errorf("invalid image reference %q", image)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package deploy
+
+import "testing"
+
+func TestValidateImage(t *testing.T) {
+	tests := []struct {
+		image string
+		ok    bool
+	}{
+		{"nginx", true},
+		{"nginx:1.27-alpine", true},
+		{"ghcr.io/acme/shop:v1.2.3", true},
+		{"localhost:5000/shop", true},
+		{"registry.example.com:5000/team/shop_api:latest", true},
+		{"ghcr.io/acme/shop@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+		{"ghcr.io/acme/shop:v1@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+		{"", false},
+		{"Shop", false},
+		{"shop:", false},
+		{"shop@sha256:abc", false},
+		{"shop; rm -rf /", false},
+		{"shop' || true '", false},
+		{"shop$(id)", false},
+		{"shop --privileged", false},
+		{"-shop", false},
+		{"shop\nExecStartPost=/bin/true", false},
+	}
+	for _, tt := range tests {
+		err := ValidateImage(tt.image)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateImage(%q) = %v, want ok %v", tt.image, err, tt.ok)
+		}
+	}
+}
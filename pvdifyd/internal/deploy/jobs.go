@@ -0,0 +1,128 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// EnqueueDeploy records a deploy job for a release and runs it in the
+// background. The returned job can be polled through the database.
+func (e *Engine) EnqueueDeploy(release *models.Release) (*models.Job, error) {
+	return e.enqueue(models.JobKindDeploy, release)
+}
+
+// EnqueueRollback is EnqueueDeploy for a release that recreates an earlier
+// one; the release it replaces is marked rolled_back rather than superseded
+func (e *Engine) EnqueueRollback(release *models.Release) (*models.Job, error) {
+	return e.enqueue(models.JobKindRollback, release)
+}
+
+// EnqueueRestart records a job that restarts every running instance of an
+// app's live release, one at a time, and runs it in the background
+func (e *Engine) EnqueueRestart(appName string) (*models.Job, error) {
+	job := &models.Job{
+		AppName: appName,
+		Kind:    models.JobKindRestart,
+	}
+	if err := e.db.CreateJob(job); err != nil {
+		return nil, err
+	}
+
+	e.run(job, func(ctx context.Context) error {
+		return e.restart(ctx, job, appName)
+	})
+	return job, nil
+}
+
+func (e *Engine) enqueue(kind models.JobKind, release *models.Release) (*models.Job, error) {
+	job := &models.Job{
+		AppName:        release.AppName,
+		Kind:           kind,
+		ReleaseVersion: release.Version,
+	}
+	if err := e.db.CreateJob(job); err != nil {
+		return nil, err
+	}
+
+	e.run(job, func(ctx context.Context) error {
+		return e.Deploy(ctx, job, release)
+	})
+	return job, nil
+}
+
+// run executes fn in a goroutine holding the app's lock, recording the
+// job's start and outcome
+func (e *Engine) run(job *models.Job, fn func(ctx context.Context) error) {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		unlock := e.lockApp(job.AppName)
+		defer unlock()
+
+		logger := e.logger.With("app", job.AppName, "job", job.ID, "kind", job.Kind)
+		if err := e.db.StartJob(job.ID); err != nil {
+			logger.Error("start job", "error", err)
+		}
+
+		err := fn(e.ctx)
+		if ferr := e.db.FinishJob(job.ID, err); ferr != nil {
+			logger.Error("finish job", "error", ferr)
+		}
+	}()
+}
+
+// step runs fn as a named step of job, recording timestamps and any error.
+// A nil job runs fn without recording.
+func (e *Engine) step(job *models.Job, name string, fn func() error) error {
+	if job == nil {
+		return fn()
+	}
+
+	step, err := e.db.StartJobStep(job.ID, name)
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if ferr := e.db.FinishJobStep(step.ID, err); ferr != nil {
+		e.logger.Error("finish job step", "job", job.ID, "step", name, "error", ferr)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// lockApp acquires the per-app lock and returns its release function
+func (e *Engine) lockApp(app string) func() {
+	unlock, _ := e.lockAppContext(context.Background(), app)
+	return unlock
+}
+
+// lockAppContext is lockApp for callers that can give up, such as API
+// requests waiting behind a deploy; it fails with ctx's error
+func (e *Engine) lockAppContext(ctx context.Context, app string) (func(), error) {
+	e.mu.Lock()
+	l, ok := e.appLocks[app]
+	if !ok {
+		l = make(chan struct{}, 1)
+		e.appLocks[app] = l
+	}
+	e.mu.Unlock()
+
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close cancels running jobs and waits for them to return
+func (e *Engine) Close() {
+	e.cancel()
+	e.wg.Wait()
+}
@@ -0,0 +1,86 @@
+package deploy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+var (
+	// memoryPattern matches podman memory sizes: a number of bytes, or of
+	// kilo-, mega- or gigabytes
+	memoryPattern = regexp.MustCompile(`^[1-9][0-9]*[bkmgBKMG]?$`)
+	// ulimitPattern matches podman ulimits: name=soft or name=soft:hard,
+	// where -1 is unlimited
+	ulimitPattern = regexp.MustCompile(`^[a-z]+=(-1|[0-9]+)(:(-1|[0-9]+))?$`)
+	// healthPathPattern restricts health check paths to what needs no
+	// quoting in the unit's shell command
+	healthPathPattern = regexp.MustCompile(`^/[A-Za-z0-9._~/-]*$`)
+)
+
+// ValidateLimits reports whether the resource limits, health check and stop
+// timeout of a process type can be written to its unit. Only web processes
+// have a port to check over HTTP.
+func ValidateLimits(name string, resources *models.ResourceLimits, healthcheck *models.HealthcheckConfig, stopTimeout string) error {
+	if r := resources; r != nil {
+		if r.Memory != "" && !memoryPattern.MatchString(r.Memory) {
+			return fmt.Errorf("invalid memory %q: use a size like 512M or 1G", r.Memory)
+		}
+		if r.CPU < 0 {
+			return fmt.Errorf("cpu can't be negative")
+		}
+		if r.Pids < 0 {
+			return fmt.Errorf("pids can't be negative")
+		}
+		for _, u := range r.Ulimits {
+			if !ulimitPattern.MatchString(u) {
+				return fmt.Errorf("invalid ulimit %q: use name=soft[:hard], like nofile=1024:2048", u)
+			}
+		}
+	}
+
+	if h := healthcheck; h != nil {
+		switch {
+		case h.Path == "" && h.Command == "":
+			return fmt.Errorf("set a health check path or command")
+		case h.Path != "" && h.Command != "":
+			return fmt.Errorf("set a health check path or command, not both")
+		case h.Path != "" && name != "web":
+			return fmt.Errorf("process type %s doesn't serve HTTP; use a health check command", name)
+		case h.Path != "" && !healthPathPattern.MatchString(h.Path):
+			return fmt.Errorf("invalid health check path %q", h.Path)
+		case strings.ContainsAny(h.Command, "\n\r\x00"):
+			return fmt.Errorf("health check commands can't contain line breaks or NUL bytes")
+		case h.Retries < 0:
+			return fmt.Errorf("health check retries can't be negative")
+		}
+		for field, value := range map[string]string{"interval": h.Interval, "timeout": h.Timeout} {
+			if value == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(value); err != nil || d < time.Second {
+				return fmt.Errorf("invalid health check %s %q: use a duration of at least 1s, like 30s", field, value)
+			}
+		}
+	}
+
+	if stopTimeout != "" {
+		if d, err := time.ParseDuration(stopTimeout); err != nil || d < time.Second {
+			return fmt.Errorf("invalid stop timeout %q: use a duration of at least 1s, like 30s", stopTimeout)
+		}
+	}
+	return nil
+}
+
+// seconds returns a validated duration in whole seconds, or zero if it is
+// unset
+func seconds(value string) int {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return int(d / time.Second)
+}
@@ -0,0 +1,120 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/systemd"
+)
+
+// portFileDir holds the port files of an app's web instances, one per
+// instance, which their units read as an EnvironmentFile. It lives in the
+// app's env file directory so it goes with it when the app is deleted.
+func portFileDir(envFileDir string) string {
+	return filepath.Join(envFileDir, "ports")
+}
+
+// assignPorts gives instances 1..count of an app's web process in a slot a
+// host port each, and writes the port files their units read. It returns
+// the ports in instance order.
+func (e *Engine) assignPorts(appName string, color models.Color, count int) ([]int, error) {
+	e.portMu.Lock()
+	defer e.portMu.Unlock()
+
+	envDir, err := e.envFileDir(appName)
+	if err != nil {
+		return nil, err
+	}
+	dir := portFileDir(envDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create port file directory: %w", err)
+	}
+
+	unit := systemd.UnitName(appName, "web", string(color))
+	ports := make([]int, count)
+	for i := 1; i <= count; i++ {
+		port, err := e.db.AllocatePort(appName, color, i, e.cfg.Ports.Start, e.cfg.Ports.End)
+		if err != nil {
+			return nil, err
+		}
+		data := []byte(fmt.Sprintf("HOST_PORT=%d\n", port))
+		if err := os.WriteFile(systemd.PortFile(dir, unit, i), data, 0600); err != nil {
+			return nil, fmt.Errorf("write port file: %w", err)
+		}
+		ports[i-1] = port
+	}
+	return ports, nil
+}
+
+// releasePorts frees the ports of an app's web instances in a slot above
+// instance keep, which must be stopped, and deletes their port files
+func (e *Engine) releasePorts(appName string, color models.Color, keep int) error {
+	e.portMu.Lock()
+	defer e.portMu.Unlock()
+
+	envDir, err := e.envFileDir(appName)
+	if err != nil {
+		return err
+	}
+	instances, err := e.db.ReleasePorts(appName, color, keep)
+	if err != nil {
+		return err
+	}
+	unit := systemd.UnitName(appName, "web", string(color))
+	for _, i := range instances {
+		if err := os.Remove(systemd.PortFile(portFileDir(envDir), unit, i)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove port file: %w", err)
+		}
+	}
+	return nil
+}
+
+// slotPorts returns the ports of instances 1..count of an app's web
+// process in a slot, stopping at the first instance without one
+func (e *Engine) slotPorts(appName string, color models.Color, count int) ([]int, error) {
+	byInstance, err := e.db.InstancePorts(appName, color)
+	if err != nil {
+		return nil, err
+	}
+	var ports []int
+	for i := 1; i <= count; i++ {
+		port, ok := byInstance[i]
+		if !ok {
+			break
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// recordedPorts returns every port held by an app's web instances in a
+// slot, in instance order, however many instances the formation now wants
+func (e *Engine) recordedPorts(appName string, color models.Color) ([]int, error) {
+	byInstance, err := e.db.InstancePorts(appName, color)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]int, 0, len(byInstance))
+	for i := range byInstance {
+		instances = append(instances, i)
+	}
+	sort.Ints(instances)
+	ports := make([]int, len(instances))
+	for n, i := range instances {
+		ports[n] = byInstance[i]
+	}
+	return ports, nil
+}
+
+// webCount returns the number of web instances among processes
+func webCount(processes []*models.Process) int {
+	for _, p := range processes {
+		if p.Name == "web" {
+			return p.Count
+		}
+	}
+	return 0
+}
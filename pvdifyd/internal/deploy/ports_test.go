@@ -0,0 +1,43 @@
+package deploy
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/philoveracity/pvdifyd/internal/db"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+func TestRecordedPorts(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "pvdify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CreateApp(&models.App{Name: "shop"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous release ran three web instances in blue; the new one
+	// wants one. Draining blue must cover all three.
+	var want []int
+	for i := 1; i <= 3; i++ {
+		port, err := database.AllocatePort("shop", models.ColorBlue, i, 20000, 20100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, port)
+	}
+	e := &Engine{db: database}
+	got, err := e.recordedPorts("shop", models.ColorBlue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recordedPorts = %v, want %v", got, want)
+	}
+}
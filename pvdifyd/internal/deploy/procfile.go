@@ -0,0 +1,70 @@
+package deploy
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// processNamePattern matches process type names. Names end up in unit and
+// container names after the app name and before the slot color, so they
+// can't contain dashes.
+var processNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,29}$`)
+
+// ValidateProcess reports whether a process type can be written to a unit.
+// Its command is a shell command line, as in a Procfile, run with
+// /bin/sh -c in the container; it goes on the unit's ExecStart line, so it
+// must be one line.
+func ValidateProcess(name, command string) error {
+	if !processNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid process type %q: use up to 30 lowercase letters, digits and underscores, starting with a letter", name)
+	}
+	if strings.ContainsAny(command, "\n\r\x00") {
+		return fmt.Errorf("process type %s: commands can't contain line breaks or NUL bytes", name)
+	}
+	return nil
+}
+
+// ParseProcfile reads process types from a Procfile: one "type: command"
+// per line, with blank lines and lines starting with "#" ignored. Types are
+// returned in file order with a zero count.
+func ParseProcfile(data string) ([]*models.Process, error) {
+	var processes []*models.Process
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, command, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("procfile line %d: expected \"type: command\"", n)
+		}
+		name, command = strings.TrimSpace(name), strings.TrimSpace(command)
+		if err := ValidateProcess(name, command); err != nil {
+			return nil, fmt.Errorf("procfile line %d: %w", n, err)
+		}
+		if command == "" {
+			return nil, fmt.Errorf("procfile line %d: %s has no command", n, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("procfile line %d: %s is declared twice", n, name)
+		}
+		seen[name] = true
+
+		processes = append(processes, &models.Process{Name: name, Command: command})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read procfile: %w", err)
+	}
+	if len(processes) == 0 {
+		return nil, fmt.Errorf("procfile declares no process types")
+	}
+	return processes, nil
+}
@@ -0,0 +1,79 @@
+package deploy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProcfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    [][2]string // Name and command of each type, in order
+		wantErr string
+	}{
+		{
+			name: "types in file order",
+			data: "web: bundle exec puma -p $PORT\nworker: bundle exec sidekiq\n",
+			want: [][2]string{{"web", "bundle exec puma -p $PORT"}, {"worker", "bundle exec sidekiq"}},
+		},
+		{
+			name: "comments, blank lines and spacing",
+			data: "# processes\n\n  web :  bin/web  \n\nclock: bin/clock # every minute\n",
+			want: [][2]string{{"web", "bin/web"}, {"clock", "bin/clock # every minute"}},
+		},
+		{
+			name: "colons in the command",
+			data: "release: rake db:migrate && echo ok:done",
+			want: [][2]string{{"release", "rake db:migrate && echo ok:done"}},
+		},
+		{
+			name:    "missing colon",
+			data:    "web bin/web",
+			wantErr: "line 1",
+		},
+		{
+			name:    "empty command",
+			data:    "web: bin/web\nworker:",
+			wantErr: "worker has no command",
+		},
+		{
+			name:    "duplicate type",
+			data:    "web: a\nweb: b",
+			wantErr: "declared twice",
+		},
+		{
+			name:    "invalid type name",
+			data:    "Web-1: a",
+			wantErr: "invalid process type",
+		},
+		{
+			name:    "no types",
+			data:    "# nothing\n",
+			wantErr: "no process types",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processes, err := ParseProcfile(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(processes) != len(tt.want) {
+				t.Fatalf("got %d types, want %d", len(processes), len(tt.want))
+			}
+			for i, p := range processes {
+				if p.Name != tt.want[i][0] || p.Command != tt.want[i][1] || p.Count != 0 {
+					t.Errorf("type %d = %s: %q (count %d), want %s: %q", i, p.Name, p.Command, p.Count, tt.want[i][0], tt.want[i][1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// RunPruner prunes every app, then unused config group versions, on startup
+// and every retention interval until ctx is cancelled. A zero interval
+// disables it.
+func (e *Engine) RunPruner(ctx context.Context) {
+	interval := e.cfg.Retention.Interval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		e.pruneAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Engine) pruneAll(ctx context.Context) {
+	apps, err := e.db.ListApps()
+	if err != nil {
+		e.logger.Error("prune: list apps", "error", err)
+		return
+	}
+	for _, app := range apps {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := e.Prune(ctx, app.Name, false); err != nil {
+			e.logger.Error("prune app", "app", app.Name, "error", err)
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err := e.pruneConfigGroups(); err != nil {
+		e.logger.Error("prune config groups", "error", err)
+	}
+}
+
+// Retention returns the number of newest releases and the age in days under
+// which an app's releases are kept: its own settings, or the configured
+// defaults
+func (e *Engine) Retention(app *models.App) (keepReleases, keepDays int) {
+	keepReleases, keepDays = e.cfg.Retention.KeepReleases, e.cfg.Retention.KeepDays
+	if app.RetainReleases > 0 {
+		keepReleases = app.RetainReleases
+	}
+	if app.RetainDays > 0 {
+		keepDays = app.RetainDays
+	}
+	return keepReleases, keepDays
+}
+
+// Prune deletes the releases and config versions of an app its retention
+// policy no longer keeps, the env files of deleted releases, and images no
+// release uses anymore. A release is kept if it is among the newest, younger
+// than the age limit, or active or still being deployed; a config version is
+// kept by the same rules, if it is the latest, or if a kept release uses it.
+// With dryRun, nothing is deleted and the result lists what would be.
+func (e *Engine) Prune(ctx context.Context, name string, dryRun bool) (*models.PruneResult, error) {
+	unlock, err := e.lockAppContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	app, err := e.db.GetApp(name)
+	if err != nil {
+		return nil, err
+	}
+	if app == nil {
+		return nil, fmt.Errorf("app %s not found", name)
+	}
+
+	keepReleases, keepDays := e.Retention(app)
+	result := &models.PruneResult{
+		AppName:        name,
+		DryRun:         dryRun,
+		KeepReleases:   keepReleases,
+		KeepDays:       keepDays,
+		Releases:       []int{},
+		ConfigVersions: []int{},
+		Images:         []string{},
+	}
+	retained := retainedBy(keepReleases, keepDays)
+
+	releases, err := e.db.ListAllReleases(name)
+	if err != nil {
+		return nil, err
+	}
+	usedConfig := make(map[int]bool)
+	prunedImages := make(map[string]int)
+	var imageOrder []*models.Release
+	for i, release := range releases {
+		switch {
+		case retained(i, release.CreatedAt),
+			release.Status == models.ReleaseStatusActive,
+			release.Status == models.ReleaseStatusPending,
+			release.Status == models.ReleaseStatusDeploying:
+			usedConfig[release.ConfigVersion] = true
+			continue
+		}
+		result.Releases = append(result.Releases, release.Version)
+		ref := release.ImageRef()
+		if prunedImages[ref] == 0 {
+			imageOrder = append(imageOrder, release)
+		}
+		prunedImages[ref]++
+	}
+
+	configs, err := e.db.ListConfigVersionMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, cfg := range configs {
+		if i == 0 || retained(i, cfg.CreatedAt) || usedConfig[cfg.Version] {
+			continue
+		}
+		result.ConfigVersions = append(result.ConfigVersions, cfg.Version)
+	}
+
+	// An image can go once the pruned releases are the only ones, of any
+	// app, that use it
+	var images []string
+	for _, release := range imageOrder {
+		count, err := e.db.CountImageReleases(release.Image, release.ImageDigest)
+		if err != nil {
+			return nil, err
+		}
+		if ref := release.ImageRef(); count == prunedImages[ref] {
+			images = append(images, ref)
+		}
+	}
+
+	if dryRun {
+		result.Images = append(result.Images, images...)
+		return result, nil
+	}
+
+	logger := e.logger.With("app", name)
+	if len(result.Releases) > 0 {
+		if err := e.db.DeleteReleases(name, result.Releases); err != nil {
+			return nil, err
+		}
+	}
+	if len(result.ConfigVersions) > 0 {
+		if err := e.db.DeleteConfigVersions(name, result.ConfigVersions); err != nil {
+			return nil, err
+		}
+	}
+	e.cleanEnvFiles(name, logger)
+
+	// Podman keeps images a container still uses; report just the images
+	// actually removed
+	for _, image := range images {
+		if err := e.podman.RemoveImage(ctx, image); err != nil {
+			logger.Warn("remove image", "image", image, "error", err)
+			continue
+		}
+		result.Images = append(result.Images, image)
+	}
+
+	if len(result.Releases) > 0 || len(result.ConfigVersions) > 0 {
+		logger.Info("pruned releases", "releases", len(result.Releases),
+			"config_versions", len(result.ConfigVersions), "images", len(result.Images))
+	}
+	return result, nil
+}
+
+// pruneConfigGroups deletes config group versions under the configured
+// retention defaults. The latest version of each group and versions pinned
+// by a release are always kept.
+func (e *Engine) pruneConfigGroups() error {
+	pinned, err := e.db.ListPinnedConfigGroupVersions()
+	if err != nil {
+		return err
+	}
+	versions, err := e.db.ListConfigGroupVersionMeta()
+	if err != nil {
+		return err
+	}
+
+	retained := retainedBy(e.cfg.Retention.KeepReleases, e.cfg.Retention.KeepDays)
+	pruned := 0
+	i := 0
+	for n, cfg := range versions {
+		// Versions come newest first within each group
+		if n == 0 || versions[n-1].GroupName != cfg.GroupName {
+			i = 0
+		} else {
+			i++
+		}
+		if i == 0 || retained(i, cfg.CreatedAt) || pinned[models.ReleaseConfigGroup{Name: cfg.GroupName, Version: cfg.Version}] {
+			continue
+		}
+		if err := e.db.DeleteConfigGroupVersion(cfg.GroupName, cfg.Version); err != nil {
+			return err
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		e.logger.Info("pruned config group versions", "versions", pruned)
+	}
+	return nil
+}
+
+// retainedBy returns whether the i-th newest item created at a given time is
+// kept by a retention policy
+func retainedBy(keepNewest, keepDays int) func(i int, createdAt time.Time) bool {
+	cutoff := time.Now().AddDate(0, 0, -keepDays)
+	return func(i int, createdAt time.Time) bool {
+		return i < keepNewest || (keepDays > 0 && createdAt.After(cutoff))
+	}
+}
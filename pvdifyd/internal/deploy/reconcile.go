@@ -0,0 +1,265 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/systemd"
+)
+
+// allColors lists every slot a unit can live in, including the uncolored
+// units written before blue/green deploys
+var allColors = []models.Color{"", models.ColorBlue, models.ColorGreen}
+
+// RunReconciler converges the host to the database on startup, every
+// reconcile interval, and whenever Reconcile is called, until ctx is
+// cancelled
+func (e *Engine) RunReconciler(ctx context.Context) {
+	interval := e.cfg.Deploy.ReconcileInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	e.reconcileAll(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.reconcileAll(ctx)
+		case app := <-e.kick:
+			if err := e.ReconcileApp(ctx, app); err != nil {
+				e.logger.Error("reconcile app", "app", app, "error", err)
+			}
+		}
+	}
+}
+
+// Reconcile asks the reconciler to converge an app as soon as possible,
+// without waiting for the next interval
+func (e *Engine) Reconcile(app string) {
+	select {
+	case e.kick <- app:
+	default:
+		// A pass is already pending; the periodic run will catch up
+	}
+}
+
+func (e *Engine) reconcileAll(ctx context.Context) {
+	apps, err := e.db.ListApps()
+	if err != nil {
+		e.logger.Error("reconcile: list apps", "error", err)
+		return
+	}
+	for _, app := range apps {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := e.ReconcileApp(ctx, app.Name); err != nil {
+			e.logger.Error("reconcile app", "app", app.Name, "error", err)
+		}
+	}
+}
+
+// ReconcileApp makes the host match the app's active release and desired
+// process counts: drifted unit files are rewritten, missing or dead
+// instances are started, surplus instances and instances in the idle slot
+// are stopped. Web instances started get a port and those stopped free
+// theirs, and the app's routes follow; web instances are drained before
+// they are stopped. Apps without an active release are left alone.
+func (e *Engine) ReconcileApp(ctx context.Context, name string) error {
+	unlock := e.lockApp(name)
+	defer unlock()
+
+	app, err := e.db.GetApp(name)
+	if err != nil || app == nil {
+		return err
+	}
+	release, err := e.db.GetActiveRelease(name)
+	if err != nil || release == nil {
+		return err
+	}
+	processes, err := e.db.ListProcesses(name)
+	if err != nil {
+		return err
+	}
+	processes = releaseProcesses(processes, release)
+
+	logger := e.logger.With("app", name, "version", release.Version, "color", app.ActiveColor)
+
+	env, err := e.writeEnvFile(release)
+	if err != nil {
+		return err
+	}
+
+	// Rewrite unit files that no longer match the database
+	drifted := make(map[string]bool)
+	for _, p := range processes {
+		cfg := e.unitConfig(app, p, app.ActiveColor, release.ImageRef(), env)
+		want, err := e.generator.Render(cfg)
+		if err != nil {
+			return err
+		}
+		have, err := e.generator.Current(app.Name, p.Name, string(app.ActiveColor))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(want, have) {
+			continue
+		}
+		if _, err := e.generator.Generate(cfg); err != nil {
+			return err
+		}
+		drifted[p.Name] = true
+		logger.Warn("reconcile: rewrote drifted unit file", "process", p.Name)
+	}
+	if len(drifted) > 0 {
+		if err := e.systemd.DaemonReload(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Web instances get a port before they start and give it up once
+	// stopped
+	routed, err := e.db.InstancePorts(name, app.ActiveColor)
+	if err != nil {
+		return err
+	}
+	count := webCount(processes)
+	if _, err := e.assignPorts(name, app.ActiveColor, count); err != nil {
+		return err
+	}
+	// A removed web process is taken down by its removal job, which drains
+	// it and frees its ports
+	ownsWeb := hasWeb(processes)
+
+	// Web instances scaled away leave the routes, and finish the requests
+	// they have, before they are stopped
+	var surplus []int
+	for i, port := range routed {
+		if i > count {
+			surplus = append(surplus, port)
+		}
+	}
+	if ownsWeb && len(surplus) > 0 {
+		live, err := e.slotPorts(name, app.ActiveColor, count)
+		if err != nil {
+			return err
+		}
+		if err := e.updateRoutes(ctx, name, live); err != nil {
+			return err
+		}
+		if err := e.ReloadRoutes(); err != nil {
+			return err
+		}
+		logger.Info("reconcile: draining instances scaled away", "ports", surplus)
+		if err := e.drain(ctx, logger, surplus); err != nil {
+			return err
+		}
+		maps.DeleteFunc(routed, func(i, _ int) bool { return i > count })
+	}
+
+	for _, p := range processes {
+		unit := systemd.UnitName(app.Name, p.Name, string(app.ActiveColor))
+		if err := e.reconcileUnit(ctx, logger, unit, p.Count, drifted[p.Name]); err != nil {
+			return err
+		}
+
+		// Nothing should run in the idle slot outside of a deploy
+		for _, color := range allColors {
+			if color == app.ActiveColor {
+				continue
+			}
+			if err := e.reconcileUnit(ctx, logger, systemd.UnitName(app.Name, p.Name, string(color)), 0, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The idle slot keeps ports for the next deploy's instances; nothing
+	// deploys to the uncolored slot again
+	for _, color := range allColors {
+		keep := count
+		if color == "" && app.ActiveColor != "" {
+			keep = 0
+		}
+		if !ownsWeb {
+			continue
+		}
+		if err := e.releasePorts(name, color, keep); err != nil {
+			return err
+		}
+	}
+
+	// Spread the domains across the instances again if they changed
+	ports, err := e.db.InstancePorts(name, app.ActiveColor)
+	if err != nil {
+		return err
+	}
+	if ownsWeb && !maps.Equal(routed, ports) {
+		live, err := e.slotPorts(name, app.ActiveColor, count)
+		if err != nil {
+			return err
+		}
+		if err := e.updateRoutes(ctx, name, live); err != nil {
+			return err
+		}
+		if err := e.ReloadRoutes(); err != nil {
+			return err
+		}
+		logger.Info("reconcile: updated routes", "ports", live)
+	}
+
+	e.cleanEnvFiles(name, logger)
+	return nil
+}
+
+// reconcileUnit ensures exactly instances 1..count of unit are running,
+// restarting them if their unit file was rewritten
+func (e *Engine) reconcileUnit(ctx context.Context, logger *slog.Logger, unit string, count int, restart bool) error {
+	for i := 1; i <= count; i++ {
+		status, err := e.systemd.Status(ctx, unit, i)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case status.Active != "active" && status.Active != "activating":
+			if err := e.systemd.Start(ctx, unit, i); err != nil {
+				return err
+			}
+			if err := e.systemd.Enable(ctx, fmt.Sprintf("%s@%d", unit, i)); err != nil {
+				return err
+			}
+			logger.Info("reconcile: started instance", "unit", unit, "instance", i, "was", status.Active)
+		case restart:
+			if err := e.systemd.Restart(ctx, unit, i); err != nil {
+				return err
+			}
+			logger.Info("reconcile: restarted instance with updated unit", "unit", unit, "instance", i)
+		}
+	}
+
+	running, err := e.systemd.ListInstances(ctx, unit)
+	if err != nil {
+		return err
+	}
+	for _, i := range running {
+		if i <= count {
+			continue
+		}
+		if err := e.stopInstance(ctx, unit, i); err != nil {
+			return err
+		}
+		logger.Info("reconcile: stopped surplus instance", "unit", unit, "instance", i)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/proxy"
+)
+
+// Proxy returns the built-in reverse proxy, or nil if it is disabled
+func (e *Engine) Proxy() *proxy.Proxy {
+	return e.proxy
+}
+
+// ReloadRoutes loads the proxy's route table from the domains and the live
+// slots' web instances. It is a no-op without the proxy.
+func (e *Engine) ReloadRoutes() error {
+	if e.proxy == nil {
+		return nil
+	}
+	routes, err := e.db.ListRoutes()
+	if err != nil {
+		return fmt.Errorf("load routes: %w", err)
+	}
+	e.proxy.SetRoutes(routes)
+	return nil
+}
+
+// RunRouteReloader reloads the proxy's route table on startup and every
+// reload interval until ctx is cancelled, picking up domain changes made
+// outside of deploys and reconciles
+func (e *Engine) RunRouteReloader(ctx context.Context) {
+	if e.proxy == nil {
+		return
+	}
+	interval := e.cfg.Proxy.ReloadInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.ReloadRoutes(); err != nil {
+			e.logger.Error("reload routes", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/models"
+	"github.com/philoveracity/pvdifyd/internal/podman"
+	"github.com/philoveracity/pvdifyd/internal/systemd"
+)
+
+// Status reports the runtime state of every desired instance of an app's
+// processes, plus anything running on the host for the app that isn't
+// desired: surplus instances, instances in the idle slot and containers no
+// process accounts for
+func (e *Engine) Status(ctx context.Context, app *models.App, processes []*models.Process) ([]models.ProcessStatus, error) {
+	prefix := "pvdify-" + app.Name + "-"
+
+	containers, err := e.podman.ListContainers(ctx, prefix)
+	if err != nil {
+		// Still report what systemd knows
+		e.logger.Warn("list containers", "app", app.Name, "error", err)
+	}
+	byName := make(map[string]*podman.ContainerInfo, len(containers))
+	for i := range containers {
+		byName[containers[i].Name()] = &containers[i]
+	}
+
+	statuses := []models.ProcessStatus{}
+	seen := make(map[string]bool)
+	for _, p := range processes {
+		for _, color := range allColors {
+			unit := systemd.UnitName(app.Name, p.Name, string(color))
+
+			desired := 0
+			if color == app.ActiveColor {
+				desired = p.Count
+			}
+			instances, err := e.instancesOf(ctx, unit, desired)
+			if err != nil {
+				return nil, err
+			}
+			var ports map[int]int
+			if p.Name == "web" {
+				if ports, err = e.db.InstancePorts(app.Name, color); err != nil {
+					return nil, err
+				}
+			}
+
+			for _, i := range instances {
+				st, err := e.instanceStatus(ctx, unit, i, byName)
+				if err != nil {
+					return nil, err
+				}
+				st.Name = p.Name
+				st.Color = string(color)
+				st.Desired = i <= desired
+				st.Port = ports[i]
+				statuses = append(statuses, st)
+				seen[fmt.Sprintf("%s-%d", unit, i)] = true
+			}
+		}
+	}
+
+	// Containers named like this app's that no process accounts for, except
+	// those of other apps whose names extend this one ("shop" vs "shop-api")
+	others, err := e.db.ListApps()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		name := c.Name()
+		if seen[name] || belongsToOther(name, app.Name, others) {
+			continue
+		}
+		statuses = append(statuses, models.ProcessStatus{
+			State:       c.State,
+			Container:   name,
+			ContainerID: shortID(c.ID),
+			Restarts:    c.Restarts,
+		})
+	}
+
+	return statuses, nil
+}
+
+// instancesOf returns instances 1..desired together with any other
+// instance of unit systemd has loaded, in order
+func (e *Engine) instancesOf(ctx context.Context, unit string, desired int) ([]int, error) {
+	running, err := e.systemd.ListInstances(ctx, unit)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]int, 0, desired+len(running))
+	for i := 1; i <= desired; i++ {
+		instances = append(instances, i)
+	}
+	for _, i := range running {
+		if i > desired {
+			instances = append(instances, i)
+		}
+	}
+	sort.Ints(instances)
+	return instances, nil
+}
+
+// instanceStatus combines the systemd state of one instance with its
+// container's podman state
+func (e *Engine) instanceStatus(ctx context.Context, unit string, instance int, containers map[string]*podman.ContainerInfo) (models.ProcessStatus, error) {
+	svc, err := e.systemd.Status(ctx, unit, instance)
+	if err != nil {
+		return models.ProcessStatus{}, err
+	}
+
+	st := models.ProcessStatus{
+		Instance: instance,
+		State:    svc.Active,
+		SubState: svc.SubState,
+		Restarts: svc.Restarts,
+	}
+
+	name := fmt.Sprintf("%s-%d", unit, instance)
+	c, ok := containers[name]
+	if !ok {
+		return st, nil
+	}
+	st.Container = name
+	st.ContainerID = shortID(c.ID)
+	if c.State != "running" {
+		return st, nil
+	}
+
+	if c.StartedAt > 0 {
+		st.Uptime = time.Since(time.Unix(c.StartedAt, 0)).Round(time.Second).String()
+	}
+	if stats, err := e.podman.GetStats(ctx, name); err == nil {
+		st.CPU = stats.CPU
+		st.Memory = stats.Memory
+	} else {
+		e.logger.Debug("container stats", "container", name, "error", err)
+	}
+	if health, err := e.podman.Health(ctx, name); err == nil {
+		st.Health = health
+	} else {
+		e.logger.Debug("container health", "container", name, "error", err)
+	}
+
+	return st, nil
+}
+
+// belongsToOther reports whether a container matched by app's name prefix
+// actually belongs to another app with a longer, hyphenated name
+func belongsToOther(container, app string, apps []*models.App) bool {
+	for _, other := range apps {
+		if other.Name != app && strings.HasPrefix(other.Name, app+"-") &&
+			strings.HasPrefix(container, "pvdify-"+other.Name+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// shortID truncates a container ID the way podman ps does
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
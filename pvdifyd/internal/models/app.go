@@ -15,28 +15,34 @@ const (
 
 // App represents a deployable application slot
 type App struct {
-	Name        string            `json:"name" db:"name"`
-	Environment string            `json:"environment" db:"environment"`
-	Status      AppStatus         `json:"status" db:"status"`
-	Image       string            `json:"image,omitempty" db:"image"`
-	BindPort    int               `json:"bind_port,omitempty" db:"bind_port"`
-	Resources   *ResourceLimits   `json:"resources,omitempty"`
-	Healthcheck *HealthcheckConfig `json:"healthcheck,omitempty"`
-	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time         `json:"updated_at" db:"updated_at"`
+	Name           string    `json:"name" db:"name"`
+	Environment    string    `json:"environment" db:"environment"`
+	Status         AppStatus `json:"status" db:"status"`
+	Image          string    `json:"image,omitempty" db:"image"`
+	BindPort       int       `json:"bind_port,omitempty"`    // Host port of the live slot's first web instance
+	StandbyPort    int       `json:"standby_port,omitempty"` // Host port of the idle slot's first web instance
+	ActiveColor    Color     `json:"active_color,omitempty" db:"active_color"`
+	RetainReleases int       `json:"retain_releases,omitempty" db:"retain_releases"` // 0 uses retention.keep_releases
+	RetainDays     int       `json:"retain_days,omitempty" db:"retain_days"`         // 0 uses retention.keep_days
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
 }
 
-// ResourceLimits defines container resource constraints
-type ResourceLimits struct {
-	Memory string  `json:"memory" yaml:"memory"` // e.g., "512M"
-	CPU    float64 `json:"cpu" yaml:"cpu"`       // e.g., 0.5
-}
+// Color identifies one of the two slots used for blue/green deploys
+type Color string
+
+const (
+	ColorBlue  Color = "blue"
+	ColorGreen Color = "green"
+)
 
-// HealthcheckConfig defines health check parameters
-type HealthcheckConfig struct {
-	Path     string `json:"path" yaml:"path"`         // e.g., "/health"
-	Interval string `json:"interval" yaml:"interval"` // e.g., "30s"
-	Timeout  string `json:"timeout" yaml:"timeout"`   // e.g., "5s"
+// Other returns the slot a new release should be started in. Apps deployed
+// before blue/green existed have no color and move to blue.
+func (c Color) Other() Color {
+	if c == ColorBlue {
+		return ColorGreen
+	}
+	return ColorBlue
 }
 
 // CreateAppRequest is the payload for creating a new app
@@ -47,7 +53,7 @@ type CreateAppRequest struct {
 
 // UpdateAppRequest is the payload for updating an app
 type UpdateAppRequest struct {
-	Image       *string         `json:"image,omitempty"`
-	Resources   *ResourceLimits `json:"resources,omitempty"`
-	Healthcheck *HealthcheckConfig `json:"healthcheck,omitempty"`
+	Image          *string `json:"image,omitempty"`
+	RetainReleases *int    `json:"retain_releases,omitempty"` // 0 goes back to retention.keep_releases
+	RetainDays     *int    `json:"retain_days,omitempty"`     // 0 goes back to retention.keep_days
 }
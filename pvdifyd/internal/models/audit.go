@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// AuditAction names a kind of audited change
+type AuditAction string
+
+const (
+	AuditAppCreate      AuditAction = "app.create"
+	AuditAppUpdate      AuditAction = "app.update"
+	AuditAppDelete      AuditAction = "app.delete"
+	AuditDeploy         AuditAction = "release.deploy"
+	AuditRollback       AuditAction = "release.rollback"
+	AuditReleasePrune   AuditAction = "release.prune"
+	AuditConfigSet      AuditAction = "config.set"
+	AuditConfigUnset    AuditAction = "config.unset"
+	AuditConfigRestore  AuditAction = "config.restore"
+	AuditConfigReveal   AuditAction = "config.reveal"
+	AuditConfigSecret   AuditAction = "config.secret"
+	AuditGroupCreate    AuditAction = "config_group.create"
+	AuditGroupDelete    AuditAction = "config_group.delete"
+	AuditGroupSet       AuditAction = "config_group.set"
+	AuditGroupUnset     AuditAction = "config_group.unset"
+	AuditGroupReveal    AuditAction = "config_group.reveal"
+	AuditGroupAttach    AuditAction = "config_group.attach"
+	AuditGroupDetach    AuditAction = "config_group.detach"
+	AuditDomainAdd      AuditAction = "domain.add"
+	AuditDomainRemove   AuditAction = "domain.remove"
+	AuditDomainDNS      AuditAction = "domain.dns"
+	AuditProcessScale   AuditAction = "process.scale"
+	AuditFormation      AuditAction = "process.formation"
+	AuditProcessUpdate  AuditAction = "process.update"
+	AuditProcessRestart AuditAction = "process.restart"
+	AuditAccessGrant    AuditAction = "access.grant"
+	AuditAccessRevoke   AuditAction = "access.revoke"
+	AuditTokenCreate    AuditAction = "token.create"
+	AuditTokenRevoke    AuditAction = "token.revoke"
+	AuditKeyRotate      AuditAction = "key.rotate"
+)
+
+// AuditEvent records who changed what and when. Details never hold secret
+// values, only names such as config keys.
+type AuditEvent struct {
+	ID         int64                  `json:"id" db:"id"`
+	AppName    string                 `json:"app_name,omitempty" db:"app_name"` // Empty for events not tied to an app
+	Actor      string                 `json:"actor" db:"actor"`                 // Authenticated subject
+	Action     AuditAction            `json:"action" db:"action"`
+	Target     string                 `json:"target,omitempty" db:"target"` // e.g. release version, domain, grant subject
+	Details    map[string]interface{} `json:"details,omitempty" db:"details"`
+	RequestID  string                 `json:"request_id,omitempty" db:"request_id"`
+	RemoteAddr string                 `json:"remote_addr,omitempty" db:"remote_addr"`
+	CreatedAt  time.Time              `json:"created_at" db:"created_at"`
+}
+
+// AuditFilter narrows an audit log query. Zero fields don't filter.
+type AuditFilter struct {
+	AppName string
+	Actor   string
+	Action  string // Exact action, or a prefix such as "config"
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
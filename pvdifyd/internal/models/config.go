@@ -2,19 +2,109 @@ package models
 
 import "time"
 
-// ConfigVar represents a versioned configuration snapshot
+// ConfigVar represents a versioned configuration snapshot of an app, or of
+// a config group
 type ConfigVar struct {
 	ID        int64     `json:"id" db:"id"`
-	AppName   string    `json:"app_name" db:"app_name"`
+	AppName   string    `json:"app_name,omitempty" db:"app_name"`     // Empty for config group versions
+	GroupName string    `json:"group_name,omitempty" db:"group_name"` // Set for config group versions
 	Version   int       `json:"version" db:"version"`
-	Data      []byte    `json:"-" db:"data"` // SOPS encrypted YAML
+	Data      []byte    `json:"-" db:"data"` // YAML; age encrypted at rest, plaintext once loaded
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
+// Owner names the app or config group the version belongs to, for messages
+func (c *ConfigVar) Owner() string {
+	if c.GroupName != "" {
+		return "group " + c.GroupName
+	}
+	return c.AppName
+}
+
 // ConfigData represents decrypted config key-value pairs
 type ConfigData map[string]string
 
 // SetConfigRequest is the payload for setting config vars
 type SetConfigRequest struct {
-	Vars map[string]string `json:"vars" validate:"required"`
+	Vars    map[string]string `json:"vars" validate:"required"`
+	Replace bool              `json:"replace,omitempty"` // Replace the whole config instead of merging into it
+}
+
+// ConfigChangeResponse is returned when config vars are set or unset. Release
+// and Job are set when the change was released; they are omitted when it was
+// staged or the app has never been deployed.
+type ConfigChangeResponse struct {
+	Version int        `json:"version"`
+	Vars    ConfigData `json:"vars"`    // Secret values masked
+	Secrets []string   `json:"secrets"` // Keys whose values are masked
+	Release *Release   `json:"release,omitempty"`
+	Job     *Job       `json:"job,omitempty"`
+}
+
+// ConfigVersion summarizes a config version, without its values
+type ConfigVersion struct {
+	Version   int       `json:"version"`
+	Keys      []string  `json:"keys"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ConfigVersionDetail is a config version with its values
+type ConfigVersionDetail struct {
+	Version   int        `json:"version"`
+	Vars      ConfigData `json:"vars"`    // Secret values masked unless revealed
+	Secrets   []string   `json:"secrets"` // Secret keys
+	Revealed  bool       `json:"revealed,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"` // Unset for the empty config of a new app
+}
+
+// ConfigDiffChange is the kind of change to a key between config versions
+type ConfigDiffChange string
+
+const (
+	ConfigKeyAdded   ConfigDiffChange = "added"
+	ConfigKeyRemoved ConfigDiffChange = "removed"
+	ConfigKeyChanged ConfigDiffChange = "changed"
+)
+
+// ConfigDiffEntry describes how one key differs between config versions.
+// Values are masked unless requested.
+type ConfigDiffEntry struct {
+	Key    string           `json:"key"`
+	Change ConfigDiffChange `json:"change"`
+	Old    string           `json:"old,omitempty"` // Unset for added keys
+	New    string           `json:"new,omitempty"` // Unset for removed keys
+}
+
+// ConfigDiff lists the keys that differ between two config versions, by key
+type ConfigDiff struct {
+	From    int                `json:"from"`
+	To      int                `json:"to"`
+	Masked  bool               `json:"masked"`
+	Changes []*ConfigDiffEntry `json:"changes"`
+}
+
+// RestoreConfigRequest is the payload for restoring a config version
+type RestoreConfigRequest struct {
+	Version int `json:"version" validate:"required"`
+}
+
+// SecretSource says why a config var is or isn't secret
+type SecretSource string
+
+const (
+	SecretSourcePattern  SecretSource = "pattern"  // Key matches a secret pattern
+	SecretSourceExplicit SecretSource = "explicit" // Marked secret or not secret for the app
+)
+
+// ConfigSecret records whether a config var's value is masked in responses
+type ConfigSecret struct {
+	Key    string       `json:"key"`
+	Secret bool         `json:"secret"`
+	Source SecretSource `json:"source,omitempty"` // Empty for keys that are not secret by default
+}
+
+// SetConfigSecretRequest is the payload for marking a config var secret or
+// not secret
+type SetConfigSecretRequest struct {
+	Secret bool `json:"secret"`
 }
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// ConfigGroup is a named set of config vars shared by several apps, such as
+// SMTP or S3 settings. Like app config, it is versioned.
+type ConfigGroup struct {
+	Name      string    `json:"name" db:"name"`
+	Version   int       `json:"version" db:"-"` // Latest version, 0 before any vars are set
+	Apps      []string  `json:"apps" db:"-"`    // Attached apps
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty" db:"created_by"`
+}
+
+// ConfigGroupDetail is a config group with the vars of its latest version
+type ConfigGroupDetail struct {
+	*ConfigGroup
+	Vars     ConfigData `json:"vars"`     // Secret values masked unless revealed
+	Secrets  []string   `json:"secrets"`  // Keys whose values are secret
+	Revealed bool       `json:"revealed"` // Whether secret values are shown
+}
+
+// ConfigGroupAttachment attaches a config group to an app. Groups with a
+// higher position take precedence over lower ones, and the app's own config
+// over all of them.
+type ConfigGroupAttachment struct {
+	AppName   string    `json:"app_name" db:"app_name"`
+	GroupName string    `json:"group_name" db:"group_name"`
+	Position  int       `json:"position" db:"position"`
+	Version   int       `json:"version" db:"-"` // Latest version of the group
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// CreateConfigGroupRequest is the payload for creating a config group
+type CreateConfigGroupRequest struct {
+	Name string            `json:"name" validate:"required"`
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// AttachConfigGroupRequest is the payload for attaching a config group
+type AttachConfigGroupRequest struct {
+	Position int `json:"position,omitempty"` // 1-based; if omitted, after (above) the attached groups
+}
+
+// ConfigGroupsChangeResponse is returned when config groups are attached to
+// or detached from an app. Release and Job are set when the change was
+// released.
+type ConfigGroupsChangeResponse struct {
+	Groups  []*ConfigGroupAttachment `json:"groups"`
+	Release *Release                 `json:"release,omitempty"`
+	Job     *Job                     `json:"job,omitempty"`
+}
+
+// ConfigGroupChangeResponse is returned when a group's config vars change.
+// Releases lists the releases started on attached apps.
+type ConfigGroupChangeResponse struct {
+	Version  int               `json:"version"`
+	Vars     ConfigData        `json:"vars"`    // Secret values masked
+	Secrets  []string          `json:"secrets"` // Keys whose values are masked
+	Releases []*DeployResponse `json:"releases"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Role is a named set of permissions
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"    // Everything, including managing apps and access
+	RoleDeployer Role = "deployer" // Deploy, scale, restart and manage config
+	RoleViewer   Role = "viewer"   // Read-only, without config values
+)
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	switch r {
+	case RoleAdmin, RoleDeployer, RoleViewer:
+		return true
+	}
+	return false
+}
+
+// Grant gives a subject a role, either globally or on a single app
+type Grant struct {
+	ID        int64     `json:"id" db:"id"`
+	Subject   string    `json:"subject" db:"subject"`             // Access email, or "token:<name>" for API tokens
+	Role      Role      `json:"role" db:"role"`                   // Role granted
+	AppName   string    `json:"app_name,omitempty" db:"app_name"` // Empty for a global grant
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty" db:"created_by"`
+}
+
+// GrantRequest is the payload for granting a role
+type GrantRequest struct {
+	Role Role `json:"role" validate:"required"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// JobStatus represents the state of a background job
+type JobStatus string
+
+const (
+	JobStatusPending   JobStatus = "pending"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+)
+
+// JobKind identifies what a job does
+type JobKind string
+
+const (
+	JobKindDeploy   JobKind = "deploy"
+	JobKindRollback JobKind = "rollback"
+	// JobKindRemoveProcesses stops the instances of removed process types
+	JobKindRemoveProcesses JobKind = "remove_processes"
+	// JobKindRestart restarts the instances of the live release
+	JobKindRestart JobKind = "restart"
+)
+
+// Job tracks a long-running operation such as a deploy
+type Job struct {
+	ID             int64      `json:"id" db:"id"`
+	AppName        string     `json:"app_name" db:"app_name"`
+	Kind           JobKind    `json:"kind" db:"kind"`
+	ReleaseVersion int        `json:"release_version,omitempty" db:"release_version"`
+	Status         JobStatus  `json:"status" db:"status"`
+	Error          string     `json:"error,omitempty" db:"error"`
+	Steps          []*JobStep `json:"steps"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	StartedAt      *time.Time `json:"started_at,omitempty" db:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty" db:"finished_at"`
+}
+
+// Done reports whether the job has finished, successfully or not
+func (j *Job) Done() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed
+}
+
+// JobStep is a single stage of a job
+type JobStep struct {
+	ID         int64      `json:"id" db:"id"`
+	JobID      int64      `json:"-" db:"job_id"`
+	Name       string     `json:"name" db:"name"`
+	Status     JobStatus  `json:"status" db:"status"`
+	Error      string     `json:"error,omitempty" db:"error"`
+	StartedAt  time.Time  `json:"started_at" db:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" db:"finished_at"`
+}
+
+// DeployResponse is returned when a deploy has been queued
+type DeployResponse struct {
+	Release *Release `json:"release"`
+	Job     *Job     `json:"job"`
+}
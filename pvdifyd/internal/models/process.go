@@ -7,15 +7,84 @@ type Process struct {
 	Name    string `json:"name" db:"name"` // e.g., "web", "worker"
 	Command string `json:"command,omitempty" db:"command"`
 	Count   int    `json:"count" db:"count"`
+	// Limits and health check of each instance; nil uses the unit defaults
+	Resources   *ResourceLimits    `json:"resources,omitempty" db:"resources"`
+	Healthcheck *HealthcheckConfig `json:"healthcheck,omitempty" db:"healthcheck"`
+	// How long instances get to exit after SIGTERM before they are killed,
+	// e.g. "30s"; empty uses 10s
+	StopTimeout string `json:"stop_timeout,omitempty" db:"stop_timeout"`
+}
+
+// ResourceLimits defines container resource constraints. Unset fields use
+// the unit defaults.
+type ResourceLimits struct {
+	Memory  string   `json:"memory,omitempty" yaml:"memory"`   // e.g., "512M"
+	CPU     float64  `json:"cpu,omitempty" yaml:"cpu"`         // e.g., 0.5
+	Pids    int      `json:"pids,omitempty" yaml:"pids"`       // Max processes in the container
+	Ulimits []string `json:"ulimits,omitempty" yaml:"ulimits"` // e.g., "nofile=1024:2048"
+}
+
+// HealthcheckConfig defines health check parameters. Web processes can be
+// checked over HTTP at Path; any process by running Command in its
+// container.
+type HealthcheckConfig struct {
+	Path     string `json:"path,omitempty" yaml:"path"`         // e.g., "/health"
+	Command  string `json:"command,omitempty" yaml:"command"`   // e.g., "pgrep -f worker"
+	Interval string `json:"interval,omitempty" yaml:"interval"` // e.g., "30s"
+	Timeout  string `json:"timeout,omitempty" yaml:"timeout"`   // e.g., "5s"
+	Retries  int    `json:"retries,omitempty" yaml:"retries"`
 }
 
 // ProcessStatus represents runtime status of a process instance
 type ProcessStatus struct {
-	Name      string `json:"name"`
-	Instance  int    `json:"instance"`
-	State     string `json:"state"` // running, stopped, failed
-	Container string `json:"container,omitempty"`
-	Uptime    string `json:"uptime,omitempty"`
+	Name        string  `json:"name"`
+	Instance    int     `json:"instance"`
+	Color       string  `json:"color,omitempty"`
+	Port        int     `json:"port,omitempty"`      // Host port of web instances
+	State       string  `json:"state"`               // systemd ActiveState: active, inactive, failed, ...
+	SubState    string  `json:"sub_state,omitempty"` // systemd SubState: running, dead, auto-restart, ...
+	Container   string  `json:"container,omitempty"`
+	ContainerID string  `json:"container_id,omitempty"`
+	Uptime      string  `json:"uptime,omitempty"`
+	Restarts    int     `json:"restarts"`
+	Memory      int64   `json:"memory_bytes,omitempty"`
+	CPU         float64 `json:"cpu_percent"`
+	Health      string  `json:"health,omitempty"` // podman health: healthy, unhealthy, starting
+	Desired     bool    `json:"desired"`          // false for instances running that shouldn't be
+}
+
+// FormationProcess declares a process type. A nil Count keeps the type's
+// current count; new types start with one web instance and no others.
+type FormationProcess struct {
+	Name    string `json:"name"`
+	Command string `json:"command,omitempty"` // Empty runs the image's default command
+	Count   *int   `json:"count,omitempty"`
+}
+
+// FormationRequest is the payload for replacing an app's process types;
+// types it leaves out are removed
+type FormationRequest struct {
+	Processes []FormationProcess `json:"processes"`
+}
+
+// FormationResponse is returned when an app's process types change. Release
+// and Job are set if new commands or types were released; RemovalJob is set
+// if types were removed and their instances are being stopped.
+type FormationResponse struct {
+	Processes  []*Process `json:"processes"`
+	Removed    []string   `json:"removed"`
+	Release    *Release   `json:"release,omitempty"`
+	Job        *Job       `json:"job,omitempty"`
+	RemovalJob *Job       `json:"removal_job,omitempty"`
+}
+
+// UpdateProcessRequest is the payload for changing the limits, health check
+// or stop timeout of a process type. A nil field is left as is; an empty one
+// goes back to the defaults.
+type UpdateProcessRequest struct {
+	Resources   *ResourceLimits    `json:"resources,omitempty"`
+	Healthcheck *HealthcheckConfig `json:"healthcheck,omitempty"`
+	StopTimeout *string            `json:"stop_timeout,omitempty"`
 }
 
 // ScaleRequest is the payload for scaling processes
@@ -1,16 +1,20 @@
 package models
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // ReleaseStatus represents the state of a release
 type ReleaseStatus string
 
 const (
-	ReleaseStatusPending  ReleaseStatus = "pending"
-	ReleaseStatusDeploying ReleaseStatus = "deploying"
-	ReleaseStatusActive   ReleaseStatus = "active"
+	ReleaseStatusPending    ReleaseStatus = "pending"
+	ReleaseStatusDeploying  ReleaseStatus = "deploying"
+	ReleaseStatusActive     ReleaseStatus = "active"
 	ReleaseStatusRolledBack ReleaseStatus = "rolled_back"
-	ReleaseStatusFailed   ReleaseStatus = "failed"
+	ReleaseStatusSuperseded ReleaseStatus = "superseded"
+	ReleaseStatusFailed     ReleaseStatus = "failed"
 )
 
 // Release represents an immutable deployment version
@@ -19,16 +23,71 @@ type Release struct {
 	AppName       string        `json:"app_name" db:"app_name"`
 	Version       int           `json:"version" db:"version"`
 	Image         string        `json:"image" db:"image"`
+	ImageDigest   string        `json:"image_digest,omitempty" db:"image_digest"` // Resolved when the release is first deployed
 	ConfigVersion int           `json:"config_version,omitempty" db:"config_version"`
 	Status        ReleaseStatus `json:"status" db:"status"`
+	FailureReason string        `json:"failure_reason,omitempty" db:"failure_reason"`
 	CreatedAt     time.Time     `json:"created_at" db:"created_at"`
 	CreatedBy     string        `json:"created_by,omitempty" db:"created_by"`
+
+	// Config group versions the release was built with, lowest precedence
+	// first; the app's own config overrides them all
+	ConfigGroups []ReleaseConfigGroup `json:"config_groups,omitempty" db:"-"`
+
+	// Process types the release runs, with their commands. Releases created
+	// before process types were pinned have none and run the app's current
+	// commands.
+	Processes []ReleaseProcess `json:"processes,omitempty" db:"-"`
+}
+
+// ImageRef returns the reference containers of the release run: the image
+// pinned to its digest, so the release always runs the same code even if
+// the tag moves. Releases without a digest run the tag.
+func (r *Release) ImageRef() string {
+	if r.ImageDigest == "" {
+		return r.Image
+	}
+	repo := r.Image
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	// A colon after the last slash starts the tag; one before it is a
+	// registry port
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	return repo + "@" + r.ImageDigest
+}
+
+// ReleaseConfigGroup pins a config group version to a release
+type ReleaseConfigGroup struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+}
+
+// ReleaseProcess pins a process type's command to a release; an empty
+// command runs the image's default
+type ReleaseProcess struct {
+	Name    string `json:"name"`
+	Command string `json:"command,omitempty"`
 }
 
 // CreateReleaseRequest is the payload for creating a new release (deploy)
 type CreateReleaseRequest struct {
-	Image     string `json:"image" validate:"required"`
-	CreatedBy string `json:"created_by,omitempty"`
+	Image    string `json:"image,omitempty"`    // If omitted, redeploy the current image with the latest config
+	Procfile string `json:"procfile,omitempty"` // If set, replaces the app's process types before the release is created
+}
+
+// PruneResult lists what pruning an app removed, or would remove on a dry
+// run, under its retention policy
+type PruneResult struct {
+	AppName        string   `json:"app_name"`
+	DryRun         bool     `json:"dry_run"`
+	KeepReleases   int      `json:"keep_releases"`
+	KeepDays       int      `json:"keep_days"`
+	Releases       []int    `json:"releases"`
+	ConfigVersions []int    `json:"config_versions"`
+	Images         []string `json:"images"`
 }
 
 // RollbackRequest is the payload for rolling back to a previous release
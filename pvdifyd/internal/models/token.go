@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// APIToken is a long-lived credential for non-interactive clients such as
+// CI. Only a hash of the token is stored.
+type APIToken struct {
+	ID         int64      `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	TokenHash  string     `json:"-" db:"token_hash"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"os/exec"
 	"strings"
 	"time"
@@ -53,27 +54,39 @@ func (c *Client) Ping(ctx context.Context) error {
 
 // ContainerInfo represents container information
 type ContainerInfo struct {
-	ID      string `json:"Id"`
-	Name    string `json:"Name"`
-	State   string `json:"State"`
-	Image   string `json:"Image"`
-	Created string `json:"Created"`
-	Ports   []Port `json:"Ports"`
+	ID        string   `json:"Id"`
+	Names     []string `json:"Names"`
+	State     string   `json:"State"`
+	Status    string   `json:"Status"` // e.g. "Up 2 hours (healthy)"
+	Image     string   `json:"Image"`
+	Created   string   `json:"Created"`
+	StartedAt int64    `json:"StartedAt"` // Unix seconds
+	Restarts  int      `json:"Restarts"`
+	Ports     []Port   `json:"Ports"`
+}
+
+// Name returns the container's primary name
+func (c *ContainerInfo) Name() string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return c.Names[0]
 }
 
 // Port represents a port mapping
 type Port struct {
-	HostPort      int    `json:"hostPort"`
-	ContainerPort int    `json:"containerPort"`
+	HostPort      int    `json:"host_port"`
+	ContainerPort int    `json:"container_port"`
 	Protocol      string `json:"protocol"`
 }
 
 // ListContainers returns all containers matching a filter
 func (c *Client) ListContainers(ctx context.Context, namePrefix string) ([]ContainerInfo, error) {
 	filter := fmt.Sprintf(`{"name":["%s"]}`, namePrefix)
-	url := fmt.Sprintf("http://d/v4.0.0/libpod/containers/json?all=true&filters=%s", filter)
+	url := fmt.Sprintf("http://d/v4.0.0/libpod/containers/json?all=true&filters=%s", neturl.QueryEscape(filter))
 
-	resp, err := c.http.Get(url)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("list containers: %w", err)
 	}
@@ -98,6 +111,32 @@ func (c *Client) PullImage(ctx context.Context, image string) error {
 	return nil
 }
 
+// ImageDigest returns the digest of a local image's manifest, such as
+// "sha256:..."
+func (c *Client) ImageDigest(ctx context.Context, image string) (string, error) {
+	cmd := exec.CommandContext(ctx, "podman", "image", "inspect", "--format", "{{.Digest}}", image)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("inspect image: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	digest := strings.TrimSpace(string(output))
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("image %s has no digest", image)
+	}
+	return digest, nil
+}
+
+// RemoveImage removes a local image. Podman refuses to remove an image a
+// container still uses.
+func (c *Client) RemoveImage(ctx context.Context, image string) error {
+	cmd := exec.CommandContext(ctx, "podman", "rmi", image)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("remove image: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
 // ImageExists checks if an image exists locally
 func (c *Client) ImageExists(ctx context.Context, image string) (bool, error) {
 	url := fmt.Sprintf("http://d/v4.0.0/libpod/images/%s/exists", image)
@@ -144,25 +183,71 @@ func (c *Client) RemoveContainer(ctx context.Context, name string, force bool) e
 
 // ContainerStats represents container resource usage
 type ContainerStats struct {
-	CPU    float64 `json:"cpu_percent"`
-	Memory int64   `json:"memory"`
+	CPU         float64 `json:"CPU"`      // Percent of one CPU
+	Memory      int64   `json:"MemUsage"` // Bytes
+	MemoryLimit int64   `json:"MemLimit"` // Bytes
 }
 
 // GetStats returns resource stats for a container
 func (c *Client) GetStats(ctx context.Context, name string) (*ContainerStats, error) {
-	url := fmt.Sprintf("http://d/v4.0.0/libpod/containers/%s/stats?stream=false", name)
-	resp, err := c.http.Get(url)
+	url := fmt.Sprintf("http://d/v4.0.0/libpod/containers/stats?containers=%s&stream=false", name)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("get stats: %w", err)
 	}
 	defer resp.Body.Close()
 
-	var stats ContainerStats
-	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+	var body struct {
+		Error string           `json:"Error"`
+		Stats []ContainerStats `json:"Stats"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
 		return nil, fmt.Errorf("decode stats: %w", err)
 	}
+	if body.Error != "" {
+		return nil, fmt.Errorf("get stats: %s", body.Error)
+	}
+	if len(body.Stats) == 0 {
+		return nil, fmt.Errorf("no stats for container %s", name)
+	}
+
+	return &body.Stats[0], nil
+}
 
-	return &stats, nil
+// Health returns the podman health check status of a container: "healthy",
+// "unhealthy", "starting", or "" if it has no health check
+func (c *Client) Health(ctx context.Context, name string) (string, error) {
+	url := fmt.Sprintf("http://d/v4.0.0/libpod/containers/%s/json", name)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("inspect container: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("inspect container returned %d", resp.StatusCode)
+	}
+
+	// Podman 4 reports health under Healthcheck, later versions under Health
+	var inspect struct {
+		State struct {
+			Health      *struct{ Status string } `json:"Health"`
+			Healthcheck *struct{ Status string } `json:"Healthcheck"`
+		} `json:"State"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return "", fmt.Errorf("decode inspect: %w", err)
+	}
+
+	switch {
+	case inspect.State.Health != nil:
+		return inspect.State.Health.Status, nil
+	case inspect.State.Healthcheck != nil:
+		return inspect.State.Healthcheck.Status, nil
+	}
+	return "", nil
 }
 
 // HealthCheck performs a health check on a container's exposed port
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/config"
+)
+
+// Balancing strategies
+const (
+	RoundRobin = "round_robin"
+	LeastConn  = "least_conn"
+)
+
+// Proxy routes HTTP requests by hostname to the web instances of the app
+// that owns it, balancing across them. Instances that refuse or drop
+// connections are ejected for a while. Upgraded connections (WebSockets)
+// and streamed responses (server-sent events) pass straight through.
+type Proxy struct {
+	balance   string
+	maxFails  int
+	ejectTime time.Duration
+	transport http.RoundTripper
+	logger    *slog.Logger
+
+	mu     sync.RWMutex
+	routes map[string]*pool
+	// backends outlive route reloads so their connection counts and
+	// ejections carry over
+	backends map[int]*backend
+}
+
+// pool is the set of instances behind a hostname
+type pool struct {
+	backends []*backend
+	next     atomic.Uint64
+}
+
+// backend is a web instance, reached on its host port
+type backend struct {
+	port    int
+	proxy   *httputil.ReverseProxy
+	conns   atomic.Int64
+	mu      sync.Mutex
+	fails   int
+	ejected time.Time // Ejected until
+}
+
+// New creates a proxy with an empty route table
+func New(cfg config.ProxyConfig, logger *slog.Logger) (*Proxy, error) {
+	switch cfg.Balance {
+	case RoundRobin, LeastConn:
+	default:
+		return nil, fmt.Errorf("unknown proxy balance %q: use %s or %s", cfg.Balance, RoundRobin, LeastConn)
+	}
+
+	ejectTime := cfg.EjectTime
+	if ejectTime <= 0 {
+		ejectTime = 30 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.MaxIdleConnsPerHost = 32
+
+	return &Proxy{
+		balance:   cfg.Balance,
+		maxFails:  max(cfg.MaxFails, 1),
+		ejectTime: ejectTime,
+		transport: transport,
+		logger:    logger,
+		routes:    make(map[string]*pool),
+		backends:  make(map[int]*backend),
+	}, nil
+}
+
+// SetRoutes replaces the route table with the host ports behind each
+// hostname. Requests already in flight finish on the instance they were
+// sent to.
+func (p *Proxy) SetRoutes(routes map[string][]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	table := make(map[string]*pool, len(routes))
+	backends := make(map[int]*backend)
+	for hostname, ports := range routes {
+		pl := &pool{}
+		for _, port := range ports {
+			b, ok := backends[port]
+			if !ok {
+				if b, ok = p.backends[port]; !ok {
+					b = p.newBackend(port)
+				}
+				backends[port] = b
+			}
+			pl.backends = append(pl.backends, b)
+		}
+		// Keep the rotation where it was so a reload doesn't send the next
+		// requests to the first instance
+		if old, ok := p.routes[normalize(hostname)]; ok {
+			pl.next.Store(old.next.Load())
+		}
+		table[normalize(hostname)] = pl
+	}
+	// Instances taken out of routing stay known until their requests in
+	// flight finish, so they can be drained
+	for port, b := range p.backends {
+		if _, ok := backends[port]; !ok && b.conns.Load() > 0 {
+			backends[port] = b
+		}
+	}
+	p.routes = table
+	p.backends = backends
+}
+
+// Connections returns the number of requests in flight to the instances on
+// host ports, including open WebSocket and event stream connections
+func (p *Proxy) Connections(ports ...int) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	n := 0
+	for _, port := range ports {
+		if b, ok := p.backends[port]; ok {
+			n += int(b.conns.Load())
+		}
+	}
+	return n
+}
+
+// ListenAndServe accepts app traffic on addr until ctx is cancelled
+func (p *Proxy) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           p,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          slog.NewLogLogger(p.logger.Handler(), slog.LevelWarn),
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	p.logger.Info("starting proxy", "addr", addr, "balance", p.balance)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP forwards a request to an instance of the app behind its host.
+// Requests without a body are retried on another instance if the first
+// can't be connected to, since nothing has been sent yet.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	retry := r.Body == nil || r.Body == http.NoBody
+	tried := make(map[*backend]bool)
+	for {
+		b, routed := p.acquire(r.Host, tried)
+		if !routed {
+			http.Error(w, "no app is routed at this hostname", http.StatusNotFound)
+			return
+		}
+		if b == nil {
+			http.Error(w, "no instance is available", http.StatusBadGateway)
+			return
+		}
+		tried[b] = true
+
+		var failed error
+		req := r
+		if retry {
+			req = r.WithContext(context.WithValue(r.Context(), dialFailedKey{}, &failed))
+		}
+
+		// ReverseProxy panics with http.ErrAbortHandler when a response
+		// can't be copied, so the count is released on the way out
+		func() {
+			defer b.conns.Add(-1)
+			b.proxy.ServeHTTP(w, req)
+		}()
+
+		if failed == nil {
+			return
+		}
+		p.logger.Debug("proxy: retrying on another instance", "host", r.Host, "port", b.port, "error", failed)
+	}
+}
+
+// acquire picks an instance behind host and counts a request in flight to
+// it, in one step so a route reload can't lose track of the request. It
+// reports whether any instance is routed at host.
+func (p *Proxy) acquire(host string, tried map[*backend]bool) (*backend, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	pl := p.routes[normalize(host)]
+	if pl == nil || len(pl.backends) == 0 {
+		return nil, false
+	}
+	b := p.pick(pl, tried)
+	if b != nil {
+		b.conns.Add(1)
+	}
+	return b, true
+}
+
+// pick chooses an instance of pl that hasn't been tried for this request.
+// Ejected instances are only used once none are left, since a request to
+// an instance that may have recovered beats an error.
+func (p *Proxy) pick(pl *pool, tried map[*backend]bool) *backend {
+	now := time.Now()
+	var candidates, ejected []*backend
+	for _, b := range pl.backends {
+		switch {
+		case tried[b]:
+		case b.isEjected(now):
+			ejected = append(ejected, b)
+		default:
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Start at the next instance in turn; least_conn uses the rotation to
+	// break ties
+	start := int(pl.next.Add(1)-1) % len(candidates)
+	if p.balance == RoundRobin {
+		return candidates[start]
+	}
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		b := candidates[(start+i)%len(candidates)]
+		if b.conns.Load() < best.conns.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+// dialFailedKey marks a request that can be retried. Its value points at
+// the error to report when an instance can't be connected to.
+type dialFailedKey struct{}
+
+func (p *Proxy) newBackend(port int) *backend {
+	b := &backend{port: port}
+	target := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", port)}
+	b.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Host = r.In.Host
+			// cloudflared connects over loopback and already says who the
+			// client is and how it connected
+			trusted := fromLoopback(r.In)
+			if trusted {
+				r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
+			}
+			r.SetXForwarded()
+			if proto := r.In.Header.Get("X-Forwarded-Proto"); trusted && proto != "" {
+				r.Out.Header.Set("X-Forwarded-Proto", proto)
+			}
+		},
+		Transport: p.transport,
+		ModifyResponse: func(*http.Response) error {
+			b.succeeded()
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// The client went away; that says nothing about the instance
+			if r.Context().Err() != nil {
+				return
+			}
+			if b.failed(time.Now(), p.maxFails, p.ejectTime) {
+				p.logger.Warn("proxy: ejected instance", "port", b.port, "for", p.ejectTime.String(), "error", err)
+			}
+			if failed, ok := r.Context().Value(dialFailedKey{}).(*error); ok && isDialError(err) {
+				*failed = err
+				return
+			}
+			p.logger.Debug("proxy: request failed", "host", r.Host, "port", b.port, "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return b
+}
+
+func (b *backend) isEjected(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.ejected)
+}
+
+func (b *backend) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails = 0
+	b.ejected = time.Time{}
+}
+
+// failed records a failed request, and ejects the instance once it has
+// failed maxFails times in a row. It reports whether the instance was
+// ejected.
+func (b *backend) failed(now time.Time, maxFails int, ejectTime time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	if b.fails < maxFails || now.Before(b.ejected) {
+		return false
+	}
+	b.ejected = now.Add(ejectTime)
+	return true
+}
+
+// isDialError reports whether err happened before the request was sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// fromLoopback reports whether a request came from this host
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// normalize lowercases a hostname and strips its port and trailing dot
+func normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/philoveracity/pvdifyd/internal/config"
+)
+
+func newTestProxy(t *testing.T, balance string) *Proxy {
+	t.Helper()
+	p, err := New(config.ProxyConfig{Balance: balance, MaxFails: 1, EjectTime: time.Minute}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestNewRejectsUnknownBalance(t *testing.T) {
+	if _, err := New(config.ProxyConfig{Balance: "random"}, slog.Default()); err == nil {
+		t.Fatal("expected an error for an unknown balance")
+	}
+}
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance string
+		conns   []int64
+		ejected []bool
+		tried   []bool
+		picks   []int // Indexes of the backends picked by successive calls, -1 for none
+	}{
+		{
+			name:    "round robin rotates",
+			balance: RoundRobin,
+			conns:   []int64{0, 0, 0},
+			picks:   []int{0, 1, 2, 0},
+		},
+		{
+			name:    "round robin ignores connections",
+			balance: RoundRobin,
+			conns:   []int64{5, 0},
+			picks:   []int{0, 1, 0},
+		},
+		{
+			name:    "least conn prefers the idlest",
+			balance: LeastConn,
+			conns:   []int64{4, 1, 3},
+			picks:   []int{1, 1, 1},
+		},
+		{
+			name:    "least conn breaks ties in turn",
+			balance: LeastConn,
+			conns:   []int64{2, 2},
+			picks:   []int{0, 1, 0},
+		},
+		{
+			name:    "ejected skipped",
+			balance: RoundRobin,
+			conns:   []int64{0, 0},
+			ejected: []bool{true, false},
+			picks:   []int{1, 1},
+		},
+		{
+			name:    "ejected used when none left",
+			balance: RoundRobin,
+			conns:   []int64{0, 0},
+			ejected: []bool{true, true},
+			picks:   []int{0, 1},
+		},
+		{
+			name:    "tried skipped",
+			balance: RoundRobin,
+			conns:   []int64{0, 0},
+			tried:   []bool{false, true},
+			picks:   []int{0, 0},
+		},
+		{
+			name:    "all tried",
+			balance: LeastConn,
+			conns:   []int64{0},
+			tried:   []bool{true},
+			picks:   []int{-1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, tt.balance)
+			pl := &pool{}
+			tried := make(map[*backend]bool)
+			for i, n := range tt.conns {
+				b := p.newBackend(9000 + i)
+				b.conns.Store(n)
+				if i < len(tt.ejected) && tt.ejected[i] {
+					b.ejected = time.Now().Add(time.Minute)
+				}
+				if i < len(tt.tried) && tt.tried[i] {
+					tried[b] = true
+				}
+				pl.backends = append(pl.backends, b)
+			}
+
+			for call, want := range tt.picks {
+				got := p.pick(pl, tried)
+				switch {
+				case want < 0 && got != nil:
+					t.Fatalf("call %d: picked port %d, want none", call, got.port)
+				case want >= 0 && got != pl.backends[want]:
+					t.Fatalf("call %d: picked %v, want port %d", call, got, pl.backends[want].port)
+				}
+			}
+		})
+	}
+}
+
+func TestSetRoutes(t *testing.T) {
+	p := newTestProxy(t, RoundRobin)
+	p.SetRoutes(map[string][]int{
+		"Shop.Example.com.": {9001, 9002},
+		"api.example.com":   {9002},
+	})
+
+	shop := p.routes["shop.example.com"]
+	api := p.routes["api.example.com"]
+	if shop == nil || api == nil {
+		t.Fatalf("routes not normalized: %v", p.routes)
+	}
+	if shop.backends[1] != api.backends[0] {
+		t.Error("a port routed at two hostnames should share one backend")
+	}
+
+	// Rotation and backends carry over a reload
+	shop.next.Store(7)
+	kept := shop.backends[0]
+	kept.conns.Store(1)
+	drained := p.backends[9002]
+	p.SetRoutes(map[string][]int{"shop.example.com": {9001, 9003}})
+
+	if got := p.routes["shop.example.com"].next.Load(); got != 7 {
+		t.Errorf("rotation = %d after reload, want 7", got)
+	}
+	if p.routes["shop.example.com"].backends[0] != kept {
+		t.Error("backend was replaced by a reload")
+	}
+	if _, ok := p.routes["api.example.com"]; ok {
+		t.Error("unrouted hostname kept")
+	}
+	if _, ok := p.backends[9002]; ok {
+		t.Error("idle unrouted backend kept")
+	}
+
+	// An unrouted backend with requests in flight is kept until they finish
+	drained.conns.Store(0)
+	kept.conns.Store(2)
+	p.SetRoutes(nil)
+	if got := p.Connections(9001); got != 2 {
+		t.Errorf("Connections(9001) = %d after unrouting, want 2", got)
+	}
+	kept.conns.Store(0)
+	p.SetRoutes(nil)
+	if len(p.backends) != 0 {
+		t.Errorf("backends = %v after draining, want none", p.backends)
+	}
+}
+
+func TestAbortedResponseReleasesConnection(t *testing.T) {
+	// The instance promises a body and dies partway through it
+	instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer instance.Close()
+	_, portStr, _ := net.SplitHostPort(instance.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	p := newTestProxy(t, LeastConn)
+	p.SetRoutes(map[string][]int{"shop.example.com": {port}})
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL, nil)
+	req.Host = "shop.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Connections(port) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Connections(%d) = %d after an aborted response, want 0", port, p.Connections(port))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
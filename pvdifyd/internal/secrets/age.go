@@ -0,0 +1,261 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+)
+
+// ageHeader starts every binary age file
+const ageHeader = "age-encryption.org/v1\n"
+
+// Keyring encrypts config data to the recipients of all its keys and
+// decrypts it with any of them. A keyring loaded from a file follows
+// changes to it, so keys can be rotated while pvdifyd is running.
+type Keyring struct {
+	path string // Empty for keyrings not backed by a file
+
+	mu         sync.RWMutex
+	info       os.FileInfo
+	identities []*age.X25519Identity
+}
+
+// NewKeyring creates a keyring from identities. The first is the primary
+// key; the others are kept during a rotation.
+func NewKeyring(identities ...*age.X25519Identity) *Keyring {
+	return &Keyring{identities: identities}
+}
+
+// Load reads age identities from a key file in age-keygen format, or uses
+// key directly if it is an AGE-SECRET-KEY itself
+func Load(key string) (*Keyring, error) {
+	if strings.HasPrefix(key, "AGE-SECRET-KEY-") {
+		identities, err := parseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, err
+		}
+		return NewKeyring(identities...), nil
+	}
+
+	k := &Keyring{path: key}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadOrCreate loads the key file at path, first generating a new key there
+// if none exists. created reports whether a key was generated.
+func LoadOrCreate(path string) (k *Keyring, created bool, err error) {
+	if strings.HasPrefix(path, "AGE-SECRET-KEY-") {
+		k, err = Load(path)
+		return k, false, err
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := GenerateKeyFile(path); err != nil {
+			return nil, false, err
+		}
+		created = true
+	}
+
+	k, err = Load(path)
+	return k, created, err
+}
+
+// GenerateKeyFile writes a new X25519 key to path in age-keygen format,
+// readable only by its owner. It refuses to overwrite an existing file.
+func GenerateKeyFile(path string) error {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return fmt.Errorf("generate age key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create age key directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create age key: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(formatKeys(id)); err != nil {
+		return fmt.Errorf("write age key: %w", err)
+	}
+	return f.Close()
+}
+
+// WriteKeyFile atomically replaces the key file at path with identities,
+// primary key first
+func WriteKeyFile(path string, identities ...*age.X25519Identity) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".age-key-*")
+	if err != nil {
+		return fmt.Errorf("create age key: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod age key: %w", err)
+	}
+	if _, err := tmp.Write(formatKeys(identities...)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write age key: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync age key: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write age key: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replace age key: %w", err)
+	}
+	return nil
+}
+
+// formatKeys renders identities in age-keygen format
+func formatKeys(identities ...*age.X25519Identity) []byte {
+	var buf bytes.Buffer
+	for _, id := range identities {
+		fmt.Fprintf(&buf, "# created: %s\n# public key: %s\n%s\n",
+			time.Now().Format(time.RFC3339), id.Recipient(), id)
+	}
+	return buf.Bytes()
+}
+
+// parseIdentities reads X25519 identities in age-keygen format
+func parseIdentities(r io.Reader) ([]*age.X25519Identity, error) {
+	parsed, err := age.ParseIdentities(r)
+	if err != nil {
+		return nil, fmt.Errorf("parse age key: %w", err)
+	}
+
+	identities := make([]*age.X25519Identity, 0, len(parsed))
+	for _, id := range parsed {
+		x, ok := id.(*age.X25519Identity)
+		if !ok {
+			return nil, errors.New("parse age key: only X25519 keys are supported")
+		}
+		identities = append(identities, x)
+	}
+	return identities, nil
+}
+
+// refresh reloads the key file if it has been replaced since it was last
+// read. A key file that can't be read is an error rather than a reason to
+// keep using keys that may have been retired.
+func (k *Keyring) refresh() error {
+	if k.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("stat age key: %w", err)
+	}
+
+	k.mu.RLock()
+	unchanged := k.info != nil && os.SameFile(k.info, info) && k.info.ModTime().Equal(info.ModTime())
+	k.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return fmt.Errorf("open age key: %w", err)
+	}
+	defer f.Close()
+
+	identities, err := parseIdentities(f)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.identities = identities
+	k.info = info
+	k.mu.Unlock()
+	return nil
+}
+
+// Identities returns the keyring's keys, primary first
+func (k *Keyring) Identities() ([]*age.X25519Identity, error) {
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]*age.X25519Identity(nil), k.identities...), nil
+}
+
+// Encrypt encrypts plaintext to every key of the keyring, so that during a
+// rotation both the old and new keys can read it
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, error) {
+	identities, err := k.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make([]age.Recipient, len(identities))
+	for i, id := range identities {
+		recipients[i] = id.Recipient()
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt decrypts data encrypted to any key of the keyring
+func (k *Keyring) Decrypt(ciphertext []byte) ([]byte, error) {
+	if !k.IsEncrypted(ciphertext) {
+		return nil, errors.New("decrypt: data is not age encrypted")
+	}
+
+	identities, err := k.Identities()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]age.Identity, len(identities))
+	for i, id := range identities {
+		ids[i] = id
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), ids...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// IsEncrypted reports whether data is a binary age file
+func (k *Keyring) IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageHeader))
+}
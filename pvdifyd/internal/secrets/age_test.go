@@ -0,0 +1,141 @@
+package secrets
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func newIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k := NewKeyring(newIdentity(t))
+	plaintext := []byte("DATABASE_URL: postgres://u:p@db/app\nEMPTY: \"\"\n")
+
+	ciphertext, err := k.Encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.IsEncrypted(ciphertext) {
+		t.Error("ciphertext isn't recognized as encrypted")
+	}
+	if bytes.Contains(ciphertext, []byte("postgres")) {
+		t.Error("ciphertext contains the plaintext")
+	}
+	got, err := k.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("decrypted %q, want %q", got, plaintext)
+	}
+
+	if k.IsEncrypted(plaintext) {
+		t.Error("plaintext is recognized as encrypted")
+	}
+	if _, err := k.Decrypt(plaintext); err == nil {
+		t.Error("decrypting plaintext succeeded")
+	}
+	if _, err := NewKeyring(newIdentity(t)).Decrypt(ciphertext); err == nil {
+		t.Error("another key decrypted the ciphertext")
+	}
+}
+
+func TestKeyringEncryptsToEveryKey(t *testing.T) {
+	primary, old := newIdentity(t), newIdentity(t)
+	ciphertext, err := NewKeyring(primary, old).Encrypt([]byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, id := range map[string]*age.X25519Identity{"primary": primary, "old": old} {
+		if _, err := NewKeyring(id).Decrypt(ciphertext); err != nil {
+			t.Errorf("%s key can't decrypt: %v", name, err)
+		}
+	}
+}
+
+func TestLoadOrCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "age.key")
+
+	k, created, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("created = false for a missing key file")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file mode = %v, want 0600", perm)
+	}
+	ciphertext, err := k.Encrypt([]byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second start loads the same key rather than generating another
+	k, created, err = LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("created = true for an existing key file")
+	}
+	if _, err := k.Decrypt(ciphertext); err != nil {
+		t.Errorf("reloaded key can't decrypt: %v", err)
+	}
+}
+
+func TestLoadKeyString(t *testing.T) {
+	id := newIdentity(t)
+	k, err := Load(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := k.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].String() != id.String() {
+		t.Errorf("identities = %v, want the key given", identities)
+	}
+}
+
+func TestKeyringFollowsKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "age.key")
+	first, second := newIdentity(t), newIdentity(t)
+	if err := WriteKeyFile(path, first); err != nil {
+		t.Fatal(err)
+	}
+	k, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteKeyFile(path, second); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := k.Encrypt([]byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyring(second).Decrypt(ciphertext); err != nil {
+		t.Errorf("keyring didn't pick up the replaced key file: %v", err)
+	}
+	if _, err := NewKeyring(first).Decrypt(ciphertext); err == nil {
+		t.Error("keyring still encrypts to the replaced key")
+	}
+}
@@ -0,0 +1,161 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"filippo.io/age"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+// rotateGrace is how long rotation waits after retiring the old key for
+// writes that started with the previous key file to finish. Tests shorten
+// it.
+var rotateGrace = 2 * time.Second
+
+// Store gives key rotation raw access to the encrypted config versions of
+// apps and config groups
+type Store interface {
+	ListEncryptedConfig() ([]*models.ConfigVar, error) // Data is left encrypted
+	UpdateEncryptedConfig(row *models.ConfigVar, data []byte) error
+}
+
+// Rotate replaces the key in the key file at path with a new one and
+// re-encrypts every config version to it, while pvdifyd keeps running:
+//
+//  1. The new key is added in front of the old one. pvdifyd picks up the
+//     file change and encrypts new config to both keys.
+//  2. Every config version is re-encrypted to the new key only.
+//  3. Every config version is verified to decrypt with the new key alone;
+//     any still readable by the old key (written concurrently) is
+//     re-encrypted again. Nothing is retired unless this passes.
+//  4. The old key is removed from the key file, and config written while it
+//     was being removed is re-encrypted.
+//
+// If rotation is interrupted, running it again resumes with the new key
+// already in the file instead of generating another one.
+func Rotate(path string, store Store, logf func(format string, args ...interface{})) error {
+	current, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if current.path == "" {
+		return errors.New("rotation needs sops.age_key to be a key file, not a literal key")
+	}
+	keys, err := current.Identities()
+	if err != nil {
+		return err
+	}
+
+	var next *age.X25519Identity
+	var old []*age.X25519Identity
+	if len(keys) > 1 {
+		next, old = keys[0], keys[1:]
+		logf("Resuming interrupted rotation to %s", next.Recipient())
+	} else {
+		next, err = age.GenerateX25519Identity()
+		if err != nil {
+			return fmt.Errorf("generate age key: %w", err)
+		}
+		old = keys
+		if err := WriteKeyFile(path, append([]*age.X25519Identity{next}, old...)...); err != nil {
+			return err
+		}
+		logf("Added new key %s", next.Recipient())
+	}
+
+	all := NewKeyring(append([]*age.X25519Identity{next}, old...)...)
+	nextOnly := NewKeyring(next)
+	oldOnly := NewKeyring(old...)
+
+	// Re-encrypt everything to the new key
+	rows, err := store.ListEncryptedConfig()
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := reencrypt(store, row, all, nextOnly); err != nil {
+			return err
+		}
+	}
+	logf("Re-encrypted %d config versions", len(rows))
+
+	// Verify before the old key is gone for good
+	for pass := 0; ; pass++ {
+		stale, err := staleRows(store, nextOnly, oldOnly)
+		if err != nil {
+			return fmt.Errorf("verify: %w; old key kept", err)
+		}
+		if len(stale) == 0 {
+			break
+		}
+		if pass == 5 {
+			return fmt.Errorf("verify: %d config versions keep being written with the old key; old key kept", len(stale))
+		}
+		for _, row := range stale {
+			if err := reencrypt(store, row, all, nextOnly); err != nil {
+				return err
+			}
+		}
+	}
+	logf("Verified all config versions decrypt with the new key")
+
+	if err := WriteKeyFile(path, next); err != nil {
+		return err
+	}
+	logf("Retired %d old key(s)", len(old))
+
+	// Catch writes that loaded the two-key file just before it was replaced
+	time.Sleep(rotateGrace)
+	stale, err := staleRows(store, nextOnly, oldOnly)
+	if err != nil {
+		return fmt.Errorf("final check: %w", err)
+	}
+	for _, row := range stale {
+		if err := reencrypt(store, row, all, nextOnly); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reencrypt decrypts a config version with from and stores it encrypted
+// with to
+func reencrypt(store Store, row *models.ConfigVar, from, to *Keyring) error {
+	plaintext, err := from.Decrypt(row.Data)
+	if err != nil {
+		return fmt.Errorf("decrypt config %s v%d: %w", row.Owner(), row.Version, err)
+	}
+	data, err := to.Encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("encrypt config %s v%d: %w", row.Owner(), row.Version, err)
+	}
+	if err := store.UpdateEncryptedConfig(row, data); err != nil {
+		return err
+	}
+	row.Data = data
+	return nil
+}
+
+// staleRows returns config versions the old key can still read. It fails if
+// any can't be read with the new key.
+func staleRows(store Store, next, old *Keyring) ([]*models.ConfigVar, error) {
+	rows, err := store.ListEncryptedConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []*models.ConfigVar
+	for _, row := range rows {
+		if _, err := old.Decrypt(row.Data); err == nil {
+			stale = append(stale, row)
+			continue
+		}
+		if _, err := next.Decrypt(row.Data); err != nil {
+			return nil, fmt.Errorf("config %s v%d doesn't decrypt with the new key: %w", row.Owner(), row.Version, err)
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,199 @@
+package secrets
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/philoveracity/pvdifyd/internal/db"
+	"github.com/philoveracity/pvdifyd/internal/models"
+)
+
+func init() {
+	rotateGrace = 0
+}
+
+// newRotateDB returns a database whose config is encrypted with the key
+// file at the returned path, holding versions of two apps and a group
+func newRotateDB(t *testing.T) (*db.DB, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "age.key")
+	if err := GenerateKeyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := db.New(filepath.Join(dir, "pvdify.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	database.SetCipher(keyring)
+
+	for _, app := range []string{"shop", "blog"} {
+		if err := database.CreateApp(&models.App{Name: app}); err != nil {
+			t.Fatal(err)
+		}
+		for v := 1; v <= 3; v++ {
+			if _, err := database.CreateConfigVersion(app, fmt.Appendf(nil, "APP: %s\nV: %d\n", app, v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := database.CreateConfigGroup("smtp", "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateConfigGroupVersion("smtp", []byte("SMTP_HOST: mail\n")); err != nil {
+		t.Fatal(err)
+	}
+	return database, path
+}
+
+func keyFileIdentities(t *testing.T, path string) []*age.X25519Identity {
+	t.Helper()
+	k, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := k.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// checkEncryptedTo fails unless every config version decrypts with only
+// and with none of the others
+func checkEncryptedTo(t *testing.T, store Store, only *age.X25519Identity, others ...*age.X25519Identity) {
+	t.Helper()
+	rows, err := store.ListEncryptedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 7 {
+		t.Fatalf("%d config versions, want 7", len(rows))
+	}
+	for _, row := range rows {
+		if _, err := NewKeyring(only).Decrypt(row.Data); err != nil {
+			t.Errorf("%s v%d doesn't decrypt with the new key: %v", row.Owner(), row.Version, err)
+		}
+		for _, other := range others {
+			if _, err := NewKeyring(other).Decrypt(row.Data); err == nil {
+				t.Errorf("%s v%d still decrypts with an old key", row.Owner(), row.Version)
+			}
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	database, path := newRotateDB(t)
+	old := keyFileIdentities(t, path)[0]
+
+	if err := Rotate(path, database, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := keyFileIdentities(t, path)
+	if len(ids) != 1 || ids[0].String() == old.String() {
+		t.Fatalf("key file holds %d keys after rotation, want only a new one", len(ids))
+	}
+	checkEncryptedTo(t, database, ids[0], old)
+
+	// The daemon's keyring follows the key file, so config reads on
+	cfg, err := database.GetConfigVersion("shop", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cfg.Data) != "APP: shop\nV: 2\n" {
+		t.Errorf("shop v2 = %q after rotation", cfg.Data)
+	}
+}
+
+func TestRotateResumes(t *testing.T) {
+	database, path := newRotateDB(t)
+	old := keyFileIdentities(t, path)[0]
+
+	// A run that added its key and re-encrypted part of the config before
+	// it was interrupted
+	next, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeyFile(path, next, old); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := database.ListEncryptedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows[:3] {
+		if err := reencrypt(database, row, NewKeyring(old), NewKeyring(next)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Rotate(path, database, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := keyFileIdentities(t, path)
+	if len(ids) != 1 || ids[0].String() != next.String() {
+		t.Fatal("resumed rotation didn't finish with the key the interrupted run added")
+	}
+	checkEncryptedTo(t, database, next, old)
+}
+
+// lossyStore drops writes to one config version, so it stays encrypted to
+// the old key however often it is re-encrypted
+type lossyStore struct {
+	*db.DB
+	drop int64
+}
+
+func (s *lossyStore) UpdateEncryptedConfig(row *models.ConfigVar, data []byte) error {
+	if row.ID == s.drop && row.GroupName == "" {
+		return nil
+	}
+	return s.DB.UpdateEncryptedConfig(row, data)
+}
+
+func TestRotateKeepsOldKeyUntilVerified(t *testing.T) {
+	database, path := newRotateDB(t)
+	old := keyFileIdentities(t, path)[0]
+
+	rows, err := database.ListEncryptedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Rotate(path, &lossyStore{DB: database, drop: rows[0].ID}, t.Logf); err == nil {
+		t.Fatal("rotation succeeded with a config version left on the old key")
+	}
+
+	ids := keyFileIdentities(t, path)
+	if len(ids) != 2 || ids[1].String() != old.String() {
+		t.Fatalf("key file holds %d keys after failed verification, want the new and old", len(ids))
+	}
+
+	// Every version is still readable, and running again finishes the job
+	rows, err = database.ListEncryptedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if _, err := NewKeyring(ids...).Decrypt(row.Data); err != nil {
+			t.Errorf("%s v%d unreadable after failed rotation: %v", row.Owner(), row.Version, err)
+		}
+	}
+	if err := Rotate(path, database, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	checkEncryptedTo(t, database, ids[0], old)
+}
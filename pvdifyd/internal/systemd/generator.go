@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 )
 
@@ -12,19 +13,30 @@ import (
 type UnitConfig struct {
 	App           string
 	Process       string
-	Image         string
-	Port          int
+	Color         string // Blue/green slot; empty for units predating blue/green
+	Image         string // Checked by deploy.ValidateImage; it goes on ExecStart unquoted
+	PortDir       string // Directory of the instances' port files; empty for processes that don't serve HTTP
 	ContainerPort int
 	Memory        string
 	CPU           string
-	Command       string
+	PidsLimit     int      // Max processes in the container; zero uses podman's default
+	Ulimits       []string // podman --ulimit values, e.g. nofile=1024:2048
+	Command       string   // Shell command line, run with /bin/sh -c in the container
 	EnvFile       string
-	User          string
+	// Multi-line config vars, which podman's env file can't hold: systemd
+	// reads them from MultilineEnvFile and podman passes them on
+	MultilineEnvFile string
+	MultilineEnv     []string
+	User             string
 	// Health check configuration
 	HealthCheckPath     string // HTTP path for health check (e.g., /health)
+	HealthCheckCommand  string // Command run in the container instead of an HTTP check
 	HealthCheckInterval int    // Interval in seconds between checks (default: 30)
 	HealthCheckTimeout  int    // Timeout in seconds for health check (default: 5)
 	HealthCheckRetries  int    // Number of retries before marking unhealthy (default: 3)
+	// Seconds an instance gets to exit after SIGTERM before podman kills it
+	// (default: 10)
+	StopTimeout int
 }
 
 // Generator creates systemd unit files
@@ -35,7 +47,7 @@ type Generator struct {
 
 // New creates a new systemd generator
 func New(unitDir string) (*Generator, error) {
-	tmpl, err := template.New("unit").Parse(unitTemplate)
+	tmpl, err := template.New("unit").Funcs(template.FuncMap{"quote": execQuote}).Parse(unitTemplate)
 	if err != nil {
 		return nil, fmt.Errorf("parse template: %w", err)
 	}
@@ -48,6 +60,23 @@ func New(unitDir string) (*Generator, error) {
 
 // Generate creates a systemd unit file for an app process
 func (g *Generator) Generate(cfg *UnitConfig) (string, error) {
+	data, err := g.Render(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	unitPath := g.UnitPath(cfg.App, cfg.Process, cfg.Color)
+
+	if err := os.WriteFile(unitPath, data, 0644); err != nil {
+		return "", fmt.Errorf("write unit file: %w", err)
+	}
+
+	return unitPath, nil
+}
+
+// Render returns the unit file content for cfg without writing it, after
+// filling in defaults
+func (g *Generator) Render(cfg *UnitConfig) ([]byte, error) {
 	if cfg.ContainerPort == 0 {
 		cfg.ContainerPort = 3000
 	}
@@ -70,26 +99,21 @@ func (g *Generator) Generate(cfg *UnitConfig) (string, error) {
 	if cfg.HealthCheckRetries == 0 {
 		cfg.HealthCheckRetries = 3
 	}
+	if cfg.StopTimeout == 0 {
+		cfg.StopTimeout = 10
+	}
 
 	var buf bytes.Buffer
 	if err := g.tmpl.Execute(&buf, cfg); err != nil {
-		return "", fmt.Errorf("execute template: %w", err)
-	}
-
-	unitName := fmt.Sprintf("pvdify-%s-%s@.service", cfg.App, cfg.Process)
-	unitPath := filepath.Join(g.unitDir, unitName)
-
-	if err := os.WriteFile(unitPath, buf.Bytes(), 0644); err != nil {
-		return "", fmt.Errorf("write unit file: %w", err)
+		return nil, fmt.Errorf("execute template: %w", err)
 	}
 
-	return unitPath, nil
+	return buf.Bytes(), nil
 }
 
 // Remove deletes a systemd unit file
-func (g *Generator) Remove(app, process string) error {
-	unitName := fmt.Sprintf("pvdify-%s-%s@.service", app, process)
-	unitPath := filepath.Join(g.unitDir, unitName)
+func (g *Generator) Remove(app, process, color string) error {
+	unitPath := g.UnitPath(app, process, color)
 
 	if err := os.Remove(unitPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("remove unit file: %w", err)
@@ -97,13 +121,59 @@ func (g *Generator) Remove(app, process string) error {
 	return nil
 }
 
+// Current returns the unit file content on disk, or nil if it doesn't exist
+func (g *Generator) Current(app, process, color string) ([]byte, error) {
+	data, err := os.ReadFile(g.UnitPath(app, process, color))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read unit file: %w", err)
+	}
+	return data, nil
+}
+
 // UnitPath returns the path for an app's process unit
-func (g *Generator) UnitPath(app, process string) string {
-	return filepath.Join(g.unitDir, fmt.Sprintf("pvdify-%s-%s@.service", app, process))
+func (g *Generator) UnitPath(app, process, color string) string {
+	return filepath.Join(g.unitDir, UnitName(app, process, color)+"@.service")
+}
+
+// UnitName returns the template unit name (without "@.service") for an app's
+// process in a blue/green slot, as accepted by Manager
+func UnitName(app, process, color string) string {
+	if color == "" {
+		return fmt.Sprintf("pvdify-%s-%s", app, process)
+	}
+	return fmt.Sprintf("pvdify-%s-%s-%s", app, process, color)
+}
+
+// PortFile returns the file holding the host port of an instance of a
+// unit, in dir
+func PortFile(dir, unit string, instance int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s@%d.env", unit, instance))
+}
+
+// UnitName returns the template unit name for this config; it also names
+// the containers
+func (c *UnitConfig) UnitName() string {
+	return UnitName(c.App, c.Process, c.Color)
+}
+
+// TimeoutStopSec returns how long systemd waits for ExecStop, which is
+// podman's stop timeout plus time to remove the container
+func (c *UnitConfig) TimeoutStopSec() int {
+	return c.StopTimeout + 20
+}
+
+// execQuote quotes s as a single argument of an Exec line, which systemd
+// unquotes and expands % specifiers and $ variables in
+func execQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + r.Replace(s) + `"`
 }
 
 const unitTemplate = `[Unit]
-Description=Pvdify {{.App}} {{.Process}} process %i
+Description=Pvdify {{.App}} {{.Process}} process %i{{if .Color}} ({{.Color}}){{end}}
 After=network.target
 Wants=network.target
 
@@ -113,33 +183,56 @@ User={{.User}}
 Restart=always
 RestartSec=5
 TimeoutStartSec=120
-TimeoutStopSec=30
+TimeoutStopSec={{.TimeoutStopSec}}
+{{- if .PortDir}}
 
-# Pull image before starting
-ExecStartPre=/usr/bin/podman pull {{.Image}}
+# Each instance publishes its own host port, set as HOST_PORT
+EnvironmentFile={{.PortDir}}/{{.UnitName}}@%i.env
+{{- end}}
+{{- if .MultilineEnvFile}}
+
+# Multi-line config vars, passed on to the container by name
+EnvironmentFile={{.MultilineEnvFile}}
+{{- end}}
 
-# Run container with health check
-ExecStart=/usr/bin/podman run --rm \
-    --name pvdify-{{.App}}-{{.Process}}-%i \
-    -p {{.Port}}:{{.ContainerPort}} \
+# Run container with health check, pulling the image if it isn't there;
+# releases run it by digest, so a restart never picks up a moved tag
+ExecStart=/usr/bin/podman run --rm --pull=missing \
+    --name {{.UnitName}}-%i \
+{{- if .PortDir}}
+    -p ${HOST_PORT}:{{.ContainerPort}} \
+{{- end}}
     --memory={{.Memory}} \
     --cpus={{.CPU}} \
+{{- if .PidsLimit}}
+    --pids-limit={{.PidsLimit}} \
+{{- end}}
+{{- range .Ulimits}}
+    --ulimit={{.}} \
+{{- end}}
     --env-file {{.EnvFile}} \
+{{- range .MultilineEnv}}
+    --env {{.}} \
+{{- end}}
+{{- if or .HealthCheckPath .HealthCheckCommand}}
 {{- if .HealthCheckPath}}
     --health-cmd="curl -sf http://localhost:{{.ContainerPort}}{{.HealthCheckPath}} || exit 1" \
+{{- else}}
+    --health-cmd={{quote .HealthCheckCommand}} \
+{{- end}}
     --health-interval={{.HealthCheckInterval}}s \
     --health-timeout={{.HealthCheckTimeout}}s \
     --health-retries={{.HealthCheckRetries}} \
     --health-start-period=10s \
 {{- end}}
     {{.Image}}{{if .Command}} \
-    {{.Command}}{{end}}
+    /bin/sh -c {{quote .Command}}{{end}}
 
 # Stop container gracefully
-ExecStop=/usr/bin/podman stop -t 10 pvdify-{{.App}}-{{.Process}}-%i
+ExecStop=/usr/bin/podman stop -t {{.StopTimeout}} {{.UnitName}}-%i
 
 # Cleanup on failure
-ExecStopPost=-/usr/bin/podman rm -f pvdify-{{.App}}-{{.Process}}-%i
+ExecStopPost=-/usr/bin/podman rm -f {{.UnitName}}-%i
 
 # Environment
 Environment=PODMAN_USERNS=keep-id
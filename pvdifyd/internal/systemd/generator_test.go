@@ -0,0 +1,67 @@
+package systemd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderCommandRunsInShell(t *testing.T) {
+	g, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command string
+		want    string // Last line of ExecStart
+	}{
+		{"", "    registry.example.com/shop@sha256:abc\n"},
+		{"bin/worker", "    /bin/sh -c \"bin/worker\"\n"},
+		{
+			`bundle exec puma -p $PORT && echo "100% up" \ done`,
+			`    /bin/sh -c "bundle exec puma -p $$PORT && echo \"100%% up\" \\ done"` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		data, err := g.Render(&UnitConfig{
+			App:     "shop",
+			Process: "web",
+			Color:   "blue",
+			Image:   "registry.example.com/shop@sha256:abc",
+			Command: tt.command,
+			EnvFile: "/var/lib/pvdify/config/shop/1.env",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit := string(data)
+		execStart := unit[strings.Index(unit, "ExecStart="):]
+		execStart = execStart[:strings.Index(execStart, "\n\n")+1]
+		if !strings.HasSuffix(execStart, tt.want) {
+			t.Errorf("command %q: ExecStart ends\n%s\nwant\n%s", tt.command, execStart[strings.LastIndex(execStart[:len(execStart)-1], "\n")+1:], tt.want)
+		}
+	}
+}
+
+func TestRenderPullsWithoutShell(t *testing.T) {
+	g, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := g.Render(&UnitConfig{
+		App:     "shop",
+		Process: "web",
+		Image:   "registry.example.com/shop@sha256:abc",
+		EnvFile: "/var/lib/pvdify/config/shop/1.env",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := string(data)
+	if strings.Contains(unit, "ExecStartPre=") {
+		t.Error("unit has an ExecStartPre line; the image should be pulled by podman run")
+	}
+	if !strings.Contains(unit, "ExecStart=/usr/bin/podman run --rm --pull=missing \\\n") {
+		t.Error("ExecStart doesn't pull a missing image")
+	}
+}
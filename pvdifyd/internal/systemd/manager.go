@@ -80,13 +80,14 @@ type ServiceStatus struct {
 	MainPID   int
 	Memory    string
 	LoadState string
+	Restarts  int
 }
 
 // Status returns the status of a service instance
 func (m *Manager) Status(ctx context.Context, unit string, instance int) (*ServiceStatus, error) {
 	name := fmt.Sprintf("%s@%d", unit, instance)
 	cmd := exec.CommandContext(ctx, "systemctl", "show", name,
-		"--property=ActiveState,SubState,MainPID,MemoryCurrent,LoadState")
+		"--property=ActiveState,SubState,MainPID,MemoryCurrent,LoadState,NRestarts")
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("show %s: %w", name, err)
@@ -110,6 +111,8 @@ func (m *Manager) Status(ctx context.Context, unit string, instance int) (*Servi
 			status.Memory = formatBytes(value)
 		case "LoadState":
 			status.LoadState = value
+		case "NRestarts":
+			status.Restarts, _ = strconv.Atoi(value)
 		}
 	}
 
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 type Config struct {
 	Tunnel          string        `yaml:"tunnel"`
 	CredentialsFile string        `yaml:"credentials-file"`
+	Metrics         string        `yaml:"metrics,omitempty"`
 	Ingress         []IngressRule `yaml:"ingress"`
 }
 
@@ -26,10 +28,14 @@ type Manager struct {
 	configPath      string
 	credentialsFile string
 	tunnelID        string
+	service         string // systemd unit running cloudflared
+	metrics         string // cloudflared's metrics address, for readiness
 }
 
-// NewManager creates a new tunnel manager
-func NewManager(configPath, credentialsFile string) (*Manager, error) {
+// NewManager creates a new tunnel manager. service is the systemd unit
+// running cloudflared on configPath, restarted to apply domain changes, and
+// metrics is the address it serves readiness on.
+func NewManager(configPath, credentialsFile, service, metrics string) (*Manager, error) {
 	// Try to extract tunnel ID from existing config
 	var tunnelID string
 	if data, err := os.ReadFile(configPath); err == nil {
@@ -43,6 +49,8 @@ func NewManager(configPath, credentialsFile string) (*Manager, error) {
 		configPath:      configPath,
 		credentialsFile: credentialsFile,
 		tunnelID:        tunnelID,
+		service:         service,
+		metrics:         metrics,
 	}, nil
 }
 
@@ -59,6 +67,7 @@ func (m *Manager) Load() (*Config, error) {
 			return &Config{
 				Tunnel:          m.tunnelID,
 				CredentialsFile: m.credentialsFile,
+				Metrics:         m.metrics,
 				Ingress:         []IngressRule{{Service: "http_status:404"}},
 			}, nil
 		}
@@ -86,62 +95,140 @@ func (m *Manager) Save(cfg *Config) error {
 		return fmt.Errorf("marshal config: %w", err)
 	}
 
-	if err := os.WriteFile(m.configPath, data, 0644); err != nil {
+	// Write to a temporary file and rename it so readers never observe a
+	// partially written config
+	tmp, err := os.CreateTemp(dir, filepath.Base(m.configPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp config: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
 		return fmt.Errorf("write config: %w", err)
 	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod config: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close config: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.configPath); err != nil {
+		return fmt.Errorf("replace config: %w", err)
+	}
 
 	return nil
 }
 
 // AddRoute adds a route to the tunnel configuration
 func (m *Manager) AddRoute(hostname string, port int) error {
+	return m.AddRoutes([]string{hostname}, port)
+}
+
+// AddRoutes points several hostnames at a port in a single config write,
+// so they switch over together
+func (m *Manager) AddRoutes(hostnames []string, port int) error {
+	routes := make([]Route, len(hostnames))
+	for i, hostname := range hostnames {
+		routes[i] = Route{Hostname: hostname, Port: port}
+	}
+	_, err := m.SetRoutes(routes)
+	return err
+}
+
+// Route points a hostname at a local port
+type Route struct {
+	Hostname string
+	Port     int
+}
+
+// SetRoutes points each hostname at its port in a single config write, so
+// they switch over together. It reports whether the config changed;
+// cloudflared only picks up a change once it is reloaded.
+func (m *Manager) SetRoutes(routes []Route) (bool, error) {
 	cfg, err := m.Load()
 	if err != nil {
-		return err
+		return false, err
+	}
+	before, err := yaml.Marshal(cfg)
+	if err != nil {
+		return false, fmt.Errorf("marshal config: %w", err)
+	}
+
+	if m.metrics != "" {
+		cfg.Metrics = m.metrics
+	}
+	for _, r := range routes {
+		service := fmt.Sprintf("http://localhost:%d", r.Port)
+		cfg.Ingress = setRoute(cfg.Ingress, r.Hostname, service)
+	}
+
+	after, err := yaml.Marshal(cfg)
+	if err != nil {
+		return false, fmt.Errorf("marshal config: %w", err)
 	}
+	if bytes.Equal(before, after) {
+		return false, nil
+	}
+	return true, m.Save(cfg)
+}
 
+// setRoute updates the rule for hostname or inserts one before the
+// catch-all (last rule)
+func setRoute(ingress []IngressRule, hostname, service string) []IngressRule {
 	// Check if route already exists
-	for i, rule := range cfg.Ingress {
+	for i, rule := range ingress {
 		if rule.Hostname == hostname {
 			// Update existing rule
-			cfg.Ingress[i].Service = fmt.Sprintf("http://localhost:%d", port)
-			return m.Save(cfg)
+			ingress[i].Service = service
+			return ingress
 		}
 	}
 
-	// Insert before catch-all (last rule)
 	newRule := IngressRule{
 		Hostname: hostname,
-		Service:  fmt.Sprintf("http://localhost:%d", port),
+		Service:  service,
 	}
 
-	if len(cfg.Ingress) > 0 {
+	if len(ingress) > 0 {
 		// Insert before last rule (catch-all)
-		cfg.Ingress = append(cfg.Ingress[:len(cfg.Ingress)-1],
-			append([]IngressRule{newRule}, cfg.Ingress[len(cfg.Ingress)-1])...)
-	} else {
-		cfg.Ingress = append([]IngressRule{newRule}, IngressRule{Service: "http_status:404"})
+		return append(ingress[:len(ingress)-1],
+			append([]IngressRule{newRule}, ingress[len(ingress)-1])...)
 	}
-
-	return m.Save(cfg)
+	return append([]IngressRule{newRule}, IngressRule{Service: "http_status:404"})
 }
 
 // RemoveRoute removes a route from the tunnel configuration
 func (m *Manager) RemoveRoute(hostname string) error {
+	_, err := m.RemoveRoutes([]string{hostname})
+	return err
+}
+
+// RemoveRoutes removes the routes of several hostnames in a single config
+// write. It reports whether any were removed.
+func (m *Manager) RemoveRoutes(hostnames []string) (bool, error) {
 	cfg, err := m.Load()
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	remove := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		remove[hostname] = true
+	}
 	var filtered []IngressRule
 	for _, rule := range cfg.Ingress {
-		if rule.Hostname != hostname {
+		if rule.Hostname == "" || !remove[rule.Hostname] {
 			filtered = append(filtered, rule)
 		}
 	}
+	if len(filtered) == len(cfg.Ingress) {
+		return false, nil
+	}
 
 	cfg.Ingress = filtered
-	return m.Save(cfg)
+	return true, m.Save(cfg)
 }
 
 // ListRoutes returns all configured routes
@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// Reload restarts cloudflared so it reads the current config, and waits
+// until it is connected to Cloudflare again, at which point it serves the
+// new ingress rules. cloudflared can't reload a local config in place.
+func (m *Manager) Reload(ctx context.Context) error {
+	if m.service == "" {
+		return fmt.Errorf("tunnel.service is not set: cloudflared can't be reloaded to apply route changes")
+	}
+
+	cmd := exec.CommandContext(ctx, "systemctl", "restart", m.service)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("restart %s: %s: %w", m.service, string(output), err)
+	}
+
+	if m.metrics == "" {
+		return nil
+	}
+	return m.waitReady(ctx, 30*time.Second)
+}
+
+// waitReady polls cloudflared's /ready endpoint until it reports a
+// connection to Cloudflare
+func (m *Manager) waitReady(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/ready", m.metrics)
+	client := &http.Client{Timeout: 2 * time.Second}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		if lastErr = ready(ctx, client, url); lastErr == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cloudflared not ready after restart: %w", lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ready checks cloudflared's readiness once
+func ready(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		ReadyConnections int `json:"readyConnections"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body.ReadyConnections == 0 {
+		return fmt.Errorf("%s: status %d, %d connections", url, resp.StatusCode, body.ReadyConnections)
+	}
+	return nil
+}